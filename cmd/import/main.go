@@ -0,0 +1,74 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/KingKord/bookings/internal/config"
+	"github.com/KingKord/bookings/internal/driver"
+	"github.com/KingKord/bookings/internal/importer"
+	"github.com/KingKord/bookings/internal/repository/dbrepo"
+	"log"
+	"os"
+	"strings"
+)
+
+// main imports reservations from a CSV file, checking it without importing anything unless -commit is set
+func main() {
+	dbHost := flag.String("dbhost", "localhost", "Database host")
+	dbName := flag.String("dbname", "", "Database name")
+	dbUser := flag.String("dbuser", "", "Database user")
+	dbPassword := flag.String("dbpass", "", "Database pass")
+	dbPort := flag.String("dbport", "5432", "Database port")
+	dbSSL := flag.String("dbssl", "disable", "Database ssl setting (disable, prefer, require)")
+	commit := flag.Bool("commit", false, "Import the valid rows, without it the file is only checked")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] file.csv\n\nThe file has a header with the columns %s\n\n",
+			os.Args[0], strings.Join(importer.Columns, ", "))
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *dbName == "" || *dbUser == "" || flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	f, err := os.Open(flag.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	connectionString := fmt.Sprintf("host=%s port=%s dbname=%s user=%s password=%s sslmode=%s", *dbHost, *dbPort, *dbName, *dbUser, *dbPassword, *dbSSL)
+	db, err := driver.ConnectSQL(connectionString)
+	if err != nil {
+		log.Fatal("Cannot connect to database! Dying...")
+	}
+	defer db.SQL.Close()
+
+	var app config.AppConfig
+	report, err := importer.Run(dbrepo.NewPostgresRepo(db.SQL, &app), f, *commit)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, row := range report.Rows {
+		for _, msg := range append(row.Errors, row.Conflicts...) {
+			fmt.Printf("line %d: %s\n", row.Line, msg)
+		}
+	}
+
+	valid := report.ValidRows()
+	switch {
+	case report.Committed:
+		fmt.Printf("Imported %d of %d reservations\n", valid, len(report.Rows))
+	case *commit:
+		fmt.Printf("Nothing imported, none of the %d reservations is valid\n", len(report.Rows))
+	default:
+		fmt.Printf("%d of %d reservations can be imported, run again with -commit to import them\n", valid, len(report.Rows))
+	}
+
+	if !*commit && valid < len(report.Rows) {
+		os.Exit(1)
+	}
+}
@@ -3,18 +3,26 @@ package main
 import (
 	"database/sql"
 	"encoding/gob"
+	"errors"
 	"flag"
 	"fmt"
+	"github.com/KingKord/bookings/internal/calsync"
 	"github.com/KingKord/bookings/internal/config"
 	"github.com/KingKord/bookings/internal/driver"
+	"github.com/KingKord/bookings/internal/events"
+	"github.com/KingKord/bookings/internal/grpcserver"
 	"github.com/KingKord/bookings/internal/handlers"
 	"github.com/KingKord/bookings/internal/helpers"
 	"github.com/KingKord/bookings/internal/models"
 	"github.com/KingKord/bookings/internal/render"
+	"github.com/KingKord/bookings/internal/sessionstore"
+	"github.com/KingKord/bookings/internal/webhook"
 	"github.com/alexedwards/scs/v2"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 )
 
@@ -24,6 +32,11 @@ var app config.AppConfig
 var session *scs.SessionManager
 var infoLog *log.Logger
 var errorLog *log.Logger
+var grpcAddr string
+var calendarSyncInterval time.Duration
+
+// errMissingFlags is returned by run when the database flags aren't set
+var errMissingFlags = errors.New("missing required flags -dbname and -dbuser")
 
 // main is the main application function
 func main() {
@@ -44,6 +57,25 @@ func main() {
 	fmt.Println("Starting mail listener...")
 	listenForMail()
 
+	fmt.Println("Starting webhook dispatcher...")
+	webhook.NewDispatcher(handlers.Repo.DB, errorLog).Start(app.Events)
+
+	if calendarSyncInterval > 0 {
+		fmt.Println("Starting calendar imports...")
+		calsync.New(&app, handlers.Repo.DB).Start(calendarSyncInterval)
+	}
+
+	if grpcAddr != "" {
+		lis, err := net.Listen("tcp", grpcAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(fmt.Sprintf("Starting gRPC service on %s", grpcAddr))
+		go func() {
+			log.Fatal(grpcserver.New(&app, handlers.Repo).Serve(lis))
+		}()
+	}
+
 	fmt.Println(fmt.Sprintf("Starting application on port %s", portNumber))
 
 	srv := &http.Server{
@@ -71,12 +103,16 @@ func run() (*driver.DB, error) {
 	dbPassword := flag.String("dbpass", "", "Database pass")
 	dbPort := flag.String("dbport", "5432", "Database port")
 	dbSSL := flag.String("dbssl", "disable", "Database ssl setting (disable, prefer, require)")
+	propertyCode := flag.String("property", "FSBB", "Property code used to number invoices")
+	baseURL := flag.String("baseurl", "http://localhost:8080", "Public URL used for links in emails")
+	flag.StringVar(&grpcAddr, "grpcaddr", "", "Address of the gRPC service such as :9090, it is off unless set")
+	flag.DurationVar(&calendarSyncInterval, "icalsync", 15*time.Minute, "How often imported calendars are synced, 0 to disable it")
+	sessionStore := flag.String("sessionstore", sessionstore.Memory, "Session store (memory, postgres), use postgres when running more than one replica")
 
 	flag.Parse()
 
 	if *dbName == "" || *dbUser == "" {
-		fmt.Println("Missing required flags")
-		os.Exit(1)
+		return nil, errMissingFlags
 	}
 
 	mailChan := make(chan models.MailData)
@@ -85,6 +121,9 @@ func run() (*driver.DB, error) {
 	// change this to true when in production
 	app.InProduction = *inProduction
 	app.UseCache = *useCache
+	app.PropertyCode = *propertyCode
+	app.BaseURL = strings.TrimSuffix(*baseURL, "/")
+	app.Events = events.NewBroker()
 
 	infoLog = log.New(os.Stdout, "INFO\t", log.Ldate|log.Ltime)
 	app.InfoLog = infoLog
@@ -92,14 +131,6 @@ func run() (*driver.DB, error) {
 	errorLog = log.New(os.Stdout, "ERROR\t", log.Ldate|log.Ltime|log.Lshortfile)
 	app.ErrorLog = errorLog
 
-	// scs is the external package that helps us to work with sessions
-	session = scs.New()
-	session.Lifetime = 24 * time.Hour
-	session.Cookie.Persist = true
-	session.Cookie.SameSite = http.SameSiteLaxMode
-	session.Cookie.Secure = app.InProduction
-
-	app.Session = session
 	// connect to database
 	log.Println("Connecting to database...")
 	connectionString := fmt.Sprintf("host=%s port=%s dbname=%s user=%s password=%s sslmode=%s", *dbHost, *dbPort, *dbName, *dbUser, *dbPassword, *dbSSL)
@@ -108,6 +139,21 @@ func run() (*driver.DB, error) {
 		log.Fatal("Cannot connect to database! Dying...")
 	}
 	log.Println("Connected to database!")
+
+	// scs is the external package that helps us to work with sessions
+	session = scs.New()
+	session.Store, err = sessionstore.New(*sessionStore, db.SQL)
+	if err != nil {
+		return nil, err
+	}
+	session.Lifetime = 24 * time.Hour
+	session.Cookie.Persist = true
+	session.Cookie.SameSite = http.SameSiteLaxMode
+	session.Cookie.Secure = app.InProduction
+
+	app.Session = session
+	log.Printf("Using %s session store", *sessionStore)
+
 	tc, err := render.CreateTemplateCache()
 	if err != nil {
 		log.Fatal("cannot create template cache")
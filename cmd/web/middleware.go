@@ -1,9 +1,18 @@
 package main
 
 import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/KingKord/bookings/internal/apikey"
+	"github.com/KingKord/bookings/internal/handlers"
 	"github.com/KingKord/bookings/internal/helpers"
+	"github.com/KingKord/bookings/internal/models"
+	"github.com/KingKord/bookings/internal/rbac"
 	"github.com/justinas/nosurf"
 	"net/http"
+	"strings"
 )
 
 // NoSurf adds CSRF protection to all POST requests
@@ -16,14 +25,28 @@ func NoSurf(next http.Handler) http.Handler {
 		Secure:   app.InProduction,
 		SameSite: http.SameSiteLaxMode,
 	})
+	// the API authenticates every request with a bearer token instead of cookies
+	csrfHandler.ExemptFunc(func(r *http.Request) bool {
+		return strings.HasPrefix(r.URL.Path, "/api/")
+	})
 	return csrfHandler
 }
 
+// JSON marks a route as answering in JSON, which the route tests check against the OpenAPI document
+func JSON(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		next.ServeHTTP(w, r)
+	})
+}
+
 // SessionLoad loads and saves the session on every request
 func SessionLoad(next http.Handler) http.Handler {
 	return session.LoadAndSave(next)
 }
 
+// Auth only lets logged-in staff users through whose session hasn't been signed out and whose
+// account is still enabled
 func Auth(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if !helpers.IsAuthenticated(r) {
@@ -31,6 +54,129 @@ func Auth(next http.Handler) http.Handler {
 			http.Redirect(w, r, "/user/login", http.StatusSeeOther)
 			return
 		}
+
+		active, err := handlers.Repo.DB.TouchUserSession(session.GetString(r.Context(), "session_id"), helpers.ClientIP(r))
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+		if !active {
+			_ = session.Destroy(r.Context())
+			session.Put(r.Context(), "error", "Your session has ended, log in again")
+			http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+			return
+		}
+
+		user, err := handlers.Repo.DB.GetUserByID(session.GetInt(r.Context(), "user_id"))
+		if err != nil || user.Disabled {
+			_ = session.Destroy(r.Context())
+			session.Put(r.Context(), "error", "Log in first!")
+			http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+			return
+		}
+
 		next.ServeHTTP(w, r)
 	})
 }
+
+// RequirePermission only lets staff users whose role grants p through. The user is
+// reloaded on every request so that role changes and disabled accounts apply immediately
+func RequirePermission(p rbac.Permission) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user, err := handlers.Repo.DB.GetUserByID(session.GetInt(r.Context(), "user_id"))
+			if err != nil || user.Disabled {
+				_ = session.Destroy(r.Context())
+				session.Put(r.Context(), "error", "Log in first!")
+				http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+				return
+			}
+			session.Put(r.Context(), "access_level", user.AccessLevel)
+
+			// a role change can make two-factor authentication mandatory for a user already logged in
+			if rbac.Requires2FA(user.AccessLevel) && !user.TOTPEnabled {
+				session.Put(r.Context(), "warning", "Your role requires two-factor authentication, set it up to continue")
+				http.Redirect(w, r, "/user/2fa/setup", http.StatusSeeOther)
+				return
+			}
+
+			if !rbac.Can(user.AccessLevel, p) {
+				session.Put(r.Context(), "error", "You don't have permission to do that")
+				http.Redirect(w, r, "/admin/dashboard", http.StatusSeeOther)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// GuestAuth only lets logged-in guests through
+func GuestAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !helpers.IsGuest(r) {
+			session.Put(r.Context(), "error", "Log in first!")
+			http.Redirect(w, r, "/guest/login", http.StatusSeeOther)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// apiKeyContextKey is the request context key APIAuth stores the authenticated API key under
+type apiKeyContextKey struct{}
+
+// APIAuth only lets requests through that carry an active API key as a bearer token, and
+// records the use of the key
+func APIAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || token == "" {
+			apiUnauthorized(w)
+			return
+		}
+
+		key, err := handlers.Repo.DB.GetAPIKeyByHash(apikey.Hash(token))
+		if errors.Is(err, sql.ErrNoRows) || (err == nil && !key.IsActive()) {
+			apiUnauthorized(w)
+			return
+		}
+		if err != nil {
+			helpers.ServerErrorJSON(w, err)
+			return
+		}
+
+		err = handlers.Repo.DB.TouchAPIKey(key.ID)
+		if err != nil {
+			helpers.ServerErrorJSON(w, err)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), apiKeyContextKey{}, key)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func apiUnauthorized(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+	helpers.ErrorJSON(w, http.StatusUnauthorized, helpers.APIError{
+		Code:    "unauthorized",
+		Message: "A valid API key is required",
+	})
+}
+
+// RequireScope only lets requests through whose API key has scope s, it must run after APIAuth
+func RequireScope(s apikey.Scope) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key, _ := r.Context().Value(apiKeyContextKey{}).(models.APIKey)
+			if !apikey.Allows(key.Scopes, s) {
+				helpers.ErrorJSON(w, http.StatusForbidden, helpers.APIError{
+					Code:    "insufficient_scope",
+					Message: fmt.Sprintf("The API key needs the %s scope", s),
+				})
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
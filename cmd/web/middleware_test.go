@@ -1,8 +1,13 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"github.com/KingKord/bookings/internal/apikey"
+	"github.com/KingKord/bookings/internal/rbac"
 	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 )
 
@@ -16,6 +21,28 @@ func TestNoSurf(t *testing.T) {
 	default:
 		t.Error(fmt.Sprintf("type is not http.Handler, but is %T", v))
 	}
+
+	tests := []struct {
+		name           string
+		url            string
+		expectedStatus int
+	}{
+		// without a CSRF token the API still gets to check the bearer token
+		{"api", "/api/v1/reservations", http.StatusUnauthorized},
+		{"site", "/search-availability", http.StatusBadRequest},
+	}
+
+	mux := routes(&app)
+	for _, e := range tests {
+		req, _ := http.NewRequest("POST", e.url, strings.NewReader("{}"))
+		rr := httptest.NewRecorder()
+
+		mux.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("failed %s: expected status %d, but got %d", e.name, e.expectedStatus, rr.Code)
+		}
+	}
 }
 
 func TestSessionLoad(t *testing.T) {
@@ -29,3 +56,120 @@ func TestSessionLoad(t *testing.T) {
 		t.Error(fmt.Sprintf("type is not http.Handler, but is %T", v))
 	}
 }
+
+func TestJSON(t *testing.T) {
+	var myH myHandler
+	h := JSON(&myH)
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+
+	if ct := rr.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("expected content type application/json, got %q", ct)
+	}
+}
+
+func TestAuth(t *testing.T) {
+	var myH myHandler
+	h := SessionLoad(Auth(&myH))
+
+	tests := []struct {
+		name             string
+		userID           int
+		sessionID        string
+		expectedLocation string
+	}{
+		{"active", 1, "current-sid", ""},
+		{"not logged in", 0, "", "/user/login"},
+		{"signed out session", 1, "other-sid", "/user/login"},
+		{"disabled user", 3, "current-sid", "/user/login"},
+	}
+
+	for _, e := range tests {
+		ctx, _ := session.Load(context.Background(), "")
+		if e.userID != 0 {
+			session.Put(ctx, "user_id", e.userID)
+			session.Put(ctx, "session_id", e.sessionID)
+		}
+		token, _, _ := session.Commit(ctx)
+
+		req, _ := http.NewRequest("GET", "/admin/dashboard", nil)
+		req.AddCookie(&http.Cookie{Name: session.Cookie.Name, Value: token})
+		rr := httptest.NewRecorder()
+
+		h.ServeHTTP(rr, req)
+
+		if loc := rr.Header().Get("Location"); loc != e.expectedLocation {
+			t.Errorf("failed %s: expected location %q, but got %q", e.name, e.expectedLocation, loc)
+		}
+	}
+}
+
+func TestRequirePermission(t *testing.T) {
+	var myH myHandler
+	h := RequirePermission(rbac.ManageUsers)(&myH)
+
+	switch v := h.(type) {
+	case http.Handler:
+	// do nothing
+	default:
+		t.Error(fmt.Sprintf("type is not http.Handler, but is %T", v))
+	}
+}
+
+func TestAPIAuth(t *testing.T) {
+	var myH myHandler
+	h := APIAuth(&myH)
+
+	tests := []struct {
+		name           string
+		authorization  string
+		expectedStatus int
+	}{
+		{"valid key", "Bearer bk_read", http.StatusOK},
+		{"no key", "", http.StatusUnauthorized},
+		{"unknown key", "Bearer bk_guess", http.StatusUnauthorized},
+		{"not a bearer token", "bk_read", http.StatusUnauthorized},
+		{"expired key", "Bearer bk_expired", http.StatusUnauthorized},
+		{"revoked key", "Bearer bk_revoked", http.StatusUnauthorized},
+		{"database error", "Bearer bk_error", http.StatusInternalServerError},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("GET", "/api/v1/rooms", nil)
+		req.Header.Set("Authorization", e.authorization)
+		rr := httptest.NewRecorder()
+
+		h.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("failed %s: expected status %d, but got %d", e.name, e.expectedStatus, rr.Code)
+		}
+	}
+}
+
+func TestRequireScope(t *testing.T) {
+	var myH myHandler
+	h := APIAuth(RequireScope(apikey.CreateReservations)(&myH))
+
+	tests := []struct {
+		name           string
+		key            string
+		expectedStatus int
+	}{
+		{"missing scope", "bk_read", http.StatusForbidden},
+		{"admin has every scope", "bk_admin", http.StatusOK},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("POST", "/api/v1/reservations", nil)
+		req.Header.Set("Authorization", "Bearer "+e.key)
+		rr := httptest.NewRecorder()
+
+		h.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("failed %s: expected status %d, but got %d", e.name, e.expectedStatus, rr.Code)
+		}
+	}
+}
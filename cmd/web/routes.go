@@ -1,8 +1,10 @@
 package main
 
 import (
+	"github.com/KingKord/bookings/internal/apikey"
 	"github.com/KingKord/bookings/internal/config"
 	"github.com/KingKord/bookings/internal/handlers"
+	"github.com/KingKord/bookings/internal/rbac"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"net/http"
@@ -21,7 +23,7 @@ func routes(app *config.AppConfig) http.Handler {
 	mux.Get("/majors-suite", handlers.Repo.Majors)
 	mux.Get("/search-availability", handlers.Repo.Availability)
 	mux.Post("/search-availability", handlers.Repo.PostAvailability)
-	mux.Post("/search-availability-json", handlers.Repo.AvailabilityJSON)
+	mux.With(JSON).Post("/search-availability-json", handlers.Repo.AvailabilityJSON)
 	mux.Get("/contact", handlers.Repo.Contact)
 
 	mux.Get("/choose-room/{id}", handlers.Repo.ChooseRoom)
@@ -34,22 +36,141 @@ func routes(app *config.AppConfig) http.Handler {
 	mux.Get("/user/login", handlers.Repo.ShowLogin)
 	mux.Post("/user/login", handlers.Repo.PostShowLogin)
 	mux.Get("/user/logout", handlers.Repo.LogOut)
+	mux.Get("/user/login/verify", handlers.Repo.ShowLoginVerify)
+	mux.Post("/user/login/verify", handlers.Repo.PostLoginVerify)
+	mux.Get("/user/2fa/setup", handlers.Repo.TwoFactorSetup)
+	mux.Post("/user/2fa/setup", handlers.Repo.PostTwoFactorSetup)
+	mux.With(Auth).Post("/user/2fa/disable", handlers.Repo.PostTwoFactorDisable)
+	mux.Get("/user/forgot-password", handlers.Repo.ForgotPassword)
+	mux.Post("/user/forgot-password", handlers.Repo.PostForgotPassword)
+	mux.Get("/user/reset-password", handlers.Repo.ResetPassword)
+	mux.Post("/user/reset-password", handlers.Repo.PostResetPassword)
+
+	mux.Get("/guest/register", handlers.Repo.GuestRegister)
+	mux.Post("/guest/register", handlers.Repo.PostGuestRegister)
+	mux.Get("/guest/login", handlers.Repo.GuestLogin)
+	mux.Post("/guest/login", handlers.Repo.PostGuestLogin)
+	mux.Get("/guest/logout", handlers.Repo.GuestLogOut)
+	mux.With(GuestAuth).Get("/guest/stays", handlers.Repo.GuestStays)
+
+	mux.With(JSON).Get("/api/openapi.json", handlers.Repo.OpenAPISpec)
+	mux.Get("/api/docs", handlers.Repo.APIDocs)
+
+	mux.Route("/api/v1", func(mux chi.Router) {
+		mux.Use(APIAuth)
+		mux.Use(JSON)
+		mux.NotFound(handlers.Repo.APINotFound)
+		mux.MethodNotAllowed(handlers.Repo.APIMethodNotAllowed)
+
+		mux.Group(func(mux chi.Router) {
+			mux.Use(RequireScope(apikey.ReadAvailability))
+			mux.Get("/rooms", handlers.Repo.APIRooms)
+			mux.Get("/rooms/{id}/availability", handlers.Repo.APIRoomAvailability)
+			mux.Get("/availability", handlers.Repo.APIAvailability)
+		})
+
+		mux.With(RequireScope(apikey.CreateReservations)).Post("/reservations", handlers.Repo.APICreateReservation)
+
+		mux.Group(func(mux chi.Router) {
+			mux.Use(RequireScope(apikey.Admin))
+			mux.Get("/reservations/{id}", handlers.Repo.APIReservation)
+			mux.Delete("/reservations/{id}", handlers.Repo.APICancelReservation)
+		})
+	})
+
+	mux.Get("/ical/{token}.ics", handlers.Repo.ICalFeed)
 
 	mux.Route("/admin", func(mux chi.Router) {
-		//mux.Use(Auth)
+		mux.Use(Auth)
 
 		mux.Get("/dashboard", handlers.Repo.AdminDashboard)
-		mux.Get("/reservations-new", handlers.Repo.AdminNewReservations)
-		mux.Get("/reservations-all", handlers.Repo.AdminAllReservations)
-		mux.Get("/reservations-calendar", handlers.Repo.AdminReservationsCalendar)
-		mux.Post("/reservations-calendar", handlers.Repo.AdminPostReservationsCalendar)
+		mux.Get("/account", handlers.Repo.AdminAccount)
+		mux.Get("/account/sessions/{sessionID}/revoke/do", handlers.Repo.AdminRevokeSession)
+		mux.Get("/account/sessions/revoke-others/do", handlers.Repo.AdminRevokeOtherSessions)
+
+		mux.Group(func(mux chi.Router) {
+			mux.Use(RequirePermission(rbac.ViewReservations))
+			mux.Get("/reservations-new", handlers.Repo.AdminNewReservations)
+			mux.Get("/reservations-all", handlers.Repo.AdminAllReservations)
+			mux.Get("/reservations-calendar", handlers.Repo.AdminReservationsCalendar)
+			mux.Get("/reservations-timeline", handlers.Repo.AdminReservationsTimeline)
+			mux.Get("/reservations/{src}/{id}/show", handlers.Repo.AdminShowReservation)
+			mux.Get("/search", handlers.Repo.AdminSearch)
+			mux.Get("/invoices/{id}/pdf", handlers.Repo.AdminInvoicePDF)
+		})
+
+		mux.With(RequirePermission(rbac.ExportReservations)).Get("/reservations-export", handlers.Repo.AdminExportReservations)
+
+		mux.Group(func(mux chi.Router) {
+			mux.Use(RequirePermission(rbac.CreateReservations))
+			mux.Get("/reservations-create", handlers.Repo.AdminNewReservation)
+			mux.Post("/reservations-create", handlers.Repo.PostAdminNewReservation)
+			mux.With(JSON).Get("/reservations-create/availability", handlers.Repo.AdminNewReservationAvailability)
+		})
+
+		mux.Group(func(mux chi.Router) {
+			mux.Use(RequirePermission(rbac.ImportReservations))
+			mux.Get("/reservations-import", handlers.Repo.AdminImportReservations)
+			mux.Post("/reservations-import", handlers.Repo.PostAdminImportReservations)
+		})
+
+		mux.With(RequirePermission(rbac.ManageBlocks)).Post("/reservations-calendar", handlers.Repo.AdminPostReservationsCalendar)
+		mux.With(RequirePermission(rbac.EditReservations)).Post("/reservations/{src}/{id}", handlers.Repo.AdminPostShowReservation)
+		mux.With(RequirePermission(rbac.EditReservations), JSON).Post("/reservations-timeline/{id}/move", handlers.Repo.AdminMoveReservation)
+		mux.With(RequirePermission(rbac.ProcessReservations)).Get("/process-reservation/{src}/{id}/do", handlers.Repo.AdminProcessReservation)
+		mux.With(RequirePermission(rbac.DeleteReservations)).Get("/delete-reservation/{src}/{id}/do", handlers.Repo.AdminDeleteReservation)
+
+		mux.Group(func(mux chi.Router) {
+			mux.Use(RequirePermission(rbac.ManageCharges))
+			mux.Post("/reservations/{src}/{id}/charges", handlers.Repo.AdminPostCharge)
+			mux.Post("/reservations/{src}/{id}/charges/{chargeID}/delete", handlers.Repo.AdminDeleteCharge)
+			mux.Post("/reservations/{src}/{id}/invoice", handlers.Repo.AdminIssueInvoice)
+		})
+		mux.With(RequirePermission(rbac.IssueCreditNotes)).Post("/invoices/{id}/credit-note", handlers.Repo.AdminPostCreditNote)
+
+		mux.Group(func(mux chi.Router) {
+			mux.Use(RequirePermission(rbac.ManageCalendarFeeds))
+			mux.Get("/calendar-feeds", handlers.Repo.AdminCalendarFeeds)
+			mux.Post("/calendar-feeds", handlers.Repo.PostAdminCalendarFeeds)
+			mux.Get("/calendar-feeds/{id}/delete/do", handlers.Repo.AdminDeleteCalendarFeed)
+			mux.Get("/calendar-imports", handlers.Repo.AdminCalendarImports)
+			mux.Post("/calendar-imports", handlers.Repo.PostAdminCalendarImports)
+			mux.Get("/calendar-imports/{id}/sync/do", handlers.Repo.AdminSyncCalendarImport)
+			mux.Get("/calendar-imports/{id}/delete/do", handlers.Repo.AdminDeleteCalendarImport)
+		})
 
-		mux.Get("/reservations/{src}/{id}/show", handlers.Repo.AdminShowReservation)
-		mux.Post("/reservations/{src}/{id}", handlers.Repo.AdminPostShowReservation)
+		mux.Group(func(mux chi.Router) {
+			mux.Use(RequirePermission(rbac.ManageUsers))
+			mux.Get("/users", handlers.Repo.AdminUsers)
+			mux.Get("/users/new", handlers.Repo.AdminNewUser)
+			mux.Post("/users/new", handlers.Repo.PostAdminNewUser)
+			mux.Get("/users/{id}", handlers.Repo.AdminShowUser)
+			mux.Post("/users/{id}", handlers.Repo.PostAdminShowUser)
+			mux.Get("/delete-user/{id}/do", handlers.Repo.AdminDeleteUser)
+			mux.Get("/users/{id}/reset-2fa/do", handlers.Repo.AdminResetTwoFactor)
+			mux.Get("/users/{id}/unlock/do", handlers.Repo.AdminUnlockUser)
+			mux.Get("/users/{id}/logout/do", handlers.Repo.AdminLogOutUser)
+			mux.Get("/login-activity", handlers.Repo.AdminLoginActivity)
+		})
 
-		mux.Get("/process-reservation/{src}/{id}/do", handlers.Repo.AdminProcessReservation)
-		mux.Get("/delete-reservation/{src}/{id}/do", handlers.Repo.AdminDeleteReservation)
+		mux.Group(func(mux chi.Router) {
+			mux.Use(RequirePermission(rbac.ManageAPIKeys))
+			mux.Get("/api-keys", handlers.Repo.AdminAPIKeys)
+			mux.Get("/api-keys/new", handlers.Repo.AdminNewAPIKey)
+			mux.Post("/api-keys/new", handlers.Repo.PostAdminNewAPIKey)
+			mux.Get("/api-keys/{id}/revoke/do", handlers.Repo.AdminRevokeAPIKey)
+		})
 
+		mux.Group(func(mux chi.Router) {
+			mux.Use(RequirePermission(rbac.ManageWebhooks))
+			mux.Get("/webhooks", handlers.Repo.AdminWebhooks)
+			mux.Get("/webhooks/new", handlers.Repo.AdminNewWebhook)
+			mux.Post("/webhooks/new", handlers.Repo.PostAdminNewWebhook)
+			mux.Get("/webhooks/{id}", handlers.Repo.AdminShowWebhook)
+			mux.Post("/webhooks/{id}", handlers.Repo.PostAdminShowWebhook)
+			mux.Get("/webhooks/{id}/delete/do", handlers.Repo.AdminDeleteWebhook)
+			mux.Get("/webhooks/{id}/deliveries/{deliveryID}/redeliver/do", handlers.Repo.AdminRedeliverWebhook)
+		})
 	})
 
 	fileServer := http.FileServer(http.Dir("./static/"))
@@ -1,9 +1,14 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"github.com/KingKord/bookings/internal/apidocs"
 	"github.com/KingKord/bookings/internal/config"
 	"github.com/go-chi/chi/v5"
+	"net/http"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -19,3 +24,47 @@ func TestRoutes(t *testing.T) {
 		t.Error(fmt.Sprintf("type is not *chi.Mux, type is %T", v))
 	}
 }
+
+// isJSONRoute reports whether a route was registered with the JSON middleware
+func isJSONRoute(middlewares []func(http.Handler) http.Handler) bool {
+	for _, mw := range middlewares {
+		if reflect.ValueOf(mw).Pointer() == reflect.ValueOf(JSON).Pointer() {
+			return true
+		}
+	}
+	return false
+}
+
+func TestRoutesAreDocumented(t *testing.T) {
+	var spec struct {
+		Paths map[string]map[string]interface{} `json:"paths"`
+	}
+	err := json.Unmarshal(apidocs.Spec, &spec)
+	if err != nil {
+		t.Fatal("cannot parse the OpenAPI document:", err)
+	}
+
+	routed := make(map[string]bool)
+	err = chi.Walk(routes(&app).(chi.Router), func(method, route string, handler http.Handler, middlewares ...func(http.Handler) http.Handler) error {
+		// every API route is documented, even one registered without the JSON middleware
+		if !isJSONRoute(middlewares) && !strings.HasPrefix(route, "/api/v1/") {
+			return nil
+		}
+		routed[method+" "+route] = true
+		if _, ok := spec.Paths[route][strings.ToLower(method)]; !ok {
+			t.Errorf("%s %s is missing from the OpenAPI document", method, route)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for path, operations := range spec.Paths {
+		for method := range operations {
+			if !routed[strings.ToUpper(method)+" "+path] {
+				t.Errorf("the OpenAPI document describes %s %s, which has no route", strings.ToUpper(method), path)
+			}
+		}
+	}
+}
@@ -47,6 +47,14 @@ func sendMsg(m models.MailData) {
 		email.SetBody(mail.TextHTML, msgToSend)
 	}
 
+	for _, a := range m.Attachments {
+		email.Attach(&mail.File{
+			Name:     a.Name,
+			MimeType: a.MimeType,
+			Data:     a.Data,
+		})
+	}
+
 	err = email.Send(client)
 	if err != nil {
 		log.Println(err)
@@ -1,12 +1,22 @@
 package main
 
 import (
+	"github.com/KingKord/bookings/internal/handlers"
+	"github.com/KingKord/bookings/internal/helpers"
+	"github.com/alexedwards/scs/v2"
+	"log"
 	"net/http"
 	"os"
 	"testing"
 )
 
 func TestMain(m *testing.M) {
+	app.InfoLog = log.New(os.Stdout, "INFO\t", log.Ldate|log.Ltime)
+	app.ErrorLog = log.New(os.Stdout, "ERROR\t", log.Ldate|log.Ltime|log.Lshortfile)
+	session = scs.New()
+	app.Session = session
+	helpers.NewHelpers(&app)
+	handlers.NewHandlers(handlers.NewTestRepo(&app))
 
 	os.Exit(m.Run())
 }
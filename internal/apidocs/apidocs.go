@@ -0,0 +1,11 @@
+// Package apidocs holds the OpenAPI document of the JSON endpoints
+package apidocs
+
+import (
+	_ "embed"
+)
+
+// Spec is the OpenAPI 3 document, keep it in step with the routes, TestRoutesAreDocumented checks it
+//
+//go:embed openapi.json
+var Spec []byte
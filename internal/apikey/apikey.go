@@ -0,0 +1,75 @@
+package apikey
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+)
+
+// Scope is something an API key is allowed to do
+type Scope string
+
+const (
+	ReadAvailability   Scope = "availability:read"
+	CreateReservations Scope = "reservations:write"
+	// Admin grants every scope
+	Admin Scope = "admin"
+)
+
+// ScopeInfo describes a scope for the admin area
+type ScopeInfo struct {
+	Scope       Scope
+	Name        string
+	Description string
+}
+
+// Scopes lists every scope a key can be given
+var Scopes = []ScopeInfo{
+	{ReadAvailability, "Read availability", "List rooms and search availability"},
+	{CreateReservations, "Create reservations", "Book rooms"},
+	{Admin, "Admin", "Everything, including reading and cancelling any reservation"},
+}
+
+// keyPrefix marks a string as one of our API keys, so a leaked key is easy to recognise
+const keyPrefix = "bk_"
+
+// displayLength is how much of a key is kept in the clear to tell keys apart
+const displayLength = len(keyPrefix) + 8
+
+// Generate returns a new API key, the prefix shown in the admin area and the hash the key is stored as
+func Generate() (key, prefix, hash string, err error) {
+	b := make([]byte, 32)
+	_, err = rand.Read(b)
+	if err != nil {
+		return "", "", "", err
+	}
+	key = keyPrefix + base64.RawURLEncoding.EncodeToString(b)
+	return key, key[:displayLength], Hash(key), nil
+}
+
+// Hash returns the hex encoded sha256 hash a key is stored as
+func Hash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// Valid reports whether s is a known scope
+func Valid(s string) bool {
+	for _, x := range Scopes {
+		if string(x.Scope) == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Allows reports whether a key with scopes may use scope s
+func Allows(scopes []string, s Scope) bool {
+	for _, x := range scopes {
+		if Scope(x) == s || Scope(x) == Admin {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,53 @@
+package apikey
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGenerate(t *testing.T) {
+	key, prefix, hash, err := Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(key, prefix) || !strings.HasPrefix(prefix, "bk_") {
+		t.Errorf("key %s does not start with prefix %s", key, prefix)
+	}
+	if hash != Hash(key) {
+		t.Error("hash does not match the key")
+	}
+
+	other, _, _, _ := Generate()
+	if other == key {
+		t.Error("generated the same key twice")
+	}
+}
+
+var allowsTests = []struct {
+	name     string
+	scopes   []string
+	scope    Scope
+	expected bool
+}{
+	{"granted", []string{"availability:read"}, ReadAvailability, true},
+	{"not granted", []string{"availability:read"}, CreateReservations, false},
+	{"admin grants everything", []string{"admin"}, CreateReservations, true},
+	{"no scopes", nil, ReadAvailability, false},
+}
+
+func TestAllows(t *testing.T) {
+	for _, e := range allowsTests {
+		if Allows(e.scopes, e.scope) != e.expected {
+			t.Errorf("%s: expected %t", e.name, e.expected)
+		}
+	}
+}
+
+func TestValid(t *testing.T) {
+	if !Valid("reservations:write") {
+		t.Error("expected reservations:write to be valid")
+	}
+	if Valid("reservations:delete") {
+		t.Error("expected reservations:delete to be invalid")
+	}
+}
@@ -0,0 +1,295 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: bookings/v1/bookings.proto
+
+package bookingspb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	BookingsService_SearchAvailability_FullMethodName = "/bookings.v1.BookingsService/SearchAvailability"
+	BookingsService_GetRoom_FullMethodName            = "/bookings.v1.BookingsService/GetRoom"
+	BookingsService_CreateReservation_FullMethodName  = "/bookings.v1.BookingsService/CreateReservation"
+	BookingsService_CancelReservation_FullMethodName  = "/bookings.v1.BookingsService/CancelReservation"
+	BookingsService_WatchReservations_FullMethodName  = "/bookings.v1.BookingsService/WatchReservations"
+)
+
+// BookingsServiceClient is the client API for BookingsService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type BookingsServiceClient interface {
+	// SearchAvailability lists the rooms free for every night of a date range. Scope availability:read
+	SearchAvailability(ctx context.Context, in *SearchAvailabilityRequest, opts ...grpc.CallOption) (*SearchAvailabilityResponse, error)
+	// GetRoom returns a room. Scope availability:read
+	GetRoom(ctx context.Context, in *GetRoomRequest, opts ...grpc.CallOption) (*GetRoomResponse, error)
+	// CreateReservation books a room and emails the guest a confirmation. Scope reservations:write
+	CreateReservation(ctx context.Context, in *CreateReservationRequest, opts ...grpc.CallOption) (*CreateReservationResponse, error)
+	// CancelReservation cancels a reservation and frees up its room. Scope admin
+	CancelReservation(ctx context.Context, in *CancelReservationRequest, opts ...grpc.CallOption) (*CancelReservationResponse, error)
+	// WatchReservations streams reservations as they are created and cancelled. Scope admin
+	WatchReservations(ctx context.Context, in *WatchReservationsRequest, opts ...grpc.CallOption) (BookingsService_WatchReservationsClient, error)
+}
+
+type bookingsServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewBookingsServiceClient(cc grpc.ClientConnInterface) BookingsServiceClient {
+	return &bookingsServiceClient{cc}
+}
+
+func (c *bookingsServiceClient) SearchAvailability(ctx context.Context, in *SearchAvailabilityRequest, opts ...grpc.CallOption) (*SearchAvailabilityResponse, error) {
+	out := new(SearchAvailabilityResponse)
+	err := c.cc.Invoke(ctx, BookingsService_SearchAvailability_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *bookingsServiceClient) GetRoom(ctx context.Context, in *GetRoomRequest, opts ...grpc.CallOption) (*GetRoomResponse, error) {
+	out := new(GetRoomResponse)
+	err := c.cc.Invoke(ctx, BookingsService_GetRoom_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *bookingsServiceClient) CreateReservation(ctx context.Context, in *CreateReservationRequest, opts ...grpc.CallOption) (*CreateReservationResponse, error) {
+	out := new(CreateReservationResponse)
+	err := c.cc.Invoke(ctx, BookingsService_CreateReservation_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *bookingsServiceClient) CancelReservation(ctx context.Context, in *CancelReservationRequest, opts ...grpc.CallOption) (*CancelReservationResponse, error) {
+	out := new(CancelReservationResponse)
+	err := c.cc.Invoke(ctx, BookingsService_CancelReservation_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *bookingsServiceClient) WatchReservations(ctx context.Context, in *WatchReservationsRequest, opts ...grpc.CallOption) (BookingsService_WatchReservationsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &BookingsService_ServiceDesc.Streams[0], BookingsService_WatchReservations_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &bookingsServiceWatchReservationsClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type BookingsService_WatchReservationsClient interface {
+	Recv() (*WatchReservationsResponse, error)
+	grpc.ClientStream
+}
+
+type bookingsServiceWatchReservationsClient struct {
+	grpc.ClientStream
+}
+
+func (x *bookingsServiceWatchReservationsClient) Recv() (*WatchReservationsResponse, error) {
+	m := new(WatchReservationsResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// BookingsServiceServer is the server API for BookingsService service.
+// All implementations must embed UnimplementedBookingsServiceServer
+// for forward compatibility
+type BookingsServiceServer interface {
+	// SearchAvailability lists the rooms free for every night of a date range. Scope availability:read
+	SearchAvailability(context.Context, *SearchAvailabilityRequest) (*SearchAvailabilityResponse, error)
+	// GetRoom returns a room. Scope availability:read
+	GetRoom(context.Context, *GetRoomRequest) (*GetRoomResponse, error)
+	// CreateReservation books a room and emails the guest a confirmation. Scope reservations:write
+	CreateReservation(context.Context, *CreateReservationRequest) (*CreateReservationResponse, error)
+	// CancelReservation cancels a reservation and frees up its room. Scope admin
+	CancelReservation(context.Context, *CancelReservationRequest) (*CancelReservationResponse, error)
+	// WatchReservations streams reservations as they are created and cancelled. Scope admin
+	WatchReservations(*WatchReservationsRequest, BookingsService_WatchReservationsServer) error
+	mustEmbedUnimplementedBookingsServiceServer()
+}
+
+// UnimplementedBookingsServiceServer must be embedded to have forward compatible implementations.
+type UnimplementedBookingsServiceServer struct {
+}
+
+func (UnimplementedBookingsServiceServer) SearchAvailability(context.Context, *SearchAvailabilityRequest) (*SearchAvailabilityResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SearchAvailability not implemented")
+}
+func (UnimplementedBookingsServiceServer) GetRoom(context.Context, *GetRoomRequest) (*GetRoomResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetRoom not implemented")
+}
+func (UnimplementedBookingsServiceServer) CreateReservation(context.Context, *CreateReservationRequest) (*CreateReservationResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CreateReservation not implemented")
+}
+func (UnimplementedBookingsServiceServer) CancelReservation(context.Context, *CancelReservationRequest) (*CancelReservationResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CancelReservation not implemented")
+}
+func (UnimplementedBookingsServiceServer) WatchReservations(*WatchReservationsRequest, BookingsService_WatchReservationsServer) error {
+	return status.Errorf(codes.Unimplemented, "method WatchReservations not implemented")
+}
+func (UnimplementedBookingsServiceServer) mustEmbedUnimplementedBookingsServiceServer() {}
+
+// UnsafeBookingsServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to BookingsServiceServer will
+// result in compilation errors.
+type UnsafeBookingsServiceServer interface {
+	mustEmbedUnimplementedBookingsServiceServer()
+}
+
+func RegisterBookingsServiceServer(s grpc.ServiceRegistrar, srv BookingsServiceServer) {
+	s.RegisterService(&BookingsService_ServiceDesc, srv)
+}
+
+func _BookingsService_SearchAvailability_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SearchAvailabilityRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BookingsServiceServer).SearchAvailability(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: BookingsService_SearchAvailability_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BookingsServiceServer).SearchAvailability(ctx, req.(*SearchAvailabilityRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _BookingsService_GetRoom_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetRoomRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BookingsServiceServer).GetRoom(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: BookingsService_GetRoom_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BookingsServiceServer).GetRoom(ctx, req.(*GetRoomRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _BookingsService_CreateReservation_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CreateReservationRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BookingsServiceServer).CreateReservation(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: BookingsService_CreateReservation_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BookingsServiceServer).CreateReservation(ctx, req.(*CreateReservationRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _BookingsService_CancelReservation_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CancelReservationRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BookingsServiceServer).CancelReservation(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: BookingsService_CancelReservation_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BookingsServiceServer).CancelReservation(ctx, req.(*CancelReservationRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _BookingsService_WatchReservations_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchReservationsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(BookingsServiceServer).WatchReservations(m, &bookingsServiceWatchReservationsServer{stream})
+}
+
+type BookingsService_WatchReservationsServer interface {
+	Send(*WatchReservationsResponse) error
+	grpc.ServerStream
+}
+
+type bookingsServiceWatchReservationsServer struct {
+	grpc.ServerStream
+}
+
+func (x *bookingsServiceWatchReservationsServer) Send(m *WatchReservationsResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// BookingsService_ServiceDesc is the grpc.ServiceDesc for BookingsService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var BookingsService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "bookings.v1.BookingsService",
+	HandlerType: (*BookingsServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "SearchAvailability",
+			Handler:    _BookingsService_SearchAvailability_Handler,
+		},
+		{
+			MethodName: "GetRoom",
+			Handler:    _BookingsService_GetRoom_Handler,
+		},
+		{
+			MethodName: "CreateReservation",
+			Handler:    _BookingsService_CreateReservation_Handler,
+		},
+		{
+			MethodName: "CancelReservation",
+			Handler:    _BookingsService_CancelReservation_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchReservations",
+			Handler:       _BookingsService_WatchReservations_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "bookings/v1/bookings.proto",
+}
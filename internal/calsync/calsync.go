@@ -0,0 +1,288 @@
+package calsync
+
+import (
+	"errors"
+	"fmt"
+	"github.com/KingKord/bookings/internal/config"
+	"github.com/KingKord/bookings/internal/events"
+	"github.com/KingKord/bookings/internal/ical"
+	"github.com/KingKord/bookings/internal/models"
+	"github.com/KingKord/bookings/internal/repository"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// requestTimeout bounds fetching a calendar
+	requestTimeout = 30 * time.Second
+	// maxCalendarSize is the most bytes read from a calendar
+	maxCalendarSize = 5 << 20
+)
+
+// syncMu keeps two syncs, say a scheduled one and one started by an admin, from importing
+// the same events twice
+var syncMu sync.Mutex
+
+// Result counts the changes a sync made to the blocks of a room
+type Result struct {
+	Added   int
+	Updated int
+	Removed int
+	// Conflicts are the overlaps with reservations that the sync brought up
+	Conflicts []models.CalendarConflict
+}
+
+// Syncer imports the events of external calendars, such as those of other booking sites, as blocks
+// of their rooms. Events are matched to blocks by UID, so an event that moves moves its block and an
+// event that goes away frees its dates
+type Syncer struct {
+	app    *config.AppConfig
+	db     repository.DatabaseRepo
+	client *http.Client
+}
+
+// New returns a syncer using the database repository db
+func New(a *config.AppConfig, db repository.DatabaseRepo) *Syncer {
+	return &Syncer{
+		app:    a,
+		db:     db,
+		client: &http.Client{Timeout: requestTimeout},
+	}
+}
+
+// Start syncs every external calendar now and then every interval, in the background
+func (s *Syncer) Start(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			s.SyncAll()
+			<-ticker.C
+		}
+	}()
+}
+
+// SyncAll syncs every external calendar, logging the ones that fail
+func (s *Syncer) SyncAll() {
+	sources, err := s.db.AllCalendarSources()
+	if err != nil {
+		s.app.ErrorLog.Println(err)
+		return
+	}
+
+	for _, src := range sources {
+		_, err := s.Sync(src)
+		if err != nil {
+			s.app.ErrorLog.Printf("syncing calendar %d (%s): %s", src.ID, src.Name, err)
+		}
+	}
+}
+
+// Sync imports the events of an external calendar and records the outcome on it.
+// The owner is emailed about new conflicts with reservations
+func (s *Syncer) Sync(src models.CalendarSource) (Result, error) {
+	syncMu.Lock()
+	res, err := s.sync(src)
+	syncErr := ""
+	if err != nil {
+		syncErr = err.Error()
+	}
+	if recErr := s.db.RecordCalendarSync(src.ID, syncErr); recErr != nil && err == nil {
+		err = recErr
+	}
+	syncMu.Unlock()
+
+	if err != nil {
+		return res, err
+	}
+
+	if len(res.Conflicts) > 0 {
+		s.notifyConflicts(src, res.Conflicts)
+	}
+	return res, nil
+}
+
+func (s *Syncer) sync(src models.CalendarSource) (Result, error) {
+	var res Result
+
+	events, err := s.fetch(src.URL)
+	if err != nil {
+		return res, err
+	}
+
+	existing, err := s.db.ExternalBlocks(src.ID)
+	if err != nil {
+		return res, err
+	}
+
+	before, err := s.db.CalendarConflicts(src.ID)
+	if err != nil {
+		return res, err
+	}
+
+	blocks, removeIDs := reconcile(src, existing, events)
+	for _, b := range blocks {
+		if b.ID > 0 {
+			res.Updated++
+		} else {
+			res.Added++
+		}
+	}
+	res.Removed = len(removeIDs)
+
+	if len(blocks) > 0 || len(removeIDs) > 0 {
+		err = s.db.SaveExternalBlocks(src.ID, blocks, removeIDs)
+		if err != nil {
+			return res, err
+		}
+		s.publishChanges(src, existing, blocks, removeIDs)
+	}
+
+	after, err := s.db.CalendarConflicts(src.ID)
+	if err != nil {
+		return res, err
+	}
+	res.Conflicts = newConflicts(before, after)
+
+	return res, nil
+}
+
+// publishChanges publishes the blocks a sync saved. A moved block is removed from its old dates and
+// added on its new ones
+func (s *Syncer) publishChanges(src models.CalendarSource, existing, blocks []models.RoomRestriction, removeIDs []int) {
+	byID := make(map[int]models.RoomRestriction)
+	for _, b := range existing {
+		b.Room = src.Room
+		byID[b.ID] = b
+	}
+
+	for _, id := range removeIDs {
+		s.app.Events.PublishBlock(events.BlockRemoved, byID[id])
+	}
+	for _, b := range blocks {
+		if old, ok := byID[b.ID]; ok && b.ID > 0 {
+			s.app.Events.PublishBlock(events.BlockRemoved, old)
+		}
+		b.Room = src.Room
+		s.app.Events.PublishBlock(events.BlockAdded, b)
+	}
+}
+
+// fetch downloads and parses a calendar, webcal URLs are fetched over https
+func (s *Syncer) fetch(url string) ([]ical.Event, error) {
+	if rest, ok := strings.CutPrefix(url, "webcal://"); ok {
+		url = "https://" + rest
+	}
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/calendar")
+	req.Header.Set("User-Agent", "bookings-calendar-sync/1")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("calendar responded %s", resp.Status)
+	}
+
+	events, err := ical.Parse(io.LimitReader(resp.Body, maxCalendarSize))
+	if errors.Is(err, ical.ErrNotCalendar) {
+		return nil, fmt.Errorf("%s doesn't serve an iCalendar file", url)
+	}
+	return events, err
+}
+
+// reconcile compares the events of a calendar with the blocks imported from it before. It returns
+// the blocks to save, those with an id have moved, and the ids of the blocks whose events are gone
+func reconcile(src models.CalendarSource, existing []models.RoomRestriction, events []ical.Event) ([]models.RoomRestriction, []int) {
+	byUID := make(map[string]models.RoomRestriction)
+	for _, b := range existing {
+		byUID[b.ExternalUID] = b
+	}
+
+	var blocks []models.RoomRestriction
+	seen := make(map[string]bool)
+	for _, e := range events {
+		// recurring events repeat their UID, only the first occurrence is kept
+		if seen[e.UID] {
+			continue
+		}
+		seen[e.UID] = true
+
+		b, ok := byUID[e.UID]
+		if ok && b.StartDate.Equal(e.Start) && b.EndDate.Equal(e.End) {
+			continue
+		}
+		if !ok {
+			b = models.RoomRestriction{
+				RoomID:           src.RoomID,
+				RestrictionID:    models.ExternalRestrictionID,
+				CalendarSourceID: src.ID,
+				ExternalUID:      e.UID,
+			}
+		}
+		b.StartDate, b.EndDate = e.Start, e.End
+		blocks = append(blocks, b)
+	}
+
+	var removeIDs []int
+	for _, b := range existing {
+		if !seen[b.ExternalUID] {
+			removeIDs = append(removeIDs, b.ID)
+		}
+	}
+
+	return blocks, removeIDs
+}
+
+// newConflicts returns the conflicts in after that weren't in before
+func newConflicts(before, after []models.CalendarConflict) []models.CalendarConflict {
+	known := make(map[string]bool)
+	for _, c := range before {
+		known[conflictKey(c)] = true
+	}
+
+	var conflicts []models.CalendarConflict
+	for _, c := range after {
+		if !known[conflictKey(c)] {
+			conflicts = append(conflicts, c)
+		}
+	}
+	return conflicts
+}
+
+func conflictKey(c models.CalendarConflict) string {
+	return fmt.Sprintf("%s/%d", c.Block.ExternalUID, c.Reservation.ID)
+}
+
+// notifyConflicts emails the property owner about conflicts with reservations
+func (s *Syncer) notifyConflicts(src models.CalendarSource, conflicts []models.CalendarConflict) {
+	var b strings.Builder
+	b.WriteString(fmt.Sprintf(`
+		<strong>Calendar Conflict</strong><br>
+		The calendar %s of %s blocks nights that are already reserved:<br>
+`, src.Name, src.Room.RoomName))
+	for _, c := range conflicts {
+		b.WriteString(fmt.Sprintf(`
+		%s to %s overlaps the reservation of %s %s from %s to %s<br>
+`, c.Block.StartDate.Format("02-01-2006"), c.Block.EndDate.Format("02-01-2006"),
+			c.Reservation.FirstName, c.Reservation.LastName,
+			c.Reservation.StartDate.Format("02-01-2006"), c.Reservation.EndDate.Format("02-01-2006")))
+	}
+
+	s.app.MailChan <- models.MailData{
+		To:      "me@here.com",
+		From:    "me@here.com",
+		Subject: "Calendar Conflict",
+		Content: b.String(),
+	}
+}
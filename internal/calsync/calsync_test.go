@@ -0,0 +1,207 @@
+package calsync
+
+import (
+	"fmt"
+	"github.com/KingKord/bookings/internal/config"
+	"github.com/KingKord/bookings/internal/events"
+	"github.com/KingKord/bookings/internal/models"
+	"github.com/KingKord/bookings/internal/repository"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func day(d int) time.Time {
+	return time.Date(2050, 1, d, 0, 0, 0, 0, time.UTC)
+}
+
+// fakeDB keeps the blocks of one external calendar in memory, next to a reservation
+// of John Smith from the 2nd to the 4th
+type fakeDB struct {
+	repository.DatabaseRepo
+	blocks  map[int]models.RoomRestriction
+	nextID  int
+	syncErr string
+}
+
+func newFakeDB() *fakeDB {
+	return &fakeDB{blocks: make(map[int]models.RoomRestriction), nextID: 1}
+}
+
+func (db *fakeDB) ExternalBlocks(sourceID int) ([]models.RoomRestriction, error) {
+	var blocks []models.RoomRestriction
+	for _, b := range db.blocks {
+		blocks = append(blocks, b)
+	}
+	return blocks, nil
+}
+
+func (db *fakeDB) SaveExternalBlocks(sourceID int, blocks []models.RoomRestriction, removeIDs []int) error {
+	for _, b := range blocks {
+		if b.ID == 0 {
+			b.ID = db.nextID
+			db.nextID++
+		}
+		db.blocks[b.ID] = b
+	}
+	for _, id := range removeIDs {
+		delete(db.blocks, id)
+	}
+	return nil
+}
+
+func (db *fakeDB) CalendarConflicts(sourceID int) ([]models.CalendarConflict, error) {
+	res := models.Reservation{ID: 1, FirstName: "John", LastName: "Smith", StartDate: day(2), EndDate: day(4)}
+	var conflicts []models.CalendarConflict
+	for _, b := range db.blocks {
+		if b.StartDate.Before(res.EndDate) && res.StartDate.Before(b.EndDate) {
+			conflicts = append(conflicts, models.CalendarConflict{Block: b, Reservation: res})
+		}
+	}
+	return conflicts, nil
+}
+
+func (db *fakeDB) RecordCalendarSync(id int, syncErr string) error {
+	db.syncErr = syncErr
+	return nil
+}
+
+func calendar(events ...string) string {
+	return "BEGIN:VCALENDAR\r\nVERSION:2.0\r\n" + strings.Join(events, "") + "END:VCALENDAR\r\n"
+}
+
+func event(uid, start, end string) string {
+	return fmt.Sprintf("BEGIN:VEVENT\r\nUID:%s\r\nDTSTART;VALUE=DATE:%s\r\nDTEND;VALUE=DATE:%s\r\nSUMMARY:Reserved\r\nEND:VEVENT\r\n", uid, start, end)
+}
+
+func TestSync(t *testing.T) {
+	body := calendar(event("a", "20500106", "20500108"), event("b", "20500110", "20500112"))
+	status := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		fmt.Fprint(w, body)
+	}))
+	defer srv.Close()
+
+	mailChan := make(chan models.MailData, 10)
+	app := &config.AppConfig{MailChan: mailChan, ErrorLog: log.New(io.Discard, "", 0), Events: events.NewBroker()}
+	published, unsubscribe := app.Events.Subscribe()
+	defer unsubscribe()
+	db := newFakeDB()
+	s := New(app, db)
+	src := models.CalendarSource{ID: 1, RoomID: 1, Room: models.Room{ID: 1, RoomName: "General's Quarters"}, Name: "Airbnb", URL: srv.URL}
+
+	var tests = []struct {
+		name     string
+		body     string
+		expected Result
+		// blocks are the dates of the blocks after the sync, by UID
+		blocks map[string][2]time.Time
+		// events are the block events published by the sync, as type and first night
+		events []string
+	}{
+		{
+			"first sync",
+			body,
+			Result{Added: 2},
+			map[string][2]time.Time{"a": {day(6), day(8)}, "b": {day(10), day(12)}},
+			[]string{"block.added 2050-01-06", "block.added 2050-01-10"},
+		},
+		{
+			"unchanged",
+			body,
+			Result{},
+			map[string][2]time.Time{"a": {day(6), day(8)}, "b": {day(10), day(12)}},
+			nil,
+		},
+		{
+			"moved and removed",
+			calendar(event("a", "20500103", "20500105")),
+			Result{Updated: 1, Removed: 1},
+			map[string][2]time.Time{"a": {day(3), day(5)}},
+			[]string{"block.removed 2050-01-10", "block.removed 2050-01-06", "block.added 2050-01-03"},
+		},
+		{
+			"still conflicting",
+			calendar(event("a", "20500103", "20500105"), event("c", "20500120", "20500121")),
+			Result{Added: 1},
+			map[string][2]time.Time{"a": {day(3), day(5)}, "c": {day(20), day(21)}},
+			[]string{"block.added 2050-01-20"},
+		},
+	}
+
+	for _, e := range tests {
+		body = e.body
+		got, err := s.Sync(src)
+		if err != nil {
+			t.Fatalf("%s: %s", e.name, err)
+		}
+		if got.Added != e.expected.Added || got.Updated != e.expected.Updated || got.Removed != e.expected.Removed {
+			t.Errorf("%s: expected %+v but got %+v", e.name, e.expected, got)
+		}
+		if len(db.blocks) != len(e.blocks) {
+			t.Errorf("%s: expected %d blocks but got %d", e.name, len(e.blocks), len(db.blocks))
+		}
+		for _, b := range db.blocks {
+			dates, ok := e.blocks[b.ExternalUID]
+			if !ok || !b.StartDate.Equal(dates[0]) || !b.EndDate.Equal(dates[1]) {
+				t.Errorf("%s: unexpected block %s from %s to %s", e.name, b.ExternalUID, b.StartDate, b.EndDate)
+			}
+			if b.RoomID != 1 || b.RestrictionID != models.ExternalRestrictionID {
+				t.Errorf("%s: expected an external block of room 1, got %+v", e.name, b)
+			}
+		}
+
+		var gotEvents []string
+		for len(published) > 0 {
+			ev := <-published
+			if ev.Block.Room.RoomName != "General's Quarters" {
+				t.Errorf("%s: expected the room name on the event, got %+v", e.name, ev.Block)
+			}
+			gotEvents = append(gotEvents, ev.Type+" "+ev.Block.StartDate.Format("2006-01-02"))
+		}
+		if strings.Join(gotEvents, ", ") != strings.Join(e.events, ", ") {
+			t.Errorf("%s: expected events %v but got %v", e.name, e.events, gotEvents)
+		}
+	}
+
+	// only the move onto John Smith's reservation is a new conflict
+	if len(mailChan) != 1 {
+		t.Fatalf("expected one conflict email but got %d", len(mailChan))
+	}
+	msg := <-mailChan
+	if msg.Subject != "Calendar Conflict" || !strings.Contains(msg.Content, "John Smith") {
+		t.Errorf("unexpected email %+v", msg)
+	}
+
+	status = http.StatusNotFound
+	_, err := s.Sync(src)
+	if err == nil || db.syncErr == "" {
+		t.Error("expected a failed fetch to be recorded")
+	}
+	if len(db.blocks) != 2 {
+		t.Errorf("expected a failed fetch to keep the blocks, got %d", len(db.blocks))
+	}
+}
+
+func TestFetch(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "<html><body>Sign in</body></html>")
+	}))
+	defer srv.Close()
+
+	s := New(&config.AppConfig{}, nil)
+	_, err := s.fetch(srv.URL)
+	if err == nil || !strings.Contains(err.Error(), "doesn't serve an iCalendar file") {
+		t.Errorf("expected an HTML page to be rejected, got %v", err)
+	}
+
+	_, err = s.fetch("webcal://127.0.0.1:1/calendar.ics")
+	if err == nil || !strings.Contains(err.Error(), "https://127.0.0.1:1") {
+		t.Errorf("expected webcal to be fetched over https, got %v", err)
+	}
+}
@@ -1,6 +1,7 @@
 package config
 
 import (
+	"github.com/KingKord/bookings/internal/events"
 	"github.com/KingKord/bookings/internal/models"
 	"github.com/alexedwards/scs/v2"
 	"html/template"
@@ -16,4 +17,7 @@ type AppConfig struct {
 	InProduction  bool
 	Session       *scs.SessionManager
 	MailChan      chan models.MailData
+	PropertyCode  string
+	BaseURL       string
+	Events        *events.Broker
 }
@@ -0,0 +1,127 @@
+package events
+
+import (
+	"github.com/KingKord/bookings/internal/models"
+	"sync"
+	"time"
+)
+
+// event types
+const (
+	ReservationCreated   = "reservation.created"
+	ReservationModified  = "reservation.modified"
+	ReservationProcessed = "reservation.processed"
+	ReservationCancelled = "reservation.cancelled"
+	ReservationDeleted   = "reservation.deleted"
+	BlockAdded           = "block.added"
+	BlockRemoved         = "block.removed"
+)
+
+// TypeInfo describes an event type for the admin area
+type TypeInfo struct {
+	Type        string
+	Description string
+}
+
+// Types lists every event type
+var Types = []TypeInfo{
+	{ReservationCreated, "A room was booked"},
+	{ReservationModified, "A guest's details were changed"},
+	{ReservationProcessed, "A reservation was marked as processed"},
+	{ReservationCancelled, "A reservation was cancelled through the API"},
+	{ReservationDeleted, "A reservation was deleted"},
+	{BlockAdded, "A night was blocked on the calendar"},
+	{BlockRemoved, "A block was removed from the calendar"},
+}
+
+// ValidType reports whether t is a known event type
+func ValidType(t string) bool {
+	for _, info := range Types {
+		if info.Type == t {
+			return true
+		}
+	}
+	return false
+}
+
+// bufferSize is how many events a subscriber can fall behind before events are dropped for it
+const bufferSize = 64
+
+// Event is something that happened to a reservation or to a block
+type Event struct {
+	Type        string
+	Reservation models.Reservation
+	Block       models.RoomRestriction
+	OccurredAt  time.Time
+}
+
+// Broker fans reservation events out to every subscriber and handler. A nil Broker discards events
+type Broker struct {
+	mu          sync.Mutex
+	subscribers map[chan Event]struct{}
+	handlers    []func(Event)
+}
+
+// NewBroker returns a broker without subscribers
+func NewBroker() *Broker {
+	return &Broker{subscribers: make(map[chan Event]struct{})}
+}
+
+// Publish sends a reservation event to every subscriber and handler. It doesn't wait for subscribers,
+// a subscriber whose buffer is full misses the event, but it waits for the handlers
+func (b *Broker) Publish(eventType string, res models.Reservation) {
+	b.publish(Event{Type: eventType, Reservation: res, OccurredAt: time.Now()})
+}
+
+// PublishBlock sends a block event to every subscriber, like Publish
+func (b *Broker) PublishBlock(eventType string, block models.RoomRestriction) {
+	b.publish(Event{Type: eventType, Block: block, OccurredAt: time.Now()})
+}
+
+func (b *Broker) publish(e Event) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	for ch := range b.subscribers {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+	handlers := b.handlers
+	b.mu.Unlock()
+
+	for _, h := range handlers {
+		h(e)
+	}
+}
+
+// Handle calls h with every event published from now on. Unlike subscribers, handlers run in the
+// goroutine of the publisher before Publish returns, so they never miss an event
+func (b *Broker) Handle(h func(Event)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers = append(b.handlers, h)
+}
+
+// Subscribe returns a channel receiving every event published from now on, and a function
+// to call when done with it
+func (b *Broker) Subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, bufferSize)
+
+	b.mu.Lock()
+	b.subscribers[ch] = struct{}{}
+	b.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subscribers, ch)
+			b.mu.Unlock()
+			close(ch)
+		})
+	}
+}
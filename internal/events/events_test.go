@@ -0,0 +1,78 @@
+package events
+
+import (
+	"github.com/KingKord/bookings/internal/models"
+	"testing"
+)
+
+func TestBroker(t *testing.T) {
+	b := NewBroker()
+
+	first, unsubscribeFirst := b.Subscribe()
+	second, unsubscribeSecond := b.Subscribe()
+	defer unsubscribeSecond()
+
+	b.Publish(ReservationCreated, models.Reservation{ID: 1})
+
+	for _, ch := range []<-chan Event{first, second} {
+		e := <-ch
+		if e.Type != ReservationCreated || e.Reservation.ID != 1 {
+			t.Errorf("unexpected event %+v", e)
+		}
+	}
+
+	unsubscribeFirst()
+	unsubscribeFirst()
+	if _, ok := <-first; ok {
+		t.Error("expected the channel to be closed after unsubscribing")
+	}
+
+	b.Publish(ReservationCancelled, models.Reservation{ID: 1})
+	if e := <-second; e.Type != ReservationCancelled {
+		t.Errorf("expected a cancelled event, got %s", e.Type)
+	}
+}
+
+func TestPublishDoesNotBlock(t *testing.T) {
+	b := NewBroker()
+	_, unsubscribe := b.Subscribe()
+	defer unsubscribe()
+
+	// nobody reads, publishing past the buffer must not block
+	for i := 0; i < bufferSize*2; i++ {
+		b.Publish(ReservationCreated, models.Reservation{ID: i})
+	}
+
+	var nilBroker *Broker
+	nilBroker.Publish(ReservationCreated, models.Reservation{})
+}
+
+func TestPublishBlock(t *testing.T) {
+	b := NewBroker()
+	ch, unsubscribe := b.Subscribe()
+	defer unsubscribe()
+
+	b.PublishBlock(BlockAdded, models.RoomRestriction{RoomID: 2})
+	if e := <-ch; e.Type != BlockAdded || e.Block.RoomID != 2 {
+		t.Errorf("unexpected event %+v", e)
+	}
+}
+
+func TestHandle(t *testing.T) {
+	b := NewBroker()
+	_, unsubscribe := b.Subscribe()
+	defer unsubscribe()
+
+	var handled []int
+	b.Handle(func(e Event) {
+		handled = append(handled, e.Reservation.ID)
+	})
+
+	// the subscriber falls behind, the handler still sees every event by the time Publish returns
+	for i := 0; i < bufferSize*2; i++ {
+		b.Publish(ReservationCreated, models.Reservation{ID: i})
+	}
+	if len(handled) != bufferSize*2 || handled[bufferSize*2-1] != bufferSize*2-1 {
+		t.Errorf("expected every event to be handled, got %d", len(handled))
+	}
+}
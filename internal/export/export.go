@@ -0,0 +1,125 @@
+package export
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+const dateLayout = "2006-01-02"
+
+type kind int
+
+const (
+	kindString kind = iota
+	kindInt
+	kindAmount
+	kindDate
+)
+
+// Cell is a typed value of a table, so that spreadsheets get numbers and dates rather than text
+type Cell struct {
+	kind kind
+	s    string
+	n    int
+	t    time.Time
+}
+
+// String returns a text cell
+func String(s string) Cell {
+	return Cell{kind: kindString, s: s}
+}
+
+// Int returns a whole number cell
+func Int(n int) Cell {
+	return Cell{kind: kindInt, n: n}
+}
+
+// Amount returns a money cell of an amount in cents
+func Amount(cents int) Cell {
+	return Cell{kind: kindAmount, n: cents}
+}
+
+// Date returns a date cell, a zero time gives an empty cell
+func Date(t time.Time) Cell {
+	if t.IsZero() {
+		return String("")
+	}
+	return Cell{kind: kindDate, t: t}
+}
+
+// Text returns the cell as it is written to a CSV file
+func (c Cell) Text() string {
+	switch c.kind {
+	case kindInt:
+		return strconv.Itoa(c.n)
+	case kindAmount:
+		return formatAmount(c.n)
+	case kindDate:
+		return c.t.Format(dateLayout)
+	}
+	return c.s
+}
+
+func formatAmount(cents int) string {
+	sign := ""
+	if cents < 0 {
+		sign = "-"
+		cents = -cents
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, cents/100, cents%100)
+}
+
+// Writer writes a table row by row, so that large tables are never held in memory
+type Writer interface {
+	// Header writes the column names, before any row
+	Header(names ...string) error
+	Row(cells ...Cell) error
+	// Close writes whatever is buffered and ends the file, it doesn't close the underlying writer
+	Close() error
+}
+
+// csvWriter writes comma separated values
+type csvWriter struct {
+	w *csv.Writer
+}
+
+// NewCSV returns a writer of comma separated values
+func NewCSV(w io.Writer) Writer {
+	return &csvWriter{w: csv.NewWriter(w)}
+}
+
+func (cw *csvWriter) Header(names ...string) error {
+	return cw.w.Write(names)
+}
+
+func (cw *csvWriter) Row(cells ...Cell) error {
+	record := make([]string, len(cells))
+	for i, c := range cells {
+		record[i] = c.Text()
+		if c.kind == kindString {
+			record[i] = defuse(record[i])
+		}
+	}
+	return cw.w.Write(record)
+}
+
+func (cw *csvWriter) Close() error {
+	cw.w.Flush()
+	return cw.w.Error()
+}
+
+// defuse keeps spreadsheet apps from running text that looks like a formula, such as a guest
+// name starting with =, by prefixing it with a quote
+func defuse(s string) string {
+	if s == "" {
+		return s
+	}
+	switch s[0] {
+	case '=', '+', '-', '@', '\t', '\r':
+		return "'" + s
+	}
+	return s
+}
@@ -0,0 +1,113 @@
+package export
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeTable(w Writer) error {
+	err := w.Header("ID", "Name", "Arrival", "Nights", "Total")
+	if err != nil {
+		return err
+	}
+	err = w.Row(Int(1), String("Smith, John"), Date(time.Date(2050, 1, 2, 0, 0, 0, 0, time.UTC)), Int(2), Amount(12050))
+	if err != nil {
+		return err
+	}
+	err = w.Row(Int(2), String("=HYPERLINK(\"http://evil\")"), Date(time.Time{}), Int(1), Amount(-5))
+	if err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+func TestCSV(t *testing.T) {
+	var b strings.Builder
+	err := writeTable(NewCSV(&b))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "ID,Name,Arrival,Nights,Total\n" +
+		"1,\"Smith, John\",2050-01-02,2,120.50\n" +
+		"2,\"'=HYPERLINK(\"\"http://evil\"\")\",,1,-0.05\n"
+	if b.String() != expected {
+		t.Errorf("unexpected csv:\n%s", b.String())
+	}
+}
+
+func TestXLSX(t *testing.T) {
+	var b bytes.Buffer
+	err := writeTable(NewXLSX(&b, "Reservations & Co"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(b.Bytes()), int64(b.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parts := make(map[string]string)
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, _ := io.ReadAll(rc)
+		rc.Close()
+		parts[f.Name] = string(content)
+	}
+
+	for _, name := range []string{"[Content_Types].xml", "_rels/.rels", "xl/workbook.xml", "xl/_rels/workbook.xml.rels", "xl/styles.xml", "xl/worksheets/sheet1.xml"} {
+		if _, ok := parts[name]; !ok {
+			t.Errorf("missing part %s", name)
+		}
+	}
+
+	if !strings.Contains(parts["xl/workbook.xml"], `name="Reservations &amp; Co"`) {
+		t.Errorf("sheet name not escaped in %s", parts["xl/workbook.xml"])
+	}
+
+	sheet := parts["xl/worksheets/sheet1.xml"]
+	for _, s := range []string{
+		`<c r="A1" s="3" t="inlineStr"><is><t xml:space="preserve">ID</t></is></c>`,
+		`<c r="B2" s="0" t="inlineStr"><is><t xml:space="preserve">Smith, John</t></is></c>`,
+		// 2050-01-02 is day 54790 of the spreadsheet calendar
+		`<c r="C2" s="1"><v>54790</v></c>`,
+		`<c r="E2" s="2"><v>120.50</v></c>`,
+		`<c r="E3" s="2"><v>-0.05</v></c>`,
+		`</sheetData></worksheet>`,
+	} {
+		if !strings.Contains(sheet, s) {
+			t.Errorf("expected %s in\n%s", s, sheet)
+		}
+	}
+	if strings.Contains(sheet, `r="C3"`) {
+		t.Error("expected no cell for an empty date")
+	}
+}
+
+func TestColumnName(t *testing.T) {
+	var tests = []struct {
+		i        int
+		expected string
+	}{
+		{0, "A"},
+		{25, "Z"},
+		{26, "AA"},
+		{51, "AZ"},
+		{701, "ZZ"},
+		{702, "AAA"},
+	}
+
+	for _, e := range tests {
+		if got := columnName(e.i); got != e.expected {
+			t.Errorf("column %d: expected %s but got %s", e.i, e.expected, got)
+		}
+	}
+}
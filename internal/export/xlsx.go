@@ -0,0 +1,181 @@
+package export
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// cell styles, the indexes of the cellXfs in xlsxStyles
+const (
+	styleDefault = 0
+	styleDate    = 1
+	styleAmount  = 2
+	styleHeader  = 3
+)
+
+// excelEpoch is day 0 of the serial dates of spreadsheets
+var excelEpoch = time.Date(1899, 12, 30, 0, 0, 0, 0, time.UTC)
+
+// xlsxWriter writes an Office Open XML workbook with a single sheet. The sheet is streamed into
+// the zip file as rows are written, using inline strings so that no shared string table has to
+// be built first
+type xlsxWriter struct {
+	zw   *zip.Writer
+	w    *bufio.Writer
+	rows int
+	err  error
+}
+
+// NewXLSX returns a writer of an Excel workbook whose only sheet is called sheetName
+func NewXLSX(w io.Writer, sheetName string) Writer {
+	xw := &xlsxWriter{zw: zip.NewWriter(w)}
+
+	parts := []struct{ name, content string }{
+		{"[Content_Types].xml", xlsxContentTypes},
+		{"_rels/.rels", xlsxRels},
+		{"xl/workbook.xml", fmt.Sprintf(xlsxWorkbook, escapeXML(sheetName))},
+		{"xl/_rels/workbook.xml.rels", xlsxWorkbookRels},
+		{"xl/styles.xml", xlsxStyles},
+	}
+	for _, p := range parts {
+		f, err := xw.zw.Create(p.name)
+		if err == nil {
+			_, err = io.WriteString(f, xml.Header+p.content)
+		}
+		if err != nil {
+			xw.err = err
+			return xw
+		}
+	}
+
+	// the sheet is the last part, so it stays open while rows are written
+	f, err := xw.zw.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		xw.err = err
+		return xw
+	}
+	xw.w = bufio.NewWriter(f)
+	xw.write(xml.Header + `<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+	return xw
+}
+
+func (xw *xlsxWriter) write(s string) {
+	if xw.err != nil {
+		return
+	}
+	_, xw.err = xw.w.WriteString(s)
+}
+
+func (xw *xlsxWriter) Header(names ...string) error {
+	cells := make([]Cell, len(names))
+	for i, n := range names {
+		cells[i] = String(n)
+	}
+	return xw.row(cells, styleHeader)
+}
+
+func (xw *xlsxWriter) Row(cells ...Cell) error {
+	return xw.row(cells, styleDefault)
+}
+
+func (xw *xlsxWriter) row(cells []Cell, style int) error {
+	xw.rows++
+	xw.write(fmt.Sprintf(`<row r="%d">`, xw.rows))
+	for i, c := range cells {
+		ref := fmt.Sprintf("%s%d", columnName(i), xw.rows)
+		switch c.kind {
+		case kindInt:
+			xw.write(fmt.Sprintf(`<c r="%s" s="%d"><v>%d</v></c>`, ref, style, c.n))
+		case kindAmount:
+			xw.write(fmt.Sprintf(`<c r="%s" s="%d"><v>%s</v></c>`, ref, styleAmount, formatAmount(c.n)))
+		case kindDate:
+			y, m, d := c.t.Date()
+			days := int(time.Date(y, m, d, 0, 0, 0, 0, time.UTC).Sub(excelEpoch).Hours() / 24)
+			xw.write(fmt.Sprintf(`<c r="%s" s="%d"><v>%d</v></c>`, ref, styleDate, days))
+		default:
+			if c.s == "" {
+				continue
+			}
+			xw.write(fmt.Sprintf(`<c r="%s" s="%d" t="inlineStr"><is><t xml:space="preserve">%s</t></is></c>`,
+				ref, style, escapeXML(c.s)))
+		}
+	}
+	xw.write(`</row>`)
+	return xw.err
+}
+
+func (xw *xlsxWriter) Close() error {
+	xw.write(`</sheetData></worksheet>`)
+	if xw.err == nil {
+		xw.err = xw.w.Flush()
+	}
+	if xw.err == nil {
+		xw.err = xw.zw.Close()
+	}
+	return xw.err
+}
+
+// columnName returns the letters of the ith column, counting from 0: A, B, ..., Z, AA, AB, ...
+func columnName(i int) string {
+	name := ""
+	for i >= 0 {
+		name = string(rune('A'+i%26)) + name
+		i = i/26 - 1
+	}
+	return name
+}
+
+// escapeXML escapes text for XML, dropping the characters XML can't hold
+func escapeXML(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if r < 0x20 && r != '\t' && r != '\n' && r != '\r' {
+			return -1
+		}
+		return r
+	}, s)
+	var b strings.Builder
+	_ = xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+const xlsxContentTypes = `<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+	`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+	`<Default Extension="xml" ContentType="application/xml"/>` +
+	`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+	`<Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>` +
+	`<Override PartName="/xl/styles.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.styles+xml"/>` +
+	`</Types>`
+
+const xlsxRels = `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+	`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>` +
+	`</Relationships>`
+
+const xlsxWorkbook = `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" ` +
+	`xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">` +
+	`<sheets><sheet name="%s" sheetId="1" r:id="rId1"/></sheets>` +
+	`</workbook>`
+
+const xlsxWorkbookRels = `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+	`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/>` +
+	`<Relationship Id="rId2" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" Target="styles.xml"/>` +
+	`</Relationships>`
+
+// xlsxStyles defines the cell styles: default, date, amount with two decimals and bold header
+const xlsxStyles = `<styleSheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">` +
+	`<numFmts count="1"><numFmt numFmtId="164" formatCode="yyyy-mm-dd"/></numFmts>` +
+	`<fonts count="2"><font><sz val="11"/><name val="Calibri"/></font><font><b/><sz val="11"/><name val="Calibri"/></font></fonts>` +
+	`<fills count="2"><fill><patternFill patternType="none"/></fill><fill><patternFill patternType="gray125"/></fill></fills>` +
+	`<borders count="1"><border><left/><right/><top/><bottom/><diagonal/></border></borders>` +
+	`<cellStyleXfs count="1"><xf numFmtId="0" fontId="0" fillId="0" borderId="0"/></cellStyleXfs>` +
+	`<cellXfs count="4">` +
+	`<xf numFmtId="0" fontId="0" fillId="0" borderId="0" xfId="0"/>` +
+	`<xf numFmtId="164" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/>` +
+	`<xf numFmtId="2" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/>` +
+	`<xf numFmtId="0" fontId="1" fillId="0" borderId="0" xfId="0" applyFont="1"/>` +
+	`</cellXfs>` +
+	`</styleSheet>`
@@ -61,3 +61,12 @@ func (f *Form) IsEmail(field string) {
 		f.Errors.Add(field, "Invalid email address")
 	}
 }
+
+// Matches checks that field has the same value as other, e.g. a password confirmation
+func (f *Form) Matches(field, other string) bool {
+	if f.Get(field) != f.Get(other) {
+		f.Errors.Add(field, "The values do not match")
+		return false
+	}
+	return true
+}
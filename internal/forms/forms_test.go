@@ -100,3 +100,31 @@ func TestForm_MinLength(t *testing.T) {
 	}
 
 }
+
+func TestForm_Matches(t *testing.T) {
+	postedData := url.Values{}
+	postedData.Add("password", "secret123")
+	postedData.Add("password_confirm", "secret124")
+	form := New(postedData)
+
+	if form.Matches("password_confirm", "password") {
+		t.Error("shows values match when they do not")
+	}
+
+	if form.Errors.Get("password_confirm") == "" {
+		t.Error("should have error but did not get one")
+	}
+
+	postedData = url.Values{}
+	postedData.Add("password", "secret123")
+	postedData.Add("password_confirm", "secret123")
+	form = New(postedData)
+
+	if !form.Matches("password_confirm", "password") {
+		t.Error("shows values do not match when they do")
+	}
+
+	if !form.Valid() {
+		t.Error("got invalid when should have been valid")
+	}
+}
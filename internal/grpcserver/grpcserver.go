@@ -0,0 +1,226 @@
+package grpcserver
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/KingKord/bookings/internal/apikey"
+	"github.com/KingKord/bookings/internal/bookingspb"
+	"github.com/KingKord/bookings/internal/config"
+	"github.com/KingKord/bookings/internal/events"
+	"github.com/KingKord/bookings/internal/handlers"
+	"github.com/KingKord/bookings/internal/models"
+	"github.com/KingKord/bookings/internal/repository"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"sort"
+	"time"
+)
+
+// dateLayout is the date format used by the service
+const dateLayout = "2006-01-02"
+
+// Server implements the bookings gRPC service on top of the handlers repository
+type Server struct {
+	bookingspb.UnimplementedBookingsServiceServer
+	app  *config.AppConfig
+	repo *handlers.Repository
+}
+
+// New returns a gRPC server serving the bookings service, with API key authentication and request logging
+func New(a *config.AppConfig, repo *handlers.Repository) *grpc.Server {
+	srv := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(logUnary(a), authUnary(repo)),
+		grpc.ChainStreamInterceptor(logStream(a), authStream(repo)),
+	)
+	bookingspb.RegisterBookingsServiceServer(srv, &Server{app: a, repo: repo})
+	return srv
+}
+
+// SearchAvailability lists the rooms free for every night of a date range
+func (s *Server) SearchAvailability(ctx context.Context, req *bookingspb.SearchAvailabilityRequest) (*bookingspb.SearchAvailabilityResponse, error) {
+	fields := make(map[string]string)
+	start, err := time.Parse(dateLayout, req.GetStartDate())
+	if err != nil {
+		fields["start_date"] = "Must be a date such as 2050-01-31"
+	}
+	end, err := time.Parse(dateLayout, req.GetEndDate())
+	if err != nil {
+		fields["end_date"] = "Must be a date such as 2050-01-31"
+	}
+	if len(fields) == 0 && !end.After(start) {
+		fields["end_date"] = "Must be after start_date"
+	}
+	if len(fields) > 0 {
+		return nil, invalidArgument(fields)
+	}
+
+	rooms, err := s.repo.DB.SearchAvailabilityForAllRooms(start, end)
+	if err != nil {
+		return nil, s.internal(err)
+	}
+
+	res := &bookingspb.SearchAvailabilityResponse{}
+	for _, rm := range rooms {
+		res.Rooms = append(res.Rooms, newRoom(rm))
+	}
+	return res, nil
+}
+
+// GetRoom returns a room
+func (s *Server) GetRoom(ctx context.Context, req *bookingspb.GetRoomRequest) (*bookingspb.GetRoomResponse, error) {
+	room, err := s.repo.DB.GetRoomByID(int(req.GetId()))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, status.Error(codes.NotFound, "room not found")
+	}
+	if err != nil {
+		return nil, s.internal(err)
+	}
+
+	return &bookingspb.GetRoomResponse{Room: newRoom(room)}, nil
+}
+
+// CreateReservation books a room
+func (s *Server) CreateReservation(ctx context.Context, req *bookingspb.CreateReservationRequest) (*bookingspb.CreateReservationResponse, error) {
+	res, fields, err := s.repo.NewReservation(handlers.ReservationRequest{
+		RoomID:    int(req.GetRoomId()),
+		StartDate: req.GetStartDate(),
+		EndDate:   req.GetEndDate(),
+		FirstName: req.GetFirstName(),
+		LastName:  req.GetLastName(),
+		Email:     req.GetEmail(),
+		Phone:     req.GetPhone(),
+	})
+	if err != nil {
+		return nil, s.internal(err)
+	}
+	if len(fields) > 0 {
+		return nil, invalidArgument(fields)
+	}
+
+	res, err = s.repo.MakeReservation(res)
+	if errors.Is(err, repository.ErrRoomNotAvailable) {
+		return nil, status.Error(codes.FailedPrecondition, "the room is not available for these dates")
+	}
+	if err != nil {
+		return nil, s.internal(err)
+	}
+
+	return &bookingspb.CreateReservationResponse{Reservation: newReservation(res)}, nil
+}
+
+// CancelReservation cancels a reservation, freeing up its room
+func (s *Server) CancelReservation(ctx context.Context, req *bookingspb.CancelReservationRequest) (*bookingspb.CancelReservationResponse, error) {
+	res, err := s.repo.CancelReservation(int(req.GetId()))
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return nil, status.Error(codes.NotFound, "reservation not found")
+	case errors.Is(err, repository.ErrAlreadyCancelled):
+		return nil, status.Error(codes.FailedPrecondition, "the reservation has already been cancelled")
+	case err != nil:
+		return nil, s.internal(err)
+	}
+
+	return &bookingspb.CancelReservationResponse{Reservation: newReservation(res)}, nil
+}
+
+// WatchReservations streams reservations as they are created and cancelled, until the client goes away
+func (s *Server) WatchReservations(req *bookingspb.WatchReservationsRequest, stream bookingspb.BookingsService_WatchReservationsServer) error {
+	if s.app.Events == nil {
+		return status.Error(codes.Unavailable, "reservation events are not enabled")
+	}
+
+	ch, unsubscribe := s.app.Events.Subscribe()
+	defer unsubscribe()
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case e := <-ch:
+			t, ok := eventTypes[e.Type]
+			if !ok {
+				continue
+			}
+			err := stream.Send(&bookingspb.WatchReservationsResponse{
+				Type:        t,
+				Reservation: newReservation(e.Reservation),
+				OccurredAt:  timestamppb.New(e.OccurredAt),
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// eventTypes are the events streamed to watchers, the others aren't part of the service
+var eventTypes = map[string]bookingspb.WatchReservationsResponse_Type{
+	events.ReservationCreated:   bookingspb.WatchReservationsResponse_TYPE_CREATED,
+	events.ReservationCancelled: bookingspb.WatchReservationsResponse_TYPE_CANCELLED,
+}
+
+func newRoom(rm models.Room) *bookingspb.Room {
+	return &bookingspb.Room{Id: int64(rm.ID), Name: rm.RoomName}
+}
+
+func newReservation(res models.Reservation) *bookingspb.Reservation {
+	st := bookingspb.Reservation_STATUS_CONFIRMED
+	if res.IsCancelled() {
+		st = bookingspb.Reservation_STATUS_CANCELLED
+	}
+	return &bookingspb.Reservation{
+		Id:        int64(res.ID),
+		Status:    st,
+		Room:      &bookingspb.Room{Id: int64(res.Room.ID), Name: res.Room.RoomName},
+		StartDate: res.StartDate.Format(dateLayout),
+		EndDate:   res.EndDate.Format(dateLayout),
+		FirstName: res.FirstName,
+		LastName:  res.LastName,
+		Email:     res.Email,
+		Phone:     res.Phone,
+		Processed: res.Processed == 1,
+		CreatedAt: timestamppb.New(res.CreatedAt),
+	}
+}
+
+// invalidArgument returns an InvalidArgument status carrying the error of each field as BadRequest details
+func invalidArgument(fields map[string]string) error {
+	names := make([]string, 0, len(fields))
+	for f := range fields {
+		names = append(names, f)
+	}
+	sort.Strings(names)
+
+	br := &errdetails.BadRequest{}
+	for _, f := range names {
+		br.FieldViolations = append(br.FieldViolations, &errdetails.BadRequest_FieldViolation{
+			Field:       f,
+			Description: fields[f],
+		})
+	}
+
+	st, err := status.New(codes.InvalidArgument, "the request has invalid fields").WithDetails(br)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, "the request has invalid fields")
+	}
+	return st.Err()
+}
+
+// internal logs err and returns an Internal status that doesn't leak it to the client
+func (s *Server) internal(err error) error {
+	s.app.ErrorLog.Println(err)
+	return status.Error(codes.Internal, "internal error")
+}
+
+// the scope each method needs, a method missing here can't be called
+var methodScopes = map[string]apikey.Scope{
+	bookingspb.BookingsService_SearchAvailability_FullMethodName: apikey.ReadAvailability,
+	bookingspb.BookingsService_GetRoom_FullMethodName:            apikey.ReadAvailability,
+	bookingspb.BookingsService_CreateReservation_FullMethodName:  apikey.CreateReservations,
+	bookingspb.BookingsService_CancelReservation_FullMethodName:  apikey.Admin,
+	bookingspb.BookingsService_WatchReservations_FullMethodName:  apikey.Admin,
+}
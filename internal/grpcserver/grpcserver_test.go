@@ -0,0 +1,219 @@
+package grpcserver
+
+import (
+	"context"
+	"github.com/KingKord/bookings/internal/bookingspb"
+	"github.com/KingKord/bookings/internal/config"
+	"github.com/KingKord/bookings/internal/events"
+	"github.com/KingKord/bookings/internal/handlers"
+	"github.com/KingKord/bookings/internal/models"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"io"
+	"log"
+	"net"
+	"testing"
+	"time"
+)
+
+// newTestClient serves the service over an in-memory connection backed by the test repository
+func newTestClient(t *testing.T) (bookingspb.BookingsServiceClient, *config.AppConfig) {
+	mailChan := make(chan models.MailData)
+	go func() {
+		for range mailChan {
+		}
+	}()
+
+	app := &config.AppConfig{
+		InfoLog:  log.New(io.Discard, "", 0),
+		ErrorLog: log.New(io.Discard, "", 0),
+		MailChan: mailChan,
+		Events:   events.NewBroker(),
+	}
+
+	lis := bufconn.Listen(1 << 20)
+	srv := New(app, handlers.NewTestRepo(app))
+	go srv.Serve(lis)
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		conn.Close()
+		srv.Stop()
+		close(mailChan)
+	})
+	return bookingspb.NewBookingsServiceClient(conn), app
+}
+
+func withKey(key string) context.Context {
+	return metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+key)
+}
+
+func TestAuth(t *testing.T) {
+	client, _ := newTestClient(t)
+
+	var tests = []struct {
+		name         string
+		ctx          context.Context
+		expectedCode codes.Code
+	}{
+		{"no key", context.Background(), codes.Unauthenticated},
+		{"unknown key", withKey("bk_unknown"), codes.Unauthenticated},
+		{"expired key", withKey("bk_expired"), codes.Unauthenticated},
+		{"revoked key", withKey("bk_revoked"), codes.Unauthenticated},
+		{"lookup fails", withKey("bk_error"), codes.Internal},
+		{"missing scope", withKey("bk_read"), codes.PermissionDenied},
+		{"admin key", withKey("bk_admin"), codes.OK},
+	}
+
+	for _, e := range tests {
+		_, err := client.CancelReservation(e.ctx, &bookingspb.CancelReservationRequest{Id: 1})
+		if status.Code(err) != e.expectedCode {
+			t.Errorf("%s: expected code %s but got %s", e.name, e.expectedCode, status.Code(err))
+		}
+	}
+}
+
+func TestSearchAvailability(t *testing.T) {
+	client, _ := newTestClient(t)
+	ctx := withKey("bk_read")
+
+	res, err := client.SearchAvailability(ctx, &bookingspb.SearchAvailabilityRequest{StartDate: "3000-01-01", EndDate: "3000-01-02"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.GetRooms()) != 1 || res.GetRooms()[0].GetId() != 1 {
+		t.Errorf("expected room 1 to be available, got %v", res.GetRooms())
+	}
+
+	_, err = client.SearchAvailability(ctx, &bookingspb.SearchAvailabilityRequest{StartDate: "3000-01-02", EndDate: "3000-01-01"})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected InvalidArgument for end before start, got %s", status.Code(err))
+	}
+}
+
+func TestGetRoom(t *testing.T) {
+	client, _ := newTestClient(t)
+	ctx := withKey("bk_read")
+
+	var tests = []struct {
+		id           int64
+		expectedCode codes.Code
+	}{
+		{1, codes.OK},
+		{3, codes.Internal},
+		{101, codes.NotFound},
+	}
+
+	for _, e := range tests {
+		_, err := client.GetRoom(ctx, &bookingspb.GetRoomRequest{Id: e.id})
+		if status.Code(err) != e.expectedCode {
+			t.Errorf("room %d: expected code %s but got %s", e.id, e.expectedCode, status.Code(err))
+		}
+	}
+}
+
+func TestCreateReservation(t *testing.T) {
+	client, _ := newTestClient(t)
+	ctx := withKey("bk_admin")
+
+	valid := func() *bookingspb.CreateReservationRequest {
+		return &bookingspb.CreateReservationRequest{
+			RoomId:    1,
+			StartDate: "3000-01-01",
+			EndDate:   "3000-01-02",
+			FirstName: "John",
+			LastName:  "Smith",
+			Email:     "john@smith.com",
+		}
+	}
+
+	res, err := client.CreateReservation(ctx, valid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.GetReservation().GetStatus() != bookingspb.Reservation_STATUS_CONFIRMED {
+		t.Errorf("expected a confirmed reservation, got %s", res.GetReservation().GetStatus())
+	}
+
+	req := valid()
+	req.Email = "invalid"
+	_, err = client.CreateReservation(ctx, req)
+	st := status.Convert(err)
+	if st.Code() != codes.InvalidArgument {
+		t.Fatalf("expected InvalidArgument for an invalid email, got %s", st.Code())
+	}
+	br, ok := st.Details()[0].(*errdetails.BadRequest)
+	if !ok || len(br.GetFieldViolations()) != 1 || br.GetFieldViolations()[0].GetField() != "email" {
+		t.Errorf("expected a field violation for email, got %v", st.Details())
+	}
+
+	req = valid()
+	req.StartDate, req.EndDate = "2050-01-01", "2050-01-02"
+	_, err = client.CreateReservation(ctx, req)
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("expected FailedPrecondition for a taken room, got %s", status.Code(err))
+	}
+}
+
+func TestCancelReservation(t *testing.T) {
+	client, _ := newTestClient(t)
+	ctx := withKey("bk_admin")
+
+	var tests = []struct {
+		id           int64
+		expectedCode codes.Code
+	}{
+		{1, codes.OK},
+		{3, codes.FailedPrecondition},
+		{101, codes.NotFound},
+	}
+
+	for _, e := range tests {
+		_, err := client.CancelReservation(ctx, &bookingspb.CancelReservationRequest{Id: e.id})
+		if status.Code(err) != e.expectedCode {
+			t.Errorf("reservation %d: expected code %s but got %s", e.id, e.expectedCode, status.Code(err))
+		}
+	}
+}
+
+func TestWatchReservations(t *testing.T) {
+	client, app := newTestClient(t)
+
+	ctx, cancel := context.WithTimeout(withKey("bk_admin"), 5*time.Second)
+	defer cancel()
+
+	stream, err := client.WatchReservations(ctx, &bookingspb.WatchReservationsRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the subscription is only made once the server handles the call, keep publishing until it arrives
+	go func() {
+		for ctx.Err() == nil {
+			app.Events.Publish(events.ReservationCancelled, models.Reservation{ID: 7})
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+
+	e, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.GetType() != bookingspb.WatchReservationsResponse_TYPE_CANCELLED || e.GetReservation().GetId() != 7 {
+		t.Errorf("expected cancellation of reservation 7, got %v", e)
+	}
+}
@@ -0,0 +1,87 @@
+package grpcserver
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/KingKord/bookings/internal/apikey"
+	"github.com/KingKord/bookings/internal/config"
+	"github.com/KingKord/bookings/internal/handlers"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"strings"
+	"time"
+)
+
+// authenticate checks the API key sent in the authorization metadata of a call to method,
+// and records its use. It mirrors the APIAuth and RequireScope middleware of the JSON API
+func authenticate(ctx context.Context, repo *handlers.Repository, method string) error {
+	var token string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if v := md.Get("authorization"); len(v) > 0 {
+			token, _ = strings.CutPrefix(v[0], "Bearer ")
+		}
+	}
+	if token == "" {
+		return status.Error(codes.Unauthenticated, "a valid API key is required")
+	}
+
+	key, err := repo.DB.GetAPIKeyByHash(apikey.Hash(token))
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && !key.IsActive()) {
+		return status.Error(codes.Unauthenticated, "a valid API key is required")
+	}
+	if err != nil {
+		return status.Error(codes.Internal, "internal error")
+	}
+
+	scope, ok := methodScopes[method]
+	if !ok || !apikey.Allows(key.Scopes, scope) {
+		return status.Errorf(codes.PermissionDenied, "the API key needs the %s scope", scope)
+	}
+
+	err = repo.DB.TouchAPIKey(key.ID)
+	if err != nil {
+		return status.Error(codes.Internal, "internal error")
+	}
+	return nil
+}
+
+func authUnary(repo *handlers.Repository) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if err := authenticate(ctx, repo, info.FullMethod); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+func authStream(repo *handlers.Repository) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if err := authenticate(ss.Context(), repo, info.FullMethod); err != nil {
+			return err
+		}
+		return handler(srv, ss)
+	}
+}
+
+// logUnary logs every call with its status code and duration
+func logUnary(a *config.AppConfig) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		start := time.Now()
+		res, err := handler(ctx, req)
+		a.InfoLog.Printf("grpc %s %s %s", info.FullMethod, status.Code(err), time.Since(start))
+		return res, err
+	}
+}
+
+// logStream logs every stream when it ends
+func logStream(a *config.AppConfig) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		start := time.Now()
+		err := handler(srv, ss)
+		a.InfoLog.Printf("grpc %s %s %s", info.FullMethod, status.Code(err), time.Since(start))
+		return err
+	}
+}
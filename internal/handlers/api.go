@@ -0,0 +1,346 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/KingKord/bookings/internal/apidocs"
+	"github.com/KingKord/bookings/internal/helpers"
+	"github.com/KingKord/bookings/internal/models"
+	"github.com/KingKord/bookings/internal/render"
+	"github.com/KingKord/bookings/internal/repository"
+	"github.com/go-chi/chi/v5"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// apiDateLayout is the date format used by the JSON API
+const apiDateLayout = "2006-01-02"
+
+// maxCalendarDays is the longest range a room availability calendar can cover
+const maxCalendarDays = 366
+
+// reservation statuses returned by the API
+const (
+	statusConfirmed = "confirmed"
+	statusCancelled = "cancelled"
+)
+
+type apiRoom struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+type apiDay struct {
+	Date      string `json:"date"`
+	Available bool   `json:"available"`
+}
+
+type apiReservation struct {
+	ID        int       `json:"id"`
+	Status    string    `json:"status"`
+	Room      apiRoom   `json:"room"`
+	StartDate string    `json:"start_date"`
+	EndDate   string    `json:"end_date"`
+	FirstName string    `json:"first_name"`
+	LastName  string    `json:"last_name"`
+	Email     string    `json:"email"`
+	Phone     string    `json:"phone"`
+	Processed bool      `json:"processed"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func newAPIReservation(res models.Reservation) apiReservation {
+	status := statusConfirmed
+	if res.IsCancelled() {
+		status = statusCancelled
+	}
+	return apiReservation{
+		ID:        res.ID,
+		Status:    status,
+		Room:      apiRoom{ID: res.Room.ID, Name: res.Room.RoomName},
+		StartDate: res.StartDate.Format(apiDateLayout),
+		EndDate:   res.EndDate.Format(apiDateLayout),
+		FirstName: res.FirstName,
+		LastName:  res.LastName,
+		Email:     res.Email,
+		Phone:     res.Phone,
+		Processed: res.Processed == 1,
+		CreatedAt: res.CreatedAt,
+	}
+}
+
+func newAPIRooms(rooms []models.Room) []apiRoom {
+	out := make([]apiRoom, 0, len(rooms))
+	for _, rm := range rooms {
+		out = append(out, apiRoom{ID: rm.ID, Name: rm.RoomName})
+	}
+	return out
+}
+
+// apiDateRange parses the start and end query parameters, an empty parameter falls back to its default
+func apiDateRange(r *http.Request, defaultStart, defaultEnd time.Time) (time.Time, time.Time, map[string]string) {
+	fields := make(map[string]string)
+	start, end := defaultStart, defaultEnd
+
+	var err error
+	if s := r.URL.Query().Get("start"); s != "" {
+		start, err = time.Parse(apiDateLayout, s)
+		if err != nil {
+			fields["start"] = "Must be a date such as 2050-01-31"
+		}
+	}
+	if e := r.URL.Query().Get("end"); e != "" {
+		end, err = time.Parse(apiDateLayout, e)
+		if err != nil {
+			fields["end"] = "Must be a date such as 2050-01-31"
+		}
+	}
+	if len(fields) == 0 && !end.After(start) {
+		fields["end"] = "Must be after start"
+	}
+	return start, end, fields
+}
+
+func apiValidationError(w http.ResponseWriter, fields map[string]string) {
+	helpers.ErrorJSON(w, http.StatusUnprocessableEntity, helpers.APIError{
+		Code:    "validation_failed",
+		Message: "The request has invalid fields",
+		Fields:  fields,
+	})
+}
+
+func apiNotFound(w http.ResponseWriter, what string) {
+	helpers.ErrorJSON(w, http.StatusNotFound, helpers.APIError{
+		Code:    "not_found",
+		Message: fmt.Sprintf("%s not found", what),
+	})
+}
+
+// apiID returns the id url parameter, writing a not found error if it isn't a number
+func apiID(w http.ResponseWriter, r *http.Request, what string) (int, bool) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		apiNotFound(w, what)
+		return 0, false
+	}
+	return id, true
+}
+
+// APINotFound is the not found handler for the API
+func (m *Repository) APINotFound(w http.ResponseWriter, r *http.Request) {
+	apiNotFound(w, "Resource")
+}
+
+// APIMethodNotAllowed is the method not allowed handler for the API
+func (m *Repository) APIMethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	helpers.ErrorJSON(w, http.StatusMethodNotAllowed, helpers.APIError{
+		Code:    "method_not_allowed",
+		Message: fmt.Sprintf("%s is not allowed here", r.Method),
+	})
+}
+
+// APIRooms lists all rooms
+func (m *Repository) APIRooms(w http.ResponseWriter, r *http.Request) {
+	rooms, err := m.DB.AllRooms()
+	if err != nil {
+		helpers.ServerErrorJSON(w, err)
+		return
+	}
+
+	helpers.WriteJSON(w, http.StatusOK, map[string]interface{}{
+		"rooms": newAPIRooms(rooms),
+	})
+}
+
+// APIAvailability lists the rooms free for the whole of a date range
+func (m *Repository) APIAvailability(w http.ResponseWriter, r *http.Request) {
+	fields := make(map[string]string)
+	if r.URL.Query().Get("start") == "" {
+		fields["start"] = "This field cannot be blank"
+	}
+	if r.URL.Query().Get("end") == "" {
+		fields["end"] = "This field cannot be blank"
+	}
+	if len(fields) > 0 {
+		apiValidationError(w, fields)
+		return
+	}
+
+	start, end, fields := apiDateRange(r, time.Time{}, time.Time{})
+	if len(fields) > 0 {
+		apiValidationError(w, fields)
+		return
+	}
+
+	rooms, err := m.DB.SearchAvailabilityForAllRooms(start, end)
+	if err != nil {
+		helpers.ServerErrorJSON(w, err)
+		return
+	}
+
+	helpers.WriteJSON(w, http.StatusOK, map[string]interface{}{
+		"start_date": start.Format(apiDateLayout),
+		"end_date":   end.Format(apiDateLayout),
+		"rooms":      newAPIRooms(rooms),
+	})
+}
+
+// APIRoomAvailability returns a room's availability night by night, for the next 30 nights by default
+func (m *Repository) APIRoomAvailability(w http.ResponseWriter, r *http.Request) {
+	id, ok := apiID(w, r, "Room")
+	if !ok {
+		return
+	}
+
+	room, err := m.DB.GetRoomByID(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		apiNotFound(w, "Room")
+		return
+	}
+	if err != nil {
+		helpers.ServerErrorJSON(w, err)
+		return
+	}
+
+	now := time.Now()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	start, end, fields := apiDateRange(r, today, today.AddDate(0, 0, 30))
+	if len(fields) == 0 && end.Sub(start) > maxCalendarDays*24*time.Hour {
+		fields["end"] = fmt.Sprintf("The range can be at most %d days", maxCalendarDays)
+	}
+	if len(fields) > 0 {
+		apiValidationError(w, fields)
+		return
+	}
+
+	restrictions, err := m.DB.GetRestrictionsForRoomByDate(id, start, end)
+	if err != nil {
+		helpers.ServerErrorJSON(w, err)
+		return
+	}
+
+	days := []apiDay{}
+	for d := start; d.Before(end); d = d.AddDate(0, 0, 1) {
+		available := true
+		for _, rr := range restrictions {
+			if !d.Before(rr.StartDate) && d.Before(rr.EndDate) {
+				available = false
+				break
+			}
+		}
+		days = append(days, apiDay{Date: d.Format(apiDateLayout), Available: available})
+	}
+
+	helpers.WriteJSON(w, http.StatusOK, map[string]interface{}{
+		"room": apiRoom{ID: room.ID, Name: room.RoomName},
+		"days": days,
+	})
+}
+
+// APICreateReservation books a room
+func (m *Repository) APICreateReservation(w http.ResponseWriter, r *http.Request) {
+	var req ReservationRequest
+
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(&req)
+	if err != nil {
+		helpers.ErrorJSON(w, http.StatusBadRequest, helpers.APIError{
+			Code:    "invalid_body",
+			Message: fmt.Sprintf("The request body is not valid JSON: %s", err),
+		})
+		return
+	}
+
+	reservation, fields, err := m.NewReservation(req)
+	if err != nil {
+		helpers.ServerErrorJSON(w, err)
+		return
+	}
+	if len(fields) > 0 {
+		apiValidationError(w, fields)
+		return
+	}
+
+	reservation, err = m.MakeReservation(reservation)
+	if errors.Is(err, repository.ErrRoomNotAvailable) {
+		helpers.ErrorJSON(w, http.StatusConflict, helpers.APIError{
+			Code:    "not_available",
+			Message: "The room is not available for these dates",
+		})
+		return
+	}
+	if err != nil {
+		helpers.ServerErrorJSON(w, err)
+		return
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("/api/v1/reservations/%d", reservation.ID))
+	helpers.WriteJSON(w, http.StatusCreated, map[string]interface{}{
+		"reservation": newAPIReservation(reservation),
+	})
+}
+
+// APIReservation returns a reservation
+func (m *Repository) APIReservation(w http.ResponseWriter, r *http.Request) {
+	id, ok := apiID(w, r, "Reservation")
+	if !ok {
+		return
+	}
+
+	res, err := m.DB.GetReservationByID(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		apiNotFound(w, "Reservation")
+		return
+	}
+	if err != nil {
+		helpers.ServerErrorJSON(w, err)
+		return
+	}
+
+	helpers.WriteJSON(w, http.StatusOK, map[string]interface{}{
+		"reservation": newAPIReservation(res),
+	})
+}
+
+// APICancelReservation cancels a reservation, freeing up its room
+func (m *Repository) APICancelReservation(w http.ResponseWriter, r *http.Request) {
+	id, ok := apiID(w, r, "Reservation")
+	if !ok {
+		return
+	}
+
+	res, err := m.CancelReservation(id)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		apiNotFound(w, "Reservation")
+		return
+	case errors.Is(err, repository.ErrAlreadyCancelled):
+		helpers.ErrorJSON(w, http.StatusConflict, helpers.APIError{
+			Code:    "already_cancelled",
+			Message: "The reservation has already been cancelled",
+		})
+		return
+	case err != nil:
+		helpers.ServerErrorJSON(w, err)
+		return
+	}
+
+	helpers.WriteJSON(w, http.StatusOK, map[string]interface{}{
+		"reservation": newAPIReservation(res),
+	})
+}
+
+// OpenAPISpec serves the OpenAPI document of the JSON endpoints
+func (m *Repository) OpenAPISpec(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(apidocs.Spec)
+}
+
+// APIDocs renders the API documentation viewer
+func (m *Repository) APIDocs(w http.ResponseWriter, r *http.Request) {
+	render.Template(w, r, "api-docs.page.tmpl", &models.TemplateData{})
+}
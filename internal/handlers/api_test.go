@@ -0,0 +1,137 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+var apiTests = []struct {
+	name           string
+	method         string
+	url            string
+	body           string
+	expectedStatus int
+	expectedError  string
+}{
+	{"openapi document", "GET", "/api/openapi.json", "", http.StatusOK, ""},
+	{"rooms", "GET", "/api/v1/rooms", "", http.StatusOK, ""},
+	{"availability", "GET", "/api/v1/availability?start=3000-01-01&end=3000-01-02", "", http.StatusOK, ""},
+	{"availability without dates", "GET", "/api/v1/availability", "", http.StatusUnprocessableEntity, "validation_failed"},
+	{"availability bad date", "GET", "/api/v1/availability?start=01-01-3000&end=3000-01-02", "", http.StatusUnprocessableEntity, "validation_failed"},
+	{"availability end before start", "GET", "/api/v1/availability?start=3000-01-02&end=3000-01-01", "", http.StatusUnprocessableEntity, "validation_failed"},
+	{"availability database error", "GET", "/api/v1/availability?start=3002-01-01&end=3002-01-02", "", http.StatusInternalServerError, "internal_error"},
+	{"room calendar", "GET", "/api/v1/rooms/1/availability?start=2050-01-01&end=2050-01-05", "", http.StatusOK, ""},
+	{"room calendar default range", "GET", "/api/v1/rooms/1/availability", "", http.StatusOK, ""},
+	{"room calendar too long", "GET", "/api/v1/rooms/1/availability?start=2050-01-01&end=2052-01-01", "", http.StatusUnprocessableEntity, "validation_failed"},
+	{"room calendar unknown room", "GET", "/api/v1/rooms/101/availability", "", http.StatusNotFound, "not_found"},
+	{"room calendar bad id", "GET", "/api/v1/rooms/abc/availability", "", http.StatusNotFound, "not_found"},
+	{"room calendar database error", "GET", "/api/v1/rooms/2/availability", "", http.StatusInternalServerError, "internal_error"},
+	{"create reservation", "POST", "/api/v1/reservations",
+		`{"room_id":1,"start_date":"3000-01-01","end_date":"3000-01-02","first_name":"John","last_name":"Smith","email":"john@smith.com"}`,
+		http.StatusCreated, ""},
+	{"create reservation invalid json", "POST", "/api/v1/reservations", `{"room_id":`, http.StatusBadRequest, "invalid_body"},
+	{"create reservation unknown field", "POST", "/api/v1/reservations", `{"room":1}`, http.StatusBadRequest, "invalid_body"},
+	{"create reservation invalid fields", "POST", "/api/v1/reservations",
+		`{"room_id":1,"start_date":"3000-01-01","end_date":"3000-01-01","first_name":"Jo","last_name":"Smith","email":"john"}`,
+		http.StatusUnprocessableEntity, "validation_failed"},
+	{"create reservation unknown room", "POST", "/api/v1/reservations",
+		`{"room_id":101,"start_date":"3000-01-01","end_date":"3000-01-02","first_name":"John","last_name":"Smith","email":"john@smith.com"}`,
+		http.StatusUnprocessableEntity, "validation_failed"},
+	{"create reservation not available", "POST", "/api/v1/reservations",
+		`{"room_id":1,"start_date":"2050-01-01","end_date":"2050-01-02","first_name":"John","last_name":"Smith","email":"john@smith.com"}`,
+		http.StatusConflict, "not_available"},
+	{"create reservation insert error", "POST", "/api/v1/reservations",
+		`{"room_id":2,"start_date":"3000-01-01","end_date":"3000-01-02","first_name":"John","last_name":"Smith","email":"john@smith.com"}`,
+		http.StatusInternalServerError, "internal_error"},
+	{"reservation", "GET", "/api/v1/reservations/1", "", http.StatusOK, ""},
+	{"missing reservation", "GET", "/api/v1/reservations/101", "", http.StatusNotFound, "not_found"},
+	{"cancel reservation", "DELETE", "/api/v1/reservations/1", "", http.StatusOK, ""},
+	{"cancel cancelled reservation", "DELETE", "/api/v1/reservations/3", "", http.StatusConflict, "already_cancelled"},
+	{"cancel missing reservation", "DELETE", "/api/v1/reservations/101", "", http.StatusNotFound, "not_found"},
+	{"unknown endpoint", "GET", "/api/v1/guests", "", http.StatusNotFound, "not_found"},
+	{"wrong method", "PUT", "/api/v1/reservations/1", "", http.StatusMethodNotAllowed, "method_not_allowed"},
+}
+
+func TestAPI(t *testing.T) {
+	routes := getRoutes()
+
+	for _, e := range apiTests {
+		req, _ := http.NewRequest(e.method, e.url, strings.NewReader(e.body))
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+
+		routes.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("failed %s: expected status %d, but got %d", e.name, e.expectedStatus, rr.Code)
+		}
+		if ct := rr.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("failed %s: expected a JSON response, but got %s", e.name, ct)
+		}
+
+		var body struct {
+			Error struct {
+				Code string `json:"code"`
+			} `json:"error"`
+		}
+		err := json.Unmarshal(rr.Body.Bytes(), &body)
+		if err != nil {
+			t.Errorf("failed %s: cannot parse response: %s", e.name, err)
+		}
+		if body.Error.Code != e.expectedError {
+			t.Errorf("failed %s: expected error %q, but got %q", e.name, e.expectedError, body.Error.Code)
+		}
+	}
+}
+
+func TestAPIRoomAvailability(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/api/v1/rooms/1/availability?start=2050-01-01&end=2050-01-05", nil)
+	rr := httptest.NewRecorder()
+
+	getRoutes().ServeHTTP(rr, req)
+
+	var body struct {
+		Days []apiDay `json:"days"`
+	}
+	err := json.Unmarshal(rr.Body.Bytes(), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// room 1 is booked for the nights of the 2nd and 3rd
+	expected := []bool{true, false, false, true}
+	if len(body.Days) != len(expected) {
+		t.Fatalf("expected %d days, but got %d", len(expected), len(body.Days))
+	}
+	for i, day := range body.Days {
+		if day.Available != expected[i] {
+			t.Errorf("%s: expected available %t, but got %t", day.Date, expected[i], day.Available)
+		}
+	}
+}
+
+func TestAPICreateReservation(t *testing.T) {
+	body := `{"room_id":1,"start_date":"3000-01-01","end_date":"3000-01-02","first_name":"John","last_name":"Smith","email":"john@smith.com"}`
+	req, _ := http.NewRequest("POST", "/api/v1/reservations", strings.NewReader(body))
+	rr := httptest.NewRecorder()
+
+	getRoutes().ServeHTTP(rr, req)
+
+	if loc := rr.Header().Get("Location"); loc != "/api/v1/reservations/1" {
+		t.Errorf("expected location /api/v1/reservations/1, but got %s", loc)
+	}
+
+	var resp struct {
+		Reservation apiReservation `json:"reservation"`
+	}
+	err := json.Unmarshal(rr.Body.Bytes(), &resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Reservation.Status != statusConfirmed || resp.Reservation.StartDate != "3000-01-01" {
+		t.Errorf("unexpected reservation %+v", resp.Reservation)
+	}
+}
@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"github.com/KingKord/bookings/internal/events"
+	"github.com/KingKord/bookings/internal/forms"
+	"github.com/KingKord/bookings/internal/helpers"
+	"github.com/KingKord/bookings/internal/models"
+	"net/url"
+	"time"
+)
+
+// ReservationRequest is a request to book a room from the JSON API or the gRPC service,
+// dates are YYYY-MM-DD
+type ReservationRequest struct {
+	RoomID    int    `json:"room_id"`
+	StartDate string `json:"start_date"`
+	EndDate   string `json:"end_date"`
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+	Email     string `json:"email"`
+	Phone     string `json:"phone"`
+}
+
+// NewReservation checks a booking request with the rules of the reservation form. It returns
+// the reservation asked for, or the error message of each invalid field
+func (m *Repository) NewReservation(req ReservationRequest) (models.Reservation, map[string]string, error) {
+	form := forms.New(url.Values{
+		"first_name": {req.FirstName},
+		"last_name":  {req.LastName},
+		"email":      {req.Email},
+		"start_date": {req.StartDate},
+		"end_date":   {req.EndDate},
+	})
+	form.Required("first_name", "last_name", "email", "start_date", "end_date")
+	form.MinLength("first_name", 3)
+	form.IsEmail("email")
+
+	fields := make(map[string]string)
+	for field := range form.Errors {
+		fields[field] = form.Errors.Get(field)
+	}
+
+	startDate, err := time.Parse(apiDateLayout, req.StartDate)
+	if err != nil && fields["start_date"] == "" {
+		fields["start_date"] = "Must be a date such as 2050-01-31"
+	}
+	endDate, err := time.Parse(apiDateLayout, req.EndDate)
+	if err != nil && fields["end_date"] == "" {
+		fields["end_date"] = "Must be a date such as 2050-01-31"
+	}
+	if len(fields) == 0 && !endDate.After(startDate) {
+		fields["end_date"] = "Must be after start_date"
+	}
+
+	room, err := m.DB.GetRoomByID(req.RoomID)
+	if errors.Is(err, sql.ErrNoRows) {
+		fields["room_id"] = "Unknown room"
+	} else if err != nil {
+		return models.Reservation{}, nil, err
+	}
+
+	if len(fields) > 0 {
+		return models.Reservation{}, fields, nil
+	}
+
+	return models.Reservation{
+		FirstName: req.FirstName,
+		LastName:  req.LastName,
+		Email:     req.Email,
+		Phone:     req.Phone,
+		StartDate: startDate,
+		EndDate:   endDate,
+		RoomID:    req.RoomID,
+		Room:      room,
+	}, nil, nil
+}
+
+// MakeReservation books the room of a reservation and notifies the guest and the property owner.
+// It returns repository.ErrRoomNotAvailable when the room is taken for any of the nights
+func (m *Repository) MakeReservation(res models.Reservation) (models.Reservation, error) {
+	return m.makeReservation(res, true)
+}
+
+// makeReservation is MakeReservation, only emailing the guest a confirmation when confirmGuest is set
+func (m *Repository) makeReservation(res models.Reservation, confirmGuest bool) (models.Reservation, error) {
+	var err error
+	res.CreatedAt = time.Now()
+	res.ConfirmationCode, err = helpers.ConfirmationCode()
+	if err != nil {
+		return res, err
+	}
+
+	// checking the room is free and taking it happen in one transaction
+	res.ID, err = m.DB.BookRoom(res)
+	if err != nil {
+		return res, err
+	}
+
+	if confirmGuest {
+		m.sendReservationConfirmation(res)
+	}
+	m.sendReservationNotification(res)
+	m.App.Events.Publish(events.ReservationCreated, res)
+
+	return res, nil
+}
+
+// CancelReservation cancels a reservation, freeing up its room, and returns it
+func (m *Repository) CancelReservation(id int) (models.Reservation, error) {
+	err := m.DB.CancelReservation(id)
+	if err != nil {
+		return models.Reservation{}, err
+	}
+
+	res, err := m.DB.GetReservationByID(id)
+	if err != nil {
+		return res, err
+	}
+
+	m.App.Events.Publish(events.ReservationCancelled, res)
+
+	return res, nil
+}
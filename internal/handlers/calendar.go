@@ -0,0 +1,306 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"github.com/KingKord/bookings/internal/models"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// calendarMonth is the reservation calendar of a month: a row of days for every room
+type calendarMonth struct {
+	First time.Time
+	Days  []time.Time
+	Rooms []calendarRoom
+}
+
+// calendarRoom is the row of a room in the reservation calendar
+type calendarRoom struct {
+	Room models.Room
+	Days []calendarDay
+	// Version is the version of the room's restrictions in the month, block edits are checked against it
+	Version string
+}
+
+// calendarDay is a cell of the reservation calendar, it has at most one of its ids set
+type calendarDay struct {
+	Date time.Time
+	// Key names the day in the fields of the calendar form
+	Key           string
+	ReservationID int
+	BlockID       int
+	ExternalID    int
+}
+
+// newCalendarMonth lays out the restrictions of the rooms over the days of the month starting at
+// first. Restrictions of other rooms are left out
+func newCalendarMonth(first time.Time, rooms []models.Room, restrictions []models.RoomRestriction) calendarMonth {
+	first = time.Date(first.Year(), first.Month(), 1, 0, 0, 0, 0, time.UTC)
+	n := first.AddDate(0, 1, -1).Day()
+
+	c := calendarMonth{
+		First: first,
+		Days:  make([]time.Time, n),
+		Rooms: make([]calendarRoom, len(rooms)),
+	}
+	keys := make([]string, n)
+	for i := range c.Days {
+		c.Days[i] = first.AddDate(0, 0, i)
+		keys[i] = c.Days[i].Format("2006-01-2")
+	}
+
+	rows := make(map[int]int, len(rooms))
+	for i, room := range rooms {
+		days := make([]calendarDay, n)
+		for j := range days {
+			days[j] = calendarDay{Date: c.Days[j], Key: keys[j]}
+		}
+		c.Rooms[i] = calendarRoom{Room: room, Days: days}
+		rows[room.ID] = i
+	}
+
+	byRoom := make([][]models.RoomRestriction, len(rooms))
+	for _, y := range restrictions {
+		row, ok := rows[y.RoomID]
+		if !ok {
+			continue
+		}
+		byRoom[row] = append(byRoom[row], y)
+		days := c.Rooms[row].Days
+		start, end := c.dayIndex(y.StartDate), c.dayIndex(y.EndDate)
+		from := start
+		if from < 0 {
+			from = 0
+		}
+
+		switch {
+		case y.ReservationID > 0:
+			// reservations are shown up to their departure day
+			for i := from; i <= end && i < n; i++ {
+				days[i].ReservationID = y.ReservationID
+			}
+		case y.RestrictionID == models.ExternalRestrictionID:
+			// imported from an external calendar, so it is changed there and not here
+			for i := from; i < end && i < n; i++ {
+				days[i].ExternalID = y.ID
+			}
+		case start >= 0 && start < n:
+			// blocks are set a day at a time
+			days[start].BlockID = y.ID
+		}
+	}
+
+	for i := range c.Rooms {
+		c.Rooms[i].Version = models.RestrictionsVersion(byRoom[i])
+	}
+
+	return c
+}
+
+// dayIndex returns the index in Days of the date of t, which is out of range for dates in
+// other months
+func (c calendarMonth) dayIndex(t time.Time) int {
+	d := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	return int(d.Sub(c.First).Hours() / 24)
+}
+
+// blockChangesFromForm reads the block edits posted from the calendar of the month starting at first.
+// Every add_block value is a room id and a day key, every remove_block value a room id and a block id,
+// joined by an underscore, and every edited room needs the version_ of its row as it was shown
+func blockChangesFromForm(form url.Values, first time.Time) (models.BlockChanges, error) {
+	c := models.BlockChanges{
+		Start:    first,
+		End:      first.AddDate(0, 1, -1),
+		Versions: make(map[int]string),
+	}
+
+	version := func(roomID int) error {
+		v := form.Get(fmt.Sprintf("version_%d", roomID))
+		if v == "" {
+			return fmt.Errorf("no version for room %d", roomID)
+		}
+		c.Versions[roomID] = v
+		return nil
+	}
+
+	for _, op := range form["add_block"] {
+		roomID, key, err := splitBlockOp(op)
+		if err != nil {
+			return c, err
+		}
+		day, err := time.Parse("2006-01-2", key)
+		if err != nil || day.Before(c.Start) || day.After(c.End) {
+			return c, fmt.Errorf("add_block %q: not a day of the month", op)
+		}
+		if err = version(roomID); err != nil {
+			return c, err
+		}
+		c.Add = append(c.Add, models.RoomRestriction{RoomID: roomID, StartDate: day})
+	}
+
+	for _, op := range form["remove_block"] {
+		roomID, key, err := splitBlockOp(op)
+		if err != nil {
+			return c, err
+		}
+		id, err := strconv.Atoi(key)
+		if err != nil || id < 1 {
+			return c, fmt.Errorf("remove_block %q: not a block id", op)
+		}
+		if err = version(roomID); err != nil {
+			return c, err
+		}
+		c.Remove = append(c.Remove, models.RoomRestriction{ID: id, RoomID: roomID})
+	}
+
+	return c, nil
+}
+
+// splitBlockOp splits a block edit into its room id and the rest
+func splitBlockOp(op string) (int, string, error) {
+	room, rest, ok := strings.Cut(op, "_")
+	roomID, err := strconv.Atoi(room)
+	if !ok || err != nil || roomID < 1 {
+		return 0, "", errors.New("malformed block edit " + strconv.Quote(op))
+	}
+	return roomID, rest, nil
+}
+
+// timelineRanges are the lengths of the timeline view, by the name used in its links
+var timelineRanges = map[string]struct {
+	Label string
+	Days  int
+	// Months is used instead of Days when set
+	Months int
+}{
+	"1w": {Label: "1 week", Days: 7},
+	"2w": {Label: "2 weeks", Days: 14},
+	"4w": {Label: "4 weeks", Days: 28},
+	"3m": {Label: "3 months", Months: 3},
+}
+
+// timelineRangeOrder is the order the ranges are offered in
+var timelineRangeOrder = []string{"1w", "2w", "4w", "3m"}
+
+// defaultTimelineRange is the range shown when none is asked for
+const defaultTimelineRange = "2w"
+
+// timelineEnd returns the day after the last day of the timeline of length rng starting at start,
+// a negative n moves back instead
+func timelineEnd(start time.Time, rng string, n int) time.Time {
+	r := timelineRanges[rng]
+	if r.Months > 0 {
+		return start.AddDate(0, n*r.Months, 0)
+	}
+	return start.AddDate(0, 0, n*r.Days)
+}
+
+// calendarTimeline is the timeline view of the reservation calendar: rooms as rows, and their
+// stays and blocks as bars across the days from Start to the day before End
+type calendarTimeline struct {
+	Start time.Time
+	End   time.Time
+	Days  []time.Time
+	Rooms []timelineRoom
+}
+
+// timelineRoom is the row of a room in the timeline view
+type timelineRoom struct {
+	Room models.Room
+	Bars []timelineBar
+}
+
+// timelineBar covers the nights of a stay or block in the timeline view. Column is the index in Days
+// of its first night there, and Before and After are set when it goes on outside the timeline
+type timelineBar struct {
+	Column int
+	Span   int
+	Before bool
+	After  bool
+	// Start and End are the arrival and departure of the whole stay or block
+	Start         time.Time
+	End           time.Time
+	ReservationID int
+	Label         string
+	// External is set for blocks imported from an external calendar
+	External bool
+}
+
+// newCalendarTimeline lays out the reservations and the blocks of the rooms over the days from start to
+// the day before end. Reservations of other rooms, cancelled ones and the restrictions of
+// reservations are left out, the bars of reservations come from the reservations themselves
+func newCalendarTimeline(start, end time.Time, rooms []models.Room, reservations []models.Reservation,
+	restrictions []models.RoomRestriction) calendarTimeline {
+	start = time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, time.UTC)
+	end = time.Date(end.Year(), end.Month(), end.Day(), 0, 0, 0, 0, time.UTC)
+
+	t := calendarTimeline{Start: start, End: end, Rooms: make([]timelineRoom, len(rooms))}
+	for d := start; d.Before(end); d = d.AddDate(0, 0, 1) {
+		t.Days = append(t.Days, d)
+	}
+
+	rows := make(map[int]int, len(rooms))
+	for i, room := range rooms {
+		t.Rooms[i] = timelineRoom{Room: room}
+		rows[room.ID] = i
+	}
+
+	add := func(roomID int, from, to time.Time, bar timelineBar) {
+		row, ok := rows[roomID]
+		if !ok {
+			return
+		}
+		first, last := t.dayIndex(from), t.dayIndex(to)
+		bar.Before, bar.After = first < 0, last > len(t.Days)
+		if bar.Before {
+			first = 0
+		}
+		if bar.After {
+			last = len(t.Days)
+		}
+		if last <= first {
+			return
+		}
+		bar.Column, bar.Span = first, last-first
+		bar.Start, bar.End = from, to
+		t.Rooms[row].Bars = append(t.Rooms[row].Bars, bar)
+	}
+
+	for _, res := range reservations {
+		if res.IsCancelled() {
+			continue
+		}
+		add(res.RoomID, res.StartDate, res.EndDate, timelineBar{
+			ReservationID: res.ID,
+			Label:         strings.TrimSpace(res.FirstName + " " + res.LastName),
+		})
+	}
+	for _, y := range restrictions {
+		if y.ReservationID > 0 {
+			continue
+		}
+		external := y.RestrictionID == models.ExternalRestrictionID
+		label := "Blocked"
+		if external {
+			label = "External"
+		}
+		add(y.RoomID, y.StartDate, y.EndDate, timelineBar{Label: label, External: external})
+	}
+
+	return t
+}
+
+// Last returns the last day of the timeline
+func (t calendarTimeline) Last() time.Time {
+	return t.End.AddDate(0, 0, -1)
+}
+
+// dayIndex returns the index in Days of the date of d, which is out of range for dates outside the
+// timeline
+func (t calendarTimeline) dayIndex(d time.Time) int {
+	d = time.Date(d.Year(), d.Month(), d.Day(), 0, 0, 0, 0, time.UTC)
+	return int(d.Sub(t.Start).Hours() / 24)
+}
@@ -0,0 +1,187 @@
+package handlers
+
+import (
+	"fmt"
+	"github.com/KingKord/bookings/internal/models"
+	"github.com/KingKord/bookings/internal/render"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewCalendarMonth(t *testing.T) {
+	day := func(m time.Month, d int) time.Time { return time.Date(2050, m, d, 0, 0, 0, 0, time.UTC) }
+	rooms := []models.Room{{ID: 1, RoomName: "General's Quarters"}, {ID: 2, RoomName: "Major's Suite"}}
+	restrictions := []models.RoomRestriction{
+		{ID: 1, RoomID: 1, ReservationID: 7, RestrictionID: 1, StartDate: day(1, 30), EndDate: day(2, 2)},
+		{ID: 2, RoomID: 1, RestrictionID: 2, StartDate: day(2, 5), EndDate: day(2, 6)},
+		{ID: 3, RoomID: 2, RestrictionID: models.ExternalRestrictionID, StartDate: day(2, 27), EndDate: day(3, 3)},
+		{ID: 4, RoomID: 3, RestrictionID: 2, StartDate: day(2, 5), EndDate: day(2, 6)},
+	}
+
+	c := newCalendarMonth(time.Date(2050, 2, 14, 10, 0, 0, 0, time.Local), rooms, restrictions)
+
+	if len(c.Days) != 28 || !c.First.Equal(day(2, 1)) {
+		t.Fatalf("expected the 28 days of February from %s, got %d from %s", day(2, 1), len(c.Days), c.First)
+	}
+	if len(c.Rooms) != 2 {
+		t.Fatalf("expected 2 rooms, got %d", len(c.Rooms))
+	}
+
+	var tests = []struct {
+		name        string
+		room        int
+		day         int
+		reservation int
+		block       int
+		external    int
+	}{
+		{"reservation from last month", 0, 1, 7, 0, 0},
+		{"departure day", 0, 2, 7, 0, 0},
+		{"after departure", 0, 3, 0, 0, 0},
+		{"block", 0, 5, 0, 2, 0},
+		{"day after block", 0, 6, 0, 0, 0},
+		{"external into next month", 1, 28, 0, 0, 3},
+		{"other room's block", 1, 5, 0, 0, 0},
+	}
+
+	for _, e := range tests {
+		d := c.Rooms[e.room].Days[e.day-1]
+		if d.ReservationID != e.reservation || d.BlockID != e.block || d.ExternalID != e.external {
+			t.Errorf("%s: expected reservation %d, block %d and external %d, got %+v", e.name, e.reservation, e.block, e.external, d)
+		}
+	}
+
+	if key := c.Rooms[0].Days[4].Key; key != "2050-02-5" {
+		t.Errorf("expected key 2050-02-5, got %s", key)
+	}
+	if v := c.Rooms[0].Version; v != models.RestrictionsVersion(restrictions[:2]) {
+		t.Errorf("expected room 1 to have the version of its restrictions, got %s", v)
+	}
+	if v := c.Rooms[1].Version; v == c.Rooms[0].Version || v != models.RestrictionsVersion(restrictions[2:3]) {
+		t.Errorf("expected room 2 to have the version of its restrictions, got %s", v)
+	}
+}
+
+// BenchmarkCalendarMonth lays out and renders a month of the calendar of a property with 100 rooms,
+// each with a few reservations and blocks
+func BenchmarkCalendarMonth(b *testing.B) {
+	first := time.Date(2050, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	var rooms []models.Room
+	var restrictions []models.RoomRestriction
+	for i := 1; i <= 100; i++ {
+		rooms = append(rooms, models.Room{ID: i, RoomName: fmt.Sprintf("Room %d", i)})
+		for d := 0; d < 31; d += 7 {
+			restrictions = append(restrictions,
+				models.RoomRestriction{ID: len(restrictions) + 1, RoomID: i, ReservationID: len(restrictions) + 1,
+					RestrictionID: 1, StartDate: first.AddDate(0, 0, d), EndDate: first.AddDate(0, 0, d+3)},
+				models.RoomRestriction{ID: len(restrictions) + 2, RoomID: i, RestrictionID: 2,
+					StartDate: first.AddDate(0, 0, d+5), EndDate: first.AddDate(0, 0, d+6)},
+			)
+		}
+	}
+
+	req, _ := http.NewRequest("GET", "/admin/reservations-calendar?y=2050&m=01", nil)
+	req = req.WithContext(getCtx(req))
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		data := make(map[string]interface{})
+		data["now"] = first
+		data["calendar"] = newCalendarMonth(first, rooms, restrictions)
+
+		rr := httptest.NewRecorder()
+		err := render.Template(rr, req, "admin-reservations-calendar.page.tmpl", &models.TemplateData{
+			StringMap: map[string]string{"this_month": "01", "this_month_year": "2050"},
+			Data:      data,
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+		if !strings.Contains(rr.Body.String(), "Room 100") {
+			b.Fatal("expected every room to be rendered")
+		}
+	}
+}
+
+func TestNewCalendarTimeline(t *testing.T) {
+	day := func(m time.Month, d int) time.Time { return time.Date(2050, m, d, 0, 0, 0, 0, time.UTC) }
+	rooms := []models.Room{{ID: 1, RoomName: "General's Quarters"}, {ID: 2, RoomName: "Major's Suite"}}
+	reservations := []models.Reservation{
+		{ID: 7, RoomID: 1, FirstName: "John", LastName: "Smith", StartDate: day(1, 30), EndDate: day(2, 3)},
+		{ID: 8, RoomID: 1, FirstName: "Jane", LastName: "Doe", StartDate: day(2, 10), EndDate: day(2, 20)},
+		{ID: 9, RoomID: 2, StartDate: day(2, 3), EndDate: day(2, 5), CancelledAt: day(1, 1)},
+		{ID: 10, RoomID: 3, StartDate: day(2, 3), EndDate: day(2, 5)},
+	}
+	restrictions := []models.RoomRestriction{
+		{ID: 1, RoomID: 1, ReservationID: 7, RestrictionID: 1, StartDate: day(1, 30), EndDate: day(2, 3)},
+		{ID: 2, RoomID: 2, RestrictionID: 2, StartDate: day(2, 5), EndDate: day(2, 6)},
+		{ID: 3, RoomID: 2, RestrictionID: models.ExternalRestrictionID, StartDate: day(2, 12), EndDate: day(2, 16)},
+	}
+
+	start := day(2, 1)
+	tl := newCalendarTimeline(start, timelineEnd(start, "2w", 1), rooms, reservations, restrictions)
+
+	if len(tl.Days) != 14 || !tl.Last().Equal(day(2, 14)) {
+		t.Fatalf("expected 14 days up to %s, got %d up to %s", day(2, 14), len(tl.Days), tl.Last())
+	}
+
+	expected := [][]timelineBar{
+		{
+			{Column: 0, Span: 2, Before: true, Start: day(1, 30), End: day(2, 3), ReservationID: 7, Label: "John Smith"},
+			{Column: 9, Span: 5, After: true, Start: day(2, 10), End: day(2, 20), ReservationID: 8, Label: "Jane Doe"},
+		},
+		{
+			{Column: 4, Span: 1, Start: day(2, 5), End: day(2, 6), Label: "Blocked"},
+			{Column: 11, Span: 3, After: true, Start: day(2, 12), End: day(2, 16), Label: "External", External: true},
+		},
+	}
+	for i, bars := range expected {
+		if len(tl.Rooms[i].Bars) != len(bars) {
+			t.Fatalf("room %d: expected %d bars, got %+v", i+1, len(bars), tl.Rooms[i].Bars)
+		}
+		for j, b := range bars {
+			if tl.Rooms[i].Bars[j] != b {
+				t.Errorf("room %d: expected bar %+v, got %+v", i+1, b, tl.Rooms[i].Bars[j])
+			}
+		}
+	}
+
+	req, _ := http.NewRequest("GET", "/admin/reservations-timeline?y=2050&m=02&range=2w", nil)
+	req = req.WithContext(getCtx(req))
+	rr := httptest.NewRecorder()
+	err := render.Template(rr, req, "admin-reservations-timeline.page.tmpl", &models.TemplateData{
+		StringMap: map[string]string{"this_month": "02", "this_month_year": "2050"},
+		Data:      map[string]interface{}{"timeline": tl},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(rr.Body.String(), `href="/admin/reservations/cal/8/show?y=2050&m=02"`) {
+		t.Error("expected the bar of reservation 8 to link to it")
+	}
+}
+
+func TestTimelineEnd(t *testing.T) {
+	start := time.Date(2050, 1, 31, 0, 0, 0, 0, time.UTC)
+
+	var tests = []struct {
+		rng      string
+		n        int
+		expected time.Time
+	}{
+		{"1w", 1, time.Date(2050, 2, 7, 0, 0, 0, 0, time.UTC)},
+		{"4w", -1, time.Date(2050, 1, 3, 0, 0, 0, 0, time.UTC)},
+		{"3m", 1, time.Date(2050, 5, 1, 0, 0, 0, 0, time.UTC)},
+	}
+
+	for _, e := range tests {
+		if got := timelineEnd(start, e.rng, e.n); !got.Equal(e.expected) {
+			t.Errorf("%s times %d: expected %s but got %s", e.rng, e.n, e.expected, got)
+		}
+	}
+}
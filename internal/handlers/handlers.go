@@ -1,22 +1,42 @@
 package handlers
 
 import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/KingKord/bookings/internal/apikey"
+	"github.com/KingKord/bookings/internal/calsync"
 	"github.com/KingKord/bookings/internal/config"
 	"github.com/KingKord/bookings/internal/driver"
+	"github.com/KingKord/bookings/internal/events"
+	"github.com/KingKord/bookings/internal/export"
 	"github.com/KingKord/bookings/internal/forms"
 	"github.com/KingKord/bookings/internal/helpers"
+	"github.com/KingKord/bookings/internal/ical"
+	"github.com/KingKord/bookings/internal/importer"
+	"github.com/KingKord/bookings/internal/invoice"
 	"github.com/KingKord/bookings/internal/models"
+	"github.com/KingKord/bookings/internal/rbac"
 	"github.com/KingKord/bookings/internal/render"
 	"github.com/KingKord/bookings/internal/repository"
 	"github.com/KingKord/bookings/internal/repository/dbrepo"
+	"github.com/KingKord/bookings/internal/throttle"
+	"github.com/KingKord/bookings/internal/totp"
+	"github.com/KingKord/bookings/internal/webhook"
 	"github.com/go-chi/chi/v5"
+	"html/template"
+	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 )
 
 // Repo the repository used by the handlers
@@ -79,6 +99,18 @@ func (m *Repository) Reservation(w http.ResponseWriter, r *http.Request) {
 
 	res.Room.RoomName = room.RoomName
 
+	// pre-fill the guest details for a logged-in guest
+	if guestID := m.App.Session.GetInt(r.Context(), "guest_id"); guestID > 0 && res.Email == "" {
+		guest, err := m.DB.GetGuestByID(guestID)
+		if err == nil {
+			res.GuestID = guest.ID
+			res.FirstName = guest.FirstName
+			res.LastName = guest.LastName
+			res.Email = guest.Email
+			res.Phone = guest.Phone
+		}
+	}
+
 	m.App.Session.Put(r.Context(), "reservation", res)
 
 	sd := res.StartDate.Format("02-01-2006")
@@ -119,6 +151,7 @@ func (m *Repository) PostReservation(w http.ResponseWriter, r *http.Request) {
 	reservation.LastName = r.Form.Get("last_name")
 	reservation.Phone = r.Form.Get("phone")
 	reservation.Email = r.Form.Get("email")
+	reservation.GuestID = m.App.Session.GetInt(r.Context(), "guest_id")
 
 	log.Printf("start date is %s", reservation.StartDate)
 	log.Printf("end date is %s", reservation.EndDate)
@@ -143,6 +176,12 @@ func (m *Repository) PostReservation(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	reservation.ConfirmationCode, err = helpers.ConfirmationCode()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
 	newReservationID, err := m.DB.InsertReservation(reservation)
 	if err != nil {
 		m.App.Session.Put(r.Context(), "error", "can't insert reservation into database")
@@ -165,13 +204,26 @@ func (m *Repository) PostReservation(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// send notifications - first to guest
+	reservation.ID = newReservationID
+	m.sendReservationConfirmation(reservation)
+	m.sendReservationNotification(reservation)
+	m.App.Events.Publish(events.ReservationCreated, reservation)
 
+	m.App.Session.Put(r.Context(), "reservation", reservation)
+
+	http.Redirect(w, r, "/reservation-summary", http.StatusSeeOther)
+
+}
+
+// sendReservationConfirmation emails the guest a confirmation of their reservation
+func (m *Repository) sendReservationConfirmation(reservation models.Reservation) {
 	htmlMessage := fmt.Sprintf(`
 		<strong>Reservation Confirmation</strong><br>
 		Dear %s, <br>
-		This is confirm your reservation from %s to %s.
-`, reservation.FirstName, reservation.StartDate.Format("02-01-2006"), reservation.EndDate.Format("02-01-2006"))
+		This is confirm your reservation from %s to %s.<br>
+		Your confirmation code is <strong>%s</strong>.
+`, reservation.FirstName, reservation.StartDate.Format("02-01-2006"), reservation.EndDate.Format("02-01-2006"),
+		reservation.ConfirmationCode)
 
 	msg := models.MailData{
 		To:       reservation.Email,
@@ -181,26 +233,22 @@ func (m *Repository) PostReservation(w http.ResponseWriter, r *http.Request) {
 		Template: "basic.html",
 	}
 	m.App.MailChan <- msg
+}
 
-	// send notifications - second to property owner
-
-	htmlMessage = fmt.Sprintf(`
+// sendReservationNotification emails the property owner about a new reservation
+func (m *Repository) sendReservationNotification(reservation models.Reservation) {
+	htmlMessage := fmt.Sprintf(`
 		<strong>Reservation Notification</strong><br>
 		A reservation has been made for %s from %s to %s
 `, reservation.Room.RoomName, reservation.StartDate.Format("02-01-2006"), reservation.EndDate.Format("02-01-2006"))
 
-	msg = models.MailData{
+	msg := models.MailData{
 		To:      "me@here.com",
 		From:    "me@here.com",
 		Subject: "Reservation Notification",
 		Content: htmlMessage,
 	}
 	m.App.MailChan <- msg
-
-	m.App.Session.Put(r.Context(), "reservation", reservation)
-
-	http.Redirect(w, r, "/reservation-summary", http.StatusSeeOther)
-
 }
 
 // Generals renders the room page
@@ -466,64 +514,485 @@ func (m *Repository) PostShowLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	ip := helpers.ClientIP(r)
+	attempt := models.LoginAttempt{Email: email, IP: ip}
+
+	ipFailures, err := m.DB.CountIPFailures(ip, time.Now().Add(-throttle.Window))
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	if ipFailures >= throttle.MaxIPFailures {
+		attempt.Outcome = models.LoginIPBlocked
+		m.recordLoginAttempt(attempt)
+
+		m.App.Session.Put(r.Context(), "error", "Too many failed logins, try again later")
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+
+	// the account may not exist, in which case only the address is throttled
+	account, err := m.DB.GetUserByEmail(email)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		helpers.ServerError(w, err)
+		return
+	}
+	attempt.UserID = account.ID
+
+	if account.IsLocked() {
+		attempt.Outcome = models.LoginLocked
+		m.recordLoginAttempt(attempt)
+
+		m.App.Session.Put(r.Context(), "error", "This account is locked after too many failed logins, try again later")
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+
+	failures := account.FailedLogins
+	if ipFailures > failures {
+		failures = ipFailures
+	}
+	sleep(throttle.Delay(failures))
+
 	id, _, err := m.DB.Authenticate(email, password)
 	if err != nil {
 		log.Println(err)
 
+		attempt.Outcome = models.LoginBadPassword
+		m.recordLoginAttempt(attempt)
+		if account.ID != 0 {
+			err = m.recordFailedLogin(account, ip)
+			if err != nil {
+				helpers.ServerError(w, err)
+				return
+			}
+		}
+
 		m.App.Session.Put(r.Context(), "error", "Invalid login credentials")
 		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
 		return
 	}
 
-	m.App.Session.Put(r.Context(), "user_id", id)
-	m.App.Session.Put(r.Context(), "flash", "Logged in successfully")
+	user, err := m.DB.GetUserByID(id)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	attempt.UserID = id
+
+	// the password is right, but the user isn't logged in until the second factor is too
+	if user.TOTPEnabled {
+		attempt.Outcome = models.LoginPasswordOnly
+		m.recordLoginAttempt(attempt)
+
+		m.App.Session.Put(r.Context(), "mfa_user_id", id)
+		http.Redirect(w, r, "/user/login/verify", http.StatusSeeOther)
+		return
+	}
+	if rbac.Requires2FA(user.AccessLevel) {
+		attempt.Outcome = models.LoginPasswordOnly
+		m.recordLoginAttempt(attempt)
+
+		m.App.Session.Put(r.Context(), "mfa_user_id", id)
+		m.App.Session.Put(r.Context(), "warning", "Your role requires two-factor authentication, set it up to continue")
+		http.Redirect(w, r, "/user/2fa/setup", http.StatusSeeOther)
+		return
+	}
+
+	err = m.DB.ResetFailedLogins(id)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	attempt.Outcome = models.LoginSucceeded
+	m.recordLoginAttempt(attempt)
+
+	err = m.logIn(r, user)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
+// sleep is replaced in tests so the progressive login delay doesn't slow them down
+var sleep = time.Sleep
+
+// recordLoginAttempt writes a login attempt to the log. A failure to write it
+// is logged but doesn't stop the login
+func (m *Repository) recordLoginAttempt(a models.LoginAttempt) {
+	err := m.DB.InsertLoginAttempt(a)
+	if err != nil {
+		m.App.ErrorLog.Println(err)
+	}
+}
+
+// recordFailedLogin counts a failed password or code against a user and tells
+// them by email when it locks their account
+func (m *Repository) recordFailedLogin(user models.User, ip string) error {
+	locked, err := m.DB.RecordFailedLogin(user.ID, throttle.MaxAccountFailures, throttle.LockoutDuration)
+	if err != nil || !locked {
+		return err
+	}
+
+	htmlMessage := fmt.Sprintf(`
+		<strong>Your account has been locked</strong><br>
+		Dear %s,<br>
+		after %d failed login attempts, the last one from %s, your account is locked until %s.<br>
+		If this wasn't you, someone may be guessing your password. Reset it from the login page once the lock
+		expires, or ask an owner to unlock the account.
+	`, user.FirstName, throttle.MaxAccountFailures, ip, time.Now().Add(throttle.LockoutDuration).Format("02-01-2006 15:04"))
+
+	msg := models.MailData{
+		To:       user.Email,
+		From:     "me@here.com",
+		Subject:  "Your account has been locked",
+		Content:  htmlMessage,
+		Template: "basic.html",
+	}
+	m.App.MailChan <- msg
+
+	return nil
+}
+
+// logIn puts a staff user in the session once all authentication steps are done
+// and records the login so it shows up in the user's list of sessions
+func (m *Repository) logIn(r *http.Request, user models.User) error {
+	sessionID, err := helpers.RandomString(16)
+	if err != nil {
+		return err
+	}
+
+	err = m.DB.InsertUserSession(models.UserSession{
+		UserID:    user.ID,
+		SessionID: sessionID,
+		UserAgent: r.UserAgent(),
+		IP:        helpers.ClientIP(r),
+	})
+	if err != nil {
+		return err
+	}
+
+	_ = m.App.Session.RenewToken(r.Context())
+	m.App.Session.Remove(r.Context(), "mfa_user_id")
+	m.App.Session.Put(r.Context(), "user_id", user.ID)
+	m.App.Session.Put(r.Context(), "access_level", user.AccessLevel)
+	m.App.Session.Put(r.Context(), "session_id", sessionID)
+	m.App.Session.Put(r.Context(), "flash", "Logged in successfully")
+	return nil
+}
+
+// logOutEverywhere ends every session of a staff user
+func (m *Repository) logOutEverywhere(ctx context.Context, userID int) error {
+	err := m.DB.RevokeUserSessions(userID, "")
+	if err != nil {
+		return err
+	}
+	return helpers.DestroyUserSessions(ctx, userID)
+}
+
 // LogOut logs a user out
 func (m *Repository) LogOut(w http.ResponseWriter, r *http.Request) {
+	if m.App.Session.Exists(r.Context(), "session_id") {
+		err := m.DB.RevokeUserSession(m.App.Session.GetInt(r.Context(), "user_id"),
+			m.App.Session.GetString(r.Context(), "session_id"))
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+	}
+
 	_ = m.App.Session.Destroy(r.Context())
 	_ = m.App.Session.RenewToken(r.Context())
 
 	http.Redirect(w, r, "/user/login", http.StatusSeeOther)
 }
 
-func (m Repository) AdminDashboard(w http.ResponseWriter, r *http.Request) {
-	render.Template(w, r, "admin-dashboard.page.tmpl", &models.TemplateData{})
+// maxDashboardNights is the longest period the dashboard shows figures for
+const maxDashboardNights = 366
+
+// dashboardCharts is the data of the dashboard charts, written into the page as JSON
+type dashboardCharts struct {
+	Days       []string `json:"days"`
+	Occupancy  []int    `json:"occupancy"`
+	LeadLabels []string `json:"lead_labels"`
+	LeadCounts []int    `json:"lead_counts"`
 }
 
-// AdminNewReservations shows all new reservations
-func (m *Repository) AdminNewReservations(w http.ResponseWriter, r *http.Request) {
-	reservations, err := m.DB.AllNewReservations()
+// AdminDashboard shows occupancy and revenue figures for a period, this month unless from and to are given,
+// and the arrivals and departures of today and this week. Revenue is only shown to roles that may view reports
+func (m Repository) AdminDashboard(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+
+	from := time.Date(today.Year(), today.Month(), 1, 0, 0, 0, 0, time.UTC)
+	to := from.AddDate(0, 1, -1)
+	if r.URL.Query().Has("from") || r.URL.Query().Has("to") {
+		f := reservationFilterFromQuery(r.URL.Query())
+		if f.From.IsZero() || f.To.IsZero() || f.To.Before(f.From) ||
+			f.To.Sub(f.From) >= maxDashboardNights*24*time.Hour {
+			m.App.Session.Put(r.Context(), "error", fmt.Sprintf("Choose a period of 1 to %d nights", maxDashboardNights))
+			http.Redirect(w, r, "/admin/dashboard", http.StatusSeeOther)
+			return
+		}
+		from, to = f.From, f.To
+	}
+
+	stats, err := m.DB.OccupancyStats(from, to)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	// revenue is for the roles that may view reports, the rest of the dashboard is for every role
+	if !rbac.Can(m.App.Session.GetInt(r.Context(), "access_level"), rbac.ViewReports) {
+		stats.Revenue = 0
+	}
+
+	days, err := m.DB.DailyOccupancy(from, to)
 	if err != nil {
 		helpers.ServerError(w, err)
 		return
 	}
 
-	data := make(map[string]interface{})
-	data["reservations"] = reservations
+	leadTimes, err := m.DB.LeadTimes(from, to)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	todayMovements, err := m.DB.CountMovements(today, today)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	// weeks start on monday
+	monday := today.AddDate(0, 0, -(int(today.Weekday())+6)%7)
+	weekMovements, err := m.DB.CountMovements(monday, monday.AddDate(0, 0, 6))
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	var charts dashboardCharts
+	for _, d := range days {
+		charts.Days = append(charts.Days, d.Date.Format("Jan 2"))
+		occupancy := 0
+		if stats.Rooms > 0 {
+			occupancy = 100 * d.Rooms / stats.Rooms
+		}
+		charts.Occupancy = append(charts.Occupancy, occupancy)
+	}
+	buckets := models.LeadTimeBuckets(leadTimes)
+	for _, b := range buckets {
+		charts.LeadLabels = append(charts.LeadLabels, b.Label)
+		charts.LeadCounts = append(charts.LeadCounts, b.Reservations)
+	}
 
-	render.Template(w, r, "admin-new-reservations.page.tmpl", &models.TemplateData{
+	data := make(map[string]interface{})
+	data["stats"] = stats
+	data["today"] = todayMovements
+	data["week"] = weekMovements
+	data["lead_times"] = buckets
+	data["charts"] = charts
+	data["filter"] = models.ReservationFilter{From: from, To: to}
+
+	render.Template(w, r, "admin-dashboard.page.tmpl", &models.TemplateData{
 		Data: data,
 	})
 }
 
+// AdminNewReservations shows all new reservations
+func (m *Repository) AdminNewReservations(w http.ResponseWriter, r *http.Request) {
+	filter := reservationFilterFromQuery(r.URL.Query())
+	filter.Status = models.ReservationNew
+	m.renderReservationList(w, r, "admin-new-reservations.page.tmpl", "new", filter)
+}
+
 // AdminAllReservations shows all reservations in admin tool
 func (m *Repository) AdminAllReservations(w http.ResponseWriter, r *http.Request) {
-	reservations, err := m.DB.AllReservations()
+	m.renderReservationList(w, r, "admin-all-reservations.page.tmpl", "all", reservationFilterFromQuery(r.URL.Query()))
+}
+
+// reservationsPerPage is the number of reservations on a page of the reservation lists
+const reservationsPerPage = 25
+
+// sortColumn is the header of a list column that sorts the list, Sorted is set when the list is
+// sorted by it already
+type sortColumn struct {
+	Title  string
+	URL    string
+	Sorted bool
+	Desc   bool
+}
+
+// pageLink links to a page of a list, a zero Number stands for the pages left out between links
+type pageLink struct {
+	Number  int
+	URL     string
+	Current bool
+}
+
+// renderReservationList renders a page of the reservations selected by filter, sorted and paged
+// by the query string. src is the list the reservations link back to
+func (m *Repository) renderReservationList(w http.ResponseWriter, r *http.Request, tmpl, src string, filter models.ReservationFilter) {
+	page := reservationPageFromQuery(r.URL.Query())
+	reservations, total, err := m.DB.ListReservations(filter, page)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	rooms, err := m.DB.AllRooms()
 	if err != nil {
 		helpers.ServerError(w, err)
 		return
 	}
 
+	path := r.URL.Path
+	listURL := func(p models.Page) string {
+		q := reservationListQuery(filter, p)
+		if len(q) == 0 {
+			return path
+		}
+		return path + "?" + q.Encode()
+	}
+
+	// a column sorts ascending, unless it is sorted ascending already
+	var columns []sortColumn
+	for _, c := range []struct{ key, title string }{
+		{models.SortByID, "ID"},
+		{models.SortByLastName, "Last Name"},
+		{models.SortByRoom, "Room"},
+		{models.SortByArrival, "Arrival"},
+		{models.SortByDeparture, "Departure"},
+	} {
+		sorted := c.key == page.Sort
+		columns = append(columns, sortColumn{
+			Title:  c.title,
+			URL:    listURL(models.Page{Sort: c.key, Desc: sorted && !page.Desc, Number: 1}),
+			Sorted: sorted,
+			Desc:   page.Desc,
+		})
+	}
+
+	pages := (total + page.Size - 1) / page.Size
+	var pageLinks []pageLink
+	for n := 1; n <= pages && (pages > 1 || page.Number > 1); n++ {
+		// link the first and last pages and the two either side of the current page
+		if n != 1 && n != pages && (n < page.Number-2 || n > page.Number+2) {
+			if pageLinks[len(pageLinks)-1].Number != 0 {
+				pageLinks = append(pageLinks, pageLink{})
+			}
+			continue
+		}
+		p := page
+		p.Number = n
+		pageLinks = append(pageLinks, pageLink{Number: n, URL: listURL(p), Current: n == page.Number})
+	}
+
 	data := make(map[string]interface{})
 	data["reservations"] = reservations
+	data["filter"] = filter
+	data["page"] = page
+	data["rooms"] = rooms
+	data["columns"] = columns
+	data["pages"] = pageLinks
 
-	render.Template(w, r, "admin-all-reservations.page.tmpl", &models.TemplateData{
-		Data: data,
+	intMap := make(map[string]int)
+	intMap["total"] = total
+
+	stringMap := make(map[string]string)
+	stringMap["src"] = src
+	for _, format := range []string{"csv", "xlsx"} {
+		q := reservationFilterQuery(filter)
+		q.Set("format", format)
+		stringMap["export_"+format] = "/admin/reservations-export?" + q.Encode()
+	}
+	if page.Number > 1 {
+		p := page
+		p.Number--
+		stringMap["previous_page"] = listURL(p)
+	}
+	if page.Number < pages {
+		p := page
+		p.Number++
+		stringMap["next_page"] = listURL(p)
+	}
+
+	render.Template(w, r, tmpl, &models.TemplateData{
+		Data:      data,
+		IntMap:    intMap,
+		StringMap: stringMap,
 	})
 }
 
+// reservationFilterFromQuery reads the filters of the reservation lists from a query string,
+// ignoring values that don't parse
+func reservationFilterFromQuery(q url.Values) models.ReservationFilter {
+	var f models.ReservationFilter
+	f.From, _ = time.Parse("2006-01-02", q.Get("from"))
+	f.To, _ = time.Parse("2006-01-02", q.Get("to"))
+	switch status := q.Get("status"); status {
+	case models.ReservationNew, models.ReservationProcessed, models.ReservationCancelled:
+		f.Status = status
+	}
+	f.RoomID, _ = strconv.Atoi(q.Get("room"))
+	f.Search = strings.TrimSpace(q.Get("q"))
+	return f
+}
+
+// reservationFilterQuery is the reverse of reservationFilterFromQuery
+func reservationFilterQuery(f models.ReservationFilter) url.Values {
+	q := url.Values{}
+	if !f.From.IsZero() {
+		q.Set("from", f.From.Format("2006-01-02"))
+	}
+	if !f.To.IsZero() {
+		q.Set("to", f.To.Format("2006-01-02"))
+	}
+	if f.Status != "" {
+		q.Set("status", f.Status)
+	}
+	if f.RoomID != 0 {
+		q.Set("room", strconv.Itoa(f.RoomID))
+	}
+	if f.Search != "" {
+		q.Set("q", f.Search)
+	}
+	return q
+}
+
+// reservationPageFromQuery reads the sort order and page number of the reservation lists from a
+// query string. Lists are sorted by arrival, latest first, unless sort and dir say otherwise
+func reservationPageFromQuery(q url.Values) models.Page {
+	p := models.Page{Sort: models.SortByArrival, Desc: true, Number: 1, Size: reservationsPerPage}
+	switch sort := q.Get("sort"); sort {
+	case models.SortByArrival, models.SortByDeparture, models.SortByLastName, models.SortByRoom, models.SortByID:
+		p.Sort = sort
+		p.Desc = q.Get("dir") == "desc"
+	}
+	if n, err := strconv.Atoi(q.Get("page")); err == nil && n > 1 {
+		p.Number = n
+	}
+	return p
+}
+
+// reservationListQuery returns the query string of a page of a reservation list
+func reservationListQuery(f models.ReservationFilter, p models.Page) url.Values {
+	q := reservationFilterQuery(f)
+	if p.Sort != models.SortByArrival || !p.Desc {
+		q.Set("sort", p.Sort)
+		if p.Desc {
+			q.Set("dir", "desc")
+		}
+	}
+	if p.Number > 1 {
+		q.Set("page", strconv.Itoa(p.Number))
+	}
+	return q
+}
+
 // AdminShowReservation shows the reservation in the admin tool
 func (m Repository) AdminShowReservation(w http.ResponseWriter, r *http.Request) {
 	exploded := strings.Split(r.RequestURI, "/")
@@ -549,9 +1018,33 @@ func (m Repository) AdminShowReservation(w http.ResponseWriter, r *http.Request)
 		helpers.ServerError(w, err)
 		return
 	}
+
+	charges, err := m.DB.GetChargesForReservation(id)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	invoices, err := m.DB.GetInvoicesForReservation(id)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	intMap := make(map[string]int)
+	for _, c := range charges {
+		if c.InvoiceID == 0 {
+			intMap["uninvoiced_total"] += c.Amount()
+			intMap["uninvoiced_count"]++
+		}
+	}
+
 	data := make(map[string]interface{})
 	data["reservation"] = res
+	data["charges"] = charges
+	data["invoices"] = invoices
 	render.Template(w, r, "admin-reservation-show.page.tmpl", &models.TemplateData{
+		IntMap:    intMap,
 		StringMap: stringMap,
 		Data:      data,
 		Form:      forms.New(nil),
@@ -594,6 +1087,7 @@ func (m Repository) AdminPostShowReservation(w http.ResponseWriter, r *http.Requ
 		helpers.ServerError(w, err)
 		return
 	}
+	m.App.Events.Publish(events.ReservationModified, res)
 
 	month := r.Form.Get("month")
 	year := r.Form.Get("year")
@@ -640,91 +1134,168 @@ func (m *Repository) AdminReservationsCalendar(w http.ResponseWriter, r *http.Re
 	stringMap["this_month_year"] = now.Format("2006")
 
 	// get the first and last days of the month
-	currentYear, currentMonth, _ := now.Date()
-	currentLocation := now.Location()
-	firstOfMonth := time.Date(currentYear, currentMonth, 1, 0, 0, 0, 0, currentLocation)
+	firstOfMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
 	lastOfMonth := firstOfMonth.AddDate(0, 1, -1)
 
-	intMap := make(map[string]int)
-	intMap["days_in_month"] = lastOfMonth.Day()
-
 	rooms, err := m.DB.AllRooms()
 	if err != nil {
 		helpers.ServerError(w, err)
 		return
 	}
 
-	data["rooms"] = rooms
-
-	for _, x := range rooms {
-		// create maps
-		reservationMap := make(map[string]int)
-		blockMap := make(map[string]int)
-
-		for d := firstOfMonth; d.After(lastOfMonth) == false; d = d.AddDate(0, 0, 1) {
-			reservationMap[d.Format("2006-01-2")] = 0
-			blockMap[d.Format("2006-01-2")] = 0
-		}
-
-		// get all the restrictions for the current room
-		restrictions, err := m.DB.GetRestrictionsForRoomByDate(x.ID, firstOfMonth, lastOfMonth)
-		if err != nil {
-			helpers.ServerError(w, err)
-			return
-		}
-
-		for _, y := range restrictions {
-			if y.ReservationID > 0 {
-				// it's a reservation
-				for d := y.StartDate; d.After(y.EndDate) == false; d = d.AddDate(0, 0, 1) {
-					reservationMap[d.Format("2006-01-2")] = y.ReservationID
-				}
-			} else {
-				// it's a block
-				blockMap[y.StartDate.Format("2006-01-2")] = y.ID
-			}
-		}
-		data[fmt.Sprintf("reservation_map_%d", x.ID)] = reservationMap
-		data[fmt.Sprintf("block_map_%d", x.ID)] = blockMap
-
-		m.App.Session.Put(r.Context(), fmt.Sprintf("block_map_%d", x.ID), blockMap)
+	// get the restrictions of all the rooms at once
+	restrictions, err := m.DB.GetRestrictionsByDate(firstOfMonth, lastOfMonth)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
 	}
 
+	data["calendar"] = newCalendarMonth(firstOfMonth, rooms, restrictions)
+
 	render.Template(w, r, "admin-reservations-calendar.page.tmpl", &models.TemplateData{
 		StringMap: stringMap,
 		Data:      data,
-		IntMap:    intMap,
 	})
 }
 
-// AdminProcessReservation marks a reservation as processed
-func (m *Repository) AdminProcessReservation(w http.ResponseWriter, r *http.Request) {
-	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
-	src := chi.URLParam(r, "src")
+// AdminReservationsTimeline displays the reservation calendar as a timeline of 1, 2 or 4 weeks or 3 months,
+// starting at the day given by y, m and d (the first of the month when d is left out). Without y it
+// starts on the Monday of this week, or on the first of this month for 3 months
+func (m *Repository) AdminReservationsTimeline(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
 
-	err := m.DB.UpdateProcessedForReservation(id, 1)
-	if err != nil {
-		log.Println(err)
+	rng := q.Get("range")
+	if _, ok := timelineRanges[rng]; !ok {
+		rng = defaultTimelineRange
 	}
 
-	year := r.URL.Query().Get("y")
-	month := r.URL.Query().Get("m")
-
-	m.App.Session.Put(r.Context(), "flash", "Reservation marked as processed")
-
-	if year == "" {
-		http.Redirect(w, r, fmt.Sprintf("/admin/reservations-%s", src), http.StatusSeeOther)
+	now := time.Now()
+	start := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	if rng == "3m" {
+		start = start.AddDate(0, 0, 1-start.Day())
 	} else {
-		http.Redirect(w, r, fmt.Sprintf("/admin/reservations-calendar?y=%s&m=%s", year, month), http.StatusSeeOther)
+		start = start.AddDate(0, 0, -(int(start.Weekday())+6)%7)
+	}
+	if q.Get("y") != "" {
+		year, _ := strconv.Atoi(q.Get("y"))
+		month, _ := strconv.Atoi(q.Get("m"))
+		day, err := strconv.Atoi(q.Get("d"))
+		if err != nil || day < 1 {
+			day = 1
+		}
+		if year < 1 || month < 1 || month > 12 {
+			helpers.ClientError(w, http.StatusBadRequest)
+			return
+		}
+		start = time.Date(year, time.Month(month), day, 0, 0, 0, 0, time.UTC)
+	}
+	end := timelineEnd(start, rng, 1)
+
+	rooms, err := m.DB.AllRooms()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	var reservations []models.Reservation
+	err = m.DB.EachReservation(models.ReservationFilter{From: start, To: end.AddDate(0, 0, -1)}, func(res models.Reservation) error {
+		reservations = append(reservations, res)
+		return nil
+	})
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	restrictions, err := m.DB.GetRestrictionsByDate(start, end.AddDate(0, 0, -1))
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	timelineURL := func(from time.Time, rng string) string {
+		return fmt.Sprintf("/admin/reservations-timeline?y=%d&m=%02d&d=%d&range=%s", from.Year(), from.Month(), from.Day(), rng)
+	}
+
+	type rangeLink struct {
+		Label  string
+		URL    string
+		Active bool
+	}
+	var ranges []rangeLink
+	for _, k := range timelineRangeOrder {
+		ranges = append(ranges, rangeLink{Label: timelineRanges[k].Label, URL: timelineURL(start, k), Active: k == rng})
+	}
+
+	data := make(map[string]interface{})
+	data["timeline"] = newCalendarTimeline(start, end, rooms, reservations, restrictions)
+	data["ranges"] = ranges
+
+	stringMap := make(map[string]string)
+	stringMap["this_month"] = start.Format("01")
+	stringMap["this_month_year"] = start.Format("2006")
+	stringMap["previous_url"] = timelineURL(timelineEnd(start, rng, -1), rng)
+	stringMap["next_url"] = timelineURL(end, rng)
+	stringMap["month_url"] = fmt.Sprintf("/admin/reservations-calendar?y=%d&m=%02d", start.Year(), start.Month())
+
+	render.Template(w, r, "admin-reservations-timeline.page.tmpl", &models.TemplateData{
+		StringMap: stringMap,
+		Data:      data,
+	})
+}
+
+// AdminProcessReservation marks a reservation as processed. Its uninvoiced charges are invoiced, and
+// the guest is emailed the invoice
+func (m *Repository) AdminProcessReservation(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+	src := chi.URLParam(r, "src")
+
+	flash := "Reservation marked as processed"
+	err := m.DB.UpdateProcessedForReservation(id, 1)
+	if err != nil {
+		log.Println(err)
+	} else {
+		if res, err := m.DB.GetReservationByID(id); err != nil {
+			log.Println(err)
+		} else {
+			m.App.Events.Publish(events.ReservationProcessed, res)
+		}
+
+		inv, err := m.DB.IssueInvoice(id, m.App.PropertyCode)
+		if err == nil {
+			m.sendInvoice(inv)
+			flash = fmt.Sprintf("Reservation marked as processed, invoice %s was emailed to the guest", inv.InvoiceNumber)
+		} else if !errors.Is(err, repository.ErrNothingToInvoice) {
+			log.Println(err)
+		}
 	}
-}
+
+	year := r.URL.Query().Get("y")
+	month := r.URL.Query().Get("m")
+
+	m.App.Session.Put(r.Context(), "flash", flash)
+
+	if year == "" {
+		http.Redirect(w, r, fmt.Sprintf("/admin/reservations-%s", src), http.StatusSeeOther)
+	} else {
+		http.Redirect(w, r, fmt.Sprintf("/admin/reservations-calendar?y=%s&m=%s", year, month), http.StatusSeeOther)
+	}
+}
 
 // AdminDeleteReservation deletes a reservation
 func (m *Repository) AdminDeleteReservation(w http.ResponseWriter, r *http.Request) {
 	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
 	src := chi.URLParam(r, "src")
 
-	_ = m.DB.DeleteReservation(id)
+	// load the reservation first, so the event can tell what was deleted
+	res, err := m.DB.GetReservationByID(id)
+	if err != nil {
+		log.Println(err)
+	}
+	err = m.DB.DeleteReservation(id)
+	if err == nil && res.ID != 0 {
+		m.App.Events.Publish(events.ReservationDeleted, res)
+	}
 	year := r.URL.Query().Get("y")
 	month := r.URL.Query().Get("m")
 
@@ -739,7 +1310,8 @@ func (m *Repository) AdminDeleteReservation(w http.ResponseWriter, r *http.Reque
 	}
 }
 
-// AdminPostReservationsCalendar handles post of reservation calendar
+// AdminPostReservationsCalendar saves the blocks added and removed on the reservation calendar. The
+// edits are rejected when the calendar of an edited room changed since the page was loaded
 func (m *Repository) AdminPostReservationsCalendar(w http.ResponseWriter, r *http.Request) {
 	err := r.ParseForm()
 	if err != nil {
@@ -749,54 +1321,2448 @@ func (m *Repository) AdminPostReservationsCalendar(w http.ResponseWriter, r *htt
 
 	year, _ := strconv.Atoi(r.Form.Get("y"))
 	month, _ := strconv.Atoi(r.Form.Get("m"))
+	if year < 1 || month < 1 || month > 12 {
+		helpers.ClientError(w, http.StatusBadRequest)
+		return
+	}
+	calendarURL := fmt.Sprintf("/admin/reservations-calendar?y=%d&m=%02d", year, month)
+
+	changes, err := blockChangesFromForm(r.PostForm, time.Date(year, time.Month(month), 1, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		m.App.ErrorLog.Println(err)
+		helpers.ClientError(w, http.StatusBadRequest)
+		return
+	}
+
+	if len(changes.Add) == 0 && len(changes.Remove) == 0 {
+		m.App.Session.Put(r.Context(), "flash", "No changes to save")
+		http.Redirect(w, r, calendarURL, http.StatusSeeOther)
+		return
+	}
+
+	added, removed, err := m.DB.UpdateBlocks(changes)
+	if errors.Is(err, repository.ErrCalendarChanged) {
+		m.App.Session.Put(r.Context(), "error",
+			"Someone else changed the calendar while you were editing it, so nothing was saved. Please make your changes again")
+		http.Redirect(w, r, calendarURL, http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
 
-	// process blocks
 	rooms, err := m.DB.AllRooms()
+	if err != nil {
+		m.App.ErrorLog.Println(err)
+	}
+	withRoom := func(b models.RoomRestriction) models.RoomRestriction {
+		for _, rm := range rooms {
+			if rm.ID == b.RoomID {
+				b.Room = rm
+			}
+		}
+		return b
+	}
+	for _, b := range removed {
+		m.App.Events.PublishBlock(events.BlockRemoved, withRoom(b))
+	}
+	for _, b := range added {
+		m.App.Events.PublishBlock(events.BlockAdded, withRoom(b))
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Changes saved")
+	http.Redirect(w, r, calendarURL, http.StatusSeeOther)
+}
+
+// showReservationURL returns the admin page of a reservation, keeping the calendar month to return to
+func showReservationURL(src string, id int, year, month string) string {
+	if year == "" {
+		return fmt.Sprintf("/admin/reservations/%s/%d/show", src, id)
+	}
+	return fmt.Sprintf("/admin/reservations/%s/%d/show?y=%s&m=%s", src, id, year, month)
+}
+
+// AdminPostCharge adds a charge to a reservation
+func (m *Repository) AdminPostCharge(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
 	if err != nil {
 		helpers.ServerError(w, err)
 		return
 	}
 
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		helpers.ClientError(w, http.StatusBadRequest)
+		return
+	}
+	src := chi.URLParam(r, "src")
+	back := showReservationURL(src, id, r.Form.Get("year"), r.Form.Get("month"))
+
 	form := forms.New(r.PostForm)
+	form.Required("description", "quantity", "unit_amount")
+	if !form.Valid() {
+		m.App.Session.Put(r.Context(), "error", "Description, quantity and price are required")
+		http.Redirect(w, r, back, http.StatusSeeOther)
+		return
+	}
 
-	for _, x := range rooms {
-		// Get the block map from the session. Loop through entire map, if we have an entry in the map
-		// that does not exist in our posted data, and if the restriction id > 0, then it is a block we need to
-		// remove.
-		curMap := m.App.Session.Get(r.Context(), fmt.Sprintf("block_map_%d", x.ID)).(map[string]int)
-		for name, value := range curMap {
-			// ok will be false if the value is not in the map
-			if val, ok := curMap[name]; ok {
-				// only pay attention to values > 0, and that are not in the form post
-				// the rest are just placeholders for days without blocks
-				if val > 0 {
-					if !form.Has(fmt.Sprintf("remove_block_%d_%s", x.ID, name)) {
-						// delete the restriction by id
-						err := m.DB.DeleteBlockByID(value)
-						if err != nil {
-							log.Println(err)
-						}
-					}
-				}
-			}
+	quantity, err := strconv.Atoi(form.Get("quantity"))
+	if err != nil || quantity < 1 {
+		m.App.Session.Put(r.Context(), "error", "Quantity must be a whole number of at least 1")
+		http.Redirect(w, r, back, http.StatusSeeOther)
+		return
+	}
+
+	amount, err := invoice.ParseAmount(form.Get("unit_amount"))
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Price must be an amount such as 120 or 120.50")
+		http.Redirect(w, r, back, http.StatusSeeOther)
+		return
+	}
+
+	err = m.DB.InsertCharge(models.Charge{
+		ReservationID: id,
+		Description:   form.Get("description"),
+		Quantity:      quantity,
+		UnitAmount:    amount,
+	})
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Charge added")
+	http.Redirect(w, r, back, http.StatusSeeOther)
+}
+
+// AdminDeleteCharge deletes a charge that is not on an invoice yet
+func (m *Repository) AdminDeleteCharge(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+	chargeID, _ := strconv.Atoi(chi.URLParam(r, "chargeID"))
+	src := chi.URLParam(r, "src")
+	back := showReservationURL(src, id, r.Form.Get("year"), r.Form.Get("month"))
+
+	err = m.DB.DeleteCharge(chargeID, id)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		helpers.ClientError(w, http.StatusNotFound)
+		return
+	case errors.Is(err, repository.ErrChargeInvoiced):
+		m.App.Session.Put(r.Context(), "error", "Invoiced charges can only be corrected with a credit note")
+		http.Redirect(w, r, back, http.StatusSeeOther)
+		return
+	case err != nil:
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Charge deleted")
+	http.Redirect(w, r, back, http.StatusSeeOther)
+}
+
+// AdminIssueInvoice issues an invoice for the uninvoiced charges of a reservation
+func (m *Repository) AdminIssueInvoice(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		helpers.ClientError(w, http.StatusBadRequest)
+		return
+	}
+	src := chi.URLParam(r, "src")
+	back := showReservationURL(src, id, r.Form.Get("year"), r.Form.Get("month"))
+
+	inv, err := m.DB.IssueInvoice(id, m.App.PropertyCode)
+	if errors.Is(err, repository.ErrNothingToInvoice) {
+		m.App.Session.Put(r.Context(), "error", "There are no uninvoiced charges")
+		http.Redirect(w, r, back, http.StatusSeeOther)
+		return
+	} else if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	if r.Form.Get("send_email") != "" {
+		m.sendInvoice(inv)
+	}
+
+	m.App.Session.Put(r.Context(), "flash", fmt.Sprintf("Invoice %s issued", inv.InvoiceNumber))
+	http.Redirect(w, r, back, http.StatusSeeOther)
+}
+
+// AdminPostCreditNote issues a credit note that reverses an invoice
+func (m *Repository) AdminPostCreditNote(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		helpers.ClientError(w, http.StatusBadRequest)
+		return
+	}
+
+	cn, err := m.DB.IssueCreditNote(id)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		helpers.ClientError(w, http.StatusNotFound)
+		return
+	case errors.Is(err, repository.ErrAlreadyCredited):
+		m.App.Session.Put(r.Context(), "error", "This invoice has already been credited")
+		// go back to the reservation of the invoice
+		cn, err = m.DB.GetInvoiceByID(id)
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+	case err != nil:
+		helpers.ServerError(w, err)
+		return
+	default:
+		if r.Form.Get("send_email") != "" {
+			m.sendInvoice(cn)
 		}
+		m.App.Session.Put(r.Context(), "flash", fmt.Sprintf("Credit note %s issued, the charges can now be corrected", cn.InvoiceNumber))
 	}
 
-	// now handle new blocks
-	for name, _ := range r.PostForm {
-		if strings.HasPrefix(name, "add_block") {
-			exploded := strings.Split(name, "_")
-			roomID, _ := strconv.Atoi(exploded[2])
-			t, _ := time.Parse("2006-01-2", exploded[3])
-			// insert a new block
-			err := m.DB.InsertBlockForRoom(roomID, t)
-			if err != nil {
-				log.Println(err)
-			}
+	src := r.Form.Get("src")
+	if src == "" {
+		src = "all"
+	}
+	http.Redirect(w, r, showReservationURL(src, cn.ReservationID, r.Form.Get("year"), r.Form.Get("month")), http.StatusSeeOther)
+}
+
+// AdminInvoicePDF downloads an invoice or credit note as PDF
+func (m *Repository) AdminInvoicePDF(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		helpers.ClientError(w, http.StatusBadRequest)
+		return
+	}
+
+	inv, err := m.DB.GetInvoiceByID(id)
+	if err != nil {
+		helpers.ClientError(w, http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, invoice.FileName(inv)))
+	_, _ = w.Write(invoice.PDF(inv, invoice.DefaultIssuer))
+}
+
+// sendInvoice emails an invoice or credit note to the guest with the PDF attached
+func (m *Repository) sendInvoice(inv models.Invoice) {
+	document := "invoice"
+	if inv.Kind == models.InvoiceKindCreditNote {
+		document = "credit note"
+	}
+
+	htmlMessage := fmt.Sprintf(`
+		<strong>Thank you for staying with us</strong><br>
+		Dear %s, <br>
+		Please find attached %s %s for your stay from %s to %s.
+`, inv.GuestName, document, inv.InvoiceNumber, inv.StartDate.Format("02-01-2006"), inv.EndDate.Format("02-01-2006"))
+
+	msg := models.MailData{
+		To:       inv.GuestEmail,
+		From:     "me@here.com",
+		Subject:  fmt.Sprintf("Your %s %s", document, inv.InvoiceNumber),
+		Content:  htmlMessage,
+		Template: "basic.html",
+		Attachments: []models.MailAttachment{
+			{
+				Name:     invoice.FileName(inv),
+				MimeType: "application/pdf",
+				Data:     invoice.PDF(inv, invoice.DefaultIssuer),
+			},
+		},
+	}
+	m.App.MailChan <- msg
+}
+
+// GuestRegister shows the guest registration page
+func (m *Repository) GuestRegister(w http.ResponseWriter, r *http.Request) {
+	data := make(map[string]interface{})
+	data["guest"] = models.Guest{}
+
+	render.Template(w, r, "guest-register.page.tmpl", &models.TemplateData{
+		Form: forms.New(nil),
+		Data: data,
+	})
+}
+
+// PostGuestRegister creates a guest account and logs the guest in
+func (m *Repository) PostGuestRegister(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't parse form")
+		http.Redirect(w, r, "/guest/register", http.StatusSeeOther)
+		return
+	}
+
+	guest := models.Guest{
+		FirstName: r.Form.Get("first_name"),
+		LastName:  r.Form.Get("last_name"),
+		Email:     r.Form.Get("email"),
+		Phone:     r.Form.Get("phone"),
+		Password:  r.Form.Get("password"),
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("first_name", "last_name", "email", "password")
+	form.MinLength("first_name", 3)
+	form.IsEmail("email")
+	form.MinLength("password", 8)
+	form.Matches("password_confirm", "password")
+
+	data := make(map[string]interface{})
+	data["guest"] = guest
+
+	if form.Valid() {
+		guest.ID, err = m.DB.InsertGuest(guest)
+		if errors.Is(err, repository.ErrDuplicateEmail) {
+			form.Errors.Add("email", "An account with this email already exists")
+		} else if err != nil {
+			helpers.ServerError(w, err)
+			return
 		}
 	}
 
-	m.App.Session.Put(r.Context(), "flash", "Changes saved")
-	http.Redirect(w, r, fmt.Sprintf("/admin/reservations-calendar?y=%d&m=%d", year, month), http.StatusSeeOther)
+	if !form.Valid() {
+		render.Template(w, r, "guest-register.page.tmpl", &models.TemplateData{
+			Form: form,
+			Data: data,
+		})
+		return
+	}
+
+	_ = m.App.Session.RenewToken(r.Context())
+	m.App.Session.Put(r.Context(), "guest_id", guest.ID)
+	m.App.Session.Put(r.Context(), "flash", "Welcome! Your account has been created")
+	http.Redirect(w, r, "/guest/stays", http.StatusSeeOther)
+}
+
+// GuestLogin shows the guest login screen
+func (m *Repository) GuestLogin(w http.ResponseWriter, r *http.Request) {
+	render.Template(w, r, "guest-login.page.tmpl", &models.TemplateData{
+		Form: forms.New(nil),
+	})
+}
+
+// PostGuestLogin handles logging the guest in
+func (m *Repository) PostGuestLogin(w http.ResponseWriter, r *http.Request) {
+	_ = m.App.Session.RenewToken(r.Context())
 
+	err := r.ParseForm()
+	if err != nil {
+		log.Println(err)
+	}
+
+	email := r.Form.Get("email")
+	password := r.Form.Get("password")
+
+	form := forms.New(r.PostForm)
+	form.Required("email", "password")
+	form.IsEmail("email")
+	if !form.Valid() {
+		render.Template(w, r, "guest-login.page.tmpl", &models.TemplateData{
+			Form: form,
+		})
+		return
+	}
+
+	id, err := m.DB.AuthenticateGuest(email, password)
+	if err != nil {
+		log.Println(err)
+
+		m.App.Session.Put(r.Context(), "error", "Invalid login credentials")
+		http.Redirect(w, r, "/guest/login", http.StatusSeeOther)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "guest_id", id)
+	m.App.Session.Put(r.Context(), "flash", "Logged in successfully")
+	http.Redirect(w, r, "/guest/stays", http.StatusSeeOther)
+}
+
+// GuestLogOut logs a guest out, leaving any staff login in the same browser alone
+func (m *Repository) GuestLogOut(w http.ResponseWriter, r *http.Request) {
+	m.App.Session.Remove(r.Context(), "guest_id")
+	_ = m.App.Session.RenewToken(r.Context())
+
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// GuestStays lists the upcoming and past reservations of the logged-in guest
+func (m *Repository) GuestStays(w http.ResponseWriter, r *http.Request) {
+	guestID := m.App.Session.GetInt(r.Context(), "guest_id")
+
+	guest, err := m.DB.GetGuestByID(guestID)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	reservations, err := m.DB.GetReservationsForGuest(guestID)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	today := time.Now().Truncate(24 * time.Hour)
+	var upcoming, past []models.Reservation
+	for _, res := range reservations {
+		if res.EndDate.Before(today) {
+			past = append(past, res)
+		} else {
+			// the repository sorts latest first, upcoming stays read better soonest first
+			upcoming = append([]models.Reservation{res}, upcoming...)
+		}
+	}
+
+	data := make(map[string]interface{})
+	data["guest"] = guest
+	data["upcoming"] = upcoming
+	data["past"] = past
+
+	render.Template(w, r, "guest-stays.page.tmpl", &models.TemplateData{
+		Data: data,
+	})
+}
+
+// AdminUsers lists all staff users
+func (m *Repository) AdminUsers(w http.ResponseWriter, r *http.Request) {
+	users, err := m.DB.AllUsers()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["users"] = users
+
+	intMap := make(map[string]int)
+	intMap["current_user"] = m.App.Session.GetInt(r.Context(), "user_id")
+
+	render.Template(w, r, "admin-users.page.tmpl", &models.TemplateData{
+		Data:   data,
+		IntMap: intMap,
+	})
+}
+
+// AdminNewUser shows the form to invite a staff user
+func (m *Repository) AdminNewUser(w http.ResponseWriter, r *http.Request) {
+	data := make(map[string]interface{})
+	data["user"] = models.User{AccessLevel: rbac.FrontDesk}
+	data["roles"] = rbac.Roles
+
+	render.Template(w, r, "admin-user-new.page.tmpl", &models.TemplateData{
+		Form: forms.New(nil),
+		Data: data,
+	})
+}
+
+// PostAdminNewUser creates a staff user and emails them a link to set their password
+func (m *Repository) PostAdminNewUser(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	accessLevel, _ := strconv.Atoi(r.Form.Get("access_level"))
+	user := models.User{
+		FirstName:   r.Form.Get("first_name"),
+		LastName:    r.Form.Get("last_name"),
+		Email:       r.Form.Get("email"),
+		AccessLevel: accessLevel,
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("first_name", "last_name", "email")
+	form.IsEmail("email")
+	if _, ok := rbac.RoleFor(accessLevel); !ok {
+		form.Errors.Add("access_level", "Choose a role")
+	}
+
+	data := make(map[string]interface{})
+	data["user"] = user
+	data["roles"] = rbac.Roles
+
+	if form.Valid() {
+		// the user never learns this password, they set their own from the invitation link
+		user.Password, err = helpers.RandomString(32)
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+
+		user.ID, err = m.DB.InsertUser(user)
+		if errors.Is(err, repository.ErrDuplicateEmail) {
+			form.Errors.Add("email", "A user with this email already exists")
+		} else if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+	}
+
+	if !form.Valid() {
+		render.Template(w, r, "admin-user-new.page.tmpl", &models.TemplateData{
+			Form: form,
+			Data: data,
+		})
+		return
+	}
+
+	err = m.sendPasswordReset(user, "Your staff account", fmt.Sprintf(
+		"an account has been created for you as %s. Use the link below to choose your password.",
+		rbac.RoleName(user.AccessLevel)), inviteTTL)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", fmt.Sprintf("Invitation sent to %s", user.Email))
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+}
+
+// AdminShowUser shows a staff user for editing
+func (m *Repository) AdminShowUser(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		helpers.ClientError(w, http.StatusBadRequest)
+		return
+	}
+
+	user, err := m.DB.GetUserByID(id)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	sessions, err := m.DB.ActiveUserSessions(id, sessionsSince())
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["user"] = user
+	data["roles"] = rbac.Roles
+	data["sessions"] = sessions
+
+	intMap := make(map[string]int)
+	intMap["current_user"] = m.App.Session.GetInt(r.Context(), "user_id")
+
+	render.Template(w, r, "admin-user-show.page.tmpl", &models.TemplateData{
+		Form:   forms.New(nil),
+		Data:   data,
+		IntMap: intMap,
+	})
+}
+
+// PostAdminShowUser saves changes to a staff user
+func (m *Repository) PostAdminShowUser(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		helpers.ClientError(w, http.StatusBadRequest)
+		return
+	}
+
+	user, err := m.DB.GetUserByID(id)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	accessLevel, _ := strconv.Atoi(r.Form.Get("access_level"))
+	user.FirstName = r.Form.Get("first_name")
+	user.LastName = r.Form.Get("last_name")
+	user.Email = r.Form.Get("email")
+
+	form := forms.New(r.PostForm)
+	form.Required("first_name", "last_name", "email")
+	form.IsEmail("email")
+
+	// owners can't lock themselves out of user management
+	currentUser := m.App.Session.GetInt(r.Context(), "user_id")
+	if id == currentUser {
+		if r.Form.Get("access_level") != "" && accessLevel != user.AccessLevel {
+			form.Errors.Add("access_level", "You can't change your own role")
+		}
+		if r.Form.Get("disabled") != "" {
+			form.Errors.Add("disabled", "You can't disable your own account")
+		}
+	} else {
+		if _, ok := rbac.RoleFor(accessLevel); !ok {
+			form.Errors.Add("access_level", "Choose a role")
+		}
+		user.AccessLevel = accessLevel
+		user.Disabled = r.Form.Get("disabled") != ""
+	}
+
+	data := make(map[string]interface{})
+	data["user"] = user
+	data["roles"] = rbac.Roles
+
+	intMap := make(map[string]int)
+	intMap["current_user"] = currentUser
+
+	if form.Valid() {
+		err = m.DB.UpdateUser(user)
+		if errors.Is(err, repository.ErrDuplicateEmail) {
+			form.Errors.Add("email", "A user with this email already exists")
+		} else if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+	}
+
+	if !form.Valid() {
+		render.Template(w, r, "admin-user-show.page.tmpl", &models.TemplateData{
+			Form:   form,
+			Data:   data,
+			IntMap: intMap,
+		})
+		return
+	}
+
+	// a disabled user is signed out at once, not when their sessions expire
+	if user.Disabled {
+		err = m.logOutEverywhere(r.Context(), id)
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Changes saved")
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+}
+
+// AdminDeleteUser deletes a staff user
+func (m *Repository) AdminDeleteUser(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		helpers.ClientError(w, http.StatusBadRequest)
+		return
+	}
+
+	if id == m.App.Session.GetInt(r.Context(), "user_id") {
+		m.App.Session.Put(r.Context(), "error", "You can't delete your own account")
+		http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+		return
+	}
+
+	// sign the user out first, their session records go with the account
+	err = m.logOutEverywhere(r.Context(), id)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	err = m.DB.DeleteUser(id)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "User deleted")
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+}
+
+// how long emailed password links stay valid
+const (
+	passwordResetTTL = time.Hour
+	inviteTTL        = 72 * time.Hour
+)
+
+// sendPasswordReset emails a single use link to set a new password
+func (m *Repository) sendPasswordReset(user models.User, subject, intro string, ttl time.Duration) error {
+	token, err := helpers.RandomString(32)
+	if err != nil {
+		return err
+	}
+
+	err = m.DB.InsertPasswordReset(user.ID, helpers.HashToken(token), time.Now().Add(ttl))
+	if err != nil {
+		return err
+	}
+
+	link := fmt.Sprintf("%s/user/reset-password?token=%s", m.App.BaseURL, token)
+	htmlMessage := fmt.Sprintf(`
+		<strong>%s</strong><br>
+		Dear %s,<br>
+		%s<br>
+		<a href="%s">%s</a><br>
+		The link can be used once and expires on %s.
+	`, subject, user.FirstName, intro, link, link, time.Now().Add(ttl).Format("02-01-2006 15:04"))
+
+	msg := models.MailData{
+		To:       user.Email,
+		From:     "me@here.com",
+		Subject:  subject,
+		Content:  htmlMessage,
+		Template: "basic.html",
+	}
+	m.App.MailChan <- msg
+
+	return nil
+}
+
+// ForgotPassword shows the form to request a password reset link
+func (m *Repository) ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	render.Template(w, r, "forgot-password.page.tmpl", &models.TemplateData{
+		Form: forms.New(nil),
+	})
+}
+
+// PostForgotPassword emails a password reset link if the address belongs to an active user
+func (m *Repository) PostForgotPassword(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("email")
+	form.IsEmail("email")
+	if !form.Valid() {
+		render.Template(w, r, "forgot-password.page.tmpl", &models.TemplateData{
+			Form: form,
+		})
+		return
+	}
+
+	user, err := m.DB.GetUserByEmail(r.Form.Get("email"))
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	if err == nil && !user.Disabled {
+		err = m.sendPasswordReset(user, "Reset your password",
+			"someone asked to reset the password for your account. If it wasn't you, ignore this email.",
+			passwordResetTTL)
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+	}
+
+	// the same answer either way, so the form can't be used to find staff addresses
+	m.App.Session.Put(r.Context(), "flash", "If the address belongs to an account, a reset link is on its way")
+	http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+}
+
+// ResetPassword shows the form to choose a new password
+func (m *Repository) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+
+	_, err := m.DB.GetPasswordResetUserID(helpers.HashToken(token))
+	if errors.Is(err, repository.ErrInvalidToken) {
+		m.App.Session.Put(r.Context(), "error", "This link is invalid or has expired")
+		http.Redirect(w, r, "/user/forgot-password", http.StatusSeeOther)
+		return
+	} else if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	stringMap := make(map[string]string)
+	stringMap["token"] = token
+
+	render.Template(w, r, "reset-password.page.tmpl", &models.TemplateData{
+		Form:      forms.New(nil),
+		StringMap: stringMap,
+	})
+}
+
+// PostResetPassword sets the new password and logs the user out everywhere
+func (m *Repository) PostResetPassword(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	token := r.Form.Get("token")
+
+	form := forms.New(r.PostForm)
+	form.Required("password")
+	form.MinLength("password", 8)
+	form.Matches("password_confirm", "password")
+	if !form.Valid() {
+		stringMap := make(map[string]string)
+		stringMap["token"] = token
+
+		render.Template(w, r, "reset-password.page.tmpl", &models.TemplateData{
+			Form:      form,
+			StringMap: stringMap,
+		})
+		return
+	}
+
+	userID, err := m.DB.ResetPassword(helpers.HashToken(token), r.Form.Get("password"))
+	if errors.Is(err, repository.ErrInvalidToken) {
+		m.App.Session.Put(r.Context(), "error", "This link is invalid or has expired")
+		http.Redirect(w, r, "/user/forgot-password", http.StatusSeeOther)
+		return
+	} else if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	err = m.logOutEverywhere(r.Context(), userID)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	if m.App.Session.GetInt(r.Context(), "user_id") == userID {
+		_ = m.App.Session.RenewToken(r.Context())
+		m.App.Session.Remove(r.Context(), "user_id")
+		m.App.Session.Remove(r.Context(), "access_level")
+	}
+	m.App.Session.Put(r.Context(), "flash", "Your password has been changed, please log in")
+	http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+}
+
+// ShowLoginVerify shows the second step of the login, asking for a two-factor code
+func (m *Repository) ShowLoginVerify(w http.ResponseWriter, r *http.Request) {
+	if !m.App.Session.Exists(r.Context(), "mfa_user_id") {
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+
+	render.Template(w, r, "login-verify.page.tmpl", &models.TemplateData{
+		Form: forms.New(nil),
+	})
+}
+
+// PostLoginVerify checks the two-factor or recovery code and completes the login
+func (m *Repository) PostLoginVerify(w http.ResponseWriter, r *http.Request) {
+	userID := m.App.Session.GetInt(r.Context(), "mfa_user_id")
+	if userID == 0 {
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	user, err := m.DB.GetUserByID(userID)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	if user.IsLocked() {
+		m.App.Session.Remove(r.Context(), "mfa_user_id")
+		m.App.Session.Put(r.Context(), "error", "This account is locked after too many failed logins, try again later")
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+
+	ip := helpers.ClientIP(r)
+	attempt := models.LoginAttempt{Email: user.Email, UserID: userID, IP: ip}
+
+	code := strings.TrimSpace(r.Form.Get("code"))
+
+	valid, usedRecoveryCode, err := m.checkTwoFactorCode(user, code)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	if !valid {
+		attempt.Outcome = models.LoginBadCode
+		m.recordLoginAttempt(attempt)
+		err = m.recordFailedLogin(user, ip)
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+
+		m.App.Session.Put(r.Context(), "error", "Invalid code")
+		http.Redirect(w, r, "/user/login/verify", http.StatusSeeOther)
+		return
+	}
+
+	err = m.DB.ResetFailedLogins(userID)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	attempt.Outcome = models.LoginSucceeded
+	m.recordLoginAttempt(attempt)
+
+	err = m.logIn(r, user)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	if usedRecoveryCode {
+		m.App.Session.Put(r.Context(), "warning", "You used a recovery code, it can't be used again")
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// checkTwoFactorCode checks a code from the authenticator app or one of the recovery codes of the user,
+// which is used up when it matches
+func (m *Repository) checkTwoFactorCode(user models.User, code string) (valid, usedRecoveryCode bool, err error) {
+	// recovery codes have a dash in the middle, authenticator codes are all digits
+	if strings.Contains(code, "-") {
+		valid, err = m.DB.UseRecoveryCode(user.ID, strings.ToLower(code))
+		return valid, true, err
+	}
+
+	step, ok := totp.ValidateStep(user.TOTPSecret, code, time.Now())
+	if !ok {
+		return false, false, nil
+	}
+	// a code stays valid for a minute or so, but is only accepted once
+	valid, err = m.DB.UseTOTPStep(user.ID, step)
+	return valid, false, err
+}
+
+// twoFactorUserID returns the user setting up two-factor authentication, either
+// logged in or half way through a login that requires it
+func (m *Repository) twoFactorUserID(r *http.Request) int {
+	if id := m.App.Session.GetInt(r.Context(), "user_id"); id != 0 {
+		return id
+	}
+	return m.App.Session.GetInt(r.Context(), "mfa_user_id")
+}
+
+// TwoFactorSetup shows the two-factor status of the user and the enrolment QR code
+func (m *Repository) TwoFactorSetup(w http.ResponseWriter, r *http.Request) {
+	userID := m.twoFactorUserID(r)
+	if userID == 0 {
+		m.App.Session.Put(r.Context(), "error", "Log in first!")
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+
+	user, err := m.DB.GetUserByID(userID)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.renderTwoFactorSetup(w, r, user, forms.New(nil))
+}
+
+// renderTwoFactorSetup renders the setup page, keeping the pending secret in the session until it is confirmed
+func (m *Repository) renderTwoFactorSetup(w http.ResponseWriter, r *http.Request, user models.User, form *forms.Form) {
+	data := make(map[string]interface{})
+	stringMap := make(map[string]string)
+	intMap := make(map[string]int)
+
+	if user.TOTPEnabled {
+		intMap["enabled"] = 1
+	} else {
+		secret := m.App.Session.GetString(r.Context(), "totp_secret")
+		if secret == "" {
+			var err error
+			secret, err = totp.GenerateSecret()
+			if err != nil {
+				helpers.ServerError(w, err)
+				return
+			}
+			m.App.Session.Put(r.Context(), "totp_secret", secret)
+		}
+
+		png, err := totp.QRCode(totp.URL(invoice.DefaultIssuer.Name, user.Email, secret))
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+		data["qr"] = template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(png))
+		stringMap["secret"] = secret
+	}
+
+	if rbac.Requires2FA(user.AccessLevel) {
+		intMap["required"] = 1
+	}
+
+	render.Template(w, r, "two-factor-setup.page.tmpl", &models.TemplateData{
+		Form:      form,
+		Data:      data,
+		StringMap: stringMap,
+		IntMap:    intMap,
+	})
+}
+
+// PostTwoFactorSetup confirms the enrolment with a code from the app and shows the recovery codes
+func (m *Repository) PostTwoFactorSetup(w http.ResponseWriter, r *http.Request) {
+	userID := m.twoFactorUserID(r)
+	if userID == 0 {
+		m.App.Session.Put(r.Context(), "error", "Log in first!")
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	user, err := m.DB.GetUserByID(userID)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	secret := m.App.Session.GetString(r.Context(), "totp_secret")
+
+	form := forms.New(r.PostForm)
+	form.Required("code")
+	var step int64
+	if form.Valid() {
+		var ok bool
+		step, ok = totp.ValidateStep(secret, r.Form.Get("code"), time.Now())
+		if !ok {
+			form.Errors.Add("code", "That code doesn't match, check the time on your phone and try again")
+		}
+	}
+	if user.TOTPEnabled || !form.Valid() {
+		m.renderTwoFactorSetup(w, r, user, form)
+		return
+	}
+
+	// the code that turns on two-factor can't be used again to log in
+	fresh, err := m.DB.UseTOTPStep(userID, step)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	if !fresh {
+		form.Errors.Add("code", "That code was already used, wait for the next one")
+		m.renderTwoFactorSetup(w, r, user, form)
+		return
+	}
+
+	codes, err := totp.GenerateRecoveryCodes(10)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	err = m.DB.EnableTOTP(userID, secret, codes)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	m.App.Session.Remove(r.Context(), "totp_secret")
+
+	// finish a login that was waiting for enrolment
+	if !m.App.Session.Exists(r.Context(), "user_id") {
+		err = m.logIn(r, user)
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+	}
+
+	data := make(map[string]interface{})
+	data["codes"] = codes
+
+	render.Template(w, r, "two-factor-recovery.page.tmpl", &models.TemplateData{
+		Data: data,
+	})
+}
+
+// PostTwoFactorDisable turns off two-factor authentication for the logged in user, who confirms it
+// with a current code so a session left open can't be used to remove the second factor
+func (m *Repository) PostTwoFactorDisable(w http.ResponseWriter, r *http.Request) {
+	userID := m.App.Session.GetInt(r.Context(), "user_id")
+	if userID == 0 {
+		m.App.Session.Put(r.Context(), "error", "Log in first!")
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	user, err := m.DB.GetUserByID(userID)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	if rbac.Requires2FA(user.AccessLevel) {
+		m.App.Session.Put(r.Context(), "error", "Your role requires two-factor authentication")
+		http.Redirect(w, r, "/user/2fa/setup", http.StatusSeeOther)
+		return
+	}
+
+	if !user.TOTPEnabled {
+		http.Redirect(w, r, "/user/2fa/setup", http.StatusSeeOther)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("disable_code")
+	if form.Valid() {
+		valid, _, err := m.checkTwoFactorCode(user, strings.TrimSpace(r.Form.Get("disable_code")))
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+		if !valid {
+			// wrong codes count towards the lockout, as they do when logging in
+			err = m.recordFailedLogin(user, helpers.ClientIP(r))
+			if err != nil {
+				helpers.ServerError(w, err)
+				return
+			}
+			form.Errors.Add("disable_code", "Invalid code")
+		}
+	}
+	if !form.Valid() {
+		m.renderTwoFactorSetup(w, r, user, form)
+		return
+	}
+
+	err = m.DB.DisableTOTP(userID)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Two-factor authentication turned off")
+	http.Redirect(w, r, "/user/2fa/setup", http.StatusSeeOther)
+}
+
+// AdminResetTwoFactor removes the two-factor enrolment of a staff member who lost their device
+func (m *Repository) AdminResetTwoFactor(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		helpers.ClientError(w, http.StatusBadRequest)
+		return
+	}
+
+	if id == m.App.Session.GetInt(r.Context(), "user_id") {
+		m.App.Session.Put(r.Context(), "error", "Manage your own two-factor authentication from your account")
+		http.Redirect(w, r, fmt.Sprintf("/admin/users/%d", id), http.StatusSeeOther)
+		return
+	}
+
+	err = m.DB.DisableTOTP(id)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	// any session opened with the old device must log in again
+	err = m.logOutEverywhere(r.Context(), id)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Two-factor authentication reset, the user enrols again at next login")
+	http.Redirect(w, r, fmt.Sprintf("/admin/users/%d", id), http.StatusSeeOther)
+}
+
+// AdminLoginActivity shows locked accounts and the latest login attempts
+func (m *Repository) AdminLoginActivity(w http.ResponseWriter, r *http.Request) {
+	locked, err := m.DB.LockedUsers()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	attempts, err := m.DB.RecentLoginAttempts(200)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["locked"] = locked
+	data["attempts"] = attempts
+
+	render.Template(w, r, "admin-login-activity.page.tmpl", &models.TemplateData{
+		Data: data,
+	})
+}
+
+// AdminUnlockUser lifts the lockout of a staff user
+func (m *Repository) AdminUnlockUser(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		helpers.ClientError(w, http.StatusBadRequest)
+		return
+	}
+
+	err = m.DB.UnlockUser(id)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Account unlocked")
+	http.Redirect(w, r, "/admin/login-activity", http.StatusSeeOther)
+}
+
+// sessionsSince is how far back a login must have been seen to still count as active
+func sessionsSince() time.Time {
+	return time.Now().Add(-24 * time.Hour)
+}
+
+// AdminAccount shows the logged in user their active sessions
+func (m *Repository) AdminAccount(w http.ResponseWriter, r *http.Request) {
+	userID := m.App.Session.GetInt(r.Context(), "user_id")
+
+	user, err := m.DB.GetUserByID(userID)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	sessions, err := m.DB.ActiveUserSessions(userID, sessionsSince())
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["user"] = user
+	data["sessions"] = sessions
+
+	stringMap := make(map[string]string)
+	stringMap["current_session"] = m.App.Session.GetString(r.Context(), "session_id")
+
+	render.Template(w, r, "admin-account.page.tmpl", &models.TemplateData{
+		Data:      data,
+		StringMap: stringMap,
+	})
+}
+
+// AdminRevokeSession signs the logged in user out of one of their other sessions
+func (m *Repository) AdminRevokeSession(w http.ResponseWriter, r *http.Request) {
+	sessionID := chi.URLParam(r, "sessionID")
+	if sessionID == m.App.Session.GetString(r.Context(), "session_id") {
+		http.Redirect(w, r, "/user/logout", http.StatusSeeOther)
+		return
+	}
+
+	err := m.DB.RevokeUserSession(m.App.Session.GetInt(r.Context(), "user_id"), sessionID)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Session signed out")
+	http.Redirect(w, r, "/admin/account", http.StatusSeeOther)
+}
+
+// AdminRevokeOtherSessions signs the logged in user out everywhere except the current session
+func (m *Repository) AdminRevokeOtherSessions(w http.ResponseWriter, r *http.Request) {
+	err := m.DB.RevokeUserSessions(m.App.Session.GetInt(r.Context(), "user_id"),
+		m.App.Session.GetString(r.Context(), "session_id"))
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Signed out everywhere else")
+	http.Redirect(w, r, "/admin/account", http.StatusSeeOther)
+}
+
+// AdminLogOutUser signs a staff member out of all their sessions
+func (m *Repository) AdminLogOutUser(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		helpers.ClientError(w, http.StatusBadRequest)
+		return
+	}
+
+	if id == m.App.Session.GetInt(r.Context(), "user_id") {
+		m.App.Session.Put(r.Context(), "error", "Sign out of your own sessions from your account")
+		http.Redirect(w, r, fmt.Sprintf("/admin/users/%d", id), http.StatusSeeOther)
+		return
+	}
+
+	err = m.logOutEverywhere(r.Context(), id)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "User signed out of all sessions")
+	http.Redirect(w, r, fmt.Sprintf("/admin/users/%d", id), http.StatusSeeOther)
+}
+
+// apiKeyExpiries are the lifetimes in days offered when issuing an API key, 0 never expires
+var apiKeyExpiries = []int{30, 90, 365, 0}
+
+// AdminAPIKeys lists the API keys with how much they are used
+func (m *Repository) AdminAPIKeys(w http.ResponseWriter, r *http.Request) {
+	keys, err := m.DB.AllAPIKeys()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["keys"] = keys
+
+	render.Template(w, r, "admin-api-keys.page.tmpl", &models.TemplateData{
+		Data: data,
+	})
+}
+
+// AdminNewAPIKey shows the form to issue an API key
+func (m *Repository) AdminNewAPIKey(w http.ResponseWriter, r *http.Request) {
+	m.renderNewAPIKey(w, r, "", map[string]bool{}, 90, forms.New(nil))
+}
+
+func (m *Repository) renderNewAPIKey(w http.ResponseWriter, r *http.Request, name string, selected map[string]bool, expiresIn int, form *forms.Form) {
+	data := make(map[string]interface{})
+	data["scopes"] = apikey.Scopes
+	data["selected"] = selected
+	data["expiries"] = apiKeyExpiries
+
+	stringMap := make(map[string]string)
+	stringMap["name"] = name
+
+	intMap := make(map[string]int)
+	intMap["expires_in"] = expiresIn
+
+	render.Template(w, r, "admin-api-key-new.page.tmpl", &models.TemplateData{
+		Form:      form,
+		Data:      data,
+		StringMap: stringMap,
+		IntMap:    intMap,
+	})
+}
+
+// PostAdminNewAPIKey issues an API key and shows it, the only time it can be seen
+func (m *Repository) PostAdminNewAPIKey(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	key := models.APIKey{
+		Name:      strings.TrimSpace(r.Form.Get("name")),
+		Scopes:    r.Form["scopes"],
+		CreatedBy: m.App.Session.GetInt(r.Context(), "user_id"),
+	}
+	expiresIn, err := strconv.Atoi(r.Form.Get("expires_in"))
+	if err != nil {
+		expiresIn = -1
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("name")
+
+	selected := make(map[string]bool)
+	for _, s := range key.Scopes {
+		if !apikey.Valid(s) {
+			form.Errors.Add("scopes", "Unknown scope")
+		}
+		selected[s] = true
+	}
+	if len(key.Scopes) == 0 {
+		form.Errors.Add("scopes", "Choose at least one scope")
+	}
+
+	validExpiry := false
+	for _, days := range apiKeyExpiries {
+		if days == expiresIn {
+			validExpiry = true
+		}
+	}
+	if !validExpiry {
+		form.Errors.Add("expires_in", "Choose when the key expires")
+	}
+
+	if !form.Valid() {
+		m.renderNewAPIKey(w, r, key.Name, selected, expiresIn, form)
+		return
+	}
+
+	plain, prefix, hash, err := apikey.Generate()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	key.Prefix = prefix
+	key.KeyHash = hash
+	if expiresIn > 0 {
+		key.ExpiresAt = time.Now().AddDate(0, 0, expiresIn)
+	}
+
+	key.ID, err = m.DB.InsertAPIKey(key)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["key"] = key
+
+	stringMap := make(map[string]string)
+	stringMap["plain_key"] = plain
+
+	render.Template(w, r, "admin-api-key-created.page.tmpl", &models.TemplateData{
+		Data:      data,
+		StringMap: stringMap,
+	})
+}
+
+// AdminRevokeAPIKey stops an API key from working
+func (m *Repository) AdminRevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		helpers.ClientError(w, http.StatusBadRequest)
+		return
+	}
+
+	err = m.DB.RevokeAPIKey(id)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "API key revoked")
+	http.Redirect(w, r, "/admin/api-keys", http.StatusSeeOther)
+}
+
+// webhookDeliveryLogSize is how many of a webhook's latest deliveries are shown
+const webhookDeliveryLogSize = 50
+
+// AdminWebhooks lists the webhooks
+func (m *Repository) AdminWebhooks(w http.ResponseWriter, r *http.Request) {
+	hooks, err := m.DB.AllWebhooks()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["webhooks"] = hooks
+
+	render.Template(w, r, "admin-webhooks.page.tmpl", &models.TemplateData{
+		Data: data,
+	})
+}
+
+// AdminNewWebhook shows the form to add a webhook
+func (m *Repository) AdminNewWebhook(w http.ResponseWriter, r *http.Request) {
+	m.renderWebhook(w, r, models.Webhook{Active: true}, nil, forms.New(nil))
+}
+
+func (m *Repository) renderWebhook(w http.ResponseWriter, r *http.Request, hook models.Webhook, deliveries []models.WebhookDelivery, form *forms.Form) {
+	selected := make(map[string]bool)
+	for _, e := range hook.Events {
+		selected[e] = true
+	}
+
+	data := make(map[string]interface{})
+	data["webhook"] = hook
+	data["types"] = events.Types
+	data["selected"] = selected
+	data["deliveries"] = deliveries
+
+	render.Template(w, r, "admin-webhook.page.tmpl", &models.TemplateData{
+		Form: form,
+		Data: data,
+	})
+}
+
+// webhookFromForm reads and validates the fields of the webhook form into hook
+func webhookFromForm(r *http.Request, hook models.Webhook) (models.Webhook, *forms.Form) {
+	hook.URL = strings.TrimSpace(r.Form.Get("url"))
+	hook.Description = strings.TrimSpace(r.Form.Get("description"))
+	hook.Events = r.Form["events"]
+	hook.Active = r.Form.Get("active") != ""
+
+	form := forms.New(r.PostForm)
+	form.Required("url")
+	if hook.URL != "" {
+		u, err := url.Parse(hook.URL)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			form.Errors.Add("url", "Must be an http or https URL")
+		}
+	}
+	for _, e := range hook.Events {
+		if !events.ValidType(e) {
+			form.Errors.Add("events", "Unknown event")
+		}
+	}
+	if len(hook.Events) == 0 {
+		form.Errors.Add("events", "Choose at least one event")
+	}
+
+	return hook, form
+}
+
+// PostAdminNewWebhook adds a webhook with a new signing secret
+func (m *Repository) PostAdminNewWebhook(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	hook, form := webhookFromForm(r, models.Webhook{})
+	if !form.Valid() {
+		m.renderWebhook(w, r, hook, nil, form)
+		return
+	}
+
+	hook.Secret, err = webhook.GenerateSecret()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	hook.ID, err = m.DB.InsertWebhook(hook)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Webhook added, use the secret below to check the signatures")
+	http.Redirect(w, r, fmt.Sprintf("/admin/webhooks/%d", hook.ID), http.StatusSeeOther)
+}
+
+// AdminShowWebhook shows a webhook with its latest deliveries
+func (m *Repository) AdminShowWebhook(w http.ResponseWriter, r *http.Request) {
+	hook, ok := m.webhookFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	deliveries, err := m.DB.WebhookDeliveries(hook.ID, webhookDeliveryLogSize)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.renderWebhook(w, r, hook, deliveries, forms.New(nil))
+}
+
+// PostAdminShowWebhook saves a webhook
+func (m *Repository) PostAdminShowWebhook(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	hook, ok := m.webhookFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	hook, form := webhookFromForm(r, hook)
+	if !form.Valid() {
+		deliveries, err := m.DB.WebhookDeliveries(hook.ID, webhookDeliveryLogSize)
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+		m.renderWebhook(w, r, hook, deliveries, form)
+		return
+	}
+
+	err = m.DB.UpdateWebhook(hook)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Changes saved")
+	http.Redirect(w, r, fmt.Sprintf("/admin/webhooks/%d", hook.ID), http.StatusSeeOther)
+}
+
+// webhookFromURL loads the webhook of the id url parameter, writing an error response if it can't
+func (m *Repository) webhookFromURL(w http.ResponseWriter, r *http.Request) (models.Webhook, bool) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		helpers.ClientError(w, http.StatusBadRequest)
+		return models.Webhook{}, false
+	}
+
+	hook, err := m.DB.GetWebhookByID(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		helpers.ClientError(w, http.StatusNotFound)
+		return hook, false
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return hook, false
+	}
+	return hook, true
+}
+
+// AdminDeleteWebhook deletes a webhook and its delivery log
+func (m *Repository) AdminDeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		helpers.ClientError(w, http.StatusBadRequest)
+		return
+	}
+
+	err = m.DB.DeleteWebhook(id)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Webhook deleted")
+	http.Redirect(w, r, "/admin/webhooks", http.StatusSeeOther)
+}
+
+// AdminRedeliverWebhook queues a delivery to be sent again
+func (m *Repository) AdminRedeliverWebhook(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		helpers.ClientError(w, http.StatusBadRequest)
+		return
+	}
+	deliveryID, err := strconv.Atoi(chi.URLParam(r, "deliveryID"))
+	if err != nil {
+		helpers.ClientError(w, http.StatusBadRequest)
+		return
+	}
+
+	err = m.DB.RedeliverWebhookDelivery(id, deliveryID)
+	if errors.Is(err, sql.ErrNoRows) {
+		m.App.Session.Put(r.Context(), "error", "Delivery not found")
+		http.Redirect(w, r, fmt.Sprintf("/admin/webhooks/%d", id), http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Delivery queued, it is sent within a few seconds")
+	http.Redirect(w, r, fmt.Sprintf("/admin/webhooks/%d", id), http.StatusSeeOther)
+}
+
+// calendarFeedHistory is how far back calendar feeds go
+const calendarFeedHistory = 365 * 24 * time.Hour
+
+// ICalFeed serves a calendar feed in iCalendar format. The token in the URL is the only credential,
+// so that calendar apps and booking sites can subscribe to it
+func (m *Repository) ICalFeed(w http.ResponseWriter, r *http.Request) {
+	feed, err := m.DB.GetCalendarFeedByToken(chi.URLParam(r, "token"))
+	if errors.Is(err, sql.ErrNoRows) {
+		helpers.ClientError(w, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	restrictions, err := m.DB.RestrictionsForFeed(feed.RoomID, time.Now().Add(-calendarFeedHistory))
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	host := "bookings"
+	if u, err := url.Parse(m.App.BaseURL); err == nil && u.Hostname() != "" {
+		host = u.Hostname()
+	}
+
+	cal := ical.Calendar{Name: "All rooms"}
+	if feed.RoomID != 0 {
+		cal.Name = feed.Room.RoomName
+	}
+
+	for _, rr := range restrictions {
+		e := ical.Event{
+			Start: rr.StartDate,
+			End:   rr.EndDate,
+			Stamp: rr.UpdatedAt,
+		}
+		if e.Stamp.IsZero() {
+			e.Stamp = time.Now()
+		}
+
+		// uids must not change when a feed is fetched again, or calendars show the event twice
+		if rr.ReservationID != 0 {
+			e.UID = fmt.Sprintf("reservation-%d@%s", rr.ReservationID, host)
+			e.Summary = "Reserved"
+			if feed.ShowGuestNames {
+				e.Summary = fmt.Sprintf("%s %s", rr.Reservation.FirstName, rr.Reservation.LastName)
+			}
+		} else {
+			e.UID = fmt.Sprintf("block-%d@%s", rr.ID, host)
+			e.Summary = "Blocked"
+		}
+		if feed.RoomID == 0 {
+			e.Summary = fmt.Sprintf("%s: %s", rr.Room.RoomName, e.Summary)
+		}
+
+		cal.Events = append(cal.Events, e)
+	}
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Content-Disposition", `inline; filename="bookings.ics"`)
+	w.Header().Set("Cache-Control", "private, max-age=300")
+	_, err = cal.WriteTo(w)
+	if err != nil {
+		m.App.ErrorLog.Println(err)
+	}
+}
+
+// AdminCalendarFeeds lists the calendar feeds with the form to add one
+func (m *Repository) AdminCalendarFeeds(w http.ResponseWriter, r *http.Request) {
+	m.renderCalendarFeeds(w, r, models.CalendarFeed{}, forms.New(nil))
+}
+
+func (m *Repository) renderCalendarFeeds(w http.ResponseWriter, r *http.Request, feed models.CalendarFeed, form *forms.Form) {
+	feeds, err := m.DB.AllCalendarFeeds()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	rooms, err := m.DB.AllRooms()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["feeds"] = feeds
+	data["rooms"] = rooms
+	data["feed"] = feed
+
+	stringMap := make(map[string]string)
+	stringMap["base_url"] = m.App.BaseURL
+
+	render.Template(w, r, "admin-calendar-feeds.page.tmpl", &models.TemplateData{
+		Form:      form,
+		Data:      data,
+		StringMap: stringMap,
+	})
+}
+
+// PostAdminCalendarFeeds adds a calendar feed with a new secret URL
+func (m *Repository) PostAdminCalendarFeeds(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	roomID, _ := strconv.Atoi(r.Form.Get("room_id"))
+	feed := models.CalendarFeed{
+		Name:           strings.TrimSpace(r.Form.Get("name")),
+		RoomID:         roomID,
+		ShowGuestNames: r.Form.Get("show_guest_names") != "",
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("name")
+	if feed.RoomID != 0 {
+		_, err := m.DB.GetRoomByID(feed.RoomID)
+		if errors.Is(err, sql.ErrNoRows) {
+			form.Errors.Add("room_id", "Choose a room")
+		} else if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+	}
+
+	if !form.Valid() {
+		m.renderCalendarFeeds(w, r, feed, form)
+		return
+	}
+
+	feed.Token, err = helpers.RandomString(24)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	_, err = m.DB.InsertCalendarFeed(feed)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Calendar feed added")
+	http.Redirect(w, r, "/admin/calendar-feeds", http.StatusSeeOther)
+}
+
+// AdminDeleteCalendarFeed deletes a calendar feed, anyone subscribed to it stops getting updates
+func (m *Repository) AdminDeleteCalendarFeed(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		helpers.ClientError(w, http.StatusBadRequest)
+		return
+	}
+
+	err = m.DB.DeleteCalendarFeed(id)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Calendar feed deleted")
+	http.Redirect(w, r, "/admin/calendar-feeds", http.StatusSeeOther)
+}
+
+// AdminCalendarImports lists the external calendars imported as blocks, their conflicts with
+// reservations and the form to add one
+func (m *Repository) AdminCalendarImports(w http.ResponseWriter, r *http.Request) {
+	m.renderCalendarImports(w, r, models.CalendarSource{}, forms.New(nil))
+}
+
+func (m *Repository) renderCalendarImports(w http.ResponseWriter, r *http.Request, src models.CalendarSource, form *forms.Form) {
+	sources, err := m.DB.AllCalendarSources()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	conflicts, err := m.DB.CalendarConflicts(0)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	rooms, err := m.DB.AllRooms()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["sources"] = sources
+	data["conflicts"] = conflicts
+	data["rooms"] = rooms
+	data["source"] = src
+
+	render.Template(w, r, "admin-calendar-imports.page.tmpl", &models.TemplateData{
+		Form: form,
+		Data: data,
+	})
+}
+
+// PostAdminCalendarImports adds an external calendar and imports it right away
+func (m *Repository) PostAdminCalendarImports(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	roomID, _ := strconv.Atoi(r.Form.Get("room_id"))
+	src := models.CalendarSource{
+		Name:   strings.TrimSpace(r.Form.Get("name")),
+		RoomID: roomID,
+		URL:    strings.TrimSpace(r.Form.Get("url")),
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("name", "url")
+	if src.URL != "" {
+		u, err := url.Parse(src.URL)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http" && u.Scheme != "webcal") || u.Host == "" {
+			form.Errors.Add("url", "Must be an http, https or webcal URL")
+		}
+	}
+	src.Room, err = m.DB.GetRoomByID(src.RoomID)
+	if errors.Is(err, sql.ErrNoRows) {
+		form.Errors.Add("room_id", "Choose a room")
+	} else if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	if !form.Valid() {
+		m.renderCalendarImports(w, r, src, form)
+		return
+	}
+
+	src.ID, err = m.DB.InsertCalendarSource(src)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.syncCalendarSource(r, src)
+	http.Redirect(w, r, "/admin/calendar-imports", http.StatusSeeOther)
+}
+
+// AdminSyncCalendarImport imports an external calendar now instead of waiting for the scheduler
+func (m *Repository) AdminSyncCalendarImport(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		helpers.ClientError(w, http.StatusBadRequest)
+		return
+	}
+
+	src, err := m.DB.GetCalendarSourceByID(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		helpers.ClientError(w, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.syncCalendarSource(r, src)
+	http.Redirect(w, r, "/admin/calendar-imports", http.StatusSeeOther)
+}
+
+// syncCalendarSource imports an external calendar and puts the outcome in the session
+func (m *Repository) syncCalendarSource(r *http.Request, src models.CalendarSource) {
+	res, err := calsync.New(m.App, m.DB).Sync(src)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", fmt.Sprintf("Couldn't import %s: %s", src.Name, err))
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", fmt.Sprintf("%s imported: %d added, %d updated, %d removed",
+		src.Name, res.Added, res.Updated, res.Removed))
+	if len(res.Conflicts) > 0 {
+		m.App.Session.Put(r.Context(), "warning", fmt.Sprintf("%s overlaps %d reservations", src.Name, len(res.Conflicts)))
+	}
+}
+
+// AdminDeleteCalendarImport deletes an external calendar, the dates it blocked are freed
+func (m *Repository) AdminDeleteCalendarImport(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		helpers.ClientError(w, http.StatusBadRequest)
+		return
+	}
+
+	removed, err := m.DB.DeleteCalendarSource(id)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	for _, b := range removed {
+		m.App.Events.PublishBlock(events.BlockRemoved, b)
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Calendar deleted, the dates it blocked are free again")
+	http.Redirect(w, r, "/admin/calendar-imports", http.StatusSeeOther)
+}
+
+// sentWriter records whether anything was written through it
+type sentWriter struct {
+	w    io.Writer
+	sent bool
+}
+
+func (sw *sentWriter) Write(p []byte) (int, error) {
+	sw.sent = true
+	return sw.w.Write(p)
+}
+
+// AdminExportReservations downloads the reservations selected by the filters of the reservation
+// lists as CSV or XLSX, with a totals row. Rows are streamed from the database to the client
+func (m *Repository) AdminExportReservations(w http.ResponseWriter, r *http.Request) {
+	filter := reservationFilterFromQuery(r.URL.Query())
+
+	// buffer the start of the file, so that an error before much is written can still be reported
+	sw := &sentWriter{w: w}
+	bw := bufio.NewWriterSize(sw, 64*1024)
+
+	var ew export.Writer
+	filename := "reservations-" + time.Now().Format("2006-01-02")
+	switch r.URL.Query().Get("format") {
+	case "csv":
+		ew = export.NewCSV(bw)
+		filename += ".csv"
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	case "xlsx":
+		ew = export.NewXLSX(bw, "Reservations")
+		filename += ".xlsx"
+		w.Header().Set("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
+	default:
+		helpers.ClientError(w, http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+
+	err := ew.Header("ID", "Room", "First Name", "Last Name", "Email", "Phone", "Arrival", "Departure",
+		"Nights", "Status", "Total", "Booked")
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	var count, nights, total int
+	err = m.DB.EachReservation(filter, func(res models.Reservation) error {
+		count++
+		nights += res.Nights()
+		total += res.TotalAmount
+		return ew.Row(
+			export.Int(res.ID),
+			export.String(res.Room.RoomName),
+			export.String(res.FirstName),
+			export.String(res.LastName),
+			export.String(res.Email),
+			export.String(res.Phone),
+			export.Date(res.StartDate),
+			export.Date(res.EndDate),
+			export.Int(res.Nights()),
+			export.String(res.Status()),
+			export.Amount(res.TotalAmount),
+			export.Date(res.CreatedAt),
+		)
+	})
+	if err == nil {
+		err = ew.Row(
+			export.String(fmt.Sprintf("Total (%d)", count)),
+			export.String(""), export.String(""), export.String(""), export.String(""), export.String(""),
+			export.String(""), export.String(""),
+			export.Int(nights),
+			export.String(""),
+			export.Amount(total),
+		)
+	}
+	if err == nil {
+		err = ew.Close()
+	}
+	if err != nil {
+		if !sw.sent {
+			w.Header().Del("Content-Disposition")
+			helpers.ServerError(w, err)
+			return
+		}
+		// the client already has part of the file, all that can be done is to cut it short
+		m.App.ErrorLog.Println(err)
+		return
+	}
+
+	err = bw.Flush()
+	if err != nil {
+		m.App.ErrorLog.Println(err)
+	}
+}
+
+// maxImportSize is the largest file of reservations that can be uploaded
+const maxImportSize = 5 << 20
+
+// AdminImportReservations shows the form to upload a file of reservations
+func (m *Repository) AdminImportReservations(w http.ResponseWriter, r *http.Request) {
+	m.renderImportReservations(w, r, nil, forms.New(nil))
+}
+
+func (m *Repository) renderImportReservations(w http.ResponseWriter, r *http.Request, report *importer.Report, form *forms.Form) {
+	data := make(map[string]interface{})
+	data["columns"] = importer.Columns
+	if report != nil {
+		data["report"] = report
+	}
+
+	render.Template(w, r, "admin-import-reservations.page.tmpl", &models.TemplateData{
+		Form: form,
+		Data: data,
+	})
+}
+
+// PostAdminImportReservations checks an uploaded file of reservations and lists what is wrong with
+// each row. When the Import button was used, the valid rows are also imported
+func (m *Repository) PostAdminImportReservations(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportSize)
+	err := r.ParseMultipartForm(maxImportSize)
+	if err != nil {
+		helpers.ClientError(w, http.StatusBadRequest)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	file, _, err := r.FormFile("file")
+	if errors.Is(err, http.ErrMissingFile) {
+		form.Errors.Add("file", "Choose a CSV file")
+		m.renderImportReservations(w, r, nil, form)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	defer file.Close()
+
+	report, err := importer.Run(m.DB, file, r.PostForm.Get("commit") != "")
+	if errors.Is(err, repository.ErrRoomNotAvailable) {
+		// a room was booked between the checks and the import
+		form.Errors.Add("file", "Nothing was imported, a room was booked meanwhile. Check the file again")
+		m.renderImportReservations(w, r, &report, form)
+		return
+	}
+	var fileErr *importer.FileError
+	if errors.As(err, &fileErr) {
+		form.Errors.Add("file", err.Error())
+		m.renderImportReservations(w, r, nil, form)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	if report.Committed {
+		for _, row := range report.Rows {
+			if row.Valid() {
+				m.App.Events.Publish(events.ReservationCreated, row.Reservation)
+			}
+		}
+	}
+
+	m.renderImportReservations(w, r, &report, form)
+}
+
+const (
+	// minGuestSearch is the fewest characters a guest search needs
+	minGuestSearch = 2
+	// guestSearchLimit is the most reservations a guest search shows
+	guestSearchLimit = 50
+)
+
+// AdminSearch finds reservations by guest name, email address, phone number or confirmation code,
+// and shows them grouped into upcoming, current and past stays
+func (m *Repository) AdminSearch(w http.ResponseWriter, r *http.Request) {
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+
+	stringMap := make(map[string]string)
+	stringMap["query"] = query
+	data := make(map[string]interface{})
+	intMap := make(map[string]int)
+
+	if utf8.RuneCountInString(query) >= minGuestSearch {
+		reservations, err := m.DB.SearchReservations(query, guestSearchLimit)
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+
+		now := time.Now()
+		today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+
+		// guests leaving today are still staying
+		var upcoming, current, past []models.Reservation
+		for _, res := range reservations {
+			switch {
+			case res.StartDate.After(today):
+				upcoming = append(upcoming, res)
+			case !res.EndDate.Before(today):
+				current = append(current, res)
+			default:
+				past = append(past, res)
+			}
+		}
+
+		data["upcoming"] = upcoming
+		data["current"] = current
+		data["past"] = past
+		intMap["found"] = len(reservations)
+		intMap["searched"] = 1
+	}
+
+	render.Template(w, r, "admin-search.page.tmpl", &models.TemplateData{
+		StringMap: stringMap,
+		IntMap:    intMap,
+		Data:      data,
+	})
+}
+
+// moveRequest is the body of a reservation move from the timeline calendar
+type moveRequest struct {
+	RoomID    int    `json:"room_id"`
+	StartDate string `json:"start_date"`
+	EndDate   string `json:"end_date"`
+}
+
+// moveConflict is a stay or block in the way of a reservation move
+type moveConflict struct {
+	Kind          string `json:"kind"`
+	ReservationID int    `json:"reservation_id,omitempty"`
+	StartDate     string `json:"start_date"`
+	EndDate       string `json:"end_date"`
+}
+
+// AdminMoveReservation moves a reservation to another room or other dates, as dragged on the timeline
+// calendar. It answers in JSON, with the stays and blocks in the way when the room is taken
+func (m *Repository) AdminMoveReservation(w http.ResponseWriter, r *http.Request) {
+	id, ok := apiID(w, r, "Reservation")
+	if !ok {
+		return
+	}
+
+	var req moveRequest
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(&req)
+	if err != nil {
+		helpers.ErrorJSON(w, http.StatusBadRequest, helpers.APIError{
+			Code:    "invalid_body",
+			Message: fmt.Sprintf("The request body is not valid JSON: %s", err),
+		})
+		return
+	}
+
+	fields := make(map[string]string)
+	start, err := time.Parse(apiDateLayout, req.StartDate)
+	if err != nil {
+		fields["start_date"] = "Must be a date such as 2050-01-31"
+	}
+	end, err := time.Parse(apiDateLayout, req.EndDate)
+	if err != nil {
+		fields["end_date"] = "Must be a date such as 2050-01-31"
+	}
+	if len(fields) == 0 && !end.After(start) {
+		fields["end_date"] = "Must be after start_date"
+	}
+	room, err := m.DB.GetRoomByID(req.RoomID)
+	if errors.Is(err, sql.ErrNoRows) {
+		fields["room_id"] = "No such room"
+	} else if err != nil {
+		helpers.ServerErrorJSON(w, err)
+		return
+	}
+	if len(fields) > 0 {
+		apiValidationError(w, fields)
+		return
+	}
+
+	conflicts, err := m.DB.MoveReservation(id, req.RoomID, start, end)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		apiNotFound(w, "Reservation")
+		return
+	case errors.Is(err, repository.ErrAlreadyCancelled):
+		helpers.ErrorJSON(w, http.StatusConflict, helpers.APIError{
+			Code:    "cancelled",
+			Message: "Cancelled reservations can't be moved",
+		})
+		return
+	case errors.Is(err, repository.ErrRoomNotAvailable):
+		out := make([]moveConflict, 0, len(conflicts))
+		for _, c := range conflicts {
+			kind := "block"
+			if c.ReservationID > 0 {
+				kind = "reservation"
+			} else if c.RestrictionID == models.ExternalRestrictionID {
+				kind = "external"
+			}
+			out = append(out, moveConflict{
+				Kind:          kind,
+				ReservationID: c.ReservationID,
+				StartDate:     c.StartDate.Format(apiDateLayout),
+				EndDate:       c.EndDate.Format(apiDateLayout),
+			})
+		}
+		helpers.WriteJSON(w, http.StatusConflict, map[string]interface{}{
+			"error": helpers.APIError{
+				Code:    "not_available",
+				Message: fmt.Sprintf("%s is not available for these dates", room.RoomName),
+			},
+			"conflicts": out,
+		})
+		return
+	case err != nil:
+		helpers.ServerErrorJSON(w, err)
+		return
+	}
+
+	res, err := m.DB.GetReservationByID(id)
+	if err != nil {
+		helpers.ServerErrorJSON(w, err)
+		return
+	}
+	m.App.Events.Publish(events.ReservationModified, res)
+
+	helpers.WriteJSON(w, http.StatusOK, map[string]interface{}{
+		"reservation": newAPIReservation(res),
+	})
+}
+
+// AdminNewReservation shows the form to book a room for a guest, such as a phone or walk-in booking.
+// The room_id and start query parameters prefill it, as when it is opened from the calendar
+func (m *Repository) AdminNewReservation(w http.ResponseWriter, r *http.Request) {
+	res := models.Reservation{}
+	res.RoomID, _ = strconv.Atoi(r.URL.Query().Get("room_id"))
+
+	start, err := time.Parse(apiDateLayout, r.URL.Query().Get("start"))
+	if err != nil {
+		now := time.Now()
+		start = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	}
+	res.StartDate, res.EndDate = start, start.AddDate(0, 0, 1)
+
+	stringMap := map[string]string{
+		"start_date": res.StartDate.Format(apiDateLayout),
+		"end_date":   res.EndDate.Format(apiDateLayout),
+		"status":     models.ReservationNew,
+		"send_email": "1",
+	}
+	m.renderNewReservation(w, r, res, stringMap, forms.New(nil))
+}
+
+func (m *Repository) renderNewReservation(w http.ResponseWriter, r *http.Request, res models.Reservation,
+	stringMap map[string]string, form *forms.Form) {
+	rooms, err := m.DB.AllRooms()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["reservation"] = res
+	data["rooms"] = rooms
+
+	render.Template(w, r, "admin-new-reservation.page.tmpl", &models.TemplateData{
+		Form:      form,
+		StringMap: stringMap,
+		Data:      data,
+	})
+}
+
+// PostAdminNewReservation books a room for a guest from the admin form. The email address is only
+// needed when the guest is to be sent a confirmation
+func (m *Repository) PostAdminNewReservation(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	res := models.Reservation{
+		FirstName: r.Form.Get("first_name"),
+		LastName:  r.Form.Get("last_name"),
+		Email:     r.Form.Get("email"),
+		Phone:     r.Form.Get("phone"),
+	}
+	res.RoomID, _ = strconv.Atoi(r.Form.Get("room_id"))
+	sendEmail := form.Has("send_email")
+	status := r.Form.Get("status")
+
+	stringMap := map[string]string{
+		"start_date": r.Form.Get("start_date"),
+		"end_date":   r.Form.Get("end_date"),
+		"status":     status,
+		"send_email": r.Form.Get("send_email"),
+	}
+
+	form.Required("first_name", "last_name", "start_date", "end_date")
+	if form.Has("email") {
+		form.IsEmail("email")
+	} else if sendEmail {
+		form.Errors.Add("email", "An email address is needed to send the confirmation")
+	}
+
+	switch status {
+	case models.ReservationNew:
+	case models.ReservationProcessed:
+		res.Processed = 1
+	default:
+		form.Errors.Add("status", "Choose a status")
+	}
+
+	res.StartDate, err = time.Parse(apiDateLayout, r.Form.Get("start_date"))
+	if err != nil && form.Errors.Get("start_date") == "" {
+		form.Errors.Add("start_date", "Invalid date")
+	}
+	res.EndDate, err = time.Parse(apiDateLayout, r.Form.Get("end_date"))
+	if err != nil && form.Errors.Get("end_date") == "" {
+		form.Errors.Add("end_date", "Invalid date")
+	}
+	if form.Errors.Get("start_date") == "" && form.Errors.Get("end_date") == "" && !res.EndDate.After(res.StartDate) {
+		form.Errors.Add("end_date", "The departure must be after the arrival")
+	}
+
+	res.Room, err = m.DB.GetRoomByID(res.RoomID)
+	if errors.Is(err, sql.ErrNoRows) {
+		form.Errors.Add("room_id", "Choose a room")
+	} else if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	if !form.Valid() {
+		m.renderNewReservation(w, r, res, stringMap, form)
+		return
+	}
+
+	res, err = m.makeReservation(res, sendEmail)
+	if errors.Is(err, repository.ErrRoomNotAvailable) {
+		form.Errors.Add("room_id", "The room is not available for these dates")
+		m.renderNewReservation(w, r, res, stringMap, form)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", fmt.Sprintf("Reservation made, the confirmation code is %s", res.ConfirmationCode))
+	http.Redirect(w, r, fmt.Sprintf("/admin/reservations/all/%d/show", res.ID), http.StatusSeeOther)
+}
+
+// AdminNewReservationAvailability lists the rooms free for the whole of the start to end range, for
+// the availability shown on the admin reservation form
+func (m *Repository) AdminNewReservationAvailability(w http.ResponseWriter, r *http.Request) {
+	start, end, fields := apiDateRange(r, time.Time{}, time.Time{})
+	if len(fields) == 0 && (start.IsZero() || end.IsZero()) {
+		fields["start"] = "Both start and end are needed"
+	}
+	if len(fields) > 0 {
+		apiValidationError(w, fields)
+		return
+	}
+
+	rooms, err := m.DB.SearchAvailabilityForAllRooms(start, end)
+	if err != nil {
+		helpers.ServerErrorJSON(w, err)
+		return
+	}
+
+	helpers.WriteJSON(w, http.StatusOK, map[string]interface{}{
+		"start_date": start.Format(apiDateLayout),
+		"end_date":   end.Format(apiDateLayout),
+		"rooms":      newAPIRooms(rooms),
+	})
 }
@@ -1,13 +1,17 @@
 package handlers
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/KingKord/bookings/internal/driver"
+	"github.com/KingKord/bookings/internal/events"
 	"github.com/KingKord/bookings/internal/models"
+	"github.com/KingKord/bookings/internal/totp"
 	"github.com/go-chi/chi/v5"
 	"log"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -39,15 +43,86 @@ var theTests = []struct {
 	{"login", "/user/login", "GET", http.StatusOK},
 	{"logout", "/user/logout", "GET", http.StatusOK},
 	{"dashboard", "/admin/dashboard", "GET", http.StatusOK},
+	{"dashboard period", "/admin/dashboard?from=2050-01-01&to=2050-03-31", "GET", http.StatusOK},
+	{"dashboard bad period", "/admin/dashboard?from=2050-02-01&to=2050-01-01", "GET", http.StatusOK},
+	{"dashboard too long", "/admin/dashboard?from=2050-01-01&to=2051-01-02", "GET", http.StatusOK},
+	{"dashboard error", "/admin/dashboard?from=3002-01-01&to=3002-01-31", "GET", http.StatusInternalServerError},
 	{"new res", "/admin/reservations-new", "GET", http.StatusOK},
 	{"all res", "/admin/reservations-all", "GET", http.StatusOK},
+	{"filtered res", "/admin/reservations-all?from=2050-01-01&to=2050-01-31&status=processed", "GET", http.StatusOK},
+	{"res list error", "/admin/reservations-all?from=3002-01-01", "GET", http.StatusInternalServerError},
+	{"sorted res", "/admin/reservations-all?sort=last_name&dir=desc&page=2", "GET", http.StatusOK},
+	{"searched new res", "/admin/reservations-new?q=smith&room=1", "GET", http.StatusOK},
+	{"guest search", "/admin/search?q=smith", "GET", http.StatusOK},
+	{"guest search error", "/admin/search?q=fail", "GET", http.StatusInternalServerError},
+	{"export unknown format", "/admin/reservations-export?format=pdf", "GET", http.StatusBadRequest},
+	{"export error", "/admin/reservations-export?format=csv&from=3002-01-01", "GET", http.StatusInternalServerError},
+	{"import res", "/admin/reservations-import", "GET", http.StatusOK},
 	{"show res", "/admin/reservations/new/1/show", "GET", http.StatusOK},
 	{"calendar page", "/admin/reservations-calendar", "GET", http.StatusOK},
 	{"show another month", "/admin/reservations-calendar?y=2023&m=10", "GET", http.StatusOK},
+	{"calendar error", "/admin/reservations-calendar?y=3002&m=01", "GET", http.StatusInternalServerError},
+	{"timeline", "/admin/reservations-timeline", "GET", http.StatusOK},
+	{"timeline of 3 months", "/admin/reservations-timeline?y=2050&m=01&range=3m", "GET", http.StatusOK},
+	{"timeline from a day", "/admin/reservations-timeline?y=2050&m=01&d=15&range=1w", "GET", http.StatusOK},
+	{"timeline of a bad month", "/admin/reservations-timeline?y=2050&m=13", "GET", http.StatusBadRequest},
+	{"timeline error", "/admin/reservations-timeline?y=3002&m=01", "GET", http.StatusInternalServerError},
+	{"new reservation", "/admin/reservations-create", "GET", http.StatusOK},
+	{"new reservation from the calendar", "/admin/reservations-create?room_id=1&start=2050-01-05", "GET", http.StatusOK},
+	{"new reservation availability", "/admin/reservations-create/availability?start=3000-01-01&end=3000-01-03", "GET", http.StatusOK},
+	{"new reservation availability without dates", "/admin/reservations-create/availability", "GET", http.StatusUnprocessableEntity},
+	{"new reservation availability error", "/admin/reservations-create/availability?start=3002-01-01&end=3002-01-03", "GET", http.StatusInternalServerError},
 	{"process reservation", "/admin/process-reservation/new/10/do", "GET", http.StatusOK},
 	{"process reservation from calendar", "/admin/process-reservation/cal/10/do?y=2023&m=09", "GET", http.StatusOK},
 	{"delete reservation ", "/admin/delete-reservation/all/1/do", "GET", http.StatusOK},
 	{"delete reservation from calendar ", "/admin/delete-reservation/all/1/do?y=2023&m=09", "GET", http.StatusOK},
+	{"invoice pdf", "/admin/invoices/1/pdf", "GET", http.StatusOK},
+	{"missing invoice pdf", "/admin/invoices/101/pdf", "GET", http.StatusNotFound},
+	{"guest register", "/guest/register", "GET", http.StatusOK},
+	{"guest login", "/guest/login", "GET", http.StatusOK},
+	{"guest logout", "/guest/logout", "GET", http.StatusOK},
+	{"guest stays", "/guest/stays", "GET", http.StatusOK},
+	{"users", "/admin/users", "GET", http.StatusOK},
+	{"new user", "/admin/users/new", "GET", http.StatusOK},
+	{"show user", "/admin/users/2", "GET", http.StatusOK},
+	{"show missing user", "/admin/users/101", "GET", http.StatusInternalServerError},
+	{"forgot password", "/user/forgot-password", "GET", http.StatusOK},
+	{"reset password", "/user/reset-password?token=abc", "GET", http.StatusOK},
+	{"reset password expired", "/user/reset-password?token=expired", "GET", http.StatusOK},
+	{"login verify without password", "/user/login/verify", "GET", http.StatusOK},
+	{"2fa setup logged out", "/user/2fa/setup", "GET", http.StatusOK},
+	{"reset 2fa", "/admin/users/2/reset-2fa/do", "GET", http.StatusOK},
+	{"login activity", "/admin/login-activity", "GET", http.StatusOK},
+	{"unlock user", "/admin/users/5/unlock/do", "GET", http.StatusOK},
+	{"unlock missing user", "/admin/users/101/unlock/do", "GET", http.StatusInternalServerError},
+	{"account", "/admin/account", "GET", http.StatusOK},
+	{"revoke session", "/admin/account/sessions/other-sid/revoke/do", "GET", http.StatusOK},
+	{"revoke other sessions", "/admin/account/sessions/revoke-others/do", "GET", http.StatusOK},
+	{"log out user", "/admin/users/2/logout/do", "GET", http.StatusOK},
+	{"api docs", "/api/docs", "GET", http.StatusOK},
+	{"api keys", "/admin/api-keys", "GET", http.StatusOK},
+	{"new api key", "/admin/api-keys/new", "GET", http.StatusOK},
+	{"revoke api key", "/admin/api-keys/1/revoke/do", "GET", http.StatusOK},
+	{"revoke api key error", "/admin/api-keys/101/revoke/do", "GET", http.StatusInternalServerError},
+	{"calendar feeds", "/admin/calendar-feeds", "GET", http.StatusOK},
+	{"delete calendar feed", "/admin/calendar-feeds/1/delete/do", "GET", http.StatusOK},
+	{"delete calendar feed error", "/admin/calendar-feeds/101/delete/do", "GET", http.StatusInternalServerError},
+	{"calendar imports", "/admin/calendar-imports", "GET", http.StatusOK},
+	{"sync calendar import", "/admin/calendar-imports/1/sync/do", "GET", http.StatusOK},
+	{"sync unknown calendar import", "/admin/calendar-imports/101/sync/do", "GET", http.StatusNotFound},
+	{"delete calendar import", "/admin/calendar-imports/1/delete/do", "GET", http.StatusOK},
+	{"delete calendar import error", "/admin/calendar-imports/101/delete/do", "GET", http.StatusInternalServerError},
+	{"ical feed", "/ical/generals.ics", "GET", http.StatusOK},
+	{"ical feed unknown token", "/ical/unknown.ics", "GET", http.StatusNotFound},
+	{"ical feed error", "/ical/error.ics", "GET", http.StatusInternalServerError},
+	{"webhooks", "/admin/webhooks", "GET", http.StatusOK},
+	{"new webhook", "/admin/webhooks/new", "GET", http.StatusOK},
+	{"show webhook", "/admin/webhooks/1", "GET", http.StatusOK},
+	{"show missing webhook", "/admin/webhooks/101", "GET", http.StatusNotFound},
+	{"delete webhook", "/admin/webhooks/1/delete/do", "GET", http.StatusOK},
+	{"delete webhook error", "/admin/webhooks/101/delete/do", "GET", http.StatusInternalServerError},
+	{"redeliver webhook", "/admin/webhooks/1/deliveries/2/redeliver/do", "GET", http.StatusOK},
+	{"redeliver missing delivery", "/admin/webhooks/1/deliveries/101/redeliver/do", "GET", http.StatusOK},
 }
 
 func TestHandlers(t *testing.T) {
@@ -706,11 +781,25 @@ var loginTests = []struct {
 }{
 	{
 		"valid-credentials",
-		"me@here.ca",
+		"hank@here.ca",
 		http.StatusSeeOther,
 		"",
 		"/",
 	},
+	{
+		"two-factor-enabled",
+		"me@here.ca",
+		http.StatusSeeOther,
+		"",
+		"/user/login/verify",
+	},
+	{
+		"two-factor-required",
+		"manager@here.ca",
+		http.StatusSeeOther,
+		"",
+		"/user/2fa/setup",
+	},
 	{
 		"invalid-credentials",
 		"jack@nimble.com",
@@ -766,6 +855,60 @@ func TestLogin(t *testing.T) {
 				t.Errorf("failed %s: expected to find %s, but did not", e.name, e.expectedHTML)
 			}
 		}
+
+		if e.name == "valid-credentials" && session.GetInt(ctx, "access_level") != 1 {
+			t.Errorf("failed %s: expected access level 1 in session, got %d", e.name, session.GetInt(ctx, "access_level"))
+		}
+
+		if e.expectedLocation == "/" && session.GetString(ctx, "session_id") == "" {
+			t.Errorf("failed %s: login was not recorded as a session", e.name)
+		}
+
+		// a password alone must not log in a user who needs a second factor
+		if e.expectedLocation != "/" && session.Exists(ctx, "user_id") {
+			t.Errorf("failed %s: user_id was put in the session", e.name)
+		}
+	}
+}
+
+var loginThrottleTests = []struct {
+	name          string
+	email         string
+	remoteAddr    string
+	expectedError string
+}{
+	{"unknown account", "jack@nimble.com", "10.0.0.1:1234", "Invalid login credentials"},
+	{"locked account", "locked@here.ca", "10.0.0.1:1234", "This account is locked after too many failed logins, try again later"},
+	{"failure that locks", "lockme@here.ca", "10.0.0.1:1234", "Invalid login credentials"},
+	{"blocked address", "me@here.ca", "10.0.0.66:1234", "Too many failed logins, try again later"},
+}
+
+func TestLoginThrottle(t *testing.T) {
+	for _, e := range loginThrottleTests {
+		postedData := url.Values{}
+		postedData.Add("email", e.email)
+		postedData.Add("password", "password")
+
+		req, _ := http.NewRequest("POST", "/user/login", strings.NewReader(postedData.Encode()))
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		req.RemoteAddr = e.remoteAddr
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(Repo.PostShowLogin)
+		handler.ServeHTTP(rr, req)
+
+		actualLoc, _ := rr.Result().Location()
+		if actualLoc.String() != "/user/login" {
+			t.Errorf("failed %s: expected location /user/login, but got %s", e.name, actualLoc.String())
+		}
+		if session.GetString(ctx, "error") != e.expectedError {
+			t.Errorf("failed %s: expected error %q, but got %q", e.name, e.expectedError, session.GetString(ctx, "error"))
+		}
+		if session.Exists(ctx, "user_id") || session.Exists(ctx, "mfa_user_id") {
+			t.Errorf("failed %s: login went through", e.name)
+		}
 	}
 }
 
@@ -831,83 +974,1909 @@ var adminPostReservationCalendarTests = []struct {
 	postedData           url.Values
 	expectedResponseCode int
 	expectedLocation     string
-	expectedHTML         string
-	blocks               int
-	reservations         int
+	expectedSession      string
 }{
 	{
-		name: "cal",
+		name: "add block",
+		postedData: url.Values{
+			"y":         {"2050"},
+			"m":         {"01"},
+			"add_block": {"1_2050-01-5"},
+			"version_1": {"abc"},
+		},
+		expectedResponseCode: http.StatusSeeOther,
+		expectedLocation:     "/admin/reservations-calendar?y=2050&m=01",
+		expectedSession:      "flash",
+	},
+	{
+		name: "remove block",
 		postedData: url.Values{
-			"year":  {time.Now().Format("2006")},
-			"month": {time.Now().Format("01")},
-			fmt.Sprintf("add_block_1_%s", time.Now().AddDate(0, 0, 2).Format("2006-01-2")): {"1"},
+			"y":            {"2050"},
+			"m":            {"1"},
+			"remove_block": {"1_7"},
+			"version_1":    {"abc"},
 		},
 		expectedResponseCode: http.StatusSeeOther,
+		expectedLocation:     "/admin/reservations-calendar?y=2050&m=01",
+		expectedSession:      "flash",
 	},
 	{
-		name:                 "cal-blocks",
-		postedData:           url.Values{},
+		name:                 "nothing to save",
+		postedData:           url.Values{"y": {"2050"}, "m": {"01"}, "version_1": {"abc"}},
 		expectedResponseCode: http.StatusSeeOther,
-		blocks:               1,
+		expectedLocation:     "/admin/reservations-calendar?y=2050&m=01",
+		expectedSession:      "flash",
 	},
 	{
-		name:                 "cal-res",
-		postedData:           url.Values{},
+		name: "stale calendar",
+		postedData: url.Values{
+			"y":            {"2050"},
+			"m":            {"01"},
+			"remove_block": {"1_7"},
+			"version_1":    {"stale"},
+		},
 		expectedResponseCode: http.StatusSeeOther,
-		reservations:         1,
+		expectedLocation:     "/admin/reservations-calendar?y=2050&m=01",
+		expectedSession:      "error",
+	},
+	{
+		name:                 "no version",
+		postedData:           url.Values{"y": {"2050"}, "m": {"01"}, "add_block": {"1_2050-01-5"}},
+		expectedResponseCode: http.StatusBadRequest,
+	},
+	{
+		name:                 "day of another month",
+		postedData:           url.Values{"y": {"2050"}, "m": {"01"}, "add_block": {"1_2050-02-5"}, "version_1": {"abc"}},
+		expectedResponseCode: http.StatusBadRequest,
+	},
+	{
+		name:                 "malformed block",
+		postedData:           url.Values{"y": {"2050"}, "m": {"01"}, "remove_block": {"1_x"}, "version_1": {"abc"}},
+		expectedResponseCode: http.StatusBadRequest,
+	},
+	{
+		name:                 "no month",
+		postedData:           url.Values{"add_block": {"1_2050-01-5"}, "version_1": {"abc"}},
+		expectedResponseCode: http.StatusBadRequest,
+	},
+	{
+		name:                 "database error",
+		postedData:           url.Values{"y": {"2050"}, "m": {"01"}, "add_block": {"2_2050-01-5"}, "version_2": {"abc"}},
+		expectedResponseCode: http.StatusInternalServerError,
 	},
 }
 
 func TestPostReservationCalendar(t *testing.T) {
 	for _, e := range adminPostReservationCalendarTests {
-		var req *http.Request
-		if e.postedData != nil {
-			req, _ = http.NewRequest("POST", "/admin/reservations-calendar", strings.NewReader(e.postedData.Encode()))
-		} else {
-			req, _ = http.NewRequest("POST", "/admin/reservations-calendar", nil)
+		req, _ := http.NewRequest("POST", "/admin/reservations-calendar", strings.NewReader(e.postedData.Encode()))
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(Repo.AdminPostReservationsCalendar)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedResponseCode {
+			t.Errorf("failed %s: expected code %d, but got %d", e.name, e.expectedResponseCode, rr.Code)
+		}
+		if e.expectedLocation != "" {
+			actualLoc, _ := rr.Result().Location()
+			if actualLoc.String() != e.expectedLocation {
+				t.Errorf("failed %s: expected location %s, but got %s", e.name, e.expectedLocation, actualLoc.String())
+			}
+		}
+		if e.expectedSession != "" && session.GetString(ctx, e.expectedSession) == "" {
+			t.Errorf("failed %s: expected a message in the session %s", e.name, e.expectedSession)
+		}
+	}
+}
+
+var chargeTests = []struct {
+	name             string
+	url              string
+	postedData       url.Values
+	expectedCode     int
+	expectedLocation string
+	expectedFlash    string
+	expectedError    string
+}{
+	{
+		name:             "add charge",
+		url:              "/admin/reservations/all/1/charges",
+		postedData:       url.Values{"description": {"Room night"}, "quantity": {"2"}, "unit_amount": {"120.50"}},
+		expectedCode:     http.StatusSeeOther,
+		expectedLocation: "/admin/reservations/all/1/show",
+		expectedFlash:    "Charge added",
+	},
+	{
+		name: "add charge from calendar",
+		url:  "/admin/reservations/cal/1/charges",
+		postedData: url.Values{"description": {"Breakfast"}, "quantity": {"1"}, "unit_amount": {"15"},
+			"year": {"2050"}, "month": {"01"}},
+		expectedCode:     http.StatusSeeOther,
+		expectedLocation: "/admin/reservations/cal/1/show?y=2050&m=01",
+		expectedFlash:    "Charge added",
+	},
+	{
+		name:             "missing description",
+		url:              "/admin/reservations/all/1/charges",
+		postedData:       url.Values{"quantity": {"1"}, "unit_amount": {"15"}},
+		expectedCode:     http.StatusSeeOther,
+		expectedLocation: "/admin/reservations/all/1/show",
+		expectedError:    "Description, quantity and price are required",
+	},
+	{
+		name:             "invalid quantity",
+		url:              "/admin/reservations/all/1/charges",
+		postedData:       url.Values{"description": {"Breakfast"}, "quantity": {"0"}, "unit_amount": {"15"}},
+		expectedCode:     http.StatusSeeOther,
+		expectedLocation: "/admin/reservations/all/1/show",
+		expectedError:    "Quantity must be a whole number of at least 1",
+	},
+	{
+		name:             "invalid amount",
+		url:              "/admin/reservations/all/1/charges",
+		postedData:       url.Values{"description": {"Breakfast"}, "quantity": {"1"}, "unit_amount": {"1.234"}},
+		expectedCode:     http.StatusSeeOther,
+		expectedLocation: "/admin/reservations/all/1/show",
+		expectedError:    "Price must be an amount such as 120 or 120.50",
+	},
+	{
+		name:         "database error",
+		url:          "/admin/reservations/all/1000/charges",
+		postedData:   url.Values{"description": {"Breakfast"}, "quantity": {"1"}, "unit_amount": {"15"}},
+		expectedCode: http.StatusInternalServerError,
+	},
+	{
+		name:             "delete charge",
+		url:              "/admin/reservations/cal/1/charges/1/delete",
+		postedData:       url.Values{"year": {"2050"}, "month": {"01"}},
+		expectedCode:     http.StatusSeeOther,
+		expectedLocation: "/admin/reservations/cal/1/show?y=2050&m=01",
+		expectedFlash:    "Charge deleted",
+	},
+	{
+		name:             "delete invoiced charge",
+		url:              "/admin/reservations/all/1/charges/2/delete",
+		postedData:       url.Values{},
+		expectedCode:     http.StatusSeeOther,
+		expectedLocation: "/admin/reservations/all/1/show",
+		expectedError:    "Invoiced charges can only be corrected with a credit note",
+	},
+	{
+		name:         "delete unknown charge",
+		url:          "/admin/reservations/all/1/charges/101/delete",
+		postedData:   url.Values{},
+		expectedCode: http.StatusNotFound,
+	},
+	{
+		name:             "issue invoice",
+		url:              "/admin/reservations/all/1/invoice",
+		postedData:       url.Values{"send_email": {"1"}},
+		expectedCode:     http.StatusSeeOther,
+		expectedLocation: "/admin/reservations/all/1/show",
+		expectedFlash:    "Invoice FSBB-INV-000001 issued",
+	},
+	{
+		name:             "nothing to invoice",
+		url:              "/admin/reservations/all/2/invoice",
+		postedData:       url.Values{},
+		expectedCode:     http.StatusSeeOther,
+		expectedLocation: "/admin/reservations/all/2/show",
+		expectedError:    "There are no uninvoiced charges",
+	},
+	{
+		name:         "invoice database error",
+		url:          "/admin/reservations/all/1000/invoice",
+		postedData:   url.Values{},
+		expectedCode: http.StatusInternalServerError,
+	},
+	{
+		name:             "credit note",
+		url:              "/admin/invoices/1/credit-note",
+		postedData:       url.Values{"src": {"new"}, "reservation_id": {"7"}, "send_email": {"1"}},
+		expectedCode:     http.StatusSeeOther,
+		expectedLocation: "/admin/reservations/new/1/show",
+		expectedFlash:    "Credit note FSBB-INV-000002 issued, the charges can now be corrected",
+	},
+	{
+		name:             "already credited",
+		url:              "/admin/invoices/2/credit-note",
+		postedData:       url.Values{"reservation_id": {"1"}},
+		expectedCode:     http.StatusSeeOther,
+		expectedLocation: "/admin/reservations/all/1/show",
+		expectedError:    "This invoice has already been credited",
+	},
+	{
+		name:         "unknown invoice",
+		url:          "/admin/invoices/101/credit-note",
+		postedData:   url.Values{"reservation_id": {"1"}},
+		expectedCode: http.StatusNotFound,
+	},
+}
+
+func TestChargesAndInvoices(t *testing.T) {
+	for _, e := range chargeTests {
+		req, _ := http.NewRequest("POST", e.url, strings.NewReader(e.postedData.Encode()))
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+
+		// route through chi so the url parameters are set
+		mux := chi.NewRouter()
+		mux.Post("/admin/reservations/{src}/{id}/charges", Repo.AdminPostCharge)
+		mux.Post("/admin/reservations/{src}/{id}/charges/{chargeID}/delete", Repo.AdminDeleteCharge)
+		mux.Post("/admin/reservations/{src}/{id}/invoice", Repo.AdminIssueInvoice)
+		mux.Post("/admin/invoices/{id}/credit-note", Repo.AdminPostCreditNote)
+		mux.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedCode {
+			t.Errorf("failed %s: expected code %d, but got %d", e.name, e.expectedCode, rr.Code)
+		}
+
+		if e.expectedLocation != "" {
+			actualLoc, _ := rr.Result().Location()
+			if actualLoc.String() != e.expectedLocation {
+				t.Errorf("failed %s: expected location %s, but got %s", e.name, e.expectedLocation, actualLoc.String())
+			}
 		}
+
+		if flash := session.GetString(ctx, "flash"); flash != e.expectedFlash {
+			t.Errorf("failed %s: expected flash %q, but got %q", e.name, e.expectedFlash, flash)
+		}
+
+		if msg := session.GetString(ctx, "error"); msg != e.expectedError {
+			t.Errorf("failed %s: expected error %q, but got %q", e.name, e.expectedError, msg)
+		}
+	}
+}
+
+func TestAdminProcessReservationSendsInvoice(t *testing.T) {
+	var tests = []struct {
+		name          string
+		id            int
+		expectedFlash string
+	}{
+		{"charges to invoice", 1, "Reservation marked as processed, invoice FSBB-INV-000001 was emailed to the guest"},
+		{"nothing to invoice", 2, "Reservation marked as processed"},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("GET", fmt.Sprintf("/admin/process-reservation/new/%d/do", e.id), nil)
 		ctx := getCtx(req)
 		req = req.WithContext(ctx)
+		rr := httptest.NewRecorder()
+
+		mux := chi.NewRouter()
+		mux.Get("/admin/process-reservation/{src}/{id}/do", Repo.AdminProcessReservation)
+		mux.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusSeeOther {
+			t.Errorf("%s: expected code %d, but got %d", e.name, http.StatusSeeOther, rr.Code)
+		}
+		if flash := session.GetString(ctx, "flash"); flash != e.expectedFlash {
+			t.Errorf("%s: expected flash %q, but got %q", e.name, e.expectedFlash, flash)
+		}
+	}
+}
+
+func TestAdminInvoicePDF(t *testing.T) {
+	routes := getRoutes()
+	ts := httptest.NewTLSServer(routes)
+	defer ts.Close()
+
+	resp, err := ts.Client().Get(ts.URL + "/admin/invoices/1/pdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.Header.Get("Content-Type") != "application/pdf" {
+		t.Errorf("expected content type application/pdf, but got %s", resp.Header.Get("Content-Type"))
+	}
+
+	if !strings.Contains(resp.Header.Get("Content-Disposition"), "FSBB-INV-000001.pdf") {
+		t.Errorf("expected invoice file name in content disposition, but got %s", resp.Header.Get("Content-Disposition"))
+	}
+}
+
+func TestRepository_ReservationPrefillsGuest(t *testing.T) {
+	reservation := models.Reservation{
+		RoomID: 1,
+	}
+
+	req, _ := http.NewRequest("GET", "/make-reservation", nil)
+	ctx := getCtx(req)
+	req = req.WithContext(ctx)
+
+	rr := httptest.NewRecorder()
+	session.Put(ctx, "reservation", reservation)
+	session.Put(ctx, "guest_id", 1)
+
+	handler := http.HandlerFunc(Repo.Reservation)
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("Reservation handler returned wrong response code: got %d, wanted %d", rr.Code, http.StatusOK)
+	}
+
+	res, _ := session.Get(ctx, "reservation").(models.Reservation)
+	if res.GuestID != 1 || res.Email != "guest@here.ca" || res.FirstName != "Jane" {
+		t.Errorf("reservation was not pre-filled from the guest account: %+v", res)
+	}
 
-		now := time.Now()
-		bm := make(map[string]int)
-		rm := make(map[string]int)
+	if !strings.Contains(rr.Body.String(), `value="guest@here.ca"`) {
+		t.Error("guest email not found in make reservation form")
+	}
+}
+
+var guestRegisterTests = []struct {
+	name               string
+	postedData         url.Values
+	expectedStatusCode int
+	expectedLocation   string
+	expectedHTML       string
+}{
+	{
+		"valid",
+		url.Values{"first_name": {"Jane"}, "last_name": {"Guest"}, "email": {"new@here.ca"},
+			"password": {"password123"}, "password_confirm": {"password123"}},
+		http.StatusSeeOther,
+		"/guest/stays",
+		"",
+	},
+	{
+		"passwords do not match",
+		url.Values{"first_name": {"Jane"}, "last_name": {"Guest"}, "email": {"new@here.ca"},
+			"password": {"password123"}, "password_confirm": {"password124"}},
+		http.StatusOK,
+		"",
+		"The values do not match",
+	},
+	{
+		"short password",
+		url.Values{"first_name": {"Jane"}, "last_name": {"Guest"}, "email": {"new@here.ca"},
+			"password": {"short"}, "password_confirm": {"short"}},
+		http.StatusOK,
+		"",
+		"This field must be at least 8 characters long",
+	},
+	{
+		"duplicate email",
+		url.Values{"first_name": {"Jane"}, "last_name": {"Guest"}, "email": {"exists@here.ca"},
+			"password": {"password123"}, "password_confirm": {"password123"}},
+		http.StatusOK,
+		"",
+		"An account with this email already exists",
+	},
+	{
+		"database error",
+		url.Values{"first_name": {"Jane"}, "last_name": {"Guest"}, "email": {"error@here.ca"},
+			"password": {"password123"}, "password_confirm": {"password123"}},
+		http.StatusInternalServerError,
+		"",
+		"",
+	},
+}
 
-		currentYear, currentMonth, _ := now.Date()
-		currentLocation := now.Location()
+func TestGuestRegister(t *testing.T) {
+	for _, e := range guestRegisterTests {
+		req, _ := http.NewRequest("POST", "/guest/register", strings.NewReader(e.postedData.Encode()))
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
 
-		firstOfMonth := time.Date(currentYear, currentMonth, 1, 0, 0, 0, 0, currentLocation)
-		lastOfMonth := firstOfMonth.AddDate(0, 1, -1)
+		handler := http.HandlerFunc(Repo.PostGuestRegister)
+		handler.ServeHTTP(rr, req)
 
-		for d := firstOfMonth; d.After(lastOfMonth) == false; d = d.AddDate(0, 0, 1) {
-			rm[d.Format("2006-01-2")] = 0
-			bm[d.Format("2006-01-2")] = 0
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("failed %s: expected code %d, but got %d", e.name, e.expectedStatusCode, rr.Code)
 		}
 
-		if e.blocks > 0 {
-			bm[firstOfMonth.Format("2006-01-2")] = e.blocks
+		if e.expectedLocation != "" {
+			actualLoc, _ := rr.Result().Location()
+			if actualLoc.String() != e.expectedLocation {
+				t.Errorf("failed %s: expected location %s, but got %s location", e.name, e.expectedLocation, actualLoc.String())
+			}
+			if session.GetInt(ctx, "guest_id") != 1 {
+				t.Errorf("failed %s: guest was not logged in", e.name)
+			}
 		}
 
-		if e.reservations > 0 {
-			rm[lastOfMonth.Format("2006-01-2")] = e.reservations
+		if e.expectedHTML != "" && !strings.Contains(rr.Body.String(), e.expectedHTML) {
+			t.Errorf("failed %s: expected to find %s, but did not", e.name, e.expectedHTML)
 		}
+	}
+}
+
+var guestLoginTests = []struct {
+	name               string
+	email              string
+	expectedStatusCode int
+	expectedLocation   string
+}{
+	{"valid-credentials", "guest@here.ca", http.StatusSeeOther, "/guest/stays"},
+	{"invalid-credentials", "jack@nimble.com", http.StatusSeeOther, "/guest/login"},
+	{"invalid-data", "j", http.StatusOK, ""},
+}
 
-		session.Put(ctx, "block_map_1", bm)
-		session.Put(ctx, "reservation_map_1", rm)
+func TestGuestLogin(t *testing.T) {
+	for _, e := range guestLoginTests {
+		postedData := url.Values{}
+		postedData.Add("email", e.email)
+		postedData.Add("password", "password")
 
-		// set the header
+		req, _ := http.NewRequest("POST", "/guest/login", strings.NewReader(postedData.Encode()))
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
 		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 		rr := httptest.NewRecorder()
 
-		// call the handler
-		handler := http.HandlerFunc(Repo.AdminPostReservationsCalendar)
+		handler := http.HandlerFunc(Repo.PostGuestLogin)
 		handler.ServeHTTP(rr, req)
 
-		if rr.Code != e.expectedResponseCode {
-			t.Errorf("failed %s: expected code %d, but got %d", e.name, e.expectedResponseCode, rr.Code)
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("failed %s: expected code %d, but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+
+		if e.expectedLocation != "" {
+			actualLoc, _ := rr.Result().Location()
+			if actualLoc.String() != e.expectedLocation {
+				t.Errorf("failed %s: expected location %s, but got %s location", e.name, e.expectedLocation, actualLoc.String())
+			}
+		}
+
+		// a guest login must never grant staff access
+		if session.Exists(ctx, "user_id") {
+			t.Errorf("failed %s: guest login put user_id in the session", e.name)
 		}
 	}
 }
+
+func TestGuestStays(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/guest/stays", nil)
+	ctx := getCtx(req)
+	req = req.WithContext(ctx)
+	session.Put(ctx, "guest_id", 1)
+	rr := httptest.NewRecorder()
+
+	handler := http.HandlerFunc(Repo.GuestStays)
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("GuestStays returned wrong response code: got %d, wanted %d", rr.Code, http.StatusOK)
+	}
+
+	html := rr.Body.String()
+	upcoming := strings.Index(html, "General&#39;s Quarters")
+	past := strings.Index(html, "Major&#39;s Suite")
+	if upcoming < 0 || past < 0 || upcoming > past {
+		t.Error("expected upcoming stay to be listed before past stay")
+	}
+
+	// test for database error
+	req, _ = http.NewRequest("GET", "/guest/stays", nil)
+	ctx = getCtx(req)
+	req = req.WithContext(ctx)
+	session.Put(ctx, "guest_id", 101)
+	rr = httptest.NewRecorder()
+
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusInternalServerError {
+		t.Errorf("GuestStays returned wrong response code: got %d, wanted %d", rr.Code, http.StatusInternalServerError)
+	}
+}
+
+var adminNewUserTests = []struct {
+	name               string
+	postedData         url.Values
+	expectedStatusCode int
+	expectedHTML       string
+	expectedLocation   string
+}{
+	{
+		name: "valid",
+		postedData: url.Values{
+			"first_name":   {"Fred"},
+			"last_name":    {"Desk"},
+			"email":        {"fred@here.ca"},
+			"access_level": {"2"},
+		},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedLocation:   "/admin/users",
+	},
+	{
+		name: "unknown role",
+		postedData: url.Values{
+			"first_name":   {"Fred"},
+			"last_name":    {"Desk"},
+			"email":        {"fred@here.ca"},
+			"access_level": {"9"},
+		},
+		expectedStatusCode: http.StatusOK,
+		expectedHTML:       "Choose a role",
+	},
+	{
+		name: "duplicate email",
+		postedData: url.Values{
+			"first_name":   {"Fred"},
+			"last_name":    {"Desk"},
+			"email":        {"exists@here.ca"},
+			"access_level": {"2"},
+		},
+		expectedStatusCode: http.StatusOK,
+		expectedHTML:       "A user with this email already exists",
+	},
+	{
+		name: "missing data",
+		postedData: url.Values{
+			"email":        {"fred"},
+			"access_level": {"2"},
+		},
+		expectedStatusCode: http.StatusOK,
+		expectedHTML:       `action="/admin/users/new"`,
+	},
+}
+
+func TestPostAdminNewUser(t *testing.T) {
+	for _, e := range adminNewUserTests {
+		req, _ := http.NewRequest("POST", "/admin/users/new", strings.NewReader(e.postedData.Encode()))
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(Repo.PostAdminNewUser)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("failed %s: expected code %d, but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+
+		if e.expectedLocation != "" {
+			actualLoc, _ := rr.Result().Location()
+			if actualLoc.String() != e.expectedLocation {
+				t.Errorf("failed %s: expected location %s, but got %s location", e.name, e.expectedLocation, actualLoc.String())
+			}
+		}
+
+		if e.expectedHTML != "" && !strings.Contains(rr.Body.String(), e.expectedHTML) {
+			t.Errorf("failed %s: expected to find %s, but did not", e.name, e.expectedHTML)
+		}
+	}
+}
+
+var adminShowUserTests = []struct {
+	name               string
+	id                 string
+	currentUser        int
+	postedData         url.Values
+	expectedStatusCode int
+	expectedHTML       string
+}{
+	{
+		name:        "valid",
+		id:          "2",
+		currentUser: 1,
+		postedData: url.Values{
+			"first_name":   {"Hank"},
+			"last_name":    {"Housekeeper"},
+			"email":        {"hank@here.ca"},
+			"access_level": {"2"},
+			"disabled":     {"1"},
+		},
+		expectedStatusCode: http.StatusSeeOther,
+	},
+	{
+		name:        "duplicate email",
+		id:          "2",
+		currentUser: 1,
+		postedData: url.Values{
+			"first_name":   {"Hank"},
+			"last_name":    {"Housekeeper"},
+			"email":        {"exists@here.ca"},
+			"access_level": {"2"},
+		},
+		expectedStatusCode: http.StatusOK,
+		expectedHTML:       "A user with this email already exists",
+	},
+	{
+		name:        "demote self",
+		id:          "1",
+		currentUser: 1,
+		postedData: url.Values{
+			"first_name":   {"Owen"},
+			"last_name":    {"Owner"},
+			"email":        {"me@here.ca"},
+			"access_level": {"1"},
+		},
+		expectedStatusCode: http.StatusOK,
+		expectedHTML:       "You can&#39;t change your own role",
+	},
+	{
+		name:        "disable self",
+		id:          "1",
+		currentUser: 1,
+		postedData: url.Values{
+			"first_name": {"Owen"},
+			"last_name":  {"Owner"},
+			"email":      {"me@here.ca"},
+			"disabled":   {"1"},
+		},
+		expectedStatusCode: http.StatusOK,
+		expectedHTML:       "You can&#39;t disable your own account",
+	},
+	{
+		name:        "edit self",
+		id:          "1",
+		currentUser: 1,
+		postedData: url.Values{
+			"first_name": {"Owen"},
+			"last_name":  {"Owner"},
+			"email":      {"me@here.ca"},
+		},
+		expectedStatusCode: http.StatusSeeOther,
+	},
+	{
+		name:               "missing user",
+		id:                 "101",
+		currentUser:        1,
+		postedData:         url.Values{},
+		expectedStatusCode: http.StatusInternalServerError,
+	},
+}
+
+func TestPostAdminShowUser(t *testing.T) {
+	mux := chi.NewRouter()
+	mux.Post("/admin/users/{id}", Repo.PostAdminShowUser)
+
+	for _, e := range adminShowUserTests {
+		req, _ := http.NewRequest("POST", "/admin/users/"+e.id, strings.NewReader(e.postedData.Encode()))
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		session.Put(ctx, "user_id", e.currentUser)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+
+		mux.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("failed %s: expected code %d, but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+
+		if e.expectedHTML != "" && !strings.Contains(rr.Body.String(), e.expectedHTML) {
+			t.Errorf("failed %s: expected to find %s, but did not", e.name, e.expectedHTML)
+		}
+	}
+}
+
+func TestPostAdminShowUserDisableLogsOut(t *testing.T) {
+	mux := chi.NewRouter()
+	mux.Post("/admin/users/{id}", Repo.PostAdminShowUser)
+
+	// a session user 2 has open
+	other, _ := session.Load(context.Background(), "")
+	session.Put(other, "user_id", 2)
+	otherToken, _, _ := session.Commit(other)
+
+	postedData := url.Values{
+		"first_name":   {"Hank"},
+		"last_name":    {"Hill"},
+		"email":        {"hank@here.ca"},
+		"access_level": {"1"},
+		"disabled":     {"1"},
+	}
+	req, _ := http.NewRequest("POST", "/admin/users/2", strings.NewReader(postedData.Encode()))
+	ctx := getCtx(req)
+	req = req.WithContext(ctx)
+	session.Put(ctx, "user_id", 1)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+
+	mux.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusSeeOther {
+		t.Errorf("PostAdminShowUser returned wrong response code: got %d, wanted %d", rr.Code, http.StatusSeeOther)
+	}
+	other, _ = session.Load(context.Background(), otherToken)
+	if session.Exists(other, "user_id") {
+		t.Error("expected the disabled user to be logged out")
+	}
+}
+
+func TestAdminDeleteUser(t *testing.T) {
+	mux := chi.NewRouter()
+	mux.Get("/admin/delete-user/{id}/do", Repo.AdminDeleteUser)
+
+	// a session user 2 has open
+	other, _ := session.Load(context.Background(), "")
+	session.Put(other, "user_id", 2)
+	otherToken, _, _ := session.Commit(other)
+
+	req, _ := http.NewRequest("GET", "/admin/delete-user/2/do", nil)
+	ctx := getCtx(req)
+	req = req.WithContext(ctx)
+	session.Put(ctx, "user_id", 1)
+	rr := httptest.NewRecorder()
+
+	mux.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusSeeOther {
+		t.Errorf("AdminDeleteUser returned wrong response code: got %d, wanted %d", rr.Code, http.StatusSeeOther)
+	}
+	if session.GetString(ctx, "flash") != "User deleted" {
+		t.Error("expected user to be deleted")
+	}
+	other, _ = session.Load(context.Background(), otherToken)
+	if session.Exists(other, "user_id") {
+		t.Error("expected the deleted user to be logged out")
+	}
+
+	// owners can't delete themselves
+	req, _ = http.NewRequest("GET", "/admin/delete-user/1/do", nil)
+	ctx = getCtx(req)
+	req = req.WithContext(ctx)
+	session.Put(ctx, "user_id", 1)
+	rr = httptest.NewRecorder()
+
+	mux.ServeHTTP(rr, req)
+
+	if session.GetString(ctx, "error") != "You can't delete your own account" {
+		t.Error("expected deleting own account to be refused")
+	}
+}
+
+var forgotPasswordTests = []struct {
+	name               string
+	email              string
+	expectedStatusCode int
+	expectedHTML       string
+}{
+	{"known user", "me@here.ca", http.StatusSeeOther, ""},
+	{"unknown user", "nobody@here.ca", http.StatusSeeOther, ""},
+	{"disabled user", "disabled@here.ca", http.StatusSeeOther, ""},
+	{"invalid email", "nobody", http.StatusOK, `action="/user/forgot-password"`},
+}
+
+func TestPostForgotPassword(t *testing.T) {
+	for _, e := range forgotPasswordTests {
+		postedData := url.Values{}
+		postedData.Add("email", e.email)
+
+		req, _ := http.NewRequest("POST", "/user/forgot-password", strings.NewReader(postedData.Encode()))
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(Repo.PostForgotPassword)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("failed %s: expected code %d, but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+
+		if e.expectedHTML != "" && !strings.Contains(rr.Body.String(), e.expectedHTML) {
+			t.Errorf("failed %s: expected to find %s, but did not", e.name, e.expectedHTML)
+		}
+
+		// known and unknown addresses must look the same
+		if e.expectedStatusCode == http.StatusSeeOther {
+			actualLoc, _ := rr.Result().Location()
+			if actualLoc.String() != "/user/login" {
+				t.Errorf("failed %s: expected location /user/login, but got %s", e.name, actualLoc.String())
+			}
+		}
+	}
+}
+
+var resetPasswordTests = []struct {
+	name               string
+	token              string
+	password           string
+	confirm            string
+	expectedStatusCode int
+	expectedLocation   string
+}{
+	{"valid", "abc", "new-password", "new-password", http.StatusSeeOther, "/user/login"},
+	{"expired token", "expired", "new-password", "new-password", http.StatusSeeOther, "/user/forgot-password"},
+	{"too short", "abc", "short", "short", http.StatusOK, ""},
+	{"mismatch", "abc", "new-password", "other-password", http.StatusOK, ""},
+}
+
+func TestPostResetPassword(t *testing.T) {
+	for _, e := range resetPasswordTests {
+		// a session the user has open elsewhere
+		other, _ := session.Load(context.Background(), "")
+		session.Put(other, "user_id", 1)
+		otherToken, _, _ := session.Commit(other)
+
+		postedData := url.Values{}
+		postedData.Add("token", e.token)
+		postedData.Add("password", e.password)
+		postedData.Add("password_confirm", e.confirm)
+
+		req, _ := http.NewRequest("POST", "/user/reset-password", strings.NewReader(postedData.Encode()))
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(Repo.PostResetPassword)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("failed %s: expected code %d, but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+
+		if e.expectedLocation != "" {
+			actualLoc, _ := rr.Result().Location()
+			if actualLoc.String() != e.expectedLocation {
+				t.Errorf("failed %s: expected location %s, but got %s location", e.name, e.expectedLocation, actualLoc.String())
+			}
+		}
+
+		other, _ = session.Load(context.Background(), otherToken)
+		loggedOut := !session.Exists(other, "user_id")
+		if e.name == "valid" && !loggedOut {
+			t.Errorf("failed %s: expected other sessions to be logged out", e.name)
+		}
+		if e.name != "valid" && loggedOut {
+			t.Errorf("failed %s: other sessions were logged out", e.name)
+		}
+	}
+}
+
+func TestPostLoginVerify(t *testing.T) {
+	// the secret of user 1 in the test repo
+	code, _ := totp.Code("JBSWY3DPEHPK3PXP", time.Now())
+
+	tests := []struct {
+		name             string
+		pending          int
+		code             string
+		expectedLocation string
+		loggedIn         bool
+	}{
+		{"valid code", 1, code, "/", true},
+		{"recovery code", 1, "ABCDE-FGHJK", "/", true},
+		{"wrong code", 1, "000000", "/user/login/verify", false},
+		{"wrong recovery code", 1, "aaaaa-bbbbb", "/user/login/verify", false},
+		{"code already used", 6, code, "/user/login/verify", false},
+		{"no password step", 0, code, "/user/login", false},
+	}
+
+	for _, e := range tests {
+		postedData := url.Values{}
+		postedData.Add("code", e.code)
+
+		req, _ := http.NewRequest("POST", "/user/login/verify", strings.NewReader(postedData.Encode()))
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		if e.pending != 0 {
+			session.Put(ctx, "mfa_user_id", e.pending)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(Repo.PostLoginVerify)
+		handler.ServeHTTP(rr, req)
+
+		actualLoc, _ := rr.Result().Location()
+		if actualLoc.String() != e.expectedLocation {
+			t.Errorf("failed %s: expected location %s, but got %s", e.name, e.expectedLocation, actualLoc.String())
+		}
+		if session.Exists(ctx, "user_id") != e.loggedIn {
+			t.Errorf("failed %s: expected logged in to be %t", e.name, e.loggedIn)
+		}
+		if e.loggedIn && session.Exists(ctx, "mfa_user_id") {
+			t.Errorf("failed %s: pending login was not cleared", e.name)
+		}
+	}
+}
+
+func TestTwoFactorSetup(t *testing.T) {
+	// a manager half way through a login that requires enrolment
+	req, _ := http.NewRequest("GET", "/user/2fa/setup", nil)
+	ctx := getCtx(req)
+	req = req.WithContext(ctx)
+	session.Put(ctx, "mfa_user_id", 4)
+	rr := httptest.NewRecorder()
+
+	handler := http.HandlerFunc(Repo.TwoFactorSetup)
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("TwoFactorSetup returned wrong response code: got %d, wanted %d", rr.Code, http.StatusOK)
+	}
+	if !strings.Contains(rr.Body.String(), "data:image/png;base64,") {
+		t.Error("expected the page to contain the QR code")
+	}
+
+	secret := session.GetString(ctx, "totp_secret")
+	if secret == "" {
+		t.Fatal("expected pending secret in session")
+	}
+
+	// a wrong code keeps the same secret and doesn't log in
+	postedData := url.Values{}
+	postedData.Add("code", "000000")
+	req, _ = http.NewRequest("POST", "/user/2fa/setup", strings.NewReader(postedData.Encode()))
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr = httptest.NewRecorder()
+
+	handler = http.HandlerFunc(Repo.PostTwoFactorSetup)
+	handler.ServeHTTP(rr, req)
+
+	if !strings.Contains(rr.Body.String(), "That code doesn&#39;t match") {
+		t.Error("expected wrong code to be rejected")
+	}
+	if session.GetString(ctx, "totp_secret") != secret || session.Exists(ctx, "user_id") {
+		t.Error("wrong code changed the secret or logged the user in")
+	}
+
+	// the right code enables 2FA, completes the login and shows recovery codes
+	code, _ := totp.Code(secret, time.Now())
+	postedData.Set("code", code)
+	req, _ = http.NewRequest("POST", "/user/2fa/setup", strings.NewReader(postedData.Encode()))
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr = httptest.NewRecorder()
+
+	handler.ServeHTTP(rr, req)
+
+	if !strings.Contains(rr.Body.String(), "Recovery Codes") {
+		t.Error("expected recovery codes to be shown")
+	}
+	if session.GetInt(ctx, "user_id") != 4 || session.Exists(ctx, "totp_secret") {
+		t.Error("expected user to be logged in and the pending secret cleared")
+	}
+}
+
+func TestPostTwoFactorDisable(t *testing.T) {
+	code, _ := totp.Code("JBSWY3DPEHPK3PXP", time.Now())
+
+	tests := []struct {
+		name     string
+		userID   int
+		code     string
+		expected string
+	}{
+		{"authenticator code", 5, code, "Two-factor authentication turned off"},
+		{"recovery code", 5, "ABCDE-FGHJK", "Two-factor authentication turned off"},
+		{"wrong code", 5, "000000", ""},
+		{"no code", 5, "", ""},
+		{"not enrolled", 2, "", ""},
+		{"required by role", 1, code, ""},
+	}
+
+	for _, e := range tests {
+		postedData := url.Values{}
+		postedData.Add("disable_code", e.code)
+
+		req, _ := http.NewRequest("POST", "/user/2fa/disable", strings.NewReader(postedData.Encode()))
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		session.Put(ctx, "user_id", e.userID)
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(Repo.PostTwoFactorDisable)
+		handler.ServeHTTP(rr, req)
+
+		if session.GetString(ctx, "flash") != e.expected {
+			t.Errorf("failed %s: expected flash %q but got %q", e.name, e.expected, session.GetString(ctx, "flash"))
+		}
+		if e.userID == 5 && e.expected == "" && !strings.Contains(rr.Body.String(), "is-invalid") {
+			t.Errorf("failed %s: expected the code to be rejected on the form", e.name)
+		}
+	}
+}
+
+func TestAdminResetTwoFactor(t *testing.T) {
+	mux := chi.NewRouter()
+	mux.Get("/admin/users/{id}/reset-2fa/do", Repo.AdminResetTwoFactor)
+
+	// a session user 2 has open
+	other, _ := session.Load(context.Background(), "")
+	session.Put(other, "user_id", 2)
+	otherToken, _, _ := session.Commit(other)
+
+	req, _ := http.NewRequest("GET", "/admin/users/2/reset-2fa/do", nil)
+	ctx := getCtx(req)
+	req = req.WithContext(ctx)
+	session.Put(ctx, "user_id", 1)
+	rr := httptest.NewRecorder()
+
+	mux.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusSeeOther {
+		t.Errorf("AdminResetTwoFactor returned wrong response code: got %d, wanted %d", rr.Code, http.StatusSeeOther)
+	}
+
+	other, _ = session.Load(context.Background(), otherToken)
+	if session.Exists(other, "user_id") {
+		t.Error("expected user to be logged out")
+	}
+	if !session.Exists(ctx, "user_id") {
+		t.Error("the owner doing the reset was logged out")
+	}
+}
+
+func TestAdminAccount(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/admin/account", nil)
+	ctx := getCtx(req)
+	req = req.WithContext(ctx)
+	session.Put(ctx, "user_id", 1)
+	session.Put(ctx, "session_id", "current-sid")
+	rr := httptest.NewRecorder()
+
+	handler := http.HandlerFunc(Repo.AdminAccount)
+	handler.ServeHTTP(rr, req)
+
+	html := rr.Body.String()
+	if !strings.Contains(html, "This session") {
+		t.Error("expected the current session to be marked")
+	}
+	if !strings.Contains(html, "/admin/account/sessions/other-sid/revoke/do") {
+		t.Error("expected a sign out link for the other session")
+	}
+	if !strings.Contains(html, "Safari on iOS") {
+		t.Error("expected the device of the other session")
+	}
+}
+
+func TestAdminRevokeSession(t *testing.T) {
+	mux := chi.NewRouter()
+	mux.Get("/admin/account/sessions/{sessionID}/revoke/do", Repo.AdminRevokeSession)
+
+	tests := []struct {
+		name             string
+		sessionID        string
+		expectedLocation string
+	}{
+		{"other session", "other-sid", "/admin/account"},
+		{"this session", "current-sid", "/user/logout"},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("GET", "/admin/account/sessions/"+e.sessionID+"/revoke/do", nil)
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		session.Put(ctx, "user_id", 1)
+		session.Put(ctx, "session_id", "current-sid")
+		rr := httptest.NewRecorder()
+
+		mux.ServeHTTP(rr, req)
+
+		actualLoc, _ := rr.Result().Location()
+		if actualLoc.String() != e.expectedLocation {
+			t.Errorf("failed %s: expected location %s, but got %s", e.name, e.expectedLocation, actualLoc.String())
+		}
+	}
+}
+
+func TestAdminLogOutUser(t *testing.T) {
+	mux := chi.NewRouter()
+	mux.Get("/admin/users/{id}/logout/do", Repo.AdminLogOutUser)
+
+	// a session user 2 has open
+	other, _ := session.Load(context.Background(), "")
+	session.Put(other, "user_id", 2)
+	otherToken, _, _ := session.Commit(other)
+
+	req, _ := http.NewRequest("GET", "/admin/users/2/logout/do", nil)
+	ctx := getCtx(req)
+	req = req.WithContext(ctx)
+	session.Put(ctx, "user_id", 1)
+	rr := httptest.NewRecorder()
+
+	mux.ServeHTTP(rr, req)
+
+	if session.GetString(ctx, "flash") != "User signed out of all sessions" {
+		t.Error("expected user to be signed out")
+	}
+	other, _ = session.Load(context.Background(), otherToken)
+	if session.Exists(other, "user_id") {
+		t.Error("expected the other session to be destroyed")
+	}
+
+	// owners sign themselves out from their account page
+	req, _ = http.NewRequest("GET", "/admin/users/1/logout/do", nil)
+	ctx = getCtx(req)
+	req = req.WithContext(ctx)
+	session.Put(ctx, "user_id", 1)
+	rr = httptest.NewRecorder()
+
+	mux.ServeHTTP(rr, req)
+
+	if !session.Exists(ctx, "user_id") {
+		t.Error("owner was signed out of their own session")
+	}
+}
+
+var postAdminNewAPIKeyTests = []struct {
+	name          string
+	postedData    url.Values
+	expectedCode  int
+	expectedError string
+}{
+	{
+		name:         "valid",
+		postedData:   url.Values{"name": {"Tablet"}, "scopes": {"availability:read", "reservations:write"}, "expires_in": {"90"}},
+		expectedCode: http.StatusOK,
+	},
+	{
+		name:          "missing name",
+		postedData:    url.Values{"name": {" "}, "scopes": {"availability:read"}, "expires_in": {"90"}},
+		expectedCode:  http.StatusOK,
+		expectedError: "This field cannot be blank",
+	},
+	{
+		name:          "no scopes",
+		postedData:    url.Values{"name": {"Tablet"}, "expires_in": {"0"}},
+		expectedCode:  http.StatusOK,
+		expectedError: "Choose at least one scope",
+	},
+	{
+		name:          "unknown scope",
+		postedData:    url.Values{"name": {"Tablet"}, "scopes": {"reservations:delete"}, "expires_in": {"0"}},
+		expectedCode:  http.StatusOK,
+		expectedError: "Unknown scope",
+	},
+	{
+		name:          "invalid expiry",
+		postedData:    url.Values{"name": {"Tablet"}, "scopes": {"admin"}, "expires_in": {"7"}},
+		expectedCode:  http.StatusOK,
+		expectedError: "Choose when the key expires",
+	},
+	{
+		name:         "database error",
+		postedData:   url.Values{"name": {"fail"}, "scopes": {"admin"}, "expires_in": {"0"}},
+		expectedCode: http.StatusInternalServerError,
+	},
+}
+
+func TestPostAdminNewAPIKey(t *testing.T) {
+	for _, e := range postAdminNewAPIKeyTests {
+		req, _ := http.NewRequest("POST", "/admin/api-keys/new", strings.NewReader(e.postedData.Encode()))
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		session.Put(ctx, "user_id", 1)
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(Repo.PostAdminNewAPIKey)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedCode {
+			t.Errorf("failed %s: expected code %d, but got %d", e.name, e.expectedCode, rr.Code)
+		}
+
+		html := rr.Body.String()
+		if e.expectedError != "" && !strings.Contains(html, e.expectedError) {
+			t.Errorf("failed %s: expected error %q", e.name, e.expectedError)
+		}
+		if e.expectedError == "" && e.expectedCode == http.StatusOK && !strings.Contains(html, `value="bk_`) {
+			t.Errorf("failed %s: expected the new key to be shown", e.name)
+		}
+	}
+}
+
+var postAdminWebhookTests = []struct {
+	name             string
+	url              string
+	postedData       url.Values
+	expectedCode     int
+	expectedError    string
+	expectedLocation string
+}{
+	{
+		name:             "new webhook",
+		url:              "/admin/webhooks/new",
+		postedData:       url.Values{"url": {"https://chat.example.com/hooks"}, "events": {"reservation.created"}, "active": {"1"}},
+		expectedCode:     http.StatusSeeOther,
+		expectedLocation: "/admin/webhooks/1",
+	},
+	{
+		name:          "missing url",
+		url:           "/admin/webhooks/new",
+		postedData:    url.Values{"url": {" "}, "events": {"reservation.created"}},
+		expectedCode:  http.StatusOK,
+		expectedError: "This field cannot be blank",
+	},
+	{
+		name:          "not an http url",
+		url:           "/admin/webhooks/new",
+		postedData:    url.Values{"url": {"ftp://example.com/hooks"}, "events": {"reservation.created"}},
+		expectedCode:  http.StatusOK,
+		expectedError: "Must be an http or https URL",
+	},
+	{
+		name:          "no events",
+		url:           "/admin/webhooks/new",
+		postedData:    url.Values{"url": {"https://chat.example.com/hooks"}},
+		expectedCode:  http.StatusOK,
+		expectedError: "Choose at least one event",
+	},
+	{
+		name:          "unknown event",
+		url:           "/admin/webhooks/new",
+		postedData:    url.Values{"url": {"https://chat.example.com/hooks"}, "events": {"room.painted"}},
+		expectedCode:  http.StatusOK,
+		expectedError: "Unknown event",
+	},
+	{
+		name:         "new webhook database error",
+		url:          "/admin/webhooks/new",
+		postedData:   url.Values{"url": {"https://chat.example.com/hooks"}, "description": {"fail"}, "events": {"block.added"}},
+		expectedCode: http.StatusInternalServerError,
+	},
+	{
+		name:             "save webhook",
+		url:              "/admin/webhooks/1",
+		postedData:       url.Values{"url": {"https://chat.example.com/hooks"}, "events": {"block.added", "block.removed"}},
+		expectedCode:     http.StatusSeeOther,
+		expectedLocation: "/admin/webhooks/1",
+	},
+	{
+		name:          "save invalid webhook",
+		url:           "/admin/webhooks/1",
+		postedData:    url.Values{"url": {"https://chat.example.com/hooks"}},
+		expectedCode:  http.StatusOK,
+		expectedError: "Choose at least one event",
+	},
+	{
+		name:         "save missing webhook",
+		url:          "/admin/webhooks/101",
+		postedData:   url.Values{"url": {"https://chat.example.com/hooks"}, "events": {"block.added"}},
+		expectedCode: http.StatusNotFound,
+	},
+	{
+		name:         "save webhook database error",
+		url:          "/admin/webhooks/1",
+		postedData:   url.Values{"url": {"https://chat.example.com/hooks"}, "description": {"fail"}, "events": {"block.added"}},
+		expectedCode: http.StatusInternalServerError,
+	},
+}
+
+func TestPostAdminWebhook(t *testing.T) {
+	for _, e := range postAdminWebhookTests {
+		req, _ := http.NewRequest("POST", e.url, strings.NewReader(e.postedData.Encode()))
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+
+		// route through chi so the url parameters are set
+		mux := chi.NewRouter()
+		mux.Post("/admin/webhooks/new", Repo.PostAdminNewWebhook)
+		mux.Post("/admin/webhooks/{id}", Repo.PostAdminShowWebhook)
+		mux.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedCode {
+			t.Errorf("failed %s: expected code %d, but got %d", e.name, e.expectedCode, rr.Code)
+		}
+		if e.expectedLocation != "" {
+			if location, _ := rr.Result().Location(); location == nil || location.String() != e.expectedLocation {
+				t.Errorf("failed %s: expected redirect to %s, but got %v", e.name, e.expectedLocation, location)
+			}
+		}
+		if e.expectedError != "" && !strings.Contains(rr.Body.String(), e.expectedError) {
+			t.Errorf("failed %s: expected error %q", e.name, e.expectedError)
+		}
+	}
+}
+
+var iCalFeedTests = []struct {
+	name        string
+	token       string
+	expected    []string
+	notExpected []string
+}{
+	{
+		name:  "room feed hides guest names",
+		token: "generals",
+		expected: []string{
+			"X-WR-CALNAME:General's Quarters\r\n",
+			"UID:reservation-1@example.com\r\n",
+			"DTSTART;VALUE=DATE:20500102\r\nDTEND;VALUE=DATE:20500104\r\nSUMMARY:Reserved\r\n",
+			"UID:block-2@example.com\r\n",
+			"SUMMARY:Blocked\r\n",
+		},
+		notExpected: []string{"Smith"},
+	},
+	{
+		name:  "property feed with guest names",
+		token: "all-rooms",
+		expected: []string{
+			"X-WR-CALNAME:All rooms\r\n",
+			"SUMMARY:General's Quarters: John Smith\r\n",
+			"SUMMARY:General's Quarters: Blocked\r\n",
+		},
+	},
+}
+
+func TestICalFeed(t *testing.T) {
+	baseURL := app.BaseURL
+	app.BaseURL = "https://example.com"
+	defer func() { app.BaseURL = baseURL }()
+
+	for _, e := range iCalFeedTests {
+		req, _ := http.NewRequest("GET", "/ical/"+e.token+".ics", nil)
+		rr := httptest.NewRecorder()
+
+		mux := chi.NewRouter()
+		mux.Get("/ical/{token}.ics", Repo.ICalFeed)
+		mux.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("failed %s: expected code %d, but got %d", e.name, http.StatusOK, rr.Code)
+		}
+		if ct := rr.Header().Get("Content-Type"); ct != "text/calendar; charset=utf-8" {
+			t.Errorf("failed %s: unexpected content type %s", e.name, ct)
+		}
+
+		body := rr.Body.String()
+		for _, s := range e.expected {
+			if !strings.Contains(body, s) {
+				t.Errorf("failed %s: expected %q in\n%s", e.name, s, body)
+			}
+		}
+		for _, s := range e.notExpected {
+			if strings.Contains(body, s) {
+				t.Errorf("failed %s: didn't expect %q", e.name, s)
+			}
+		}
+	}
+}
+
+var postAdminCalendarFeedsTests = []struct {
+	name          string
+	postedData    url.Values
+	expectedCode  int
+	expectedError string
+}{
+	{
+		name:         "room feed",
+		postedData:   url.Values{"name": {"Booking site"}, "room_id": {"1"}},
+		expectedCode: http.StatusSeeOther,
+	},
+	{
+		name:         "property feed",
+		postedData:   url.Values{"name": {"Owner's phone"}, "room_id": {"0"}, "show_guest_names": {"1"}},
+		expectedCode: http.StatusSeeOther,
+	},
+	{
+		name:          "missing name",
+		postedData:    url.Values{"name": {""}, "room_id": {"1"}},
+		expectedCode:  http.StatusOK,
+		expectedError: "This field cannot be blank",
+	},
+	{
+		name:          "unknown room",
+		postedData:    url.Values{"name": {"Booking site"}, "room_id": {"101"}},
+		expectedCode:  http.StatusOK,
+		expectedError: "Choose a room",
+	},
+	{
+		name:         "database error",
+		postedData:   url.Values{"name": {"fail"}, "room_id": {"0"}},
+		expectedCode: http.StatusInternalServerError,
+	},
+}
+
+func TestPostAdminCalendarFeeds(t *testing.T) {
+	for _, e := range postAdminCalendarFeedsTests {
+		req, _ := http.NewRequest("POST", "/admin/calendar-feeds", strings.NewReader(e.postedData.Encode()))
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(Repo.PostAdminCalendarFeeds)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedCode {
+			t.Errorf("failed %s: expected code %d, but got %d", e.name, e.expectedCode, rr.Code)
+		}
+		if e.expectedError != "" && !strings.Contains(rr.Body.String(), e.expectedError) {
+			t.Errorf("failed %s: expected error %q", e.name, e.expectedError)
+		}
+	}
+}
+
+func TestAdminDeleteCalendarImport(t *testing.T) {
+	app.Events = events.NewBroker()
+	defer func() { app.Events = nil }()
+	published, unsubscribe := app.Events.Subscribe()
+	defer unsubscribe()
+
+	req, _ := http.NewRequest("GET", "/admin/calendar-imports/1/delete/do", nil)
+	ctx := getCtx(req)
+	req = req.WithContext(ctx)
+	rr := httptest.NewRecorder()
+
+	mux := chi.NewRouter()
+	mux.Get("/admin/calendar-imports/{id}/delete/do", Repo.AdminDeleteCalendarImport)
+	mux.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusSeeOther {
+		t.Errorf("expected code %d, but got %d", http.StatusSeeOther, rr.Code)
+	}
+
+	// the dates the calendar blocked are announced as freed
+	if len(published) != 1 {
+		t.Fatalf("expected one event, got %d", len(published))
+	}
+	if e := <-published; e.Type != events.BlockRemoved || e.Block.ID != 7 || e.Block.Room.RoomName != "General's Quarters" {
+		t.Errorf("unexpected event %+v", e)
+	}
+}
+
+func TestPostAdminCalendarImports(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nUID:a\r\nDTSTART;VALUE=DATE:20500106\r\n"+
+			"DTEND;VALUE=DATE:20500108\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n")
+	}))
+	defer srv.Close()
+
+	var tests = []struct {
+		name          string
+		postedData    url.Values
+		expectedCode  int
+		expectedError string
+	}{
+		{"valid", url.Values{"name": {"Airbnb"}, "room_id": {"1"}, "url": {srv.URL}}, http.StatusSeeOther, ""},
+		{"webcal", url.Values{"name": {"Airbnb"}, "room_id": {"1"}, "url": {"webcal://127.0.0.1:1/calendar.ics"}}, http.StatusSeeOther, ""},
+		{"missing url", url.Values{"name": {"Airbnb"}, "room_id": {"1"}, "url": {""}}, http.StatusOK, "This field cannot be blank"},
+		{"bad url", url.Values{"name": {"Airbnb"}, "room_id": {"1"}, "url": {"ftp://example.com/a.ics"}}, http.StatusOK, "Must be an http, https or webcal URL"},
+		{"unknown room", url.Values{"name": {"Airbnb"}, "room_id": {"101"}, "url": {srv.URL}}, http.StatusOK, "Choose a room"},
+		{"database error", url.Values{"name": {"fail"}, "room_id": {"1"}, "url": {srv.URL}}, http.StatusInternalServerError, ""},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("POST", "/admin/calendar-imports", strings.NewReader(e.postedData.Encode()))
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(Repo.PostAdminCalendarImports)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedCode {
+			t.Errorf("failed %s: expected code %d, but got %d", e.name, e.expectedCode, rr.Code)
+		}
+		if e.expectedError != "" && !strings.Contains(rr.Body.String(), e.expectedError) {
+			t.Errorf("failed %s: expected error %q", e.name, e.expectedError)
+		}
+	}
+}
+
+func TestAdminExportReservations(t *testing.T) {
+	var tests = []struct {
+		name        string
+		query       string
+		contentType string
+		expected    []string
+		notExpected []string
+	}{
+		{
+			"csv",
+			"format=csv",
+			"text/csv; charset=utf-8",
+			[]string{
+				"ID,Room,First Name,Last Name,Email,Phone,Arrival,Departure,Nights,Status,Total,Booked\n",
+				"1,General's Quarters,John,Smith,john@smith.com,,2050-01-02,2050-01-04,2,new,240.00,\n",
+				"2,General's Quarters,Jane,Doe,jane@doe.com,,2050-02-01,2050-02-02,1,processed,120.50,\n",
+				"Total (2),,,,,,,,3,,360.50\n",
+			},
+			nil,
+		},
+		{
+			"filtered csv",
+			"format=csv&status=processed",
+			"text/csv; charset=utf-8",
+			[]string{"Jane", "Total (1),,,,,,,,1,,120.50\n"},
+			[]string{"John"},
+		},
+		{
+			"searched csv",
+			"format=csv&q=smith&room=1",
+			"text/csv; charset=utf-8",
+			[]string{"John", "Total (1),,,,,,,,2,,240.00\n"},
+			[]string{"Jane"},
+		},
+		{
+			"xlsx",
+			"format=xlsx",
+			"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+			[]string{"PK"},
+			nil,
+		},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("GET", "/admin/reservations-export?"+e.query, nil)
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(Repo.AdminExportReservations)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("failed %s: expected code %d, but got %d", e.name, http.StatusOK, rr.Code)
+		}
+		if ct := rr.Header().Get("Content-Type"); ct != e.contentType {
+			t.Errorf("failed %s: unexpected content type %s", e.name, ct)
+		}
+		if cd := rr.Header().Get("Content-Disposition"); !strings.HasPrefix(cd, "attachment; filename=\"reservations-") {
+			t.Errorf("failed %s: unexpected content disposition %s", e.name, cd)
+		}
+
+		body := rr.Body.String()
+		for _, s := range e.expected {
+			if !strings.Contains(body, s) {
+				t.Errorf("failed %s: expected %q in\n%s", e.name, s, body)
+			}
+		}
+		for _, s := range e.notExpected {
+			if strings.Contains(body, s) {
+				t.Errorf("failed %s: didn't expect %q", e.name, s)
+			}
+		}
+	}
+}
+
+func TestPostAdminImportReservations(t *testing.T) {
+	header := "room,first_name,last_name,email,start_date,end_date\n"
+
+	var tests = []struct {
+		name         string
+		file         string
+		commit       bool
+		expectedCode int
+		expected     string
+	}{
+		{"check", header + "Major's Suite,John,Smith,john@smith.com,2050-01-01,2050-01-03\n", false, http.StatusOK, "Unknown room"},
+		{"nothing to import", header + "Major's Suite,John,Smith,john@smith.com,2050-01-01,2050-01-03\n", true, http.StatusOK, "0 of 1 reservations can be imported"},
+		{"missing columns", "room,first_name\nMajor's Suite,John\n", false, http.StatusOK, "missing the columns last_name, email"},
+		{"no file", "", false, http.StatusOK, "Choose a CSV file"},
+	}
+
+	for _, e := range tests {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		if e.file != "" {
+			fw, _ := mw.CreateFormFile("file", "reservations.csv")
+			_, _ = fw.Write([]byte(e.file))
+		}
+		if e.commit {
+			_ = mw.WriteField("commit", "Import")
+		}
+		_ = mw.Close()
+
+		req, _ := http.NewRequest("POST", "/admin/reservations-import", &body)
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(Repo.PostAdminImportReservations)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedCode {
+			t.Errorf("failed %s: expected code %d, but got %d", e.name, e.expectedCode, rr.Code)
+		}
+		if !strings.Contains(rr.Body.String(), e.expected) {
+			t.Errorf("failed %s: expected the page to contain %q", e.name, e.expected)
+		}
+	}
+}
+
+func TestAdminDashboard(t *testing.T) {
+	var tests = []struct {
+		name         string
+		query        string
+		accessLevel  int
+		expectedCode int
+		expected     []string
+		notExpected  []string
+	}{
+		{"period", "from=2050-01-01&to=2050-01-02", 4, http.StatusOK, []string{"75.0%", "3 of 4 room nights sold", "1.5 nights", "120.16", "90.12", `"lead_counts":[1,0,2,0,1]`}, nil},
+		{"no revenue without reports", "from=2050-01-01&to=2050-01-02", 2, http.StatusOK, []string{"75.0%", "1.5 nights"}, []string{"ADR", "RevPAR", "120.16", "90.12", "360.50"}},
+		{"missing date", "from=2050-01-01", 4, http.StatusSeeOther, nil, nil},
+		{"too long", "from=2050-01-01&to=2051-01-02", 4, http.StatusSeeOther, nil, nil},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("GET", "/admin/dashboard?"+e.query, nil)
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		session.Put(ctx, "user_id", 1)
+		session.Put(ctx, "access_level", e.accessLevel)
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(Repo.AdminDashboard)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedCode {
+			t.Errorf("failed %s: expected code %d, but got %d", e.name, e.expectedCode, rr.Code)
+		}
+		for _, s := range e.expected {
+			if !strings.Contains(rr.Body.String(), s) {
+				t.Errorf("failed %s: expected the page to contain %s", e.name, s)
+			}
+		}
+		for _, s := range e.notExpected {
+			if strings.Contains(rr.Body.String(), s) {
+				t.Errorf("failed %s: expected the page not to contain %s", e.name, s)
+			}
+		}
+	}
+}
+
+func TestAdminAllReservations(t *testing.T) {
+	var tests = []struct {
+		name        string
+		query       string
+		expected    []string
+		notExpected []string
+	}{
+		{
+			"default",
+			"",
+			[]string{"2 reservations", "Smith", "Doe", `href="/admin/reservations-all?sort=id"`, `href="/admin/reservations-all?sort=arrival"`},
+			[]string{"No reservations found", `class="pagination"`},
+		},
+		{
+			"search",
+			"q=JANE&room=1",
+			[]string{"1 reservations", "Doe", `href="/admin/reservations-all?q=JANE&amp;room=1&amp;sort=id"`},
+			[]string{"Smith"},
+		},
+		{
+			"sorted ascending",
+			"sort=arrival&dir=asc",
+			[]string{`href="/admin/reservations-all"`},
+			nil,
+		},
+		{
+			"past the last page",
+			"page=3",
+			[]string{"No reservations found", `href="/admin/reservations-all">1</a>`, "Previous"},
+			[]string{"Next"},
+		},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("GET", "/admin/reservations-all?"+e.query, nil)
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(Repo.AdminAllReservations)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Errorf("failed %s: expected code %d, but got %d", e.name, http.StatusOK, rr.Code)
+		}
+		for _, s := range e.expected {
+			if !strings.Contains(rr.Body.String(), s) {
+				t.Errorf("failed %s: expected the page to contain %s", e.name, s)
+			}
+		}
+		for _, s := range e.notExpected {
+			if strings.Contains(rr.Body.String(), s) {
+				t.Errorf("failed %s: expected the page not to contain %s", e.name, s)
+			}
+		}
+	}
+}
+
+func TestAdminSearch(t *testing.T) {
+	var tests = []struct {
+		name        string
+		query       string
+		expected    []string
+		notExpected []string
+	}{
+		{"grouped", "sm", []string{"UPC0M1NG", "CURRENT2", "PASTSTAY"}, []string{"No reservations match"}},
+		{"one group", "jane", []string{"PASTSTAY", "None"}, []string{"UPC0M1NG", "CURRENT2"}},
+		{"by code", "current2", []string{"CURRENT2", "Jon Smyth"}, []string{"PASTSTAY"}},
+		{"no match", "nobody", []string{"No reservations match <strong>nobody</strong>"}, nil},
+		{"too short", "s", []string{"Type at least two characters"}, []string{"UPC0M1NG"}},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("GET", "/admin/search?q="+e.query, nil)
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(Repo.AdminSearch)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Errorf("failed %s: expected code %d, but got %d", e.name, http.StatusOK, rr.Code)
+		}
+		for _, s := range e.expected {
+			if !strings.Contains(rr.Body.String(), s) {
+				t.Errorf("failed %s: expected the page to contain %s", e.name, s)
+			}
+		}
+		for _, s := range e.notExpected {
+			if strings.Contains(rr.Body.String(), s) {
+				t.Errorf("failed %s: expected the page not to contain %s", e.name, s)
+			}
+		}
+	}
+}
+
+var adminMoveReservationTests = []struct {
+	name         string
+	url          string
+	body         string
+	expectedCode int
+	conflicts    int
+}{
+	{"move", "/admin/reservations-timeline/1/move", `{"room_id":1,"start_date":"2050-01-05","end_date":"2050-01-07"}`, http.StatusOK, 0},
+	{"taken", "/admin/reservations-timeline/1/move", `{"room_id":2,"start_date":"2050-01-05","end_date":"2050-01-07"}`, http.StatusConflict, 2},
+	{"cancelled", "/admin/reservations-timeline/3/move", `{"room_id":1,"start_date":"2050-01-05","end_date":"2050-01-07"}`, http.StatusConflict, 0},
+	{"unknown reservation", "/admin/reservations-timeline/101/move", `{"room_id":1,"start_date":"2050-01-05","end_date":"2050-01-07"}`, http.StatusNotFound, 0},
+	{"unknown room", "/admin/reservations-timeline/1/move", `{"room_id":101,"start_date":"2050-01-05","end_date":"2050-01-07"}`, http.StatusUnprocessableEntity, 0},
+	{"end before start", "/admin/reservations-timeline/1/move", `{"room_id":1,"start_date":"2050-01-07","end_date":"2050-01-05"}`, http.StatusUnprocessableEntity, 0},
+	{"bad date", "/admin/reservations-timeline/1/move", `{"room_id":1,"start_date":"5 January","end_date":"2050-01-07"}`, http.StatusUnprocessableEntity, 0},
+	{"bad body", "/admin/reservations-timeline/1/move", `{"room":1}`, http.StatusBadRequest, 0},
+	{"database error", "/admin/reservations-timeline/1/move", `{"room_id":1,"start_date":"3002-01-05","end_date":"3002-01-07"}`, http.StatusInternalServerError, 0},
+}
+
+func TestAdminMoveReservation(t *testing.T) {
+	for _, e := range adminMoveReservationTests {
+		req, _ := http.NewRequest("POST", e.url, strings.NewReader(e.body))
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+
+		getRoutes().ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedCode {
+			t.Errorf("%s: expected code %d, but got %d", e.name, e.expectedCode, rr.Code)
+		}
+
+		var resp struct {
+			Reservation apiReservation `json:"reservation"`
+			Conflicts   []moveConflict `json:"conflicts"`
+		}
+		err := json.Unmarshal(rr.Body.Bytes(), &resp)
+		if err != nil {
+			t.Fatalf("%s: %s", e.name, err)
+		}
+		if len(resp.Conflicts) != e.conflicts {
+			t.Errorf("%s: expected %d conflicts, but got %+v", e.name, e.conflicts, resp.Conflicts)
+		}
+		if e.expectedCode == http.StatusOK && resp.Reservation.ID != 1 {
+			t.Errorf("%s: expected the moved reservation, but got %+v", e.name, resp.Reservation)
+		}
+	}
+
+	// the kinds of conflicts tell stays from blocks
+	req, _ := http.NewRequest("POST", "/admin/reservations-timeline/1/move",
+		strings.NewReader(`{"room_id":2,"start_date":"2050-01-05","end_date":"2050-01-07"}`))
+	rr := httptest.NewRecorder()
+	getRoutes().ServeHTTP(rr, req)
+	if body := rr.Body.String(); !strings.Contains(body, `"kind": "reservation"`) || !strings.Contains(body, `"kind": "block"`) {
+		t.Errorf("expected a reservation and a block in the way, got %s", body)
+	}
+}
+
+var postAdminNewReservationTests = []struct {
+	name             string
+	postedData       url.Values
+	expectedCode     int
+	expectedLocation string
+	expectedHTML     string
+}{
+	{
+		name: "valid",
+		postedData: url.Values{"room_id": {"1"}, "start_date": {"3000-01-01"}, "end_date": {"3000-01-03"},
+			"first_name": {"John"}, "last_name": {"Smith"}, "email": {"john@smith.com"}, "status": {"new"}, "send_email": {"1"}},
+		expectedCode:     http.StatusSeeOther,
+		expectedLocation: "/admin/reservations/all/1/show",
+	},
+	{
+		name: "walk-in without email",
+		postedData: url.Values{"room_id": {"1"}, "start_date": {"3000-01-01"}, "end_date": {"3000-01-03"},
+			"first_name": {"John"}, "last_name": {"Smith"}, "phone": {"555-555-5555"}, "status": {"processed"}},
+		expectedCode:     http.StatusSeeOther,
+		expectedLocation: "/admin/reservations/all/1/show",
+	},
+	{
+		name: "confirmation without email",
+		postedData: url.Values{"room_id": {"1"}, "start_date": {"3000-01-01"}, "end_date": {"3000-01-03"},
+			"first_name": {"John"}, "last_name": {"Smith"}, "status": {"new"}, "send_email": {"1"}},
+		expectedCode: http.StatusOK,
+		expectedHTML: "An email address is needed to send the confirmation",
+	},
+	{
+		name: "invalid email",
+		postedData: url.Values{"room_id": {"1"}, "start_date": {"3000-01-01"}, "end_date": {"3000-01-03"},
+			"first_name": {"John"}, "last_name": {"Smith"}, "email": {"john"}, "status": {"new"}},
+		expectedCode: http.StatusOK,
+		expectedHTML: "Invalid email address",
+	},
+	{
+		name: "unknown status",
+		postedData: url.Values{"room_id": {"1"}, "start_date": {"3000-01-01"}, "end_date": {"3000-01-03"},
+			"first_name": {"John"}, "last_name": {"Smith"}, "status": {"cancelled"}},
+		expectedCode: http.StatusOK,
+		expectedHTML: "Choose a status",
+	},
+	{
+		name: "departure before arrival",
+		postedData: url.Values{"room_id": {"1"}, "start_date": {"3000-01-03"}, "end_date": {"3000-01-01"},
+			"first_name": {"John"}, "last_name": {"Smith"}, "status": {"new"}},
+		expectedCode: http.StatusOK,
+		expectedHTML: "The departure must be after the arrival",
+	},
+	{
+		name: "unknown room",
+		postedData: url.Values{"room_id": {"101"}, "start_date": {"3000-01-01"}, "end_date": {"3000-01-03"},
+			"first_name": {"John"}, "last_name": {"Smith"}, "status": {"new"}},
+		expectedCode: http.StatusOK,
+		expectedHTML: "Choose a room",
+	},
+	{
+		name: "room taken",
+		postedData: url.Values{"room_id": {"1"}, "start_date": {"2050-01-01"}, "end_date": {"2050-01-03"},
+			"first_name": {"John"}, "last_name": {"Smith"}, "status": {"new"}},
+		expectedCode: http.StatusOK,
+		expectedHTML: "The room is not available for these dates",
+	},
+	{
+		name: "room error",
+		postedData: url.Values{"room_id": {"3"}, "start_date": {"3000-01-01"}, "end_date": {"3000-01-03"},
+			"first_name": {"John"}, "last_name": {"Smith"}, "status": {"new"}},
+		expectedCode: http.StatusInternalServerError,
+	},
+	{
+		name: "insert error",
+		postedData: url.Values{"room_id": {"2"}, "start_date": {"3000-01-01"}, "end_date": {"3000-01-03"},
+			"first_name": {"John"}, "last_name": {"Smith"}, "status": {"new"}},
+		expectedCode: http.StatusInternalServerError,
+	},
+}
+
+func TestPostAdminNewReservation(t *testing.T) {
+	for _, e := range postAdminNewReservationTests {
+		req, _ := http.NewRequest("POST", "/admin/reservations-create", strings.NewReader(e.postedData.Encode()))
+		req = req.WithContext(getCtx(req))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(Repo.PostAdminNewReservation)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedCode {
+			t.Errorf("%s: expected code %d, but got %d", e.name, e.expectedCode, rr.Code)
+		}
+		if e.expectedLocation != "" {
+			actualLoc, _ := rr.Result().Location()
+			if actualLoc.String() != e.expectedLocation {
+				t.Errorf("%s: expected location %s, but got %s", e.name, e.expectedLocation, actualLoc.String())
+			}
+		}
+		if e.expectedHTML != "" && !strings.Contains(rr.Body.String(), e.expectedHTML) {
+			t.Errorf("%s: expected to find %q in the page", e.name, e.expectedHTML)
+		}
+	}
+}
+
 func getCtx(req *http.Request) context.Context {
 	ctx, err := session.Load(req.Context(), req.Header.Get("X-Session"))
 	if err != nil {
@@ -4,7 +4,10 @@ import (
 	"encoding/gob"
 	"fmt"
 	"github.com/KingKord/bookings/internal/config"
+	"github.com/KingKord/bookings/internal/helpers"
+	"github.com/KingKord/bookings/internal/invoice"
 	"github.com/KingKord/bookings/internal/models"
+	"github.com/KingKord/bookings/internal/rbac"
 	"github.com/KingKord/bookings/internal/render"
 	"github.com/alexedwards/scs/v2"
 	"github.com/go-chi/chi/v5"
@@ -23,10 +26,14 @@ var app config.AppConfig
 var session *scs.SessionManager
 var pathToTemplates = "./../../templates"
 var functions = template.FuncMap{
-	"humanDate":  render.HumanDate,
-	"formatDate": render.FormatDate,
-	"iterate":    render.Iterate,
-	"add":        render.Add,
+	"humanDate":    render.HumanDate,
+	"formatDate":   render.FormatDate,
+	"iterate":      render.Iterate,
+	"add":          render.Add,
+	"formatAmount": invoice.FormatAmount,
+	"can":          rbac.Can,
+	"roleName":     rbac.RoleName,
+	"deviceName":   render.DeviceName,
 }
 
 func TestMain(m *testing.M) {
@@ -67,7 +74,11 @@ func TestMain(m *testing.M) {
 	repo := NewTestRepo(&app)
 	NewHandlers(repo)
 
+	// don't wait out the progressive login delay in tests
+	sleep = func(time.Duration) {}
+
 	render.NewRenderer(&app)
+	helpers.NewHelpers(&app)
 
 	os.Exit(m.Run())
 }
@@ -103,12 +114,42 @@ func getRoutes() http.Handler {
 	mux.Get("/user/login", Repo.ShowLogin)
 	mux.Post("/user/login", Repo.PostShowLogin)
 	mux.Get("/user/logout", Repo.LogOut)
+	mux.Get("/user/login/verify", Repo.ShowLoginVerify)
+	mux.Post("/user/login/verify", Repo.PostLoginVerify)
+	mux.Get("/user/2fa/setup", Repo.TwoFactorSetup)
+	mux.Post("/user/2fa/setup", Repo.PostTwoFactorSetup)
+	mux.Post("/user/2fa/disable", Repo.PostTwoFactorDisable)
+	mux.Get("/user/forgot-password", Repo.ForgotPassword)
+	mux.Post("/user/forgot-password", Repo.PostForgotPassword)
+	mux.Get("/user/reset-password", Repo.ResetPassword)
+	mux.Post("/user/reset-password", Repo.PostResetPassword)
+
+	mux.Get("/guest/register", Repo.GuestRegister)
+	mux.Post("/guest/register", Repo.PostGuestRegister)
+	mux.Get("/guest/login", Repo.GuestLogin)
+	mux.Post("/guest/login", Repo.PostGuestLogin)
+	mux.Get("/guest/logout", Repo.GuestLogOut)
+	mux.Get("/guest/stays", Repo.GuestStays)
+
+	mux.Get("/ical/{token}.ics", Repo.ICalFeed)
 
 	mux.Get("/admin/dashboard", Repo.AdminDashboard)
+	mux.Get("/admin/account", Repo.AdminAccount)
+	mux.Get("/admin/account/sessions/{sessionID}/revoke/do", Repo.AdminRevokeSession)
+	mux.Get("/admin/account/sessions/revoke-others/do", Repo.AdminRevokeOtherSessions)
 	mux.Get("/admin/reservations-new", Repo.AdminNewReservations)
 	mux.Get("/admin/reservations-all", Repo.AdminAllReservations)
+	mux.Get("/admin/search", Repo.AdminSearch)
+	mux.Get("/admin/reservations-export", Repo.AdminExportReservations)
+	mux.Get("/admin/reservations-import", Repo.AdminImportReservations)
+	mux.Post("/admin/reservations-import", Repo.PostAdminImportReservations)
 	mux.Get("/admin/reservations-calendar", Repo.AdminReservationsCalendar)
 	mux.Post("/admin/reservations-calendar", Repo.AdminPostReservationsCalendar)
+	mux.Get("/admin/reservations-timeline", Repo.AdminReservationsTimeline)
+	mux.Post("/admin/reservations-timeline/{id}/move", Repo.AdminMoveReservation)
+	mux.Get("/admin/reservations-create", Repo.AdminNewReservation)
+	mux.Post("/admin/reservations-create", Repo.PostAdminNewReservation)
+	mux.Get("/admin/reservations-create/availability", Repo.AdminNewReservationAvailability)
 
 	mux.Get("/admin/reservations/{src}/{id}/show", Repo.AdminShowReservation)
 	mux.Post("/admin/reservations/{src}/{id}", Repo.AdminPostShowReservation)
@@ -116,6 +157,56 @@ func getRoutes() http.Handler {
 	mux.Get("/admin/process-reservation/{src}/{id}/do", Repo.AdminProcessReservation)
 	mux.Get("/admin/delete-reservation/{src}/{id}/do", Repo.AdminDeleteReservation)
 
+	mux.Post("/admin/reservations/{src}/{id}/charges", Repo.AdminPostCharge)
+	mux.Post("/admin/reservations/{src}/{id}/charges/{chargeID}/delete", Repo.AdminDeleteCharge)
+	mux.Post("/admin/reservations/{src}/{id}/invoice", Repo.AdminIssueInvoice)
+	mux.Get("/admin/invoices/{id}/pdf", Repo.AdminInvoicePDF)
+	mux.Post("/admin/invoices/{id}/credit-note", Repo.AdminPostCreditNote)
+
+	mux.Get("/admin/calendar-feeds", Repo.AdminCalendarFeeds)
+	mux.Post("/admin/calendar-feeds", Repo.PostAdminCalendarFeeds)
+	mux.Get("/admin/calendar-feeds/{id}/delete/do", Repo.AdminDeleteCalendarFeed)
+	mux.Get("/admin/calendar-imports", Repo.AdminCalendarImports)
+	mux.Post("/admin/calendar-imports", Repo.PostAdminCalendarImports)
+	mux.Get("/admin/calendar-imports/{id}/sync/do", Repo.AdminSyncCalendarImport)
+	mux.Get("/admin/calendar-imports/{id}/delete/do", Repo.AdminDeleteCalendarImport)
+	mux.Get("/admin/users", Repo.AdminUsers)
+	mux.Get("/admin/users/new", Repo.AdminNewUser)
+	mux.Post("/admin/users/new", Repo.PostAdminNewUser)
+	mux.Get("/admin/users/{id}", Repo.AdminShowUser)
+	mux.Post("/admin/users/{id}", Repo.PostAdminShowUser)
+	mux.Get("/admin/delete-user/{id}/do", Repo.AdminDeleteUser)
+	mux.Get("/admin/users/{id}/reset-2fa/do", Repo.AdminResetTwoFactor)
+	mux.Get("/admin/users/{id}/unlock/do", Repo.AdminUnlockUser)
+	mux.Get("/admin/users/{id}/logout/do", Repo.AdminLogOutUser)
+	mux.Get("/admin/login-activity", Repo.AdminLoginActivity)
+	mux.Get("/admin/api-keys", Repo.AdminAPIKeys)
+	mux.Get("/admin/api-keys/new", Repo.AdminNewAPIKey)
+	mux.Post("/admin/api-keys/new", Repo.PostAdminNewAPIKey)
+	mux.Get("/admin/api-keys/{id}/revoke/do", Repo.AdminRevokeAPIKey)
+	mux.Get("/admin/webhooks", Repo.AdminWebhooks)
+	mux.Get("/admin/webhooks/new", Repo.AdminNewWebhook)
+	mux.Post("/admin/webhooks/new", Repo.PostAdminNewWebhook)
+	mux.Get("/admin/webhooks/{id}", Repo.AdminShowWebhook)
+	mux.Post("/admin/webhooks/{id}", Repo.PostAdminShowWebhook)
+	mux.Get("/admin/webhooks/{id}/delete/do", Repo.AdminDeleteWebhook)
+	mux.Get("/admin/webhooks/{id}/deliveries/{deliveryID}/redeliver/do", Repo.AdminRedeliverWebhook)
+
+	mux.Get("/api/openapi.json", Repo.OpenAPISpec)
+	mux.Get("/api/docs", Repo.APIDocs)
+
+	mux.Route("/api/v1", func(mux chi.Router) {
+		mux.NotFound(Repo.APINotFound)
+		mux.MethodNotAllowed(Repo.APIMethodNotAllowed)
+
+		mux.Get("/rooms", Repo.APIRooms)
+		mux.Get("/rooms/{id}/availability", Repo.APIRoomAvailability)
+		mux.Get("/availability", Repo.APIAvailability)
+		mux.Post("/reservations", Repo.APICreateReservation)
+		mux.Get("/reservations/{id}", Repo.APIReservation)
+		mux.Delete("/reservations/{id}", Repo.APICancelReservation)
+	})
+
 	fileServer := http.FileServer(http.Dir("./static/"))
 	mux.Handle("/static/*", http.StripPrefix("/static", fileServer))
 	return mux
@@ -1,8 +1,15 @@
 package helpers
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"github.com/KingKord/bookings/internal/config"
+	"net"
 	"net/http"
 	"runtime/debug"
 )
@@ -25,7 +32,98 @@ func ServerError(w http.ResponseWriter, err error) {
 	http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 }
 
+// APIError is the error object returned by the JSON API
+type APIError struct {
+	Code    string            `json:"code"`
+	Message string            `json:"message"`
+	Fields  map[string]string `json:"fields,omitempty"`
+}
+
+// WriteJSON writes v as a JSON response with the given status
+func WriteJSON(w http.ResponseWriter, status int, v interface{}) {
+	out, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		ServerErrorJSON(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(out)
+}
+
+// ErrorJSON writes an API error object with the given status
+func ErrorJSON(w http.ResponseWriter, status int, e APIError) {
+	out, _ := json.MarshalIndent(map[string]APIError{"error": e}, "", "  ")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(out)
+}
+
+// ServerErrorJSON logs err and writes an internal error object, it is the API counterpart of ServerError
+func ServerErrorJSON(w http.ResponseWriter, err error) {
+	trace := fmt.Sprintf("%s\n%s", err.Error(), debug.Stack())
+	app.ErrorLog.Println(trace)
+	ErrorJSON(w, http.StatusInternalServerError, APIError{Code: "internal_error", Message: "Internal server error"})
+}
+
 func IsAuthenticated(r *http.Request) bool {
 	exist := app.Session.Exists(r.Context(), "user_id")
 	return exist
 }
+
+// IsGuest reports whether a guest account is logged in
+func IsGuest(r *http.Request) bool {
+	exist := app.Session.Exists(r.Context(), "guest_id")
+	return exist
+}
+
+// RandomString returns a url safe random string built from n random bytes
+func RandomString(n int) (string, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// ConfirmationCode returns a random reservation confirmation code, made of letters and digits that
+// can't be mistaken for one another
+func ConfirmationCode() (string, error) {
+	const alphabet = "ABCDEFGHJKMNPQRSTUVWXYZ23456789"
+
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	for i := range b {
+		b[i] = alphabet[int(b[i])%len(alphabet)]
+	}
+	return string(b), nil
+}
+
+// HashToken returns the hex encoded sha256 hash a token is stored as
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// DestroyUserSessions logs a staff user out of every session they have open
+func DestroyUserSessions(ctx context.Context, userID int) error {
+	return app.Session.Iterate(ctx, func(ctx context.Context) error {
+		if app.Session.GetInt(ctx, "user_id") != userID {
+			return nil
+		}
+		return app.Session.Destroy(ctx)
+	})
+}
+
+// ClientIP returns the address of the client that made the request
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,121 @@
+package ical
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	dateLayout     = "20060102"
+	dateTimeLayout = "20060102T150405Z"
+	// maxLineLength is the most octets a content line may have before it is folded
+	maxLineLength = 75
+)
+
+// Event is an all-day event, it ends the day before End like DTEND in iCalendar
+type Event struct {
+	UID         string
+	Start       time.Time
+	End         time.Time
+	Summary     string
+	Description string
+	// Stamp is when the event was last changed
+	Stamp time.Time
+}
+
+// Calendar is a published calendar of all-day events
+type Calendar struct {
+	Name   string
+	Events []Event
+}
+
+// WriteTo writes the calendar in iCalendar format (RFC 5545)
+func (c Calendar) WriteTo(w io.Writer) (int64, error) {
+	cw := &contentWriter{w: bufio.NewWriter(w)}
+
+	cw.line("BEGIN:VCALENDAR")
+	cw.line("VERSION:2.0")
+	cw.line("PRODID:-//KingKord//Bookings//EN")
+	cw.line("CALSCALE:GREGORIAN")
+	cw.line("METHOD:PUBLISH")
+	if c.Name != "" {
+		cw.line("X-WR-CALNAME:" + escape(c.Name))
+	}
+
+	for _, e := range c.Events {
+		cw.line("BEGIN:VEVENT")
+		cw.line("UID:" + escape(e.UID))
+		cw.line("DTSTAMP:" + e.Stamp.UTC().Format(dateTimeLayout))
+		cw.line("DTSTART;VALUE=DATE:" + e.Start.Format(dateLayout))
+		cw.line("DTEND;VALUE=DATE:" + e.End.Format(dateLayout))
+		cw.line("SUMMARY:" + escape(e.Summary))
+		if e.Description != "" {
+			cw.line("DESCRIPTION:" + escape(e.Description))
+		}
+		cw.line("TRANSP:OPAQUE")
+		cw.line("END:VEVENT")
+	}
+
+	cw.line("END:VCALENDAR")
+
+	if cw.err == nil {
+		cw.err = cw.w.Flush()
+	}
+	return cw.n, cw.err
+}
+
+// contentWriter writes folded CRLF terminated content lines, keeping the first error
+type contentWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (cw *contentWriter) line(s string) {
+	if cw.err != nil {
+		return
+	}
+	n, err := cw.w.WriteString(fold(s) + "\r\n")
+	cw.n += int64(n)
+	cw.err = err
+}
+
+// fold splits a content line into lines of at most 75 octets, continuation lines start with a space.
+// It never splits a UTF-8 character
+func fold(s string) string {
+	if len(s) <= maxLineLength {
+		return s
+	}
+
+	var b strings.Builder
+	limit := maxLineLength
+	for len(s) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(s[cut]) {
+			cut--
+		}
+		b.WriteString(s[:cut])
+		b.WriteString("\r\n ")
+		s = s[cut:]
+		// the leading space counts towards the length of continuation lines
+		limit = maxLineLength - 1
+	}
+	b.WriteString(s)
+	return b.String()
+}
+
+// escape escapes a TEXT value
+func escape(s string) string {
+	return textEscaper.Replace(s)
+}
+
+var textEscaper = strings.NewReplacer(
+	`\`, `\\`,
+	";", `\;`,
+	",", `\,`,
+	"\r\n", `\n`,
+	"\n", `\n`,
+)
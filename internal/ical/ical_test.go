@@ -0,0 +1,164 @@
+package ical
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteTo(t *testing.T) {
+	c := Calendar{
+		Name: "General's Quarters",
+		Events: []Event{
+			{
+				UID:     "reservation-1@example.com",
+				Start:   time.Date(2050, 1, 1, 0, 0, 0, 0, time.UTC),
+				End:     time.Date(2050, 1, 3, 0, 0, 0, 0, time.UTC),
+				Summary: "Smith, John; VIP",
+				Stamp:   time.Date(2049, 12, 1, 10, 30, 0, 0, time.FixedZone("CET", 3600)),
+			},
+		},
+	}
+
+	var b strings.Builder
+	n, err := c.WriteTo(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(b.Len()) {
+		t.Errorf("expected %d bytes written, got %d", b.Len(), n)
+	}
+
+	expected := "BEGIN:VCALENDAR\r\n" +
+		"VERSION:2.0\r\n" +
+		"PRODID:-//KingKord//Bookings//EN\r\n" +
+		"CALSCALE:GREGORIAN\r\n" +
+		"METHOD:PUBLISH\r\n" +
+		"X-WR-CALNAME:General's Quarters\r\n" +
+		"BEGIN:VEVENT\r\n" +
+		"UID:reservation-1@example.com\r\n" +
+		"DTSTAMP:20491201T093000Z\r\n" +
+		"DTSTART;VALUE=DATE:20500101\r\n" +
+		"DTEND;VALUE=DATE:20500103\r\n" +
+		"SUMMARY:Smith\\, John\\; VIP\r\n" +
+		"TRANSP:OPAQUE\r\n" +
+		"END:VEVENT\r\n" +
+		"END:VCALENDAR\r\n"
+	if b.String() != expected {
+		t.Errorf("unexpected calendar:\n%s", b.String())
+	}
+}
+
+func TestFold(t *testing.T) {
+	var tests = []struct {
+		name string
+		line string
+	}{
+		{"short", "SUMMARY:Blocked"},
+		{"ascii", "DESCRIPTION:" + strings.Repeat("a", 200)},
+		{"multibyte", "SUMMARY:" + strings.Repeat("ё", 100)},
+	}
+
+	for _, e := range tests {
+		folded := fold(e.line)
+		lines := strings.Split(folded, "\r\n")
+		for i, l := range lines {
+			if len(l) > maxLineLength {
+				t.Errorf("%s: line %d is %d octets long", e.name, i, len(l))
+			}
+			if i > 0 && !strings.HasPrefix(l, " ") {
+				t.Errorf("%s: continuation line %d doesn't start with a space", e.name, i)
+			}
+		}
+		if unfolded := strings.ReplaceAll(folded, "\r\n ", ""); unfolded != e.line {
+			t.Errorf("%s: unfolding doesn't give back the line", e.name)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2050, 1, d, 0, 0, 0, 0, time.UTC) }
+
+	cal := "BEGIN:VCALENDAR\r\n" +
+		"VERSION:2.0\r\n" +
+		"BEGIN:VEVENT\r\n" +
+		"UID:abc@example.com\r\n" +
+		"DTSTART;VALUE=DATE:20500101\r\n" +
+		"DTEND;VALUE=DATE:20500103\r\n" +
+		"SUMMARY:Smith\\, John\r\n" +
+		"DESCRIPTION:A long\r\n" +
+		"  description\r\n" +
+		"BEGIN:VALARM\r\n" +
+		"DESCRIPTION:Reminder\r\n" +
+		"END:VALARM\r\n" +
+		"END:VEVENT\r\n" +
+		"BEGIN:VEVENT\r\n" +
+		"UID:stay@example.com\r\n" +
+		"DTSTART;TZID=\"Europe/Berlin\":20500105T150000\r\n" +
+		"DTEND:20500107T100000Z\r\n" +
+		"END:VEVENT\r\n" +
+		"BEGIN:VEVENT\r\n" +
+		"DTSTART:20500110\r\n" +
+		"END:VEVENT\r\n" +
+		"BEGIN:VEVENT\r\n" +
+		"UID:cancelled@example.com\r\n" +
+		"DTSTART:20500112\r\n" +
+		"STATUS:CANCELLED\r\n" +
+		"END:VEVENT\r\n" +
+		"END:VCALENDAR\r\n"
+
+	events, err := Parse(strings.NewReader(cal))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Event{
+		{UID: "abc@example.com", Start: day(1), End: day(3), Summary: "Smith, John", Description: "A long description"},
+		{UID: "stay@example.com", Start: day(5), End: day(7)},
+		{UID: "20500110-20500111", Start: day(10), End: day(11)},
+	}
+	if len(events) != len(expected) {
+		t.Fatalf("expected %d events but got %d: %+v", len(expected), len(events), events)
+	}
+	for i, e := range expected {
+		if events[i] != e {
+			t.Errorf("event %d: expected %+v but got %+v", i, e, events[i])
+		}
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	var tests = []struct {
+		name string
+		cal  string
+	}{
+		{"not a calendar", "<html></html>"},
+		{"empty", ""},
+		{"no start", "BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nUID:a\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n"},
+		{"bad date", "BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nDTSTART:2050-01-01\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n"},
+		{"unterminated", "BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nDTSTART:20500101\r\n"},
+	}
+
+	for _, e := range tests {
+		_, err := Parse(strings.NewReader(e.cal))
+		if err == nil {
+			t.Errorf("%s: expected an error", e.name)
+		}
+	}
+}
+
+func TestParseRoundTrip(t *testing.T) {
+	c := Calendar{Events: []Event{
+		{UID: "block-1@example.com", Start: time.Date(2050, 1, 1, 0, 0, 0, 0, time.UTC), End: time.Date(2050, 1, 2, 0, 0, 0, 0, time.UTC), Summary: strings.Repeat("Blocked; ", 20)},
+	}}
+	var b strings.Builder
+	_, _ = c.WriteTo(&b)
+
+	events, err := Parse(strings.NewReader(b.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].UID != c.Events[0].UID || events[0].Summary != c.Events[0].Summary {
+		t.Errorf("expected the written event back, got %+v", events)
+	}
+}
@@ -0,0 +1,176 @@
+package ical
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// ErrNotCalendar is returned when parsing something that isn't an iCalendar file
+var ErrNotCalendar = errors.New("not an iCalendar file")
+
+// Parse reads the events of an iCalendar file as all-day events, leaving out cancelled ones.
+// An event with times covers the nights from the day it starts to the day it ends, like a stay
+// from check-in to check-out. An event without an end, or ending the day it starts, lasts a day
+func Parse(r io.Reader) ([]Event, error) {
+	lines, err := unfold(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(lines) == 0 || !strings.EqualFold(lines[0], "BEGIN:VCALENDAR") {
+		return nil, ErrNotCalendar
+	}
+
+	var events []Event
+	var e Event
+	var inEvent, cancelled bool
+	// depth counts the components nested in an event, such as alarms, whose properties are ignored
+	depth := 0
+
+	for i, l := range lines {
+		name, params, value := splitLine(l)
+
+		switch {
+		case name == "BEGIN" && strings.EqualFold(value, "VEVENT") && !inEvent:
+			inEvent, cancelled = true, false
+			e = Event{}
+		case !inEvent:
+			continue
+		case name == "BEGIN":
+			depth++
+		case name == "END" && depth > 0:
+			depth--
+		case depth > 0:
+			continue
+		case name == "END" && strings.EqualFold(value, "VEVENT"):
+			inEvent = false
+			if e.Start.IsZero() {
+				return nil, fmt.Errorf("line %d: event %q has no DTSTART", i+1, e.UID)
+			}
+			if !e.End.After(e.Start) {
+				e.End = e.Start.AddDate(0, 0, 1)
+			}
+			if e.UID == "" {
+				e.UID = fmt.Sprintf("%s-%s", e.Start.Format(dateLayout), e.End.Format(dateLayout))
+			}
+			if !cancelled {
+				events = append(events, e)
+			}
+		case name == "UID":
+			e.UID = value
+		case name == "SUMMARY":
+			e.Summary = unescape(value)
+		case name == "DESCRIPTION":
+			e.Description = unescape(value)
+		case name == "STATUS":
+			cancelled = strings.EqualFold(value, "CANCELLED")
+		case name == "DTSTAMP":
+			e.Stamp, _ = time.Parse(dateTimeLayout, value)
+		case name == "DTSTART":
+			e.Start, err = parseDate(value, params)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", i+1, err)
+			}
+		case name == "DTEND":
+			e.End, err = parseDate(value, params)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", i+1, err)
+			}
+		}
+	}
+
+	if inEvent {
+		return nil, errors.New("unterminated event")
+	}
+	return events, nil
+}
+
+// unfold returns the content lines of an iCalendar file, joining folded lines
+func unfold(r io.Reader) ([]string, error) {
+	var lines []string
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		l := strings.TrimRight(sc.Text(), "\r")
+		if l == "" {
+			continue
+		}
+		if (l[0] == ' ' || l[0] == '\t') && len(lines) > 0 {
+			lines[len(lines)-1] += l[1:]
+			continue
+		}
+		lines = append(lines, l)
+	}
+	return lines, sc.Err()
+}
+
+// splitLine splits a content line into its upper case name, its parameters and its value
+func splitLine(l string) (string, map[string]string, string) {
+	// the value starts at the first colon that isn't in a quoted parameter value
+	quoted := false
+	colon := -1
+	for i, c := range l {
+		if c == '"' {
+			quoted = !quoted
+		} else if c == ':' && !quoted {
+			colon = i
+			break
+		}
+	}
+	if colon < 0 {
+		return strings.ToUpper(l), nil, ""
+	}
+
+	parts := strings.Split(l[:colon], ";")
+	params := make(map[string]string)
+	for _, p := range parts[1:] {
+		k, v, _ := strings.Cut(p, "=")
+		params[strings.ToUpper(k)] = strings.Trim(v, `"`)
+	}
+	return strings.ToUpper(parts[0]), params, l[colon+1:]
+}
+
+// parseDate parses a DATE or DATE-TIME value into the date it falls on, in UTC.
+// Times in UTC or a named time zone are converted to it, floating times are taken as they are
+func parseDate(value string, params map[string]string) (time.Time, error) {
+	if params["VALUE"] == "DATE" || len(value) == len(dateLayout) {
+		return time.Parse(dateLayout, value)
+	}
+
+	loc := time.UTC
+	if tz := params["TZID"]; tz != "" {
+		if l, err := time.LoadLocation(tz); err == nil {
+			loc = l
+		}
+	}
+
+	var t time.Time
+	var err error
+	if strings.HasSuffix(value, "Z") {
+		t, err = time.Parse(dateTimeLayout, value)
+	} else {
+		t, err = time.ParseInLocation("20060102T150405", value, loc)
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	y, m, d := t.In(loc).Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC), nil
+}
+
+// unescape reverses escape
+func unescape(s string) string {
+	return textUnescaper.Replace(s)
+}
+
+var textUnescaper = strings.NewReplacer(
+	`\\`, `\`,
+	`\;`, ";",
+	`\,`, ",",
+	`\n`, "\n",
+	`\N`, "\n",
+)
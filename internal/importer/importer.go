@@ -0,0 +1,287 @@
+package importer
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"github.com/KingKord/bookings/internal/forms"
+	"github.com/KingKord/bookings/internal/models"
+	"github.com/KingKord/bookings/internal/repository"
+	"io"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const dateLayout = "2006-01-02"
+
+// Columns lists the columns of an import file, the header names them in any order.
+// phone and status may be left out, status is new or processed and defaults to new
+var Columns = []string{"room", "first_name", "last_name", "email", "phone", "start_date", "end_date", "status"}
+
+var requiredColumns = []string{"room", "first_name", "last_name", "email", "start_date", "end_date"}
+
+// MaxRows is the most reservations a file may hold
+const MaxRows = 5000
+
+// FileError is returned when a file can't be read as a file of reservations
+type FileError struct {
+	Err error
+}
+
+func (e *FileError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *FileError) Unwrap() error {
+	return e.Err
+}
+
+// Row is a reservation read from a line of the file, with what is wrong with it
+type Row struct {
+	Line        int
+	Reservation models.Reservation
+	// Errors are the fields that failed validation, as field: message
+	Errors []string
+	// Conflicts are the reservations, blocks and other rows of the file it overlaps
+	Conflicts []string
+}
+
+// Valid reports whether the row can be imported
+func (r Row) Valid() bool {
+	return len(r.Errors) == 0 && len(r.Conflicts) == 0
+}
+
+// Report lists every row of a file. Committed is set when the valid rows were imported
+type Report struct {
+	Rows      []Row
+	Committed bool
+}
+
+// ValidRows returns the number of rows that can be imported
+func (r Report) ValidRows() int {
+	n := 0
+	for _, row := range r.Rows {
+		if row.Valid() {
+			n++
+		}
+	}
+	return n
+}
+
+// Run reads a CSV file of reservations and checks every row: its fields with the rules of the
+// reservation form, and its nights against the room's restrictions and the other rows. With commit
+// set the valid rows are then imported, with their restrictions, in one transaction, and get their ids.
+// Problems with rows are in the report, a *FileError is returned when the file itself can't be read
+func Run(db repository.DatabaseRepo, r io.Reader, commit bool) (Report, error) {
+	var report Report
+
+	rooms, err := db.AllRooms()
+	if err != nil {
+		return report, err
+	}
+
+	report.Rows, err = parse(r, rooms)
+	if err != nil {
+		return report, &FileError{err}
+	}
+
+	err = checkConflicts(db, report.Rows)
+	if err != nil {
+		return report, err
+	}
+
+	if !commit || report.ValidRows() == 0 {
+		return report, nil
+	}
+
+	var valid []models.Reservation
+	for _, row := range report.Rows {
+		if row.Valid() {
+			valid = append(valid, row.Reservation)
+		}
+	}
+
+	ids, err := db.ImportReservations(valid)
+	if err != nil {
+		return report, err
+	}
+
+	i := 0
+	now := time.Now()
+	for n, row := range report.Rows {
+		if row.Valid() {
+			report.Rows[n].Reservation.ID = ids[i]
+			report.Rows[n].Reservation.CreatedAt = now
+			i++
+		}
+	}
+	report.Committed = true
+
+	return report, nil
+}
+
+// parse reads and validates the rows of a file
+func parse(r io.Reader, rooms []models.Room) ([]Row, error) {
+	cr := csv.NewReader(r)
+	cr.TrimLeadingSpace = true
+
+	header, err := cr.Read()
+	if errors.Is(err, io.EOF) {
+		return nil, errors.New("the file is empty")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	index := make(map[string]int)
+	for i, name := range header {
+		// spreadsheet apps start UTF-8 files with a byte order mark
+		name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		index[name] = i
+	}
+	var missing []string
+	for _, c := range requiredColumns {
+		if _, ok := index[c]; !ok {
+			missing = append(missing, c)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("the header is missing the columns %s", strings.Join(missing, ", "))
+	}
+
+	var rows []Row
+	for {
+		record, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(rows) == MaxRows {
+			return nil, fmt.Errorf("the file has more than %d reservations", MaxRows)
+		}
+
+		line, _ := cr.FieldPos(0)
+		values := url.Values{}
+		for _, c := range Columns {
+			if i, ok := index[c]; ok && i < len(record) {
+				values.Set(c, strings.TrimSpace(record[i]))
+			}
+		}
+		rows = append(rows, validate(line, values, rooms))
+	}
+
+	if len(rows) == 0 {
+		return nil, errors.New("the file has no reservations")
+	}
+	return rows, nil
+}
+
+// validate checks the fields of a row
+func validate(line int, values url.Values, rooms []models.Room) Row {
+	row := Row{Line: line}
+
+	form := forms.New(values)
+	form.Required(requiredColumns...)
+	form.MinLength("first_name", 3)
+	form.IsEmail("email")
+
+	startDate, err := time.Parse(dateLayout, values.Get("start_date"))
+	if err != nil && form.Errors.Get("start_date") == "" {
+		form.Errors.Add("start_date", "Must be a date such as 2050-01-31")
+	}
+	endDate, err := time.Parse(dateLayout, values.Get("end_date"))
+	if err != nil && form.Errors.Get("end_date") == "" {
+		form.Errors.Add("end_date", "Must be a date such as 2050-01-31")
+	}
+	if form.Errors.Get("start_date") == "" && form.Errors.Get("end_date") == "" && !endDate.After(startDate) {
+		form.Errors.Add("end_date", "Must be after start_date")
+	}
+
+	room, ok := findRoom(rooms, values.Get("room"))
+	if !ok && form.Errors.Get("room") == "" {
+		form.Errors.Add("room", "Unknown room")
+	}
+
+	processed := 0
+	switch strings.ToLower(values.Get("status")) {
+	case "", models.ReservationNew:
+	case models.ReservationProcessed:
+		processed = 1
+	default:
+		form.Errors.Add("status", "Must be new or processed")
+	}
+
+	// report the errors in the order of the columns
+	for _, c := range Columns {
+		if msg := form.Errors.Get(c); msg != "" {
+			row.Errors = append(row.Errors, c+": "+msg)
+		}
+	}
+
+	row.Reservation = models.Reservation{
+		FirstName: values.Get("first_name"),
+		LastName:  values.Get("last_name"),
+		Email:     values.Get("email"),
+		Phone:     values.Get("phone"),
+		StartDate: startDate,
+		EndDate:   endDate,
+		RoomID:    room.ID,
+		Room:      room,
+		Processed: processed,
+	}
+	return row
+}
+
+// findRoom finds a room by id or by name
+func findRoom(rooms []models.Room, s string) (models.Room, bool) {
+	id, err := strconv.Atoi(s)
+	for _, r := range rooms {
+		if (err == nil && r.ID == id) || strings.EqualFold(r.RoomName, s) {
+			return r, true
+		}
+	}
+	return models.Room{}, false
+}
+
+// checkConflicts adds to the valid rows the restrictions and the other rows they overlap
+func checkConflicts(db repository.DatabaseRepo, rows []Row) error {
+	for i := range rows {
+		if len(rows[i].Errors) > 0 {
+			continue
+		}
+		res := rows[i].Reservation
+
+		// the restrictions overlapping a stay are those starting before its last night
+		restrictions, err := db.GetRestrictionsForRoomByDate(res.RoomID, res.StartDate, res.EndDate.AddDate(0, 0, -1))
+		if err != nil {
+			return err
+		}
+		sort.Slice(restrictions, func(a, b int) bool {
+			return restrictions[a].StartDate.Before(restrictions[b].StartDate)
+		})
+		for _, rr := range restrictions {
+			what := "a block"
+			if rr.ReservationID > 0 {
+				what = fmt.Sprintf("reservation %d", rr.ReservationID)
+			}
+			rows[i].Conflicts = append(rows[i].Conflicts, fmt.Sprintf("overlaps %s from %s to %s",
+				what, rr.StartDate.Format(dateLayout), rr.EndDate.Format(dateLayout)))
+		}
+
+		for j := range rows {
+			other := rows[j].Reservation
+			if j == i || len(rows[j].Errors) > 0 || other.RoomID != res.RoomID {
+				continue
+			}
+			if other.StartDate.Before(res.EndDate) && res.StartDate.Before(other.EndDate) {
+				rows[i].Conflicts = append(rows[i].Conflicts, fmt.Sprintf("overlaps line %d", rows[j].Line))
+			}
+		}
+	}
+	return nil
+}
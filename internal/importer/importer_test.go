@@ -0,0 +1,123 @@
+package importer
+
+import (
+	"errors"
+	"github.com/KingKord/bookings/internal/models"
+	"github.com/KingKord/bookings/internal/repository"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeDB has two rooms, the first reserved from 2050-01-02 to 2050-01-04
+type fakeDB struct {
+	repository.DatabaseRepo
+	imported []models.Reservation
+}
+
+func (db *fakeDB) AllRooms() ([]models.Room, error) {
+	return []models.Room{{ID: 1, RoomName: "General's Quarters"}, {ID: 2, RoomName: "Major's Suite"}}, nil
+}
+
+func (db *fakeDB) GetRestrictionsForRoomByDate(roomID int, start, end time.Time) ([]models.RoomRestriction, error) {
+	rr := models.RoomRestriction{RoomID: 1, ReservationID: 7,
+		StartDate: time.Date(2050, 1, 2, 0, 0, 0, 0, time.UTC), EndDate: time.Date(2050, 1, 4, 0, 0, 0, 0, time.UTC)}
+	// the same condition as the query
+	if roomID == rr.RoomID && start.Before(rr.EndDate) && !end.Before(rr.StartDate) {
+		return []models.RoomRestriction{rr}, nil
+	}
+	return nil, nil
+}
+
+func (db *fakeDB) ImportReservations(reservations []models.Reservation) ([]int, error) {
+	db.imported = reservations
+	var ids []int
+	for i := range reservations {
+		ids = append(ids, 100+i)
+	}
+	return ids, nil
+}
+
+const file = "\ufeffRoom,First_Name,Last_Name,Email,Phone,Start_Date,End_Date,Status\n" +
+	"1,John,Smith,john@smith.com,555-1234,2050-01-04,2050-01-06,processed\n" +
+	"general's quarters,Jane,Doe,jane@doe.com,,2050-01-01,2050-01-03,\n" +
+	"2,Al,Bundy,not-an-email,,2050-02-02,2050-02-01,\n" +
+	"Major's Suite,Peggy,Bundy,peggy@bundy.com,,2050-02-01,2050-02-03,new\n" +
+	"2,Kelly,Bundy,kelly@bundy.com,,2050-02-02,2050-02-04,new\n" +
+	"3,Bud,Bundy,bud@bundy.com,,2050-03-01,2050-03-02,vip\n"
+
+func TestRun(t *testing.T) {
+	expected := []struct {
+		line      int
+		errors    []string
+		conflicts []string
+	}{
+		{2, nil, nil},
+		{3, nil, []string{"overlaps reservation 7 from 2050-01-02 to 2050-01-04"}},
+		{4, []string{"first_name: This field must be at least 3 characters long", "email: Invalid email address", "end_date: Must be after start_date"}, nil},
+		{5, nil, []string{"overlaps line 6"}},
+		{6, nil, []string{"overlaps line 5"}},
+		{7, []string{"room: Unknown room", "status: Must be new or processed"}, nil},
+	}
+
+	db := &fakeDB{}
+	report, err := Run(db, strings.NewReader(file), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Rows) != len(expected) {
+		t.Fatalf("expected %d rows but got %d", len(expected), len(report.Rows))
+	}
+	for i, e := range expected {
+		row := report.Rows[i]
+		if row.Line != e.line {
+			t.Errorf("row %d: expected line %d but got %d", i, e.line, row.Line)
+		}
+		if !reflect.DeepEqual(row.Errors, e.errors) {
+			t.Errorf("line %d: expected errors %q but got %q", e.line, e.errors, row.Errors)
+		}
+		if !reflect.DeepEqual(row.Conflicts, e.conflicts) {
+			t.Errorf("line %d: expected conflicts %q but got %q", e.line, e.conflicts, row.Conflicts)
+		}
+	}
+	if report.Committed || db.imported != nil {
+		t.Error("expected a dry run not to import anything")
+	}
+
+	report, err = Run(db, strings.NewReader(file), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Committed || report.ValidRows() != 1 || len(db.imported) != 1 {
+		t.Fatalf("expected the one valid row to be imported, got %+v", report)
+	}
+	res := db.imported[0]
+	if res.FirstName != "John" || res.RoomID != 1 || res.Processed != 1 || res.Phone != "555-1234" {
+		t.Errorf("unexpected reservation %+v", res)
+	}
+	if report.Rows[0].Reservation.ID != 100 || report.Rows[0].Reservation.CreatedAt.IsZero() {
+		t.Errorf("expected the row to get the new id and creation time, got %+v", report.Rows[0].Reservation)
+	}
+}
+
+func TestRunInvalidFile(t *testing.T) {
+	var tests = []struct {
+		name     string
+		file     string
+		expected string
+	}{
+		{"empty", "", "the file is empty"},
+		{"missing columns", "room,first_name,email\n1,John,john@smith.com\n", "missing the columns last_name, start_date, end_date"},
+		{"no rows", "room,first_name,last_name,email,start_date,end_date\n", "no reservations"},
+		{"bad csv", "room,first_name,last_name,email,start_date,end_date\n1,\"John,Smith\n", "extraneous or missing"},
+	}
+
+	for _, e := range tests {
+		_, err := Run(&fakeDB{}, strings.NewReader(e.file), true)
+		var fileErr *FileError
+		if !errors.As(err, &fileErr) || !strings.Contains(err.Error(), e.expected) {
+			t.Errorf("%s: expected a file error containing %q, got %v", e.name, e.expected, err)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package invoice
+
+import (
+	"errors"
+	"fmt"
+	"github.com/KingKord/bookings/internal/models"
+	"strconv"
+	"strings"
+)
+
+// Issuer holds the property details printed on every invoice
+type Issuer struct {
+	Name     string
+	Address  []string
+	Email    string
+	Currency string
+}
+
+// DefaultIssuer is the property the application is running for
+var DefaultIssuer = Issuer{
+	Name:     "Fort Smythe Bed & Breakfast",
+	Address:  []string{"100 Rocky Road", "Canada"},
+	Email:    "info@fsbb.ca",
+	Currency: "CAD",
+}
+
+// FormatNumber builds the printed document number, e.g. FSBB-INV-000042
+func FormatNumber(property, kind string, number int) string {
+	prefix := "INV"
+	if kind == models.InvoiceKindCreditNote {
+		prefix = "CN"
+	}
+	return fmt.Sprintf("%s-%s-%06d", property, prefix, number)
+}
+
+// FormatAmount formats an amount in cents as a decimal string
+func FormatAmount(cents int) string {
+	sign := ""
+	if cents < 0 {
+		sign = "-"
+		cents = -cents
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, cents/100, cents%100)
+}
+
+// ParseAmount parses a decimal string such as 120 or 120.50 into cents
+func ParseAmount(s string) (int, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, errors.New("amount is empty")
+	}
+
+	whole, frac, found := strings.Cut(s, ".")
+	if found && (len(frac) == 0 || len(frac) > 2) {
+		return 0, fmt.Errorf("invalid amount %q", s)
+	}
+	for len(frac) < 2 {
+		frac += "0"
+	}
+
+	w, err := strconv.Atoi(whole)
+	if err != nil || w < 0 {
+		return 0, fmt.Errorf("invalid amount %q", s)
+	}
+	f, err := strconv.Atoi(frac)
+	if err != nil || f < 0 {
+		return 0, fmt.Errorf("invalid amount %q", s)
+	}
+
+	return w*100 + f, nil
+}
+
+// FileName returns the download file name of an invoice
+func FileName(inv models.Invoice) string {
+	return fmt.Sprintf("%s.pdf", inv.InvoiceNumber)
+}
+
+// Nights returns the number of nights covered by the invoice
+func Nights(inv models.Invoice) int {
+	return int(inv.EndDate.Sub(inv.StartDate).Hours() / 24)
+}
@@ -0,0 +1,115 @@
+package invoice
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/KingKord/bookings/internal/models"
+	"strings"
+	"testing"
+	"time"
+)
+
+var parseAmountTests = []struct {
+	name     string
+	input    string
+	expected int
+	isError  bool
+}{
+	{"whole", "120", 12000, false},
+	{"one decimal", "120.5", 12050, false},
+	{"two decimals", "0.99", 99, false},
+	{"spaces", " 10.00 ", 1000, false},
+	{"empty", "", 0, true},
+	{"three decimals", "1.999", 0, true},
+	{"trailing dot", "1.", 0, true},
+	{"negative", "-5", 0, true},
+	{"letters", "abc", 0, true},
+}
+
+func TestParseAmount(t *testing.T) {
+	for _, e := range parseAmountTests {
+		got, err := ParseAmount(e.input)
+		if e.isError && err == nil {
+			t.Errorf("%s: expected error but did not get one", e.name)
+		}
+		if !e.isError && err != nil {
+			t.Errorf("%s: unexpected error %s", e.name, err)
+		}
+		if got != e.expected {
+			t.Errorf("%s: expected %d but got %d", e.name, e.expected, got)
+		}
+	}
+}
+
+func TestFormatAmount(t *testing.T) {
+	if FormatAmount(12050) != "120.50" {
+		t.Errorf("expected 120.50 but got %s", FormatAmount(12050))
+	}
+	if FormatAmount(-5) != "-0.05" {
+		t.Errorf("expected -0.05 but got %s", FormatAmount(-5))
+	}
+}
+
+func TestFormatNumber(t *testing.T) {
+	if FormatNumber("FSBB", models.InvoiceKindInvoice, 42) != "FSBB-INV-000042" {
+		t.Errorf("wrong invoice number %s", FormatNumber("FSBB", models.InvoiceKindInvoice, 42))
+	}
+	if FormatNumber("FSBB", models.InvoiceKindCreditNote, 7) != "FSBB-CN-000007" {
+		t.Errorf("wrong credit note number %s", FormatNumber("FSBB", models.InvoiceKindCreditNote, 7))
+	}
+}
+
+func TestPDF(t *testing.T) {
+	inv := models.Invoice{
+		Kind:          models.InvoiceKindInvoice,
+		InvoiceNumber: "FSBB-INV-000001",
+		ReservationID: 1,
+		GuestName:     "John (Jr) Smith",
+		GuestEmail:    "john@smith.com",
+		RoomName:      "General's Quarters",
+		StartDate:     time.Date(2050, 1, 1, 0, 0, 0, 0, time.UTC),
+		EndDate:       time.Date(2050, 1, 3, 0, 0, 0, 0, time.UTC),
+		IssuedAt:      time.Date(2050, 1, 3, 0, 0, 0, 0, time.UTC),
+		TotalAmount:   12000,
+	}
+	for i := 0; i < 40; i++ {
+		inv.Lines = append(inv.Lines, models.InvoiceLine{
+			Description: fmt.Sprintf("Night %d", i+1),
+			Quantity:    1,
+			UnitAmount:  300,
+			Amount:      300,
+		})
+	}
+
+	out := PDF(inv, DefaultIssuer)
+
+	if !bytes.HasPrefix(out, []byte("%PDF-1.4")) {
+		t.Error("output does not start with a PDF header")
+	}
+	if !bytes.HasSuffix(out, []byte("%%EOF\n")) {
+		t.Error("output does not end with EOF marker")
+	}
+	if !bytes.Contains(out, []byte("FSBB-INV-000001")) {
+		t.Error("invoice number not found in output")
+	}
+	if !bytes.Contains(out, []byte(`John \(Jr\) Smith`)) {
+		t.Error("guest name was not escaped")
+	}
+	if !strings.Contains(string(out), "/Count 2") {
+		t.Error("expected line items to overflow onto a second page")
+	}
+
+	// every xref offset must point at the start of its object
+	xref := bytes.LastIndex(out, []byte("xref\n"))
+	entries := strings.Split(string(out[xref:]), "\n")[3:]
+	for i, e := range entries {
+		if !strings.HasSuffix(e, " n ") {
+			break
+		}
+		var offset int
+		fmt.Sscanf(e, "%d", &offset)
+		if !bytes.HasPrefix(out[offset:], []byte(fmt.Sprintf("%d 0 obj", i+1))) {
+			t.Errorf("xref entry %d points at wrong offset %d", i+1, offset)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package invoice
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/KingKord/bookings/internal/models"
+	"strings"
+)
+
+// A4 page size and margins in points
+const (
+	pageWidth    = 595.0
+	pageHeight   = 842.0
+	marginLeft   = 50.0
+	marginRight  = 545.0
+	marginTop    = 792.0
+	marginBottom = 80.0
+	lineHeight   = 16.0
+)
+
+// table column positions, amounts are right aligned to these
+const (
+	colDescription = marginLeft
+	colQuantity    = 360.0
+	colUnit        = 450.0
+	colAmount      = marginRight
+)
+
+// page is a single page content stream
+type page struct {
+	buf bytes.Buffer
+}
+
+// text writes s at x, y using the regular or bold font
+func (p *page) text(x, y, size float64, bold bool, s string) {
+	font := "F1"
+	if bold {
+		font = "F2"
+	}
+	fmt.Fprintf(&p.buf, "BT /%s %.1f Tf %.2f %.2f Td (%s) Tj ET\n", font, size, x, y, escape(s))
+}
+
+// textRight writes s so that it ends at x
+func (p *page) textRight(x, y, size float64, bold bool, s string) {
+	p.text(x-textWidth(s, size), y, size, bold, s)
+}
+
+// line draws a thin horizontal rule
+func (p *page) line(x1, x2, y float64) {
+	fmt.Fprintf(&p.buf, "0.5 w %.2f %.2f m %.2f %.2f l S\n", x1, y, x2, y)
+}
+
+// PDF renders an invoice or credit note as a PDF document
+func PDF(inv models.Invoice, issuer Issuer) []byte {
+	var pages []*page
+
+	p := &page{}
+	pages = append(pages, p)
+	y := marginTop
+
+	// issuer block
+	p.text(marginLeft, y, 16, true, issuer.Name)
+	y -= lineHeight + 2
+	for _, a := range issuer.Address {
+		p.text(marginLeft, y, 10, false, a)
+		y -= lineHeight - 4
+	}
+	if issuer.Email != "" {
+		p.text(marginLeft, y, 10, false, issuer.Email)
+	}
+
+	// document title and number
+	title := "INVOICE"
+	if inv.Kind == models.InvoiceKindCreditNote {
+		title = "CREDIT NOTE"
+	}
+	p.textRight(marginRight, marginTop, 18, true, title)
+	p.textRight(marginRight, marginTop-lineHeight-4, 10, false, fmt.Sprintf("No. %s", inv.InvoiceNumber))
+	p.textRight(marginRight, marginTop-2*lineHeight-2, 10, false, fmt.Sprintf("Date: %s", inv.IssuedAt.Format("02-01-2006")))
+	if inv.CreditsNumber != "" {
+		p.textRight(marginRight, marginTop-3*lineHeight, 10, false, fmt.Sprintf("Credits invoice %s", inv.CreditsNumber))
+	}
+
+	// guest and stay details
+	y = marginTop - 6*lineHeight
+	p.text(marginLeft, y, 11, true, "Bill to")
+	p.text(320, y, 11, true, "Stay")
+	y -= lineHeight
+	p.text(marginLeft, y, 10, false, inv.GuestName)
+	p.text(320, y, 10, false, inv.RoomName)
+	y -= lineHeight - 2
+	p.text(marginLeft, y, 10, false, inv.GuestEmail)
+	p.text(320, y, 10, false, fmt.Sprintf("%s to %s (%d nights)",
+		inv.StartDate.Format("02-01-2006"), inv.EndDate.Format("02-01-2006"), Nights(inv)))
+	p.text(320, y-lineHeight+2, 10, false, fmt.Sprintf("Reservation #%d", inv.ReservationID))
+
+	// line items
+	y -= 3 * lineHeight
+	header := func(p *page, y float64) {
+		p.text(colDescription, y, 10, true, "Description")
+		p.textRight(colQuantity, y, 10, true, "Qty")
+		p.textRight(colUnit, y, 10, true, "Unit price")
+		p.textRight(colAmount, y, 10, true, "Amount")
+		p.line(marginLeft, marginRight, y-5)
+	}
+	header(p, y)
+	y -= lineHeight + 4
+
+	for _, l := range inv.Lines {
+		if y < marginBottom {
+			p = &page{}
+			pages = append(pages, p)
+			y = marginTop
+			header(p, y)
+			y -= lineHeight + 4
+		}
+		p.text(colDescription, y, 10, false, truncate(l.Description, colQuantity-colDescription-40, 10))
+		p.textRight(colQuantity, y, 10, false, fmt.Sprintf("%d", l.Quantity))
+		p.textRight(colUnit, y, 10, false, FormatAmount(l.UnitAmount))
+		p.textRight(colAmount, y, 10, false, FormatAmount(l.Amount))
+		y -= lineHeight
+	}
+
+	// total
+	if y < marginBottom+lineHeight {
+		p = &page{}
+		pages = append(pages, p)
+		y = marginTop
+	}
+	p.line(colUnit-60, marginRight, y+lineHeight-5)
+	y -= 4
+	p.text(colUnit-60, y, 11, true, fmt.Sprintf("Total %s", issuer.Currency))
+	p.textRight(colAmount, y, 11, true, FormatAmount(inv.TotalAmount))
+
+	for i, pg := range pages {
+		pg.textRight(marginRight, 40, 8, false, fmt.Sprintf("%s - page %d of %d", inv.InvoiceNumber, i+1, len(pages)))
+	}
+
+	return write(pages)
+}
+
+// write assembles the page content streams into a PDF file
+func write(pages []*page) []byte {
+	var out bytes.Buffer
+	var offsets []int
+
+	object := func(body string) {
+		offsets = append(offsets, out.Len())
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+
+	out.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+
+	// objects 1-4 are fixed, then a page and content object per page
+	var kids []string
+	for i := range pages {
+		kids = append(kids, fmt.Sprintf("%d 0 R", 5+2*i))
+	}
+
+	object("<< /Type /Catalog /Pages 2 0 R >>")
+	object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(pages)))
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>")
+
+	for i, p := range pages {
+		object(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.0f %.0f] "+
+			"/Resources << /Font << /F1 3 0 R /F2 4 0 R >> >> /Contents %d 0 R >>", pageWidth, pageHeight, 6+2*i))
+		object(fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", p.buf.Len(), p.buf.String()))
+	}
+
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, o := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", o)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+
+	return out.Bytes()
+}
+
+// escape converts s to WinAnsi and escapes it for use in a PDF string literal
+func escape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r < 32:
+			b.WriteByte(' ')
+		case r < 128:
+			b.WriteRune(r)
+		case r >= 0xa0 && r <= 0xff:
+			// latin-1 supplement maps one to one onto WinAnsi
+			b.WriteString(fmt.Sprintf("\\%03o", r))
+		default:
+			b.WriteByte('?')
+		}
+	}
+	return b.String()
+}
+
+// textWidth estimates the rendered width of s in Helvetica
+func textWidth(s string, size float64) float64 {
+	var w float64
+	for _, r := range s {
+		switch {
+		case r == '.' || r == ',' || r == ' ' || r == 'i' || r == 'l' || r == 'I':
+			w += 278
+		case r == '-' || r == '(' || r == ')':
+			w += 333
+		case r >= 'A' && r <= 'Z':
+			w += 667
+		default:
+			w += 556
+		}
+	}
+	return w * size / 1000
+}
+
+// truncate shortens s so it fits into width
+func truncate(s string, width, size float64) string {
+	if textWidth(s, size) <= width {
+		return s
+	}
+	runes := []rune(s)
+	for len(runes) > 0 && textWidth(string(runes)+"...", size) > width {
+		runes = runes[:len(runes)-1]
+	}
+	return string(runes) + "..."
+}
@@ -1,19 +1,45 @@
 package models
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
 	"time"
 )
 
 // User is the user model
 type User struct {
-	ID          int
-	FirstName   string
-	LastName    string
-	Email       string
-	Password    string
-	AccessLevel int
-	CreatedAt   time.Time
-	UpdatedAt   time.Time
+	ID           int
+	FirstName    string
+	LastName     string
+	Email        string
+	Password     string
+	AccessLevel  int
+	Disabled     bool
+	TOTPSecret   string
+	TOTPEnabled  bool
+	FailedLogins int
+	LockedUntil  time.Time
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+}
+
+// IsLocked reports whether the account is locked out after too many failed logins
+func (u User) IsLocked() bool {
+	return u.LockedUntil.After(time.Now())
+}
+
+// Guest is the guest account model, kept apart from staff users
+type Guest struct {
+	ID        int
+	FirstName string
+	LastName  string
+	Email     string
+	Phone     string
+	Password  string
+	CreatedAt time.Time
+	UpdatedAt time.Time
 }
 
 // Room is the room model
@@ -34,18 +60,89 @@ type Restriction struct {
 
 // Reservation is the reservation model
 type Reservation struct {
-	ID        int
-	FirstName string
-	LastName  string
-	Email     string
-	Phone     string
-	StartDate time.Time
-	EndDate   time.Time
-	RoomID    int
-	CreatedAt time.Time
-	UpdatedAt time.Time
-	Room      Room
-	Processed int
+	ID          int
+	FirstName   string
+	LastName    string
+	Email       string
+	Phone       string
+	StartDate   time.Time
+	EndDate     time.Time
+	RoomID      int
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+	Room        Room
+	Processed   int
+	GuestID     int
+	CancelledAt time.Time
+	// ConfirmationCode is given to the guest to quote when they get in touch
+	ConfirmationCode string
+	// TotalAmount is the sum of the charges in cents, only loaded for exports
+	TotalAmount int
+}
+
+// IsCancelled reports whether the reservation has been cancelled
+func (r Reservation) IsCancelled() bool {
+	return !r.CancelledAt.IsZero()
+}
+
+// reservation statuses, as filtered on and exported
+const (
+	ReservationNew       = "new"
+	ReservationProcessed = "processed"
+	ReservationCancelled = "cancelled"
+)
+
+// Status returns the status of the reservation
+func (r Reservation) Status() string {
+	switch {
+	case r.IsCancelled():
+		return ReservationCancelled
+	case r.Processed == 1:
+		return ReservationProcessed
+	}
+	return ReservationNew
+}
+
+// Nights returns the number of nights of the stay
+func (r Reservation) Nights() int {
+	return int(r.EndDate.Sub(r.StartDate).Hours()+12) / 24
+}
+
+// ReservationFilter selects reservations, its zero value selects them all
+type ReservationFilter struct {
+	// From and To select the stays with a night between them, either can be left zero
+	From time.Time
+	To   time.Time
+	// Status is one of the reservation statuses, or empty for any
+	Status string
+	// RoomID selects the reservations of a room, or of any room when zero
+	RoomID int
+	// Search selects the reservations whose guest name or email address contains it
+	Search string
+}
+
+// reservation list sort keys
+const (
+	SortByArrival   = "arrival"
+	SortByDeparture = "departure"
+	SortByLastName  = "last_name"
+	SortByRoom      = "room"
+	SortByID        = "id"
+)
+
+// Page selects a page of a sorted list
+type Page struct {
+	// Sort is one of the sort keys of the list, Desc reverses its order
+	Sort string
+	Desc bool
+	// Number counts from 1
+	Number int
+	Size   int
+}
+
+// Offset returns the number of rows before the page
+func (p Page) Offset() int {
+	return (p.Number - 1) * p.Size
 }
 
 // RoomRestriction is the room restriction model
@@ -61,13 +158,362 @@ type RoomRestriction struct {
 	Room          Room
 	Reservation   Reservation
 	Restrictions  Restriction
+	// CalendarSourceID and ExternalUID are set on blocks imported from an external calendar
+	CalendarSourceID int
+	ExternalUID      string
+}
+
+// ExternalRestrictionID is the restriction of blocks imported from external calendars
+const ExternalRestrictionID = 3
+
+// OwnerBlockRestrictionID is the restriction of the blocks set on the reservation calendar
+const OwnerBlockRestrictionID = 2
+
+// RestrictionsVersion returns a version of a set of restrictions, which changes whenever one of
+// them is added, removed or moved
+func RestrictionsVersion(restrictions []RoomRestriction) string {
+	lines := make([]string, 0, len(restrictions))
+	for _, r := range restrictions {
+		lines = append(lines, fmt.Sprintf("%d:%d:%d:%d:%s:%s", r.ID, r.RoomID, r.ReservationID, r.RestrictionID,
+			r.StartDate.Format("2006-01-02"), r.EndDate.Format("2006-01-02")))
+	}
+	sort.Strings(lines)
+
+	h := sha256.New()
+	for _, l := range lines {
+		h.Write([]byte(l + "\n"))
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// BlockChanges are edits of the blocks set on a window of the reservation calendar. Versions holds
+// the version of the restrictions of every edited room in the window, as the edits were made against
+type BlockChanges struct {
+	Start    time.Time
+	End      time.Time
+	Versions map[int]string
+	// Add holds the room and day of new blocks, Remove the room and id of blocks to remove
+	Add    []RoomRestriction
+	Remove []RoomRestriction
+}
+
+// Charge is a billable line item on a reservation, amounts are in cents
+type Charge struct {
+	ID            int
+	ReservationID int
+	Description   string
+	Quantity      int
+	UnitAmount    int
+	InvoiceID     int
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+}
+
+// Amount returns quantity multiplied by unit amount
+func (c Charge) Amount() int {
+	return c.Quantity * c.UnitAmount
+}
+
+// invoice kinds, each kind is numbered by its own gap-free sequence per property
+const (
+	InvoiceKindInvoice    = "invoice"
+	InvoiceKindCreditNote = "credit_note"
+)
+
+// Invoice is the invoice model, also used for credit notes
+type Invoice struct {
+	ID               int
+	Property         string
+	Kind             string
+	Number           int
+	InvoiceNumber    string
+	ReservationID    int
+	CreditsInvoiceID int
+	CreditsNumber    string
+	Credited         bool
+	GuestName        string
+	GuestEmail       string
+	RoomName         string
+	StartDate        time.Time
+	EndDate          time.Time
+	TotalAmount      int
+	IssuedAt         time.Time
+	CreatedAt        time.Time
+	UpdatedAt        time.Time
+	Lines            []InvoiceLine
+}
+
+// InvoiceLine is a snapshot of a charge at the time the invoice was issued
+type InvoiceLine struct {
+	ID          int
+	InvoiceID   int
+	Description string
+	Quantity    int
+	UnitAmount  int
+	Amount      int
+}
+
+// login attempt outcomes
+const (
+	LoginSucceeded    = "success"
+	LoginPasswordOnly = "password_ok"
+	LoginBadPassword  = "bad_password"
+	LoginBadCode      = "bad_code"
+	LoginLocked       = "locked"
+	LoginIPBlocked    = "ip_blocked"
+)
+
+// LoginAttempt is a record of a staff login attempt
+type LoginAttempt struct {
+	ID        int
+	Email     string
+	UserID    int
+	IP        string
+	Outcome   string
+	CreatedAt time.Time
+}
+
+// UserSession is a staff login, kept so users can see where they are logged in and end it
+type UserSession struct {
+	ID         int
+	UserID     int
+	SessionID  string
+	UserAgent  string
+	IP         string
+	LastSeenAt time.Time
+	RevokedAt  time.Time
+	CreatedAt  time.Time
+}
+
+// APIKey is a key integrations use to call the JSON API, only its hash is stored
+type APIKey struct {
+	ID           int
+	Name         string
+	Prefix       string
+	KeyHash      string
+	Scopes       []string
+	ExpiresAt    time.Time
+	LastUsedAt   time.Time
+	RequestCount int
+	RevokedAt    time.Time
+	CreatedBy    int
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+}
+
+// IsExpired reports whether the key has an expiry date that has passed
+func (k APIKey) IsExpired() bool {
+	return !k.ExpiresAt.IsZero() && k.ExpiresAt.Before(time.Now())
+}
+
+// IsActive reports whether the key can still be used
+func (k APIKey) IsActive() bool {
+	return k.RevokedAt.IsZero() && !k.IsExpired()
+}
+
+// Webhook is an endpoint notified of the events it subscribes to
+type Webhook struct {
+	ID          int
+	URL         string
+	Description string
+	// Secret signs the payloads, so the receiver can check they come from us
+	Secret    string
+	Events    []string
+	Active    bool
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// Subscribes reports whether the webhook is sent events of a type
+func (h Webhook) Subscribes(eventType string) bool {
+	for _, e := range h.Events {
+		if e == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookDelivery is an event sent, or still to be sent, to a webhook
+type WebhookDelivery struct {
+	ID             int
+	WebhookID      int
+	Event          string
+	Payload        string
+	Attempts       int
+	ResponseStatus int
+	Error          string
+	// NextAttemptAt is zero once the delivery succeeded or was given up on
+	NextAttemptAt time.Time
+	DeliveredAt   time.Time
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+	Webhook       Webhook
+}
+
+// IsDelivered reports whether the endpoint accepted the delivery
+func (d WebhookDelivery) IsDelivered() bool {
+	return !d.DeliveredAt.IsZero()
+}
+
+// IsFailed reports whether the delivery was given up on
+func (d WebhookDelivery) IsFailed() bool {
+	return !d.IsDelivered() && d.NextAttemptAt.IsZero()
+}
+
+// CalendarFeed is a secret iCalendar feed of the reservations and blocks of a room,
+// or of every room when RoomID is 0
+type CalendarFeed struct {
+	ID             int
+	Name           string
+	RoomID         int
+	Room           Room
+	Token          string
+	ShowGuestNames bool
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+}
+
+// CalendarSource is an external iCalendar feed whose events are imported as blocks of a room
+type CalendarSource struct {
+	ID           int
+	RoomID       int
+	Room         Room
+	Name         string
+	URL          string
+	LastSyncedAt time.Time
+	LastError    string
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+}
+
+// CalendarConflict is a block imported from an external calendar that overlaps a reservation
+type CalendarConflict struct {
+	Source      CalendarSource
+	Block       RoomRestriction
+	Reservation Reservation
+}
+
+// OccupancyStats are the occupancy and revenue figures of the nights from From to To, both included.
+// Cancelled reservations are left out
+type OccupancyStats struct {
+	From  time.Time
+	To    time.Time
+	Rooms int
+	// NightsSold counts the reserved nights of the period
+	NightsSold int
+	// Stays counts the reservations with nights in the period, StayNights their whole length
+	Stays      int
+	StayNights int
+	// Revenue is the charges of the stays in cents, spread evenly over their nights, of the nights in the period
+	Revenue int
+}
+
+// Nights returns the number of nights in the period
+func (s OccupancyStats) Nights() int {
+	return int(s.To.Sub(s.From).Hours()/24) + 1
+}
+
+// AvailableNights returns the room nights that could have been sold
+func (s OccupancyStats) AvailableNights() int {
+	return s.Rooms * s.Nights()
+}
+
+// OccupancyRate returns the percentage of available room nights that were sold
+func (s OccupancyStats) OccupancyRate() float64 {
+	if s.AvailableNights() == 0 {
+		return 0
+	}
+	return 100 * float64(s.NightsSold) / float64(s.AvailableNights())
+}
+
+// AverageStay returns the average length of stay in nights
+func (s OccupancyStats) AverageStay() float64 {
+	if s.Stays == 0 {
+		return 0
+	}
+	return float64(s.StayNights) / float64(s.Stays)
+}
+
+// ADR returns the average daily rate, the revenue per night sold, in cents
+func (s OccupancyStats) ADR() int {
+	if s.NightsSold == 0 {
+		return 0
+	}
+	return s.Revenue / s.NightsSold
+}
+
+// RevPAR returns the revenue per available room night in cents
+func (s OccupancyStats) RevPAR() int {
+	if s.AvailableNights() == 0 {
+		return 0
+	}
+	return s.Revenue / s.AvailableNights()
+}
+
+// DailyOccupancy is the number of rooms reserved for a night
+type DailyOccupancy struct {
+	Date  time.Time
+	Rooms int
+}
+
+// Movements counts the arrivals and departures of a period
+type Movements struct {
+	Arrivals   int
+	Departures int
+}
+
+// LeadTime counts the reservations made a number of days before arrival
+type LeadTime struct {
+	Days         int
+	Reservations int
+}
+
+// LeadTimeBucket counts the reservations made between MinDays and MaxDays before arrival
+type LeadTimeBucket struct {
+	Label        string
+	MinDays      int
+	MaxDays      int
+	Reservations int
+}
+
+// LeadTimeBuckets groups lead times into ranges of days, the last range is open ended.
+// Negative lead times, of reservations entered after arrival, are left out
+func LeadTimeBuckets(leadTimes []LeadTime) []LeadTimeBucket {
+	buckets := []LeadTimeBucket{
+		{Label: "Same day", MinDays: 0, MaxDays: 0},
+		{Label: "1-7 days", MinDays: 1, MaxDays: 7},
+		{Label: "8-30 days", MinDays: 8, MaxDays: 30},
+		{Label: "31-90 days", MinDays: 31, MaxDays: 90},
+		{Label: "Over 90 days", MinDays: 91, MaxDays: -1},
+	}
+	for _, l := range leadTimes {
+		if l.Days < 0 {
+			continue
+		}
+		for i, b := range buckets {
+			if l.Days <= b.MaxDays || b.MaxDays < 0 {
+				buckets[i].Reservations += l.Reservations
+				break
+			}
+		}
+	}
+	return buckets
 }
 
 // MailData holds an email message
 type MailData struct {
-	To       string
-	From     string
-	Subject  string
-	Content  string
-	Template string
+	To          string
+	From        string
+	Subject     string
+	Content     string
+	Template    string
+	Attachments []MailAttachment
+}
+
+// MailAttachment is a file attached to an email message
+type MailAttachment struct {
+	Name     string
+	MimeType string
+	Data     []byte
 }
@@ -0,0 +1,117 @@
+package rbac
+
+// Permission is an action a staff member may be allowed to perform
+type Permission string
+
+const (
+	ViewReservations    Permission = "reservations.view"
+	CreateReservations  Permission = "reservations.create"
+	EditReservations    Permission = "reservations.edit"
+	ProcessReservations Permission = "reservations.process"
+	DeleteReservations  Permission = "reservations.delete"
+	ExportReservations  Permission = "reservations.export"
+	ImportReservations  Permission = "reservations.import"
+	ManageBlocks        Permission = "blocks.manage"
+	ManageCharges       Permission = "charges.manage"
+	IssueCreditNotes    Permission = "invoices.credit"
+	ManageUsers         Permission = "users.manage"
+	ManageAPIKeys       Permission = "api_keys.manage"
+	ManageWebhooks      Permission = "webhooks.manage"
+	ManageCalendarFeeds Permission = "calendar_feeds.manage"
+	ViewReports         Permission = "reports.view"
+)
+
+// access levels stored in users.access_level
+const (
+	Housekeeping = 1
+	FrontDesk    = 2
+	Manager      = 3
+	Owner        = 4
+)
+
+// Role is a named access level and the permissions it grants
+type Role struct {
+	Level       int
+	Name        string
+	Permissions []Permission
+	// Requires2FA makes two-factor authentication mandatory for the role
+	Requires2FA bool
+}
+
+// Roles lists every role from least to most privileged
+var Roles = []Role{
+	{
+		Level: Housekeeping,
+		Name:  "Housekeeping",
+		Permissions: []Permission{
+			ViewReservations,
+		},
+	},
+	{
+		Level: FrontDesk,
+		Name:  "Front Desk",
+		Permissions: []Permission{
+			ViewReservations, CreateReservations, EditReservations, ProcessReservations, ManageBlocks,
+			ManageCharges,
+		},
+	},
+	{
+		Level:       Manager,
+		Name:        "Manager",
+		Requires2FA: true,
+		Permissions: []Permission{
+			ViewReservations, CreateReservations, EditReservations, ProcessReservations, DeleteReservations,
+			ManageBlocks, ManageCharges, IssueCreditNotes, ManageCalendarFeeds, ExportReservations,
+			ImportReservations, ViewReports,
+		},
+	},
+	{
+		Level:       Owner,
+		Name:        "Owner",
+		Requires2FA: true,
+		Permissions: []Permission{
+			ViewReservations, CreateReservations, EditReservations, ProcessReservations, DeleteReservations,
+			ManageBlocks, ManageCharges, IssueCreditNotes, ManageUsers, ManageAPIKeys, ManageWebhooks,
+			ManageCalendarFeeds, ExportReservations, ImportReservations, ViewReports,
+		},
+	},
+}
+
+// RoleFor returns the role of an access level
+func RoleFor(level int) (Role, bool) {
+	for _, r := range Roles {
+		if r.Level == level {
+			return r, true
+		}
+	}
+	return Role{}, false
+}
+
+// RoleName returns the display name of an access level
+func RoleName(level int) string {
+	r, ok := RoleFor(level)
+	if !ok {
+		return "Unknown"
+	}
+	return r.Name
+}
+
+// Can reports whether an access level grants permission p
+func Can(level int, p Permission) bool {
+	r, ok := RoleFor(level)
+	if !ok {
+		return false
+	}
+	for _, x := range r.Permissions {
+		if x == p {
+			return true
+		}
+	}
+	return false
+}
+
+// Requires2FA reports whether users with the access level must use two-factor authentication
+func Requires2FA(level int) bool {
+	r, ok := RoleFor(level)
+	return ok && r.Requires2FA
+}
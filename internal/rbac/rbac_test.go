@@ -0,0 +1,74 @@
+package rbac
+
+import "testing"
+
+var canTests = []struct {
+	name     string
+	level    int
+	perm     Permission
+	expected bool
+}{
+	{"housekeeping can view", Housekeeping, ViewReservations, true},
+	{"housekeeping cannot edit", Housekeeping, EditReservations, false},
+	{"housekeeping cannot delete", Housekeeping, DeleteReservations, false},
+	{"front desk can edit", FrontDesk, EditReservations, true},
+	{"front desk cannot delete", FrontDesk, DeleteReservations, false},
+	{"manager can delete", Manager, DeleteReservations, true},
+	{"manager cannot manage users", Manager, ManageUsers, false},
+	{"owner can manage users", Owner, ManageUsers, true},
+	{"manager cannot manage api keys", Manager, ManageAPIKeys, false},
+	{"owner can manage api keys", Owner, ManageAPIKeys, true},
+	{"manager cannot manage webhooks", Manager, ManageWebhooks, false},
+	{"owner can manage webhooks", Owner, ManageWebhooks, true},
+	{"front desk cannot manage calendar feeds", FrontDesk, ManageCalendarFeeds, false},
+	{"manager can manage calendar feeds", Manager, ManageCalendarFeeds, true},
+	{"front desk cannot export reservations", FrontDesk, ExportReservations, false},
+	{"manager can export reservations", Manager, ExportReservations, true},
+	{"front desk cannot import reservations", FrontDesk, ImportReservations, false},
+	{"housekeeping cannot create reservations", Housekeeping, CreateReservations, false},
+	{"front desk can create reservations", FrontDesk, CreateReservations, true},
+	{"manager can import reservations", Manager, ImportReservations, true},
+	{"front desk cannot view reports", FrontDesk, ViewReports, false},
+	{"manager can view reports", Manager, ViewReports, true},
+	{"unknown level", 0, ViewReservations, false},
+}
+
+func TestCan(t *testing.T) {
+	for _, e := range canTests {
+		if Can(e.level, e.perm) != e.expected {
+			t.Errorf("%s: expected %t", e.name, e.expected)
+		}
+	}
+}
+
+func TestRoleName(t *testing.T) {
+	if RoleName(Owner) != "Owner" {
+		t.Errorf("expected Owner but got %s", RoleName(Owner))
+	}
+	if RoleName(42) != "Unknown" {
+		t.Errorf("expected Unknown but got %s", RoleName(42))
+	}
+}
+
+func TestRolesAreCumulative(t *testing.T) {
+	// every role must be able to do everything the role below it can
+	for i := 1; i < len(Roles); i++ {
+		for _, p := range Roles[i-1].Permissions {
+			if !Can(Roles[i].Level, p) {
+				t.Errorf("%s is missing %s granted to %s", Roles[i].Name, p, Roles[i-1].Name)
+			}
+		}
+	}
+}
+
+func TestRequires2FA(t *testing.T) {
+	if Requires2FA(FrontDesk) {
+		t.Error("front desk should not require two-factor authentication")
+	}
+	if !Requires2FA(Owner) {
+		t.Error("owner should require two-factor authentication")
+	}
+	if Requires2FA(42) {
+		t.Error("unknown level should not require two-factor authentication")
+	}
+}
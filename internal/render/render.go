@@ -5,19 +5,26 @@ import (
 	"errors"
 	"fmt"
 	"github.com/KingKord/bookings/internal/config"
+	"github.com/KingKord/bookings/internal/invoice"
 	"github.com/KingKord/bookings/internal/models"
+	"github.com/KingKord/bookings/internal/rbac"
 	"github.com/justinas/nosurf"
 	"html/template"
 	"net/http"
 	"path/filepath"
+	"strings"
 	"time"
 )
 
 var functions = template.FuncMap{
-	"humanDate":  HumanDate,
-	"formatDate": FormatDate,
-	"iterate":    Iterate,
-	"add":        Add,
+	"humanDate":    HumanDate,
+	"formatDate":   FormatDate,
+	"iterate":      Iterate,
+	"add":          Add,
+	"formatAmount": invoice.FormatAmount,
+	"can":          rbac.Can,
+	"roleName":     rbac.RoleName,
+	"deviceName":   DeviceName,
 }
 var app *config.AppConfig
 var pathToTemplates = "./templates"
@@ -50,6 +57,37 @@ func FormatDate(t time.Time, f string) string {
 	return t.Format(f)
 }
 
+// DeviceName turns a user agent into a short description such as "Chrome on Windows"
+func DeviceName(userAgent string) string {
+	browser := "Unknown browser"
+	switch {
+	case strings.Contains(userAgent, "Edg/"):
+		browser = "Edge"
+	case strings.Contains(userAgent, "Firefox/"):
+		browser = "Firefox"
+	case strings.Contains(userAgent, "Chrome/"):
+		browser = "Chrome"
+	case strings.Contains(userAgent, "Safari/"):
+		browser = "Safari"
+	}
+
+	platform := "unknown device"
+	switch {
+	case strings.Contains(userAgent, "iPhone"), strings.Contains(userAgent, "iPad"):
+		platform = "iOS"
+	case strings.Contains(userAgent, "Android"):
+		platform = "Android"
+	case strings.Contains(userAgent, "Windows"):
+		platform = "Windows"
+	case strings.Contains(userAgent, "Mac OS X"):
+		platform = "macOS"
+	case strings.Contains(userAgent, "Linux"):
+		platform = "Linux"
+	}
+
+	return fmt.Sprintf("%s on %s", browser, platform)
+}
+
 func AddDefaultData(td *models.TemplateData, r *http.Request) *models.TemplateData {
 	td.Flash = app.Session.PopString(r.Context(), "flash")
 	td.Error = app.Session.PopString(r.Context(), "error")
@@ -57,6 +95,10 @@ func AddDefaultData(td *models.TemplateData, r *http.Request) *models.TemplateDa
 	td.CSRFToken = nosurf.Token(r)
 	if app.Session.Exists(r.Context(), "user_id") {
 		td.IsAuthenticated = 1
+		td.AccessLevel = app.Session.GetInt(r.Context(), "access_level")
+	}
+	if app.Session.Exists(r.Context(), "guest_id") {
+		td.IsGuest = 1
 	}
 
 	return td
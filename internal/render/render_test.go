@@ -73,3 +73,22 @@ func TestCreateTemplateCache(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+var deviceNameTests = []struct {
+	userAgent string
+	expected  string
+}{
+	{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/118.0.0.0 Safari/537.36", "Chrome on Windows"},
+	{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/118.0.0.0 Safari/537.36 Edg/118.0.2088.46", "Edge on Windows"},
+	{"Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.0 Mobile/15E148 Safari/604.1", "Safari on iOS"},
+	{"Mozilla/5.0 (X11; Linux x86_64; rv:109.0) Gecko/20100101 Firefox/119.0", "Firefox on Linux"},
+	{"curl/8.4.0", "Unknown browser on unknown device"},
+}
+
+func TestDeviceName(t *testing.T) {
+	for _, e := range deviceNameTests {
+		if got := DeviceName(e.userAgent); got != e.expected {
+			t.Errorf("expected %s but got %s for %s", e.expected, got, e.userAgent)
+		}
+	}
+}
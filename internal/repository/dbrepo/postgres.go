@@ -2,14 +2,62 @@ package dbrepo
 
 import (
 	"context"
+	"database/sql"
 	"errors"
+	"fmt"
+	"github.com/KingKord/bookings/internal/invoice"
 	"github.com/KingKord/bookings/internal/models"
+	"github.com/KingKord/bookings/internal/repository"
+	"github.com/jackc/pgconn"
 	"golang.org/x/crypto/bcrypt"
+	"strings"
 	"time"
 )
 
-func (m *postgresDBRepo) AllUsers() bool {
-	return true
+// AllUsers returns all staff users
+func (m *postgresDBRepo) AllUsers() ([]models.User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var users []models.User
+
+	query := `select id, first_name, last_name, email, access_level, disabled, totp_enabled, locked_until,
+			created_at, updated_at
+			from users order by last_name, first_name`
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return users, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var u models.User
+		var lockedUntil sql.NullTime
+		err := rows.Scan(
+			&u.ID,
+			&u.FirstName,
+			&u.LastName,
+			&u.Email,
+			&u.AccessLevel,
+			&u.Disabled,
+			&u.TOTPEnabled,
+			&lockedUntil,
+			&u.CreatedAt,
+			&u.UpdatedAt,
+		)
+		if err != nil {
+			return users, err
+		}
+		u.LockedUntil = lockedUntil.Time
+		users = append(users, u)
+	}
+
+	if err = rows.Err(); err != nil {
+		return users, err
+	}
+
+	return users, nil
 }
 
 // InsertReservation inserts a reservation into a database
@@ -19,8 +67,8 @@ func (m *postgresDBRepo) InsertReservation(res models.Reservation) (int, error)
 	defer cancel()
 	var newID int
 	stmt := `insert into reservations (first_name, last_name, email, phone, start_date,
-                          end_date, room_id, created_at, updated_at)
-                          values ($1, $2, $3,$4, $5, $6, $7, $8, $9) returning id`
+                          end_date, room_id, created_at, updated_at, guest_id, confirmation_code, processed)
+                          values ($1, $2, $3,$4, $5, $6, $7, $8, $9, nullif($10, 0), $11, $12) returning id`
 
 	err := m.DB.QueryRowContext(ctx, stmt,
 		res.FirstName,
@@ -32,6 +80,9 @@ func (m *postgresDBRepo) InsertReservation(res models.Reservation) (int, error)
 		res.RoomID,
 		time.Now(),
 		time.Now(),
+		res.GuestID,
+		res.ConfirmationCode,
+		res.Processed,
 	).Scan(&newID)
 
 	if err != nil {
@@ -94,6 +145,61 @@ func (m *postgresDBRepo) SearchAvailabilityByDates(start, end time.Time, roomID
 	return false, nil
 }
 
+// BookRoom inserts a reservation with its room restriction in one transaction and returns its id.
+// If the stay overlaps a restriction it fails with repository.ErrRoomNotAvailable, and bookings made
+// at the same time wait for it, so a room can't be booked twice
+func (m *postgresDBRepo) BookRoom(res models.Reservation) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// keep restrictions from being added while the stay is checked and booked
+	_, err = tx.ExecContext(ctx, `lock table room_restrictions in share row exclusive mode`)
+	if err != nil {
+		return 0, err
+	}
+
+	var overlaps int
+	err = tx.QueryRowContext(ctx, `select count(id) from room_restrictions
+		where room_id = $1 and $2 < end_date and $3 > start_date`,
+		res.RoomID, res.StartDate, res.EndDate).Scan(&overlaps)
+	if err != nil {
+		return 0, err
+	}
+	if overlaps > 0 {
+		return 0, repository.ErrRoomNotAvailable
+	}
+
+	var id int
+	err = tx.QueryRowContext(ctx, `insert into reservations (first_name, last_name, email, phone, start_date,
+			end_date, room_id, created_at, updated_at, guest_id, confirmation_code, processed)
+		values ($1, $2, $3, $4, $5, $6, $7, $8, $8, nullif($9, 0), $10, $11) returning id`,
+		res.FirstName, res.LastName, res.Email, res.Phone, res.StartDate, res.EndDate, res.RoomID,
+		time.Now(), res.GuestID, res.ConfirmationCode, res.Processed,
+	).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.ExecContext(ctx, `insert into room_restrictions (start_date, end_date, room_id, reservation_id,
+			restriction_id, created_at, updated_at)
+		values ($1, $2, $3, $4, $5, $6, $6)`,
+		res.StartDate, res.EndDate, res.RoomID, id, 1, time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
 // SearchAvailabilityForAllRooms returns a slice of available rooms, if any, for given date range
 func (m postgresDBRepo) SearchAvailabilityForAllRooms(start, end time.Time) ([]models.Room, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
@@ -160,12 +266,14 @@ func (m postgresDBRepo) GetUserByID(id int) (models.User, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	query := `select id, first_name, last_name, email, password, access_level, created_at, updated_at
+	query := `select id, first_name, last_name, email, password, access_level, disabled, totp_secret, totp_enabled,
+			failed_logins, locked_until, created_at, updated_at
 			from users where id = $1`
 
 	row := m.DB.QueryRowContext(ctx, query, id)
 
 	var u models.User
+	var lockedUntil sql.NullTime
 	err := row.Scan(
 		&u.ID,
 		&u.FirstName,
@@ -173,9 +281,15 @@ func (m postgresDBRepo) GetUserByID(id int) (models.User, error) {
 		&u.Email,
 		&u.Password,
 		&u.AccessLevel,
+		&u.Disabled,
+		&u.TOTPSecret,
+		&u.TOTPEnabled,
+		&u.FailedLogins,
+		&lockedUntil,
 		&u.CreatedAt,
 		&u.UpdatedAt,
 	)
+	u.LockedUntil = lockedUntil.Time
 	if err != nil {
 		return u, err
 	}
@@ -187,18 +301,66 @@ func (m postgresDBRepo) UpdateUser(u models.User) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	// some unclean code? now statement 'where'
 	query := `
-			update users set first_name = $1, last_name = $2, email = $3, access_level = $4, updated_at = $5 where id = $6`
+			update users set first_name = $1, last_name = $2, email = lower($3), access_level = $4, disabled = $5,
+			updated_at = $6 where id = $7`
 
 	_, err := m.DB.ExecContext(ctx, query,
 		u.FirstName,
 		u.LastName,
 		u.Email,
 		u.AccessLevel,
+		u.Disabled,
 		time.Now(),
 		u.ID,
 	)
+	if isUniqueViolation(err) {
+		return repository.ErrDuplicateEmail
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+// InsertUser creates a staff user, hashing the plain text password in u.Password
+func (m postgresDBRepo) InsertUser(u models.User) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(u.Password), 12)
+	if err != nil {
+		return 0, err
+	}
+
+	var newID int
+	stmt := `insert into users (first_name, last_name, email, password, access_level, disabled, created_at, updated_at)
+			values ($1, $2, lower($3), $4, $5, $6, $7, $8) returning id`
+
+	err = m.DB.QueryRowContext(ctx, stmt,
+		u.FirstName,
+		u.LastName,
+		u.Email,
+		string(hashedPassword),
+		u.AccessLevel,
+		u.Disabled,
+		time.Now(),
+		time.Now(),
+	).Scan(&newID)
+	if isUniqueViolation(err) {
+		return 0, repository.ErrDuplicateEmail
+	} else if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// DeleteUser deletes a staff user
+func (m postgresDBRepo) DeleteUser(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `delete from users where id = $1`, id)
 	if err != nil {
 		return err
 	}
@@ -212,9 +374,10 @@ func (m postgresDBRepo) Authenticate(email, testPassword string) (int, string, e
 
 	var id int
 	var hashedPassword string
+	var disabled bool
 
-	row := m.DB.QueryRowContext(ctx, "select id, password from users where email = $1", email)
-	err := row.Scan(&id, &hashedPassword)
+	row := m.DB.QueryRowContext(ctx, "select id, password, disabled from users where email = lower($1)", email)
+	err := row.Scan(&id, &hashedPassword, &disabled)
 	if err != nil {
 		return id, "", err
 	}
@@ -225,31 +388,71 @@ func (m postgresDBRepo) Authenticate(email, testPassword string) (int, string, e
 	} else if err != nil {
 		return 0, "", err
 	}
+
+	if disabled {
+		return 0, "", errors.New("account is disabled")
+	}
 	return id, hashedPassword, nil
 }
 
-// AllReservations returns a slice of all reservations
-func (m postgresDBRepo) AllReservations() ([]models.Reservation, error) {
+// reservationSortColumns are the columns the reservation lists are sorted on by sort key
+var reservationSortColumns = map[string]string{
+	models.SortByArrival:   "r.start_date",
+	models.SortByDeparture: "r.end_date",
+	models.SortByLastName:  "lower(r.last_name)",
+	models.SortByRoom:      "rm.room_name",
+	models.SortByID:        "r.id",
+}
+
+// ListReservations returns a page of the reservations selected by f, along with their rooms,
+// and the number of reservations selected in all. Unknown sort keys sort by arrival
+func (m postgresDBRepo) ListReservations(f models.ReservationFilter, p models.Page) ([]models.Reservation, int, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
 	var reservations []models.Reservation
+	var total int
 
-	query := `
-		select r.id, r.first_name, r.last_name, r.email, r.phone, r.start_date, r.end_date, r.room_id, r.created_at, r.updated_at,
-		       rm.id, rm.room_name
-		from reservations r 
+	where, args := reservationFilterWhere(f)
+
+	err := m.DB.QueryRowContext(ctx, `
+		select count(*)
+		from reservations r
 		left join rooms rm on (r.room_id = rm.id)
-		order by r.start_date asc
-`
-	rows, err := m.DB.QueryContext(ctx, query)
+		`+where, args...).Scan(&total)
 	if err != nil {
-		return reservations, err
+		return reservations, 0, err
+	}
+
+	column, ok := reservationSortColumns[p.Sort]
+	if !ok {
+		column = reservationSortColumns[models.SortByArrival]
+	}
+	dir := "asc"
+	if p.Desc {
+		dir = "desc"
+	}
+
+	n := len(args)
+	args = append(args, p.Size, p.Offset())
+	query := fmt.Sprintf(`
+		select r.id, r.first_name, r.last_name, r.email, r.phone, r.start_date, r.end_date, r.room_id,
+		       r.created_at, r.updated_at, r.processed, r.cancelled_at, rm.id, rm.room_name
+		from reservations r
+		left join rooms rm on (r.room_id = rm.id)
+		%s
+		order by %s %s, r.id %s
+		limit $%d offset $%d`, where, column, dir, dir, n+1, n+2)
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return reservations, 0, err
 	}
 	defer rows.Close()
 
 	for rows.Next() {
 		var i models.Reservation
+		var cancelledAt sql.NullTime
 		err = rows.Scan(
 			&i.ID,
 			&i.FirstName,
@@ -261,38 +464,66 @@ func (m postgresDBRepo) AllReservations() ([]models.Reservation, error) {
 			&i.RoomID,
 			&i.CreatedAt,
 			&i.UpdatedAt,
+			&i.Processed,
+			&cancelledAt,
 			&i.Room.ID,
 			&i.Room.RoomName,
 		)
 		if err != nil {
-			return reservations, err
+			return reservations, 0, err
 		}
+		i.CancelledAt = cancelledAt.Time
 		reservations = append(reservations, i)
 	}
 
 	if err = rows.Err(); err != nil {
-		return reservations, err
+		return reservations, 0, err
 	}
 
-	return reservations, nil
+	return reservations, total, nil
 }
 
-// AllNewReservations returns a slice of all reservations
-func (m postgresDBRepo) AllNewReservations() ([]models.Reservation, error) {
+// SearchReservations returns up to limit reservations whose confirmation code is query, whose guest's
+// name is close to it, allowing for misspellings, or whose guest's name, email address or phone number
+// contains it. The closest matches come first
+func (m postgresDBRepo) SearchReservations(query string, limit int) ([]models.Reservation, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
 	var reservations []models.Reservation
 
-	query := `
-		select r.id, r.first_name, r.last_name, r.email, r.phone, r.start_date, r.end_date, r.room_id, r.created_at, r.updated_at, r.processed,
-		       rm.id, rm.room_name
-		from reservations r 
+	// phone numbers are matched on their digits, when there are enough of them to mean something
+	digits := strings.Map(func(r rune) rune {
+		if r < '0' || r > '9' {
+			return -1
+		}
+		return r
+	}, query)
+	phonePattern := ""
+	if len(digits) >= 4 {
+		phonePattern = "%" + digits + "%"
+	}
+
+	// the conditions match the trigram indexes on reservations
+	stmt := `
+		select r.id, r.first_name, r.last_name, r.email, r.phone, r.start_date, r.end_date, r.room_id,
+		       r.created_at, r.updated_at, r.processed, r.cancelled_at, r.confirmation_code, rm.id, rm.room_name
+		from reservations r
 		left join rooms rm on (r.room_id = rm.id)
-		where processed = 0
-		order by r.start_date asc
-`
-	rows, err := m.DB.QueryContext(ctx, query)
+		where r.confirmation_code = upper($1)
+		   or r.first_name % $1
+		   or r.last_name % $1
+		   or (r.first_name || ' ' || r.last_name) % $1
+		   or (r.first_name || ' ' || r.last_name) ilike $2
+		   or r.email ilike $2
+		   or ($3 <> '' and regexp_replace(r.phone, '\D', '', 'g') like $3)
+		order by r.confirmation_code = upper($1) desc,
+		         greatest(similarity(r.last_name, $1), similarity(r.first_name || ' ' || r.last_name, $1),
+		                  similarity(r.email, $1)) desc,
+		         r.start_date desc
+		limit $4`
+
+	rows, err := m.DB.QueryContext(ctx, stmt, query, "%"+likeEscaper.Replace(query)+"%", phonePattern, limit)
 	if err != nil {
 		return reservations, err
 	}
@@ -300,6 +531,7 @@ func (m postgresDBRepo) AllNewReservations() ([]models.Reservation, error) {
 
 	for rows.Next() {
 		var i models.Reservation
+		var cancelledAt sql.NullTime
 		err = rows.Scan(
 			&i.ID,
 			&i.FirstName,
@@ -312,20 +544,250 @@ func (m postgresDBRepo) AllNewReservations() ([]models.Reservation, error) {
 			&i.CreatedAt,
 			&i.UpdatedAt,
 			&i.Processed,
+			&cancelledAt,
+			&i.ConfirmationCode,
 			&i.Room.ID,
 			&i.Room.RoomName,
 		)
 		if err != nil {
 			return reservations, err
 		}
+		i.CancelledAt = cancelledAt.Time
 		reservations = append(reservations, i)
 	}
 
+	return reservations, rows.Err()
+}
+
+// likeEscaper escapes the wildcards of a like pattern
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// reservationFilterWhere returns the where clause and arguments selecting the reservations r
+// of a filter, placeholders are numbered from 1
+func reservationFilterWhere(f models.ReservationFilter) (string, []interface{}) {
+	var conds []string
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	if !f.From.IsZero() {
+		conds = append(conds, "r.end_date > "+arg(f.From))
+	}
+	if !f.To.IsZero() {
+		conds = append(conds, "r.start_date <= "+arg(f.To))
+	}
+	if f.RoomID != 0 {
+		conds = append(conds, "r.room_id = "+arg(f.RoomID))
+	}
+	if f.Search != "" {
+		p := arg("%" + likeEscaper.Replace(f.Search) + "%")
+		conds = append(conds, fmt.Sprintf("((r.first_name || ' ' || r.last_name) ilike %s or r.email ilike %s)", p, p))
+	}
+	switch f.Status {
+	case models.ReservationNew:
+		conds = append(conds, "r.processed = 0 and r.cancelled_at is null")
+	case models.ReservationProcessed:
+		conds = append(conds, "r.processed = 1 and r.cancelled_at is null")
+	case models.ReservationCancelled:
+		conds = append(conds, "r.cancelled_at is not null")
+	}
+
+	if len(conds) == 0 {
+		return "", nil
+	}
+	return "where " + strings.Join(conds, " and "), args
+}
+
+// EachReservation calls fn with every reservation selected by f, by arrival date, along with its
+// room and charges total. Rows are read one at a time so that exports of any size use little memory,
+// an error returned by fn stops the iteration and is returned
+func (m postgresDBRepo) EachReservation(f models.ReservationFilter, fn func(models.Reservation) error) error {
+	// exports are written to the client while rows are read, so allow for slow connections
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	where, args := reservationFilterWhere(f)
+	query := `
+		select r.id, r.first_name, r.last_name, r.email, r.phone, r.start_date, r.end_date, r.room_id,
+		       r.created_at, r.updated_at, r.processed, r.cancelled_at, rm.room_name,
+		       coalesce((select sum(c.quantity * c.unit_amount) from reservation_charges c where c.reservation_id = r.id), 0)
+		from reservations r
+		left join rooms rm on (r.room_id = rm.id)
+		` + where + `
+		order by r.start_date asc, r.id asc`
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var i models.Reservation
+		var cancelledAt sql.NullTime
+		err = rows.Scan(
+			&i.ID,
+			&i.FirstName,
+			&i.LastName,
+			&i.Email,
+			&i.Phone,
+			&i.StartDate,
+			&i.EndDate,
+			&i.RoomID,
+			&i.CreatedAt,
+			&i.UpdatedAt,
+			&i.Processed,
+			&cancelledAt,
+			&i.Room.RoomName,
+			&i.TotalAmount,
+		)
+		if err != nil {
+			return err
+		}
+		i.Room.ID = i.RoomID
+		i.CancelledAt = cancelledAt.Time
+
+		err = fn(i)
+		if err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// ImportReservations inserts reservations with their room restrictions in one transaction and
+// returns their ids. Bookings made meanwhile wait for it, and if any of the reservations overlaps
+// a restriction it fails with repository.ErrRoomNotAvailable and nothing is inserted
+func (m postgresDBRepo) ImportReservations(reservations []models.Reservation) ([]int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// keep restrictions from being added while the rows are checked and inserted
+	_, err = tx.ExecContext(ctx, `lock table room_restrictions in share row exclusive mode`)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []int
+	for _, res := range reservations {
+		var overlaps int
+		err = tx.QueryRowContext(ctx, `select count(id) from room_restrictions
+			where room_id = $1 and $2 < end_date and $3 > start_date`,
+			res.RoomID, res.StartDate, res.EndDate).Scan(&overlaps)
+		if err != nil {
+			return nil, err
+		}
+		if overlaps > 0 {
+			return nil, fmt.Errorf("%w: room %d from %s", repository.ErrRoomNotAvailable, res.RoomID,
+				res.StartDate.Format("2006-01-02"))
+		}
+
+		var id int
+		err = tx.QueryRowContext(ctx, `insert into reservations (first_name, last_name, email, phone, start_date,
+				end_date, room_id, processed, created_at, updated_at)
+			values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $9) returning id`,
+			res.FirstName, res.LastName, res.Email, res.Phone, res.StartDate, res.EndDate, res.RoomID,
+			res.Processed, time.Now(),
+		).Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = tx.ExecContext(ctx, `insert into room_restrictions (start_date, end_date, room_id, reservation_id,
+				restriction_id, created_at, updated_at)
+			values ($1, $2, $3, $4, $5, $6, $6)`,
+			res.StartDate, res.EndDate, res.RoomID, id, 1, time.Now())
+		if err != nil {
+			return nil, err
+		}
+
+		ids = append(ids, id)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// MoveReservation moves a reservation to another room or other dates, along with its room restriction,
+// in one transaction. If the restrictions of other reservations or blocks overlap the new stay, it
+// returns them with repository.ErrRoomNotAvailable and nothing is changed. Cancelled reservations
+// can't be moved
+func (m postgresDBRepo) MoveReservation(id, roomID int, start, end time.Time) ([]models.RoomRestriction, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// keep restrictions from being added while the new stay is checked and moved
+	_, err = tx.ExecContext(ctx, `lock table room_restrictions in share row exclusive mode`)
+	if err != nil {
+		return nil, err
+	}
+
+	var cancelledAt sql.NullTime
+	err = tx.QueryRowContext(ctx, `select cancelled_at from reservations where id = $1 for update`, id).Scan(&cancelledAt)
+	if err != nil {
+		return nil, err
+	}
+	if cancelledAt.Valid {
+		return nil, repository.ErrAlreadyCancelled
+	}
+
+	rows, err := tx.QueryContext(ctx, `
+		select id, coalesce(reservation_id, 0), restriction_id, room_id, start_date, end_date
+		from room_restrictions
+		where room_id = $1 and $2 < end_date and $3 > start_date and coalesce(reservation_id, 0) <> $4
+		order by start_date`,
+		roomID, start, end, id)
+	if err != nil {
+		return nil, err
+	}
+	var conflicts []models.RoomRestriction
+	for rows.Next() {
+		var r models.RoomRestriction
+		err = rows.Scan(&r.ID, &r.ReservationID, &r.RestrictionID, &r.RoomID, &r.StartDate, &r.EndDate)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		conflicts = append(conflicts, r)
+	}
+	rows.Close()
 	if err = rows.Err(); err != nil {
-		return reservations, err
+		return nil, err
+	}
+	if len(conflicts) > 0 {
+		return conflicts, repository.ErrRoomNotAvailable
 	}
 
-	return reservations, nil
+	_, err = tx.ExecContext(ctx, `update reservations set room_id = $1, start_date = $2, end_date = $3, updated_at = $4
+		where id = $5`, roomID, start, end, time.Now(), id)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.ExecContext(ctx, `update room_restrictions set room_id = $1, start_date = $2, end_date = $3, updated_at = $4
+		where reservation_id = $5`, roomID, start, end, time.Now(), id)
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, tx.Commit()
 }
 
 // GetReservationByID returns one reservation by ID
@@ -336,12 +798,13 @@ func (m postgresDBRepo) GetReservationByID(id int) (models.Reservation, error) {
 	var res models.Reservation
 	query := `
 		select r.id, r.first_name, r.last_name, r.email, r.phone, r.start_date,
-		r.end_date, r.room_id, r.created_at, r.updated_at, r.processed,
-		rm.id, rm.room_name
+		r.end_date, r.room_id, r.created_at, r.updated_at, r.processed, r.cancelled_at,
+		r.confirmation_code, rm.id, rm.room_name
 		from reservations r
 		left join rooms rm on (r.room_id = rm.id)
 		where r.id = $1
 `
+	var cancelledAt sql.NullTime
 	row := m.DB.QueryRowContext(ctx, query, id)
 	err := row.Scan(
 		&res.ID,
@@ -355,12 +818,15 @@ func (m postgresDBRepo) GetReservationByID(id int) (models.Reservation, error) {
 		&res.CreatedAt,
 		&res.UpdatedAt,
 		&res.Processed,
+		&cancelledAt,
+		&res.ConfirmationCode,
 		&res.Room.ID,
 		&res.Room.RoomName,
 	)
 	if err != nil {
 		return res, err
 	}
+	res.CancelledAt = cancelledAt.Time
 
 	return res, nil
 }
@@ -401,6 +867,39 @@ func (m postgresDBRepo) DeleteReservation(id int) error {
 	return nil
 }
 
+// CancelReservation marks a reservation as cancelled and frees up its room
+func (m postgresDBRepo) CancelReservation(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var cancelledAt sql.NullTime
+	err = tx.QueryRowContext(ctx, `select cancelled_at from reservations where id = $1 for update`, id).Scan(&cancelledAt)
+	if err != nil {
+		return err
+	}
+	if cancelledAt.Valid {
+		return repository.ErrAlreadyCancelled
+	}
+
+	_, err = tx.ExecContext(ctx, `update reservations set cancelled_at = $1, updated_at = $1 where id = $2`, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `delete from room_restrictions where reservation_id = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
 // UpdateProcessedForReservation updates processed for a reservation by id
 func (m postgresDBRepo) UpdateProcessedForReservation(id, processed int) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
@@ -491,30 +990,2233 @@ func (m postgresDBRepo) GetRestrictionsForRoomByDate(roomID int, start, end time
 	return restrictions, nil
 }
 
-// InsertBlockForRoom insert a room restrictions
-func (m postgresDBRepo) InsertBlockForRoom(id int, startDate time.Time) error {
+// GetRestrictionsByDate returns the restrictions of all rooms by date range, by room
+func (m postgresDBRepo) GetRestrictionsByDate(start, end time.Time) ([]models.RoomRestriction, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	query := `insert into room_restrictions 
-    	(start_date, end_date, room_id, restriction_id, created_at, updated_at) 
-			values ($1,$2,$3,$4,$5,$6)`
-	_, err := m.DB.ExecContext(ctx, query, startDate, startDate.AddDate(0, 0, 1), id, 2, time.Now(), time.Now())
-	if err != nil {
-		return err
-	}
-	return nil
-}
+	var restrictions []models.RoomRestriction
 
-// DeleteBlockByID deletes a room restriction
-func (m postgresDBRepo) DeleteBlockByID(id int) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
+	query := `
+			select id, coalesce(reservation_id,0), restriction_id, room_id, start_date, end_date
+			from room_restrictions where $1 < end_date and $2 >= start_date
+			order by room_id, start_date
+`
+	rows, err := m.DB.QueryContext(ctx, query, start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
-	query := `delete from room_restrictions where id = $1`
-	_, err := m.DB.ExecContext(ctx, query, id)
+	for rows.Next() {
+		var r models.RoomRestriction
+		err := rows.Scan(
+			&r.ID,
+			&r.ReservationID,
+			&r.RestrictionID,
+			&r.RoomID,
+			&r.StartDate,
+			&r.EndDate,
+		)
+		if err != nil {
+			return nil, err
+		}
+		restrictions = append(restrictions, r)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return restrictions, nil
+}
+
+// UpdateBlocks adds and removes blocks set on the reservation calendar in one transaction, and returns
+// the blocks added and removed. Bookings and other edits wait for it, and if the restrictions of any
+// of the edited rooms no longer have the version the edits were made against, it fails with
+// repository.ErrCalendarChanged and nothing is changed
+func (m postgresDBRepo) UpdateBlocks(c models.BlockChanges) ([]models.RoomRestriction, []models.RoomRestriction, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var added, removed []models.RoomRestriction
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `lock table room_restrictions in share row exclusive mode`)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// the blocks of the edited rooms, by id
+	blocks := make(map[int]models.RoomRestriction)
+	for roomID, version := range c.Versions {
+		rows, err := tx.QueryContext(ctx, `
+			select id, coalesce(reservation_id, 0), restriction_id, room_id, start_date, end_date
+			from room_restrictions where $1 < end_date and $2 >= start_date and room_id = $3`,
+			c.Start, c.End, roomID)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		var restrictions []models.RoomRestriction
+		for rows.Next() {
+			var r models.RoomRestriction
+			err = rows.Scan(&r.ID, &r.ReservationID, &r.RestrictionID, &r.RoomID, &r.StartDate, &r.EndDate)
+			if err != nil {
+				rows.Close()
+				return nil, nil, err
+			}
+			restrictions = append(restrictions, r)
+			if r.RestrictionID == models.OwnerBlockRestrictionID {
+				blocks[r.ID] = r
+			}
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return nil, nil, err
+		}
+
+		if models.RestrictionsVersion(restrictions) != version {
+			return nil, nil, fmt.Errorf("room %d: %w", roomID, repository.ErrCalendarChanged)
+		}
+	}
+
+	for _, b := range c.Remove {
+		block, ok := blocks[b.ID]
+		if !ok || block.RoomID != b.RoomID {
+			return nil, nil, fmt.Errorf("block %d of room %d: %w", b.ID, b.RoomID, repository.ErrCalendarChanged)
+		}
+		_, err = tx.ExecContext(ctx, `delete from room_restrictions where id = $1`, b.ID)
+		if err != nil {
+			return nil, nil, err
+		}
+		removed = append(removed, block)
+	}
+
+	for _, b := range c.Add {
+		b.EndDate = b.StartDate.AddDate(0, 0, 1)
+		b.RestrictionID = models.OwnerBlockRestrictionID
+		err = tx.QueryRowContext(ctx, `insert into room_restrictions
+			(start_date, end_date, room_id, restriction_id, created_at, updated_at)
+			values ($1, $2, $3, $4, $5, $5) returning id`,
+			b.StartDate, b.EndDate, b.RoomID, b.RestrictionID, time.Now(),
+		).Scan(&b.ID)
+		if err != nil {
+			return nil, nil, err
+		}
+		added = append(added, b)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, nil, err
+	}
+	return added, removed, nil
+}
+
+// GetChargesForReservation returns all charges of a reservation
+func (m postgresDBRepo) GetChargesForReservation(reservationID int) ([]models.Charge, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var charges []models.Charge
+
+	query := `
+		select id, reservation_id, description, quantity, unit_amount, coalesce(invoice_id, 0), created_at, updated_at
+		from reservation_charges where reservation_id = $1
+		order by id asc
+`
+	rows, err := m.DB.QueryContext(ctx, query, reservationID)
+	if err != nil {
+		return charges, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var c models.Charge
+		err := rows.Scan(
+			&c.ID,
+			&c.ReservationID,
+			&c.Description,
+			&c.Quantity,
+			&c.UnitAmount,
+			&c.InvoiceID,
+			&c.CreatedAt,
+			&c.UpdatedAt,
+		)
+		if err != nil {
+			return charges, err
+		}
+		charges = append(charges, c)
+	}
+
+	if err = rows.Err(); err != nil {
+		return charges, err
+	}
+
+	return charges, nil
+}
+
+// InsertCharge adds a charge to a reservation
+func (m postgresDBRepo) InsertCharge(c models.Charge) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `insert into reservation_charges (reservation_id, description, quantity, unit_amount, created_at, updated_at)
+			values ($1, $2, $3, $4, $5, $6)`
+
+	_, err := m.DB.ExecContext(ctx, stmt,
+		c.ReservationID,
+		c.Description,
+		c.Quantity,
+		c.UnitAmount,
+		time.Now(),
+		time.Now(),
+	)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// DeleteCharge deletes a charge of a reservation, as long as it is not on an invoice. It returns
+// sql.ErrNoRows when the reservation has no such charge
+func (m postgresDBRepo) DeleteCharge(id, reservationID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `delete from reservation_charges where id = $1 and reservation_id = $2 and invoice_id is null`
+
+	result, err := m.DB.ExecContext(ctx, query, id, reservationID)
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		var invoiced bool
+		err = m.DB.QueryRowContext(ctx, `select invoice_id is not null from reservation_charges
+			where id = $1 and reservation_id = $2`, id, reservationID).Scan(&invoiced)
+		if err != nil {
+			return err
+		}
+		return repository.ErrChargeInvoiced
+	}
+	return nil
+}
+
+// nextInvoiceNumber takes the next number of a property's sequence. It must run inside the transaction that
+// inserts the invoice, the row lock serialises concurrent issuers and a rollback hands the number back,
+// so the sequence never has gaps.
+func nextInvoiceNumber(ctx context.Context, tx *sql.Tx, property, kind string) (int, error) {
+	var number int
+
+	query := `
+		insert into invoice_sequences (property, kind, last_number, created_at, updated_at)
+		values ($1, $2, 1, $3, $3)
+		on conflict (property, kind) do update
+			set last_number = invoice_sequences.last_number + 1, updated_at = $3
+		returning last_number
+`
+	err := tx.QueryRowContext(ctx, query, property, kind, time.Now()).Scan(&number)
+	if err != nil {
+		return 0, err
+	}
+	return number, nil
+}
+
+// insertInvoice inserts an invoice and its lines, and sets the generated id on inv
+func insertInvoice(ctx context.Context, tx *sql.Tx, inv *models.Invoice) error {
+	stmt := `insert into invoices (property, kind, number, invoice_number, reservation_id, credits_invoice_id,
+                      guest_name, guest_email, room_name, start_date, end_date, total_amount, issued_at,
+                      created_at, updated_at)
+			values ($1, $2, $3, $4, nullif($5, 0), nullif($6, 0), $7, $8, $9, $10, $11, $12, $13, $14, $15) returning id`
+
+	err := tx.QueryRowContext(ctx, stmt,
+		inv.Property,
+		inv.Kind,
+		inv.Number,
+		inv.InvoiceNumber,
+		inv.ReservationID,
+		inv.CreditsInvoiceID,
+		inv.GuestName,
+		inv.GuestEmail,
+		inv.RoomName,
+		inv.StartDate,
+		inv.EndDate,
+		inv.TotalAmount,
+		inv.IssuedAt,
+		time.Now(),
+		time.Now(),
+	).Scan(&inv.ID)
 	if err != nil {
 		return err
 	}
+
+	stmt = `insert into invoice_lines (invoice_id, description, quantity, unit_amount, amount, created_at, updated_at)
+			values ($1, $2, $3, $4, $5, $6, $7)`
+
+	for i := range inv.Lines {
+		inv.Lines[i].InvoiceID = inv.ID
+		_, err := tx.ExecContext(ctx, stmt,
+			inv.ID,
+			inv.Lines[i].Description,
+			inv.Lines[i].Quantity,
+			inv.Lines[i].UnitAmount,
+			inv.Lines[i].Amount,
+			time.Now(),
+			time.Now(),
+		)
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
+
+// IssueInvoice puts all uninvoiced charges of a reservation on a new invoice
+func (m postgresDBRepo) IssueInvoice(reservationID int, property string) (models.Invoice, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	inv := models.Invoice{
+		Property:      property,
+		Kind:          models.InvoiceKindInvoice,
+		ReservationID: reservationID,
+		IssuedAt:      time.Now(),
+	}
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return inv, err
+	}
+	defer tx.Rollback()
+
+	var firstName, lastName string
+	query := `
+		select r.first_name, r.last_name, r.email, r.start_date, r.end_date, coalesce(rm.room_name, '')
+		from reservations r
+		left join rooms rm on (r.room_id = rm.id)
+		where r.id = $1
+		for update of r
+`
+	err = tx.QueryRowContext(ctx, query, reservationID).Scan(
+		&firstName,
+		&lastName,
+		&inv.GuestEmail,
+		&inv.StartDate,
+		&inv.EndDate,
+		&inv.RoomName,
+	)
+	if err != nil {
+		return inv, err
+	}
+	inv.GuestName = strings.TrimSpace(firstName + " " + lastName)
+
+	query = `
+		select id, description, quantity, unit_amount
+		from reservation_charges where reservation_id = $1 and invoice_id is null
+		order by id asc
+		for update
+`
+	rows, err := tx.QueryContext(ctx, query, reservationID)
+	if err != nil {
+		return inv, err
+	}
+
+	var chargeIDs []int
+	for rows.Next() {
+		var c models.Charge
+		err := rows.Scan(&c.ID, &c.Description, &c.Quantity, &c.UnitAmount)
+		if err != nil {
+			rows.Close()
+			return inv, err
+		}
+		chargeIDs = append(chargeIDs, c.ID)
+		inv.Lines = append(inv.Lines, models.InvoiceLine{
+			Description: c.Description,
+			Quantity:    c.Quantity,
+			UnitAmount:  c.UnitAmount,
+			Amount:      c.Amount(),
+		})
+		inv.TotalAmount += c.Amount()
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return inv, err
+	}
+
+	if len(chargeIDs) == 0 {
+		return inv, repository.ErrNothingToInvoice
+	}
+
+	inv.Number, err = nextInvoiceNumber(ctx, tx, property, inv.Kind)
+	if err != nil {
+		return inv, err
+	}
+	inv.InvoiceNumber = invoice.FormatNumber(property, inv.Kind, inv.Number)
+
+	err = insertInvoice(ctx, tx, &inv)
+	if err != nil {
+		return inv, err
+	}
+
+	for _, id := range chargeIDs {
+		_, err := tx.ExecContext(ctx, `update reservation_charges set invoice_id = $1, updated_at = $2 where id = $3`,
+			inv.ID, time.Now(), id)
+		if err != nil {
+			return inv, err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return inv, err
+	}
+
+	return inv, nil
+}
+
+// IssueCreditNote reverses an invoice in full and releases its charges so they can be corrected and invoiced again
+func (m postgresDBRepo) IssueCreditNote(invoiceID int) (models.Invoice, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var cn models.Invoice
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return cn, err
+	}
+	defer tx.Rollback()
+
+	// lock the original so two credit notes can't be issued for it at once
+	var locked int
+	err = tx.QueryRowContext(ctx, `select id from invoices where id = $1 and kind = $2 for update`,
+		invoiceID, models.InvoiceKindInvoice).Scan(&locked)
+	if err != nil {
+		return cn, err
+	}
+
+	original, err := getInvoice(ctx, tx, invoiceID)
+	if err != nil {
+		return cn, err
+	}
+	if original.Credited {
+		return cn, repository.ErrAlreadyCredited
+	}
+
+	cn = models.Invoice{
+		Property:         original.Property,
+		Kind:             models.InvoiceKindCreditNote,
+		ReservationID:    original.ReservationID,
+		CreditsInvoiceID: original.ID,
+		CreditsNumber:    original.InvoiceNumber,
+		GuestName:        original.GuestName,
+		GuestEmail:       original.GuestEmail,
+		RoomName:         original.RoomName,
+		StartDate:        original.StartDate,
+		EndDate:          original.EndDate,
+		TotalAmount:      -original.TotalAmount,
+		IssuedAt:         time.Now(),
+	}
+	for _, l := range original.Lines {
+		cn.Lines = append(cn.Lines, models.InvoiceLine{
+			Description: l.Description,
+			Quantity:    l.Quantity,
+			UnitAmount:  -l.UnitAmount,
+			Amount:      -l.Amount,
+		})
+	}
+
+	cn.Number, err = nextInvoiceNumber(ctx, tx, cn.Property, cn.Kind)
+	if err != nil {
+		return cn, err
+	}
+	cn.InvoiceNumber = invoice.FormatNumber(cn.Property, cn.Kind, cn.Number)
+
+	err = insertInvoice(ctx, tx, &cn)
+	if err != nil {
+		return cn, err
+	}
+
+	_, err = tx.ExecContext(ctx, `update reservation_charges set invoice_id = null, updated_at = $1 where invoice_id = $2`,
+		time.Now(), original.ID)
+	if err != nil {
+		return cn, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return cn, err
+	}
+
+	return cn, nil
+}
+
+// queryer is implemented by both *sql.DB and *sql.Tx
+type queryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// scanner is implemented by both *sql.Row and *sql.Rows
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+const invoiceColumns = `
+		i.id, i.property, i.kind, i.number, i.invoice_number, coalesce(i.reservation_id, 0),
+		coalesce(i.credits_invoice_id, 0), coalesce(c.invoice_number, ''),
+		exists(select 1 from invoices cn where cn.credits_invoice_id = i.id),
+		i.guest_name, i.guest_email, i.room_name, i.start_date, i.end_date, i.total_amount,
+		i.issued_at, i.created_at, i.updated_at
+`
+
+// scanInvoice scans a row selected with invoiceColumns
+func scanInvoice(row scanner, inv *models.Invoice) error {
+	return row.Scan(
+		&inv.ID,
+		&inv.Property,
+		&inv.Kind,
+		&inv.Number,
+		&inv.InvoiceNumber,
+		&inv.ReservationID,
+		&inv.CreditsInvoiceID,
+		&inv.CreditsNumber,
+		&inv.Credited,
+		&inv.GuestName,
+		&inv.GuestEmail,
+		&inv.RoomName,
+		&inv.StartDate,
+		&inv.EndDate,
+		&inv.TotalAmount,
+		&inv.IssuedAt,
+		&inv.CreatedAt,
+		&inv.UpdatedAt,
+	)
+}
+
+// getInvoice returns an invoice with its lines
+func getInvoice(ctx context.Context, q queryer, id int) (models.Invoice, error) {
+	var inv models.Invoice
+
+	query := `select ` + invoiceColumns + `
+		from invoices i
+		left join invoices c on (i.credits_invoice_id = c.id)
+		where i.id = $1
+`
+	err := scanInvoice(q.QueryRowContext(ctx, query, id), &inv)
+	if err != nil {
+		return inv, err
+	}
+
+	query = `select id, invoice_id, description, quantity, unit_amount, amount
+		from invoice_lines where invoice_id = $1 order by id asc`
+
+	rows, err := q.QueryContext(ctx, query, id)
+	if err != nil {
+		return inv, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var l models.InvoiceLine
+		err := rows.Scan(&l.ID, &l.InvoiceID, &l.Description, &l.Quantity, &l.UnitAmount, &l.Amount)
+		if err != nil {
+			return inv, err
+		}
+		inv.Lines = append(inv.Lines, l)
+	}
+
+	if err = rows.Err(); err != nil {
+		return inv, err
+	}
+
+	return inv, nil
+}
+
+// GetInvoiceByID returns one invoice or credit note with its lines
+func (m postgresDBRepo) GetInvoiceByID(id int) (models.Invoice, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return getInvoice(ctx, m.DB, id)
+}
+
+// GetInvoicesForReservation returns the invoices and credit notes of a reservation, without lines
+func (m postgresDBRepo) GetInvoicesForReservation(reservationID int) ([]models.Invoice, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var invoices []models.Invoice
+
+	query := `select ` + invoiceColumns + `
+		from invoices i
+		left join invoices c on (i.credits_invoice_id = c.id)
+		where i.reservation_id = $1
+		order by i.issued_at asc, i.id asc
+`
+	rows, err := m.DB.QueryContext(ctx, query, reservationID)
+	if err != nil {
+		return invoices, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var inv models.Invoice
+		err := scanInvoice(rows, &inv)
+		if err != nil {
+			return invoices, err
+		}
+		invoices = append(invoices, inv)
+	}
+
+	if err = rows.Err(); err != nil {
+		return invoices, err
+	}
+
+	return invoices, nil
+}
+
+// InsertGuest registers a guest account, hashing the plain text password in g.Password
+func (m postgresDBRepo) InsertGuest(g models.Guest) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(g.Password), 12)
+	if err != nil {
+		return 0, err
+	}
+
+	var newID int
+	stmt := `insert into guests (first_name, last_name, email, phone, password, created_at, updated_at)
+			values ($1, $2, lower($3), $4, $5, $6, $7) returning id`
+
+	err = m.DB.QueryRowContext(ctx, stmt,
+		g.FirstName,
+		g.LastName,
+		g.Email,
+		g.Phone,
+		string(hashedPassword),
+		time.Now(),
+		time.Now(),
+	).Scan(&newID)
+	if isUniqueViolation(err) {
+		return 0, repository.ErrDuplicateEmail
+	} else if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// GetGuestByID returns a guest account by ID
+func (m postgresDBRepo) GetGuestByID(id int) (models.Guest, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `select id, first_name, last_name, email, phone, created_at, updated_at from guests where id = $1`
+
+	var g models.Guest
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&g.ID,
+		&g.FirstName,
+		&g.LastName,
+		&g.Email,
+		&g.Phone,
+		&g.CreatedAt,
+		&g.UpdatedAt,
+	)
+	if err != nil {
+		return g, err
+	}
+	return g, nil
+}
+
+// AuthenticateGuest authenticates a guest account
+func (m postgresDBRepo) AuthenticateGuest(email, testPassword string) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var id int
+	var hashedPassword string
+
+	row := m.DB.QueryRowContext(ctx, "select id, password from guests where email = lower($1)", email)
+	err := row.Scan(&id, &hashedPassword)
+	if err != nil {
+		return 0, err
+	}
+
+	err = bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(testPassword))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return 0, errors.New("incorrect password")
+	} else if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// GetReservationsForGuest returns all reservations made with a guest account, latest first
+func (m postgresDBRepo) GetReservationsForGuest(guestID int) ([]models.Reservation, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var reservations []models.Reservation
+
+	query := `
+		select r.id, r.first_name, r.last_name, r.email, r.phone, r.start_date, r.end_date, r.room_id,
+		       r.created_at, r.updated_at, r.processed, coalesce(r.guest_id, 0), rm.id, rm.room_name
+		from reservations r
+		left join rooms rm on (r.room_id = rm.id)
+		where r.guest_id = $1
+		order by r.start_date desc
+`
+	rows, err := m.DB.QueryContext(ctx, query, guestID)
+	if err != nil {
+		return reservations, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var i models.Reservation
+		err = rows.Scan(
+			&i.ID,
+			&i.FirstName,
+			&i.LastName,
+			&i.Email,
+			&i.Phone,
+			&i.StartDate,
+			&i.EndDate,
+			&i.RoomID,
+			&i.CreatedAt,
+			&i.UpdatedAt,
+			&i.Processed,
+			&i.GuestID,
+			&i.Room.ID,
+			&i.Room.RoomName,
+		)
+		if err != nil {
+			return reservations, err
+		}
+		reservations = append(reservations, i)
+	}
+
+	if err = rows.Err(); err != nil {
+		return reservations, err
+	}
+
+	return reservations, nil
+}
+
+// isUniqueViolation reports whether err is a postgres unique constraint violation
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505"
+}
+
+// GetUserByEmail returns a staff user by email address
+func (m postgresDBRepo) GetUserByEmail(email string) (models.User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `select id, first_name, last_name, email, access_level, disabled, failed_logins, locked_until,
+			created_at, updated_at
+			from users where email = lower($1)`
+
+	var u models.User
+	var lockedUntil sql.NullTime
+	err := m.DB.QueryRowContext(ctx, query, email).Scan(
+		&u.ID,
+		&u.FirstName,
+		&u.LastName,
+		&u.Email,
+		&u.AccessLevel,
+		&u.Disabled,
+		&u.FailedLogins,
+		&lockedUntil,
+		&u.CreatedAt,
+		&u.UpdatedAt,
+	)
+	if err != nil {
+		return u, err
+	}
+	u.LockedUntil = lockedUntil.Time
+
+	return u, nil
+}
+
+// InsertPasswordReset stores the hash of a password reset token for a user
+func (m postgresDBRepo) InsertPasswordReset(userID int, tokenHash string, expiresAt time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `insert into password_resets (user_id, token_hash, expires_at, created_at, updated_at)
+			values ($1, $2, $3, $4, $5)`
+
+	_, err := m.DB.ExecContext(ctx, stmt, userID, tokenHash, expiresAt, time.Now(), time.Now())
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetPasswordResetUserID returns the user a reset token belongs to, if it is still usable
+func (m postgresDBRepo) GetPasswordResetUserID(tokenHash string) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var userID int
+	query := `select user_id from password_resets
+			where token_hash = $1 and used_at is null and expires_at > $2`
+
+	err := m.DB.QueryRowContext(ctx, query, tokenHash, time.Now()).Scan(&userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, repository.ErrInvalidToken
+	} else if err != nil {
+		return 0, err
+	}
+
+	return userID, nil
+}
+
+// ResetPassword sets a new password for the owner of a reset token and uses up
+// every outstanding token of that user. It returns the id of the user
+func (m postgresDBRepo) ResetPassword(tokenHash, password string) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), 12)
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// lock the token so it can only be used once
+	var userID int
+	query := `select user_id from password_resets
+			where token_hash = $1 and used_at is null and expires_at > $2 for update`
+
+	err = tx.QueryRowContext(ctx, query, tokenHash, time.Now()).Scan(&userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, repository.ErrInvalidToken
+	} else if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.ExecContext(ctx, `update users set password = $1, updated_at = $2 where id = $3`,
+		string(hashedPassword), time.Now(), userID)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.ExecContext(ctx, `update password_resets set used_at = $1, updated_at = $1
+			where user_id = $2 and used_at is null`, time.Now(), userID)
+	if err != nil {
+		return 0, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return userID, nil
+}
+
+// EnableTOTP turns on two-factor authentication for a user and replaces their recovery codes
+func (m postgresDBRepo) EnableTOTP(userID int, secret string, recoveryCodes []string) error {
+	// hash before starting the clock, bcrypt is deliberately slow
+	var hashes []string
+	for _, c := range recoveryCodes {
+		hash, err := bcrypt.GenerateFromPassword([]byte(c), bcrypt.DefaultCost)
+		if err != nil {
+			return err
+		}
+		hashes = append(hashes, string(hash))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `update users set totp_secret = $1, totp_enabled = true, updated_at = $2 where id = $3`,
+		secret, time.Now(), userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `delete from user_recovery_codes where user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	for _, h := range hashes {
+		_, err = tx.ExecContext(ctx, `insert into user_recovery_codes (user_id, code_hash, created_at, updated_at)
+			values ($1, $2, $3, $4)`, userID, h, time.Now(), time.Now())
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// DisableTOTP turns off two-factor authentication for a user and removes their recovery codes
+func (m postgresDBRepo) DisableTOTP(userID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `update users set totp_secret = '', totp_enabled = false, updated_at = $1 where id = $2`,
+		time.Now(), userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `delete from user_recovery_codes where user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// UseTOTPStep records step as the last time step a code was accepted in for a user. It reports
+// false, and records nothing, when a code from that step or a later one was already accepted
+func (m postgresDBRepo) UseTOTPStep(userID int, step int64) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, `update users set totp_last_step = $1 where id = $2 and totp_last_step < $1`,
+		step, userID)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+// UseRecoveryCode checks code against the unused recovery codes of a user and marks it used if it matches
+func (m postgresDBRepo) UseRecoveryCode(userID int, code string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `select id, code_hash from user_recovery_codes
+			where user_id = $1 and used_at is null for update`, userID)
+	if err != nil {
+		return false, err
+	}
+
+	matched := 0
+	for rows.Next() {
+		var id int
+		var hash string
+		err = rows.Scan(&id, &hash)
+		if err != nil {
+			rows.Close()
+			return false, err
+		}
+		if matched == 0 && bcrypt.CompareHashAndPassword([]byte(hash), []byte(code)) == nil {
+			matched = id
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return false, err
+	}
+
+	if matched == 0 {
+		return false, nil
+	}
+
+	_, err = tx.ExecContext(ctx, `update user_recovery_codes set used_at = $1, updated_at = $1 where id = $2`,
+		time.Now(), matched)
+	if err != nil {
+		return false, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// InsertLoginAttempt records a staff login attempt and its outcome
+func (m postgresDBRepo) InsertLoginAttempt(a models.LoginAttempt) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `insert into login_attempts (email, user_id, ip, outcome, created_at, updated_at)
+			values (lower($1), nullif($2, 0), $3, $4, $5, $6)`
+
+	_, err := m.DB.ExecContext(ctx, stmt, a.Email, a.UserID, a.IP, a.Outcome, time.Now(), time.Now())
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// CountIPFailures returns the number of failed logins from an address since a point in time
+func (m postgresDBRepo) CountIPFailures(ip string, since time.Time) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var count int
+	query := `select count(id) from login_attempts
+			where ip = $1 and created_at > $2 and outcome in ($3, $4)`
+
+	err := m.DB.QueryRowContext(ctx, query, ip, since, models.LoginBadPassword, models.LoginBadCode).Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// RecordFailedLogin counts a failed login against a user and locks the account
+// for lockFor once maxFailures is reached. It reports whether this failure locked the account
+func (m postgresDBRepo) RecordFailedLogin(userID, maxFailures int, lockFor time.Duration) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var failures int
+	err := m.DB.QueryRowContext(ctx, `update users set failed_logins = failed_logins + 1 where id = $1
+			returning failed_logins`, userID).Scan(&failures)
+	if err != nil {
+		return false, err
+	}
+
+	if failures < maxFailures {
+		return false, nil
+	}
+
+	// the count starts again once the lock expires
+	_, err = m.DB.ExecContext(ctx, `update users set failed_logins = 0, locked_until = $1, updated_at = $2
+			where id = $3`, time.Now().Add(lockFor), time.Now(), userID)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// ResetFailedLogins clears the failed login count of a user after a successful login
+func (m postgresDBRepo) ResetFailedLogins(userID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `update users set failed_logins = 0 where id = $1 and failed_logins <> 0`, userID)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// UnlockUser lifts a lockout early
+func (m postgresDBRepo) UnlockUser(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `update users set failed_logins = 0, locked_until = null, updated_at = $1
+			where id = $2`, time.Now(), id)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// LockedUsers returns all users that are currently locked out
+func (m postgresDBRepo) LockedUsers() ([]models.User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var users []models.User
+
+	query := `select id, first_name, last_name, email, access_level, locked_until
+			from users where locked_until > $1 order by locked_until`
+
+	rows, err := m.DB.QueryContext(ctx, query, time.Now())
+	if err != nil {
+		return users, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var u models.User
+		err := rows.Scan(
+			&u.ID,
+			&u.FirstName,
+			&u.LastName,
+			&u.Email,
+			&u.AccessLevel,
+			&u.LockedUntil,
+		)
+		if err != nil {
+			return users, err
+		}
+		users = append(users, u)
+	}
+
+	if err = rows.Err(); err != nil {
+		return users, err
+	}
+
+	return users, nil
+}
+
+// RecentLoginAttempts returns the latest login attempts, newest first
+func (m postgresDBRepo) RecentLoginAttempts(limit int) ([]models.LoginAttempt, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var attempts []models.LoginAttempt
+
+	query := `select id, email, coalesce(user_id, 0), ip, outcome, created_at
+			from login_attempts order by created_at desc, id desc limit $1`
+
+	rows, err := m.DB.QueryContext(ctx, query, limit)
+	if err != nil {
+		return attempts, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var a models.LoginAttempt
+		err := rows.Scan(
+			&a.ID,
+			&a.Email,
+			&a.UserID,
+			&a.IP,
+			&a.Outcome,
+			&a.CreatedAt,
+		)
+		if err != nil {
+			return attempts, err
+		}
+		attempts = append(attempts, a)
+	}
+
+	if err = rows.Err(); err != nil {
+		return attempts, err
+	}
+
+	return attempts, nil
+}
+
+// InsertUserSession records a new staff login
+func (m postgresDBRepo) InsertUserSession(s models.UserSession) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `insert into user_sessions (user_id, session_id, user_agent, ip, last_seen_at, created_at, updated_at)
+			values ($1, $2, $3, $4, $5, $6, $7)`
+
+	_, err := m.DB.ExecContext(ctx, stmt, s.UserID, s.SessionID, s.UserAgent, s.IP, time.Now(), time.Now(), time.Now())
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// TouchUserSession reports whether a login is still active and, at most once a minute, updates when and where it was last seen
+func (m postgresDBRepo) TouchUserSession(sessionID, ip string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var id int
+	var revoked bool
+	var lastSeen time.Time
+
+	query := `select id, revoked_at is not null, last_seen_at from user_sessions where session_id = $1`
+	err := m.DB.QueryRowContext(ctx, query, sessionID).Scan(&id, &revoked, &lastSeen)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	if revoked {
+		return false, nil
+	}
+
+	if time.Since(lastSeen) > time.Minute {
+		_, err = m.DB.ExecContext(ctx, `update user_sessions set last_seen_at = $1, ip = $2, updated_at = $1 where id = $3`,
+			time.Now(), ip, id)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// ActiveUserSessions returns the logins of a user that are not revoked and were seen since a point in time
+func (m postgresDBRepo) ActiveUserSessions(userID int, since time.Time) ([]models.UserSession, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var sessions []models.UserSession
+
+	query := `select id, user_id, session_id, user_agent, ip, last_seen_at, created_at
+			from user_sessions
+			where user_id = $1 and revoked_at is null and last_seen_at > $2
+			order by last_seen_at desc`
+
+	rows, err := m.DB.QueryContext(ctx, query, userID, since)
+	if err != nil {
+		return sessions, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var s models.UserSession
+		err := rows.Scan(
+			&s.ID,
+			&s.UserID,
+			&s.SessionID,
+			&s.UserAgent,
+			&s.IP,
+			&s.LastSeenAt,
+			&s.CreatedAt,
+		)
+		if err != nil {
+			return sessions, err
+		}
+		sessions = append(sessions, s)
+	}
+
+	if err = rows.Err(); err != nil {
+		return sessions, err
+	}
+
+	return sessions, nil
+}
+
+// RevokeUserSession ends a single login of a user
+func (m postgresDBRepo) RevokeUserSession(userID int, sessionID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `update user_sessions set revoked_at = $1, updated_at = $1
+			where session_id = $2 and user_id = $3 and revoked_at is null`, time.Now(), sessionID, userID)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// RevokeUserSessions ends every login of a user except exceptSessionID, which may be empty
+func (m postgresDBRepo) RevokeUserSessions(userID int, exceptSessionID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `update user_sessions set revoked_at = $1, updated_at = $1
+			where user_id = $2 and session_id <> $3 and revoked_at is null`, time.Now(), userID, exceptSessionID)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// InsertAPIKey stores a new API key
+func (m postgresDBRepo) InsertAPIKey(k models.APIKey) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var expiresAt sql.NullTime
+	if !k.ExpiresAt.IsZero() {
+		expiresAt = sql.NullTime{Time: k.ExpiresAt, Valid: true}
+	}
+
+	var newID int
+	stmt := `insert into api_keys (name, prefix, key_hash, scopes, expires_at, created_by, created_at, updated_at)
+			values ($1, $2, $3, $4, $5, nullif($6, 0), $7, $8) returning id`
+
+	err := m.DB.QueryRowContext(ctx, stmt,
+		k.Name,
+		k.Prefix,
+		k.KeyHash,
+		strings.Join(k.Scopes, ","),
+		expiresAt,
+		k.CreatedBy,
+		time.Now(),
+		time.Now(),
+	).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+	return newID, nil
+}
+
+const apiKeyColumns = `id, name, prefix, key_hash, scopes, expires_at, last_used_at, request_count,
+			revoked_at, coalesce(created_by, 0), created_at, updated_at`
+
+func scanAPIKey(row scanner, k *models.APIKey) error {
+	var scopes string
+	var expiresAt, lastUsedAt, revokedAt sql.NullTime
+	err := row.Scan(
+		&k.ID,
+		&k.Name,
+		&k.Prefix,
+		&k.KeyHash,
+		&scopes,
+		&expiresAt,
+		&lastUsedAt,
+		&k.RequestCount,
+		&revokedAt,
+		&k.CreatedBy,
+		&k.CreatedAt,
+		&k.UpdatedAt,
+	)
+	if err != nil {
+		return err
+	}
+	if scopes != "" {
+		k.Scopes = strings.Split(scopes, ",")
+	}
+	k.ExpiresAt = expiresAt.Time
+	k.LastUsedAt = lastUsedAt.Time
+	k.RevokedAt = revokedAt.Time
+	return nil
+}
+
+// AllAPIKeys returns every API key, newest first
+func (m postgresDBRepo) AllAPIKeys() ([]models.APIKey, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var keys []models.APIKey
+
+	rows, err := m.DB.QueryContext(ctx, `select `+apiKeyColumns+` from api_keys order by created_at desc`)
+	if err != nil {
+		return keys, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var k models.APIKey
+		err := scanAPIKey(rows, &k)
+		if err != nil {
+			return keys, err
+		}
+		keys = append(keys, k)
+	}
+
+	if err = rows.Err(); err != nil {
+		return keys, err
+	}
+
+	return keys, nil
+}
+
+// GetAPIKeyByHash returns the API key with a hash, revoked and expired keys included
+func (m postgresDBRepo) GetAPIKeyByHash(keyHash string) (models.APIKey, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var k models.APIKey
+	row := m.DB.QueryRowContext(ctx, `select `+apiKeyColumns+` from api_keys where key_hash = $1`, keyHash)
+	err := scanAPIKey(row, &k)
+	return k, err
+}
+
+// TouchAPIKey records that an API key was used for a request
+func (m postgresDBRepo) TouchAPIKey(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `update api_keys set last_used_at = $1, request_count = request_count + 1 where id = $2`
+
+	_, err := m.DB.ExecContext(ctx, stmt, time.Now(), id)
+	return err
+}
+
+// RevokeAPIKey stops an API key from being used
+func (m postgresDBRepo) RevokeAPIKey(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `update api_keys set revoked_at = $1, updated_at = $1 where id = $2 and revoked_at is null`
+
+	_, err := m.DB.ExecContext(ctx, stmt, time.Now(), id)
+	return err
+}
+
+const webhookColumns = `id, url, description, secret, events, active, created_at, updated_at`
+
+func scanWebhook(row scanner, h *models.Webhook) error {
+	var events string
+	err := row.Scan(
+		&h.ID,
+		&h.URL,
+		&h.Description,
+		&h.Secret,
+		&events,
+		&h.Active,
+		&h.CreatedAt,
+		&h.UpdatedAt,
+	)
+	if err != nil {
+		return err
+	}
+	if events != "" {
+		h.Events = strings.Split(events, ",")
+	}
+	return nil
+}
+
+// InsertWebhook adds a webhook and returns its id
+func (m postgresDBRepo) InsertWebhook(h models.Webhook) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var newID int
+	stmt := `insert into webhooks (url, description, secret, events, active, created_at, updated_at)
+			values ($1, $2, $3, $4, $5, $6, $7) returning id`
+
+	err := m.DB.QueryRowContext(ctx, stmt,
+		h.URL,
+		h.Description,
+		h.Secret,
+		strings.Join(h.Events, ","),
+		h.Active,
+		time.Now(),
+		time.Now(),
+	).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// AllWebhooks returns every webhook, oldest first
+func (m postgresDBRepo) AllWebhooks() ([]models.Webhook, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var hooks []models.Webhook
+
+	rows, err := m.DB.QueryContext(ctx, `select `+webhookColumns+` from webhooks order by id`)
+	if err != nil {
+		return hooks, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var h models.Webhook
+		err := scanWebhook(rows, &h)
+		if err != nil {
+			return hooks, err
+		}
+		hooks = append(hooks, h)
+	}
+
+	if err = rows.Err(); err != nil {
+		return hooks, err
+	}
+
+	return hooks, nil
+}
+
+// GetWebhookByID returns a webhook by id
+func (m postgresDBRepo) GetWebhookByID(id int) (models.Webhook, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var h models.Webhook
+	row := m.DB.QueryRowContext(ctx, `select `+webhookColumns+` from webhooks where id = $1`, id)
+	err := scanWebhook(row, &h)
+	return h, err
+}
+
+// UpdateWebhook saves the url, description, events and active flag of a webhook
+func (m postgresDBRepo) UpdateWebhook(h models.Webhook) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `update webhooks set url = $1, description = $2, events = $3, active = $4, updated_at = $5
+			where id = $6`
+
+	_, err := m.DB.ExecContext(ctx, stmt,
+		h.URL,
+		h.Description,
+		strings.Join(h.Events, ","),
+		h.Active,
+		time.Now(),
+		h.ID,
+	)
+	return err
+}
+
+// DeleteWebhook deletes a webhook and its deliveries
+func (m postgresDBRepo) DeleteWebhook(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `delete from webhooks where id = $1`, id)
+	return err
+}
+
+// EnqueueWebhookDeliveries queues a payload for every active webhook subscribed to the event type,
+// and returns how many deliveries were queued
+func (m postgresDBRepo) EnqueueWebhookDeliveries(eventType string, payload []byte) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `insert into webhook_deliveries (webhook_id, event, payload, next_attempt_at, created_at, updated_at)
+			select id, $1, $2, $3, $3, $3 from webhooks
+			where active and $1 = any(string_to_array(events, ','))`
+
+	result, err := m.DB.ExecContext(ctx, stmt, eventType, string(payload), time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := result.RowsAffected()
+	return int(n), err
+}
+
+const webhookDeliveryColumns = `d.id, d.webhook_id, d.event, d.payload, d.attempts, d.response_status, d.error,
+			d.next_attempt_at, d.delivered_at, d.created_at, d.updated_at, w.url, w.secret`
+
+func scanWebhookDelivery(row scanner, d *models.WebhookDelivery) error {
+	var nextAttemptAt, deliveredAt sql.NullTime
+	err := row.Scan(
+		&d.ID,
+		&d.WebhookID,
+		&d.Event,
+		&d.Payload,
+		&d.Attempts,
+		&d.ResponseStatus,
+		&d.Error,
+		&nextAttemptAt,
+		&deliveredAt,
+		&d.CreatedAt,
+		&d.UpdatedAt,
+		&d.Webhook.URL,
+		&d.Webhook.Secret,
+	)
+	if err != nil {
+		return err
+	}
+	d.NextAttemptAt = nextAttemptAt.Time
+	d.DeliveredAt = deliveredAt.Time
+	d.Webhook.ID = d.WebhookID
+	return nil
+}
+
+func (m postgresDBRepo) queryWebhookDeliveries(ctx context.Context, query string, args ...interface{}) ([]models.WebhookDelivery, error) {
+	var deliveries []models.WebhookDelivery
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return deliveries, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var d models.WebhookDelivery
+		err := scanWebhookDelivery(rows, &d)
+		if err != nil {
+			return deliveries, err
+		}
+		deliveries = append(deliveries, d)
+	}
+
+	if err = rows.Err(); err != nil {
+		return deliveries, err
+	}
+
+	return deliveries, nil
+}
+
+// ClaimWebhookDeliveries returns up to limit deliveries that are due, pushing their next attempt back
+// by lease so that no other replica sends them while they are being sent
+func (m postgresDBRepo) ClaimWebhookDeliveries(limit int, lease time.Duration) ([]models.WebhookDelivery, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `
+		with d as (
+			update webhook_deliveries set next_attempt_at = $1
+			where id in (
+				select id from webhook_deliveries
+				where next_attempt_at <= $2
+				order by next_attempt_at
+				limit $3
+				for update skip locked
+			)
+			returning *
+		)
+		select ` + webhookDeliveryColumns + `
+		from d join webhooks w on w.id = d.webhook_id
+		order by d.id`
+
+	now := time.Now()
+	return m.queryWebhookDeliveries(ctx, query, now.Add(lease), now, limit)
+}
+
+// RecordWebhookAttempt saves the outcome of an attempt to send a delivery
+func (m postgresDBRepo) RecordWebhookAttempt(d models.WebhookDelivery) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var nextAttemptAt, deliveredAt sql.NullTime
+	if !d.NextAttemptAt.IsZero() {
+		nextAttemptAt = sql.NullTime{Time: d.NextAttemptAt, Valid: true}
+	}
+	if !d.DeliveredAt.IsZero() {
+		deliveredAt = sql.NullTime{Time: d.DeliveredAt, Valid: true}
+	}
+
+	stmt := `update webhook_deliveries set attempts = $1, response_status = $2, error = $3,
+			next_attempt_at = $4, delivered_at = $5, updated_at = $6
+			where id = $7`
+
+	_, err := m.DB.ExecContext(ctx, stmt,
+		d.Attempts,
+		d.ResponseStatus,
+		d.Error,
+		nextAttemptAt,
+		deliveredAt,
+		time.Now(),
+		d.ID,
+	)
+	return err
+}
+
+// WebhookDeliveries returns the latest deliveries of a webhook, newest first
+func (m postgresDBRepo) WebhookDeliveries(webhookID, limit int) ([]models.WebhookDelivery, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `
+		select ` + webhookDeliveryColumns + `
+		from webhook_deliveries d join webhooks w on w.id = d.webhook_id
+		where d.webhook_id = $1
+		order by d.created_at desc, d.id desc
+		limit $2`
+
+	return m.queryWebhookDeliveries(ctx, query, webhookID, limit)
+}
+
+// RedeliverWebhookDelivery queues a delivery of a webhook to be sent again right away, with a fresh
+// set of retries. It returns sql.ErrNoRows if the webhook has no such delivery
+func (m postgresDBRepo) RedeliverWebhookDelivery(webhookID, id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `update webhook_deliveries set attempts = 0, error = '', next_attempt_at = $1, delivered_at = null,
+			updated_at = $1
+			where id = $2 and webhook_id = $3`
+
+	result, err := m.DB.ExecContext(ctx, stmt, time.Now(), id, webhookID)
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+const calendarFeedColumns = `f.id, f.name, coalesce(f.room_id, 0), coalesce(r.room_name, ''), f.token, f.show_guest_names,
+			f.created_at, f.updated_at`
+
+func scanCalendarFeed(row scanner, f *models.CalendarFeed) error {
+	err := row.Scan(
+		&f.ID,
+		&f.Name,
+		&f.RoomID,
+		&f.Room.RoomName,
+		&f.Token,
+		&f.ShowGuestNames,
+		&f.CreatedAt,
+		&f.UpdatedAt,
+	)
+	f.Room.ID = f.RoomID
+	return err
+}
+
+// InsertCalendarFeed adds a calendar feed and returns its id
+func (m postgresDBRepo) InsertCalendarFeed(f models.CalendarFeed) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var newID int
+	stmt := `insert into calendar_feeds (name, room_id, token, show_guest_names, created_at, updated_at)
+			values ($1, nullif($2, 0), $3, $4, $5, $6) returning id`
+
+	err := m.DB.QueryRowContext(ctx, stmt,
+		f.Name,
+		f.RoomID,
+		f.Token,
+		f.ShowGuestNames,
+		time.Now(),
+		time.Now(),
+	).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// AllCalendarFeeds returns every calendar feed, oldest first
+func (m postgresDBRepo) AllCalendarFeeds() ([]models.CalendarFeed, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var feeds []models.CalendarFeed
+
+	query := `select ` + calendarFeedColumns + `
+		from calendar_feeds f left join rooms r on r.id = f.room_id
+		order by f.id`
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return feeds, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var f models.CalendarFeed
+		err := scanCalendarFeed(rows, &f)
+		if err != nil {
+			return feeds, err
+		}
+		feeds = append(feeds, f)
+	}
+
+	if err = rows.Err(); err != nil {
+		return feeds, err
+	}
+
+	return feeds, nil
+}
+
+// GetCalendarFeedByToken returns the calendar feed with a token
+func (m postgresDBRepo) GetCalendarFeedByToken(token string) (models.CalendarFeed, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `select ` + calendarFeedColumns + `
+		from calendar_feeds f left join rooms r on r.id = f.room_id
+		where f.token = $1`
+
+	var f models.CalendarFeed
+	row := m.DB.QueryRowContext(ctx, query, token)
+	err := scanCalendarFeed(row, &f)
+	return f, err
+}
+
+// DeleteCalendarFeed deletes a calendar feed, its URL stops working
+func (m postgresDBRepo) DeleteCalendarFeed(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `delete from calendar_feeds where id = $1`, id)
+	return err
+}
+
+// RestrictionsForFeed returns the reservations and blocks of a room, or of every room when roomID
+// is 0, that end after since. Reservations come with the guest's name and every restriction with its room
+func (m postgresDBRepo) RestrictionsForFeed(roomID int, since time.Time) ([]models.RoomRestriction, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var restrictions []models.RoomRestriction
+
+	query := `
+		select rr.id, coalesce(rr.reservation_id, 0), rr.restriction_id, rr.room_id, rr.start_date, rr.end_date,
+			rr.updated_at, rm.room_name, coalesce(res.first_name, ''), coalesce(res.last_name, '')
+		from room_restrictions rr
+		join rooms rm on rm.id = rr.room_id
+		left join reservations res on res.id = rr.reservation_id
+		where rr.end_date > $1 and ($2 = 0 or rr.room_id = $2)
+		order by rr.start_date, rr.id`
+
+	rows, err := m.DB.QueryContext(ctx, query, since, roomID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r models.RoomRestriction
+		err := rows.Scan(
+			&r.ID,
+			&r.ReservationID,
+			&r.RestrictionID,
+			&r.RoomID,
+			&r.StartDate,
+			&r.EndDate,
+			&r.UpdatedAt,
+			&r.Room.RoomName,
+			&r.Reservation.FirstName,
+			&r.Reservation.LastName,
+		)
+		if err != nil {
+			return nil, err
+		}
+		r.Room.ID = r.RoomID
+		r.Reservation.ID = r.ReservationID
+		restrictions = append(restrictions, r)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return restrictions, nil
+}
+
+const calendarSourceColumns = `s.id, s.room_id, r.room_name, s.name, s.url, s.last_synced_at, s.last_error,
+			s.created_at, s.updated_at`
+
+func scanCalendarSource(row scanner, s *models.CalendarSource) error {
+	var lastSyncedAt sql.NullTime
+	err := row.Scan(
+		&s.ID,
+		&s.RoomID,
+		&s.Room.RoomName,
+		&s.Name,
+		&s.URL,
+		&lastSyncedAt,
+		&s.LastError,
+		&s.CreatedAt,
+		&s.UpdatedAt,
+	)
+	s.Room.ID = s.RoomID
+	s.LastSyncedAt = lastSyncedAt.Time
+	return err
+}
+
+// InsertCalendarSource adds an external calendar to import and returns its id
+func (m postgresDBRepo) InsertCalendarSource(s models.CalendarSource) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var newID int
+	stmt := `insert into calendar_sources (room_id, name, url, created_at, updated_at)
+			values ($1, $2, $3, $4, $5) returning id`
+
+	err := m.DB.QueryRowContext(ctx, stmt,
+		s.RoomID,
+		s.Name,
+		s.URL,
+		time.Now(),
+		time.Now(),
+	).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// AllCalendarSources returns every external calendar, oldest first
+func (m postgresDBRepo) AllCalendarSources() ([]models.CalendarSource, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var sources []models.CalendarSource
+
+	query := `select ` + calendarSourceColumns + `
+		from calendar_sources s join rooms r on r.id = s.room_id
+		order by s.id`
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return sources, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var s models.CalendarSource
+		err := scanCalendarSource(rows, &s)
+		if err != nil {
+			return sources, err
+		}
+		sources = append(sources, s)
+	}
+
+	if err = rows.Err(); err != nil {
+		return sources, err
+	}
+
+	return sources, nil
+}
+
+// GetCalendarSourceByID returns an external calendar by id
+func (m postgresDBRepo) GetCalendarSourceByID(id int) (models.CalendarSource, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `select ` + calendarSourceColumns + `
+		from calendar_sources s join rooms r on r.id = s.room_id
+		where s.id = $1`
+
+	var s models.CalendarSource
+	row := m.DB.QueryRowContext(ctx, query, id)
+	err := scanCalendarSource(row, &s)
+	return s, err
+}
+
+// DeleteCalendarSource deletes an external calendar, along with the blocks imported from it,
+// and returns those blocks
+func (m postgresDBRepo) DeleteCalendarSource(id int) ([]models.RoomRestriction, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	query := `
+		delete from room_restrictions b using rooms rm
+		where rm.id = b.room_id and b.calendar_source_id = $1
+		returning b.id, b.room_id, rm.room_name, b.restriction_id, b.start_date, b.end_date, b.external_uid`
+
+	rows, err := tx.QueryContext(ctx, query, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var blocks []models.RoomRestriction
+	for rows.Next() {
+		b := models.RoomRestriction{CalendarSourceID: id}
+		err := rows.Scan(
+			&b.ID,
+			&b.RoomID,
+			&b.Room.RoomName,
+			&b.RestrictionID,
+			&b.StartDate,
+			&b.EndDate,
+			&b.ExternalUID,
+		)
+		if err != nil {
+			return nil, err
+		}
+		b.Room.ID = b.RoomID
+		blocks = append(blocks, b)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	_, err = tx.ExecContext(ctx, `delete from calendar_sources where id = $1`, id)
+	if err != nil {
+		return nil, err
+	}
+
+	return blocks, tx.Commit()
+}
+
+// RecordCalendarSync records that an external calendar was synced, syncErr is empty when the sync succeeded
+func (m postgresDBRepo) RecordCalendarSync(id int, syncErr string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `update calendar_sources set last_synced_at = $1, last_error = $2, updated_at = $1 where id = $3`
+	_, err := m.DB.ExecContext(ctx, stmt, time.Now(), syncErr, id)
+	return err
+}
+
+// ExternalBlocks returns the blocks imported from an external calendar
+func (m postgresDBRepo) ExternalBlocks(sourceID int) ([]models.RoomRestriction, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var blocks []models.RoomRestriction
+
+	query := `
+		select id, room_id, restriction_id, start_date, end_date, calendar_source_id, external_uid
+		from room_restrictions where calendar_source_id = $1
+		order by start_date, id`
+
+	rows, err := m.DB.QueryContext(ctx, query, sourceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var b models.RoomRestriction
+		err := rows.Scan(
+			&b.ID,
+			&b.RoomID,
+			&b.RestrictionID,
+			&b.StartDate,
+			&b.EndDate,
+			&b.CalendarSourceID,
+			&b.ExternalUID,
+		)
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, b)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return blocks, nil
+}
+
+// SaveExternalBlocks applies a sync of an external calendar in one transaction: blocks with an id get
+// their dates updated, the others are inserted, and the blocks with the ids in removeIDs are deleted
+func (m postgresDBRepo) SaveExternalBlocks(sourceID int, blocks []models.RoomRestriction, removeIDs []int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, b := range blocks {
+		if b.ID > 0 {
+			_, err = tx.ExecContext(ctx, `update room_restrictions set start_date = $1, end_date = $2, updated_at = $3
+				where id = $4 and calendar_source_id = $5`,
+				b.StartDate, b.EndDate, time.Now(), b.ID, sourceID)
+		} else {
+			_, err = tx.ExecContext(ctx, `insert into room_restrictions
+				(start_date, end_date, room_id, restriction_id, calendar_source_id, external_uid, created_at, updated_at)
+				values ($1, $2, $3, $4, $5, $6, $7, $7)`,
+				b.StartDate, b.EndDate, b.RoomID, models.ExternalRestrictionID, sourceID, b.ExternalUID, time.Now())
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, id := range removeIDs {
+		_, err = tx.ExecContext(ctx, `delete from room_restrictions where id = $1 and calendar_source_id = $2`, id, sourceID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// CalendarConflicts returns the blocks imported from an external calendar, or from any when sourceID is 0,
+// that share a night with a reservation of their room
+func (m postgresDBRepo) CalendarConflicts(sourceID int) ([]models.CalendarConflict, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var conflicts []models.CalendarConflict
+
+	query := `
+		select b.id, b.room_id, rm.room_name, b.start_date, b.end_date, b.external_uid, s.id, s.name,
+			res.id, res.first_name, res.last_name, res.start_date, res.end_date
+		from room_restrictions b
+		join calendar_sources s on s.id = b.calendar_source_id
+		join rooms rm on rm.id = b.room_id
+		join room_restrictions rr on rr.room_id = b.room_id and rr.reservation_id is not null
+			and rr.start_date < b.end_date and b.start_date < rr.end_date
+		join reservations res on res.id = rr.reservation_id
+		where $1 = 0 or b.calendar_source_id = $1
+		order by b.start_date, b.id, res.id`
+
+	rows, err := m.DB.QueryContext(ctx, query, sourceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var c models.CalendarConflict
+		err := rows.Scan(
+			&c.Block.ID,
+			&c.Block.RoomID,
+			&c.Block.Room.RoomName,
+			&c.Block.StartDate,
+			&c.Block.EndDate,
+			&c.Block.ExternalUID,
+			&c.Source.ID,
+			&c.Source.Name,
+			&c.Reservation.ID,
+			&c.Reservation.FirstName,
+			&c.Reservation.LastName,
+			&c.Reservation.StartDate,
+			&c.Reservation.EndDate,
+		)
+		if err != nil {
+			return nil, err
+		}
+		c.Block.Room.ID = c.Block.RoomID
+		c.Block.CalendarSourceID = c.Source.ID
+		c.Source.RoomID = c.Block.RoomID
+		c.Source.Room = c.Block.Room
+		c.Reservation.RoomID = c.Block.RoomID
+		c.Reservation.Room = c.Block.Room
+		conflicts = append(conflicts, c)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return conflicts, nil
+}
+
+// OccupancyStats returns the occupancy and revenue figures of the nights from from to to, both included
+func (m postgresDBRepo) OccupancyStats(from, to time.Time) (models.OccupancyStats, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	s := models.OccupancyStats{From: from, To: to}
+
+	// a stay has the nights from its start date to the day before its end date
+	query := `
+		with stays as (
+			select r.end_date - r.start_date as length,
+			       least(r.end_date, $2::date + 1) - greatest(r.start_date, $1::date) as nights,
+			       coalesce((select sum(c.quantity * c.unit_amount) from reservation_charges c where c.reservation_id = r.id), 0) as total
+			from reservations r
+			where r.cancelled_at is null and r.start_date <= $2 and r.end_date > $1
+		)
+		select (select count(*) from rooms),
+		       coalesce(sum(nights), 0)::bigint,
+		       count(*),
+		       coalesce(sum(length), 0)::bigint,
+		       coalesce(sum(total * nights / nullif(length, 0)), 0)::bigint
+		from stays`
+
+	err := m.DB.QueryRowContext(ctx, query, from, to).Scan(
+		&s.Rooms,
+		&s.NightsSold,
+		&s.Stays,
+		&s.StayNights,
+		&s.Revenue,
+	)
+	return s, err
+}
+
+// DailyOccupancy returns the number of rooms reserved for every night from from to to, both included
+func (m postgresDBRepo) DailyOccupancy(from, to time.Time) ([]models.DailyOccupancy, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var days []models.DailyOccupancy
+
+	query := `
+		select d::date, count(distinct r.room_id)
+		from generate_series($1::date, $2::date, interval '1 day') d
+		left join reservations r
+		    on (r.cancelled_at is null and r.start_date <= d::date and r.end_date > d::date)
+		group by d
+		order by d`
+
+	rows, err := m.DB.QueryContext(ctx, query, from, to)
+	if err != nil {
+		return days, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var d models.DailyOccupancy
+		err = rows.Scan(&d.Date, &d.Rooms)
+		if err != nil {
+			return days, err
+		}
+		days = append(days, d)
+	}
+
+	return days, rows.Err()
+}
+
+// CountMovements counts the reservations arriving and departing from from to to, both included
+func (m postgresDBRepo) CountMovements(from, to time.Time) (models.Movements, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var mv models.Movements
+
+	query := `
+		select count(*) filter (where start_date between $1 and $2),
+		       count(*) filter (where end_date between $1 and $2)
+		from reservations
+		where cancelled_at is null and (start_date between $1 and $2 or end_date between $1 and $2)`
+
+	err := m.DB.QueryRowContext(ctx, query, from, to).Scan(&mv.Arrivals, &mv.Departures)
+	return mv, err
+}
+
+// LeadTimes counts the reservations arriving from from to to, both included, by the number of days
+// between booking and arrival. Reservations entered after the guest arrived, such as imported
+// past stays, have no lead time and are left out
+func (m postgresDBRepo) LeadTimes(from, to time.Time) ([]models.LeadTime, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var leadTimes []models.LeadTime
+
+	query := `
+		select r.start_date - r.created_at::date as days, count(*)
+		from reservations r
+		where r.cancelled_at is null and r.start_date between $1 and $2
+			and r.start_date >= r.created_at::date
+		group by days
+		order by days`
+
+	rows, err := m.DB.QueryContext(ctx, query, from, to)
+	if err != nil {
+		return leadTimes, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var l models.LeadTime
+		err = rows.Scan(&l.Days, &l.Reservations)
+		if err != nil {
+			return leadTimes, err
+		}
+		leadTimes = append(leadTimes, l)
+	}
+
+	return leadTimes, rows.Err()
+}
@@ -1,13 +1,27 @@
 package dbrepo
 
 import (
+	"database/sql"
 	"errors"
+	"fmt"
+	"github.com/KingKord/bookings/internal/apikey"
+	"github.com/KingKord/bookings/internal/helpers"
 	"github.com/KingKord/bookings/internal/models"
+	"github.com/KingKord/bookings/internal/repository"
+	"strings"
 	"time"
 )
 
-func (m *testDBRepo) AllUsers() bool {
-	return true
+// AllUsers returns all staff users
+func (m *testDBRepo) AllUsers() ([]models.User, error) {
+	var users []models.User
+
+	users = append(users,
+		models.User{ID: 1, FirstName: "Owen", LastName: "Owner", Email: "me@here.ca", AccessLevel: 4},
+		models.User{ID: 2, FirstName: "Hank", LastName: "Housekeeper", Email: "hank@here.ca", AccessLevel: 1},
+	)
+
+	return users, nil
 }
 
 // InsertReservation inserts a reservation into a database
@@ -39,6 +53,21 @@ func (m *testDBRepo) SearchAvailabilityByDates(start, end time.Time, roomID int)
 	return false, nil
 }
 
+// BookRoom books stays from the year 3000, fails for room 2, 1000 and above 2 otherwise, and finds
+// the room taken for any other stay
+func (m *testDBRepo) BookRoom(res models.Reservation) (int, error) {
+	if res.StartDate.Year() != 3000 {
+		if res.RoomID > 2 {
+			return 0, errors.New("some error)")
+		}
+		return 0, repository.ErrRoomNotAvailable
+	}
+	if res.RoomID == 2 || res.RoomID == 1000 {
+		return 0, errors.New("some error)")
+	}
+	return 1, nil
+}
+
 // SearchAvailabilityForAllRooms returns a slice of available rooms, if any, for given date range
 func (m testDBRepo) SearchAvailabilityForAllRooms(start, end time.Time) ([]models.Room, error) {
 
@@ -63,6 +92,9 @@ func (m testDBRepo) SearchAvailabilityForAllRooms(start, end time.Time) ([]model
 func (m testDBRepo) GetRoomByID(id int) (models.Room, error) {
 
 	var room models.Room
+	if id > 100 {
+		return room, sql.ErrNoRows
+	}
 	if id > 2 {
 		return room, errors.New("some error")
 	}
@@ -72,36 +104,181 @@ func (m testDBRepo) GetRoomByID(id int) (models.Room, error) {
 
 func (m *testDBRepo) GetUserByID(id int) (models.User, error) {
 	var u models.User
+	if id > 100 {
+		return u, errors.New("some error")
+	}
+
+	u.ID = id
+	u.Email = "me@here.ca"
+	u.AccessLevel = 4
+	u.TOTPSecret = "JBSWY3DPEHPK3PXP"
+	u.TOTPEnabled = true
+	switch id {
+	case 2:
+		u = models.User{ID: id, Email: "hank@here.ca", AccessLevel: 1}
+	case 3:
+		u = models.User{ID: id, Email: "disabled@here.ca", AccessLevel: 4, Disabled: true}
+	case 4:
+		u = models.User{ID: id, Email: "manager@here.ca", AccessLevel: 3}
+	case 5:
+		u = models.User{ID: id, Email: "optional@here.ca", AccessLevel: 1, TOTPSecret: "JBSWY3DPEHPK3PXP", TOTPEnabled: true}
+	}
 	return u, nil
 }
 
+func (m *testDBRepo) InsertUser(u models.User) (int, error) {
+	if u.Email == "exists@here.ca" {
+		return 0, repository.ErrDuplicateEmail
+	}
+	return 5, nil
+}
+
 func (m *testDBRepo) UpdateUser(u models.User) error {
+	if u.Email == "exists@here.ca" {
+		return repository.ErrDuplicateEmail
+	}
+	return nil
+}
+
+func (m *testDBRepo) DeleteUser(id int) error {
 	return nil
 }
 
 func (m *testDBRepo) Authenticate(email, testPassword string) (int, string, error) {
-	if email == "me@here.ca" {
+	switch email {
+	case "me@here.ca":
 		return 1, "", nil
+	case "hank@here.ca":
+		return 2, "", nil
+	case "manager@here.ca":
+		return 4, "", nil
 	}
 	return 0, "", errors.New("some error")
 }
 
-func (m *testDBRepo) AllReservations() ([]models.Reservation, error) {
-	var reservations []models.Reservation
+// ListReservations fails for stays from the year 3002
+func (m *testDBRepo) ListReservations(f models.ReservationFilter, p models.Page) ([]models.Reservation, int, error) {
+	if f.From.Year() == 3002 {
+		return nil, 0, errors.New("some error")
+	}
 
-	return reservations, nil
+	selected := testReservations(f)
+	if p.Offset() >= len(selected) {
+		return nil, len(selected), nil
+	}
+	page := selected[p.Offset():]
+	if len(page) > p.Size {
+		page = page[:p.Size]
+	}
+	return page, len(selected), nil
 }
 
-// AllNewReservations returns a slice of all reservations
-func (m testDBRepo) AllNewReservations() ([]models.Reservation, error) {
-	var reservations []models.Reservation
+// SearchReservations fails for the query "fail", and finds a past, a current and an upcoming stay
+// for guests whose name, email address or confirmation code contains the query
+func (m *testDBRepo) SearchReservations(query string, limit int) ([]models.Reservation, error) {
+	if query == "fail" {
+		return nil, errors.New("some error")
+	}
 
-	return reservations, nil
+	now := time.Now()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	room := models.Room{ID: 1, RoomName: "General's Quarters"}
+	reservations := []models.Reservation{
+		{ID: 3, FirstName: "John", LastName: "Smith", Email: "john@smith.com", RoomID: 1, Room: room,
+			ConfirmationCode: "UPC0M1NG", StartDate: today.AddDate(0, 1, 0), EndDate: today.AddDate(0, 1, 2)},
+		{ID: 4, FirstName: "Jon", LastName: "Smyth", Email: "jon@smyth.com", RoomID: 1, Room: room,
+			ConfirmationCode: "CURRENT2", StartDate: today.AddDate(0, 0, -1), EndDate: today.AddDate(0, 0, 1)},
+		{ID: 5, FirstName: "Jane", LastName: "Smith", Email: "jane@smith.com", RoomID: 1, Room: room,
+			ConfirmationCode: "PASTSTAY", StartDate: today.AddDate(-1, 0, 0), EndDate: today.AddDate(-1, 0, 3)},
+	}
+
+	var found []models.Reservation
+	q := strings.ToLower(query)
+	for _, res := range reservations {
+		s := strings.ToLower(res.FirstName + " " + res.LastName + " " + res.Email + " " + res.ConfirmationCode)
+		if strings.Contains(s, q) && len(found) < limit {
+			found = append(found, res)
+		}
+	}
+	return found, nil
+}
+
+// EachReservation fails for stays from the year 3002
+func (m *testDBRepo) EachReservation(f models.ReservationFilter, fn func(models.Reservation) error) error {
+	if f.From.Year() == 3002 {
+		return errors.New("some error")
+	}
+
+	for _, res := range testReservations(f) {
+		err := fn(res)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// testReservations returns the reservations of the test repository selected by the status, room and
+// search of f
+func testReservations(f models.ReservationFilter) []models.Reservation {
+	room := models.Room{ID: 1, RoomName: "General's Quarters"}
+	reservations := []models.Reservation{
+		{ID: 1, FirstName: "John", LastName: "Smith", Email: "john@smith.com", RoomID: 1, Room: room,
+			StartDate: time.Date(2050, 1, 2, 0, 0, 0, 0, time.UTC), EndDate: time.Date(2050, 1, 4, 0, 0, 0, 0, time.UTC),
+			TotalAmount: 24000},
+		{ID: 2, FirstName: "Jane", LastName: "Doe", Email: "jane@doe.com", RoomID: 1, Room: room, Processed: 1,
+			StartDate: time.Date(2050, 2, 1, 0, 0, 0, 0, time.UTC), EndDate: time.Date(2050, 2, 2, 0, 0, 0, 0, time.UTC),
+			TotalAmount: 12050},
+	}
+
+	var selected []models.Reservation
+	for _, res := range reservations {
+		if f.Status != "" && res.Status() != f.Status {
+			continue
+		}
+		if f.RoomID != 0 && res.RoomID != f.RoomID {
+			continue
+		}
+		name := strings.ToLower(res.FirstName + " " + res.LastName + " " + res.Email)
+		if !strings.Contains(name, strings.ToLower(f.Search)) {
+			continue
+		}
+		selected = append(selected, res)
+	}
+	return selected
+}
+
+// ImportReservations fails when a reservation is for room 2
+func (m *testDBRepo) ImportReservations(reservations []models.Reservation) ([]int, error) {
+	var ids []int
+	for i, res := range reservations {
+		if res.RoomID == 2 {
+			return nil, errors.New("some error")
+		}
+		ids = append(ids, i+1)
+	}
+	return ids, nil
 }
 
 func (m *testDBRepo) GetReservationByID(id int) (models.Reservation, error) {
 	var res models.Reservation
+	if id > 100 {
+		return res, sql.ErrNoRows
+	}
 
+	res = models.Reservation{
+		ID:        id,
+		FirstName: "John",
+		LastName:  "Smith",
+		Email:     "john@smith.com",
+		StartDate: time.Date(2050, 1, 1, 0, 0, 0, 0, time.UTC),
+		EndDate:   time.Date(2050, 1, 2, 0, 0, 0, 0, time.UTC),
+		RoomID:    1,
+		Room:      models.Room{ID: 1, RoomName: "General's Quarters"},
+	}
+	if id == 3 {
+		res.CancelledAt = time.Date(2049, 12, 1, 0, 0, 0, 0, time.UTC)
+	}
 	return res, nil
 }
 
@@ -109,10 +286,39 @@ func (m *testDBRepo) UpdateReservation(u models.Reservation) error {
 	return nil
 }
 
+// MoveReservation knows the reservations GetReservationByID does, room 2 is taken and moving to the
+// year 3002 fails
+func (m *testDBRepo) MoveReservation(id, roomID int, start, end time.Time) ([]models.RoomRestriction, error) {
+	switch {
+	case id > 100:
+		return nil, sql.ErrNoRows
+	case id == 3:
+		return nil, repository.ErrAlreadyCancelled
+	case start.Year() == 3002:
+		return nil, errors.New("some error")
+	case roomID == 2:
+		return []models.RoomRestriction{
+			{ID: 5, RoomID: 2, ReservationID: 9, RestrictionID: 1, StartDate: start, EndDate: start.AddDate(0, 0, 2)},
+			{ID: 6, RoomID: 2, RestrictionID: models.OwnerBlockRestrictionID, StartDate: end.AddDate(0, 0, -1), EndDate: end},
+		}, repository.ErrRoomNotAvailable
+	}
+	return nil, nil
+}
+
 func (m *testDBRepo) DeleteReservation(id int) error {
 	return nil
 }
 
+func (m *testDBRepo) CancelReservation(id int) error {
+	if id > 100 {
+		return sql.ErrNoRows
+	}
+	if id == 3 {
+		return repository.ErrAlreadyCancelled
+	}
+	return nil
+}
+
 func (m *testDBRepo) UpdateProcessedForReservation(id, processed int) error {
 	return nil
 }
@@ -124,20 +330,611 @@ func (m testDBRepo) AllRooms() ([]models.Room, error) {
 	return rooms, nil
 }
 
+// GetRestrictionsByDate fails for the year 3002
+func (m testDBRepo) GetRestrictionsByDate(start, end time.Time) ([]models.RoomRestriction, error) {
+	if start.Year() == 3002 {
+		return nil, errors.New("some error")
+	}
+	return m.GetRestrictionsForRoomByDate(1, start, end)
+}
+
 // GetRestrictionsForRoomByDate returns restrictions for a room by date range
 func (m testDBRepo) GetRestrictionsForRoomByDate(roomID int, start, end time.Time) ([]models.RoomRestriction, error) {
 
 	var restrictions []models.RoomRestriction
+	if roomID == 2 {
+		return restrictions, errors.New("some error")
+	}
+
+	if roomID == 1 {
+		restrictions = append(restrictions, models.RoomRestriction{
+			ID:            1,
+			RoomID:        1,
+			ReservationID: 1,
+			RestrictionID: 1,
+			StartDate:     time.Date(2050, 1, 2, 0, 0, 0, 0, time.UTC),
+			EndDate:       time.Date(2050, 1, 4, 0, 0, 0, 0, time.UTC),
+		})
+	}
 
 	return restrictions, nil
 }
 
-// InsertBlockForRoom insert a room restrictions
-func (m testDBRepo) InsertBlockForRoom(id int, startDate time.Time) error {
+// UpdateBlocks fails with repository.ErrCalendarChanged when room 1 has the version "stale", and
+// fails for room 2
+func (m testDBRepo) UpdateBlocks(c models.BlockChanges) ([]models.RoomRestriction, []models.RoomRestriction, error) {
+	if c.Versions[1] == "stale" {
+		return nil, nil, repository.ErrCalendarChanged
+	}
+	if _, ok := c.Versions[2]; ok {
+		return nil, nil, errors.New("some error")
+	}
+
+	var added, removed []models.RoomRestriction
+	for i, b := range c.Add {
+		b.ID = 100 + i
+		b.RestrictionID = models.OwnerBlockRestrictionID
+		b.EndDate = b.StartDate.AddDate(0, 0, 1)
+		added = append(added, b)
+	}
+	for _, b := range c.Remove {
+		b.RestrictionID = models.OwnerBlockRestrictionID
+		b.StartDate = c.Start
+		b.EndDate = c.Start.AddDate(0, 0, 1)
+		removed = append(removed, b)
+	}
+	return added, removed, nil
+}
+
+// GetChargesForReservation returns all charges of a reservation
+func (m testDBRepo) GetChargesForReservation(reservationID int) ([]models.Charge, error) {
+	var charges []models.Charge
+
+	charges = append(charges, models.Charge{
+		ID:            1,
+		ReservationID: reservationID,
+		Description:   "Room night",
+		Quantity:      2,
+		UnitAmount:    12000,
+	})
+
+	return charges, nil
+}
+
+// InsertCharge adds a charge to a reservation
+func (m testDBRepo) InsertCharge(c models.Charge) error {
+	if c.ReservationID == 1000 {
+		return errors.New("some error")
+	}
+	return nil
+}
+
+// DeleteCharge deletes a charge of a reservation, as long as it is not on an invoice. Charges with an
+// id above 100 don't exist
+func (m testDBRepo) DeleteCharge(id, reservationID int) error {
+	if id > 100 {
+		return sql.ErrNoRows
+	}
+	if id == 2 {
+		return repository.ErrChargeInvoiced
+	}
+	return nil
+}
+
+// IssueInvoice puts all uninvoiced charges of a reservation on a new invoice
+func (m testDBRepo) IssueInvoice(reservationID int, property string) (models.Invoice, error) {
+	if reservationID == 2 {
+		return models.Invoice{}, repository.ErrNothingToInvoice
+	} else if reservationID == 1000 {
+		return models.Invoice{}, errors.New("some error")
+	}
+
+	return testInvoice(1, reservationID), nil
+}
+
+// IssueCreditNote reverses an invoice in full, invoices above 100 don't exist
+func (m testDBRepo) IssueCreditNote(invoiceID int) (models.Invoice, error) {
+	if invoiceID > 100 {
+		return models.Invoice{}, sql.ErrNoRows
+	}
+	if invoiceID == 2 {
+		return models.Invoice{}, repository.ErrAlreadyCredited
+	}
+
+	cn := testInvoice(invoiceID+1, 1)
+	cn.Kind = models.InvoiceKindCreditNote
+	cn.CreditsInvoiceID = invoiceID
+	return cn, nil
+}
+
+// GetInvoiceByID returns one invoice or credit note with its lines
+func (m testDBRepo) GetInvoiceByID(id int) (models.Invoice, error) {
+	if id > 100 {
+		return models.Invoice{}, errors.New("some error")
+	}
+	return testInvoice(id, 1), nil
+}
+
+// GetInvoicesForReservation returns the invoices and credit notes of a reservation
+func (m testDBRepo) GetInvoicesForReservation(reservationID int) ([]models.Invoice, error) {
+	var invoices []models.Invoice
+
+	invoices = append(invoices, testInvoice(1, reservationID))
+
+	return invoices, nil
+}
+
+func testInvoice(id, reservationID int) models.Invoice {
+	return models.Invoice{
+		ID:            id,
+		Property:      "FSBB",
+		Kind:          models.InvoiceKindInvoice,
+		Number:        id,
+		InvoiceNumber: fmt.Sprintf("FSBB-INV-%06d", id),
+		ReservationID: reservationID,
+		GuestName:     "John Smith",
+		GuestEmail:    "john@smith.com",
+		RoomName:      "General's Quarters",
+		StartDate:     time.Date(2050, 1, 1, 0, 0, 0, 0, time.UTC),
+		EndDate:       time.Date(2050, 1, 3, 0, 0, 0, 0, time.UTC),
+		TotalAmount:   24000,
+		IssuedAt:      time.Now(),
+		Lines: []models.InvoiceLine{
+			{ID: 1, InvoiceID: id, Description: "Room night", Quantity: 2, UnitAmount: 12000, Amount: 24000},
+		},
+	}
+}
+
+// InsertGuest registers a guest account
+func (m testDBRepo) InsertGuest(g models.Guest) (int, error) {
+	if g.Email == "exists@here.ca" {
+		return 0, repository.ErrDuplicateEmail
+	} else if g.Email == "error@here.ca" {
+		return 0, errors.New("some error")
+	}
+	return 1, nil
+}
+
+// GetGuestByID returns a guest account by ID
+func (m testDBRepo) GetGuestByID(id int) (models.Guest, error) {
+	if id > 100 {
+		return models.Guest{}, errors.New("some error")
+	}
+	return models.Guest{
+		ID:        id,
+		FirstName: "Jane",
+		LastName:  "Guest",
+		Email:     "guest@here.ca",
+		Phone:     "555-555-5555",
+	}, nil
+}
+
+// AuthenticateGuest authenticates a guest account
+func (m testDBRepo) AuthenticateGuest(email, testPassword string) (int, error) {
+	if email == "guest@here.ca" {
+		return 1, nil
+	}
+	return 0, errors.New("some error")
+}
+
+// GetReservationsForGuest returns all reservations made with a guest account
+func (m testDBRepo) GetReservationsForGuest(guestID int) ([]models.Reservation, error) {
+	var reservations []models.Reservation
+
+	if guestID > 100 {
+		return reservations, errors.New("some error")
+	}
+
+	reservations = append(reservations,
+		models.Reservation{
+			ID:        2,
+			StartDate: time.Now().AddDate(0, 1, 0),
+			EndDate:   time.Now().AddDate(0, 1, 2),
+			GuestID:   guestID,
+			Room:      models.Room{ID: 1, RoomName: "General's Quarters"},
+		},
+		models.Reservation{
+			ID:        1,
+			StartDate: time.Now().AddDate(0, -1, 0),
+			EndDate:   time.Now().AddDate(0, -1, 2),
+			GuestID:   guestID,
+			Room:      models.Room{ID: 2, RoomName: "Major's Suite"},
+		},
+	)
+
+	return reservations, nil
+}
+
+func (m *testDBRepo) GetUserByEmail(email string) (models.User, error) {
+	var u models.User
+	switch email {
+	case "me@here.ca":
+		u.ID = 1
+		u.AccessLevel = 4
+	case "disabled@here.ca":
+		u.ID = 3
+		u.Disabled = true
+	case "locked@here.ca":
+		u.ID = 5
+		u.LockedUntil = time.Now().Add(10 * time.Minute)
+	case "lockme@here.ca":
+		u.ID = 6
+		u.FailedLogins = 4
+	default:
+		return u, sql.ErrNoRows
+	}
+	u.Email = email
+	return u, nil
+}
+
+func (m *testDBRepo) InsertPasswordReset(userID int, tokenHash string, expiresAt time.Time) error {
+	return nil
+}
+
+func (m *testDBRepo) GetPasswordResetUserID(tokenHash string) (int, error) {
+	if tokenHash == helpers.HashToken("expired") {
+		return 0, repository.ErrInvalidToken
+	}
+	return 1, nil
+}
+
+func (m *testDBRepo) ResetPassword(tokenHash, password string) (int, error) {
+	if tokenHash == helpers.HashToken("expired") {
+		return 0, repository.ErrInvalidToken
+	}
+	return 1, nil
+}
+
+func (m *testDBRepo) EnableTOTP(userID int, secret string, recoveryCodes []string) error {
 	return nil
 }
 
-// DeleteBlockByID deletes a room restriction
-func (m testDBRepo) DeleteBlockByID(id int) error {
+func (m *testDBRepo) DisableTOTP(userID int) error {
 	return nil
 }
+
+func (m *testDBRepo) UseRecoveryCode(userID int, code string) (bool, error) {
+	return code == "abcde-fghjk", nil
+}
+
+// UseTOTPStep treats the current code of user 6 as already used
+func (m *testDBRepo) UseTOTPStep(userID int, step int64) (bool, error) {
+	return userID != 6, nil
+}
+
+func (m *testDBRepo) InsertLoginAttempt(a models.LoginAttempt) error {
+	return nil
+}
+
+func (m *testDBRepo) CountIPFailures(ip string, since time.Time) (int, error) {
+	if ip == "10.0.0.66" {
+		return 100, nil
+	}
+	return 0, nil
+}
+
+func (m *testDBRepo) RecordFailedLogin(userID, maxFailures int, lockFor time.Duration) (bool, error) {
+	return userID == 6, nil
+}
+
+func (m *testDBRepo) ResetFailedLogins(userID int) error {
+	return nil
+}
+
+func (m *testDBRepo) UnlockUser(id int) error {
+	if id > 100 {
+		return errors.New("some error")
+	}
+	return nil
+}
+
+func (m *testDBRepo) LockedUsers() ([]models.User, error) {
+	var users []models.User
+	users = append(users, models.User{ID: 5, Email: "locked@here.ca", LockedUntil: time.Now().Add(10 * time.Minute)})
+	return users, nil
+}
+
+func (m *testDBRepo) RecentLoginAttempts(limit int) ([]models.LoginAttempt, error) {
+	var attempts []models.LoginAttempt
+	attempts = append(attempts,
+		models.LoginAttempt{ID: 2, Email: "locked@here.ca", UserID: 5, IP: "10.0.0.1", Outcome: models.LoginLocked, CreatedAt: time.Now()},
+		models.LoginAttempt{ID: 1, Email: "me@here.ca", UserID: 1, IP: "10.0.0.1", Outcome: models.LoginSucceeded, CreatedAt: time.Now()},
+	)
+	return attempts, nil
+}
+
+func (m *testDBRepo) InsertUserSession(s models.UserSession) error {
+	return nil
+}
+
+func (m *testDBRepo) TouchUserSession(sessionID, ip string) (bool, error) {
+	return sessionID == "current-sid", nil
+}
+
+func (m *testDBRepo) ActiveUserSessions(userID int, since time.Time) ([]models.UserSession, error) {
+	var sessions []models.UserSession
+	if userID > 100 {
+		return sessions, errors.New("some error")
+	}
+
+	sessions = append(sessions,
+		models.UserSession{ID: 1, UserID: userID, SessionID: "current-sid", UserAgent: "Mozilla/5.0 (Windows NT 10.0; Win64; x64) Chrome/118.0", IP: "10.0.0.1", LastSeenAt: time.Now()},
+		models.UserSession{ID: 2, UserID: userID, SessionID: "other-sid", UserAgent: "Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) Safari/604.1", IP: "10.0.0.2", LastSeenAt: time.Now().Add(-time.Hour)},
+	)
+	return sessions, nil
+}
+
+func (m *testDBRepo) RevokeUserSession(userID int, sessionID string) error {
+	return nil
+}
+
+func (m *testDBRepo) RevokeUserSessions(userID int, exceptSessionID string) error {
+	return nil
+}
+
+func (m *testDBRepo) InsertAPIKey(k models.APIKey) (int, error) {
+	if k.Name == "fail" {
+		return 0, errors.New("some error")
+	}
+	return 1, nil
+}
+
+func (m *testDBRepo) AllAPIKeys() ([]models.APIKey, error) {
+	var keys []models.APIKey
+
+	keys = append(keys,
+		models.APIKey{ID: 1, Name: "Tablet", Prefix: "bk_tablet0", Scopes: []string{"availability:read", "reservations:write"},
+			LastUsedAt: time.Now(), RequestCount: 42},
+		models.APIKey{ID: 2, Name: "Old partner", Prefix: "bk_partner", Scopes: []string{"availability:read"},
+			RevokedAt: time.Now()},
+	)
+
+	return keys, nil
+}
+
+// GetAPIKeyByHash knows the keys "bk_read", "bk_admin", "bk_expired" and "bk_revoked"
+func (m *testDBRepo) GetAPIKeyByHash(keyHash string) (models.APIKey, error) {
+	switch keyHash {
+	case apikey.Hash("bk_read"):
+		return models.APIKey{ID: 1, Scopes: []string{"availability:read"}}, nil
+	case apikey.Hash("bk_admin"):
+		return models.APIKey{ID: 2, Scopes: []string{"admin"}}, nil
+	case apikey.Hash("bk_expired"):
+		return models.APIKey{ID: 3, Scopes: []string{"admin"}, ExpiresAt: time.Now().Add(-time.Hour)}, nil
+	case apikey.Hash("bk_revoked"):
+		return models.APIKey{ID: 4, Scopes: []string{"admin"}, RevokedAt: time.Now().Add(-time.Hour)}, nil
+	case apikey.Hash("bk_error"):
+		return models.APIKey{}, errors.New("some error")
+	}
+	return models.APIKey{}, sql.ErrNoRows
+}
+
+func (m *testDBRepo) TouchAPIKey(id int) error {
+	return nil
+}
+
+func (m *testDBRepo) RevokeAPIKey(id int) error {
+	if id > 100 {
+		return errors.New("some error")
+	}
+	return nil
+}
+
+func (m *testDBRepo) InsertWebhook(h models.Webhook) (int, error) {
+	if h.Description == "fail" {
+		return 0, errors.New("some error")
+	}
+	return 1, nil
+}
+
+func (m *testDBRepo) AllWebhooks() ([]models.Webhook, error) {
+	var hooks []models.Webhook
+
+	hooks = append(hooks,
+		models.Webhook{ID: 1, URL: "https://chat.example.com/hooks/bookings", Description: "Slack bridge",
+			Events: []string{"reservation.created", "reservation.cancelled"}, Active: true},
+		models.Webhook{ID: 2, URL: "https://locks.example.com/bookings", Description: "Door locks",
+			Events: []string{"reservation.created"}},
+	)
+
+	return hooks, nil
+}
+
+// GetWebhookByID fails for ids above 100
+func (m *testDBRepo) GetWebhookByID(id int) (models.Webhook, error) {
+	if id > 100 {
+		return models.Webhook{}, sql.ErrNoRows
+	}
+	return models.Webhook{ID: id, URL: "https://chat.example.com/hooks/bookings", Description: "Slack bridge",
+		Secret: "whsec_test", Events: []string{"reservation.created"}, Active: true}, nil
+}
+
+func (m *testDBRepo) UpdateWebhook(h models.Webhook) error {
+	if h.Description == "fail" {
+		return errors.New("some error")
+	}
+	return nil
+}
+
+func (m *testDBRepo) DeleteWebhook(id int) error {
+	if id > 100 {
+		return errors.New("some error")
+	}
+	return nil
+}
+
+func (m *testDBRepo) EnqueueWebhookDeliveries(eventType string, payload []byte) (int, error) {
+	return 0, nil
+}
+
+func (m *testDBRepo) ClaimWebhookDeliveries(limit int, lease time.Duration) ([]models.WebhookDelivery, error) {
+	return nil, nil
+}
+
+func (m *testDBRepo) RecordWebhookAttempt(d models.WebhookDelivery) error {
+	return nil
+}
+
+func (m *testDBRepo) WebhookDeliveries(webhookID, limit int) ([]models.WebhookDelivery, error) {
+	var deliveries []models.WebhookDelivery
+
+	deliveries = append(deliveries,
+		models.WebhookDelivery{ID: 2, WebhookID: webhookID, Event: "reservation.created", Payload: "{}", Attempts: 8,
+			ResponseStatus: 500, Error: "500 Internal Server Error", CreatedAt: time.Now()},
+		models.WebhookDelivery{ID: 1, WebhookID: webhookID, Event: "reservation.created", Payload: "{}", Attempts: 1,
+			ResponseStatus: 200, DeliveredAt: time.Now(), CreatedAt: time.Now()},
+	)
+
+	return deliveries, nil
+}
+
+// RedeliverWebhookDelivery fails for delivery ids above 100
+func (m *testDBRepo) RedeliverWebhookDelivery(webhookID, id int) error {
+	if id > 100 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (m *testDBRepo) InsertCalendarFeed(f models.CalendarFeed) (int, error) {
+	if f.Name == "fail" {
+		return 0, errors.New("some error")
+	}
+	return 1, nil
+}
+
+func (m *testDBRepo) AllCalendarFeeds() ([]models.CalendarFeed, error) {
+	var feeds []models.CalendarFeed
+
+	feeds = append(feeds,
+		models.CalendarFeed{ID: 1, Name: "Owner's phone", Token: "all-rooms", ShowGuestNames: true},
+		models.CalendarFeed{ID: 2, Name: "Booking site", RoomID: 1, Room: models.Room{ID: 1, RoomName: "General's Quarters"},
+			Token: "generals"},
+	)
+
+	return feeds, nil
+}
+
+// GetCalendarFeedByToken knows the tokens "all-rooms", "generals" and "error" (room 2, whose restrictions fail)
+func (m *testDBRepo) GetCalendarFeedByToken(token string) (models.CalendarFeed, error) {
+	switch token {
+	case "all-rooms":
+		return models.CalendarFeed{ID: 1, Name: "Owner's phone", Token: token, ShowGuestNames: true}, nil
+	case "generals":
+		return models.CalendarFeed{ID: 2, Name: "Booking site", RoomID: 1, Room: models.Room{ID: 1, RoomName: "General's Quarters"},
+			Token: token}, nil
+	case "error":
+		return models.CalendarFeed{ID: 3, RoomID: 2, Token: token}, nil
+	}
+	return models.CalendarFeed{}, sql.ErrNoRows
+}
+
+func (m *testDBRepo) DeleteCalendarFeed(id int) error {
+	if id > 100 {
+		return errors.New("some error")
+	}
+	return nil
+}
+
+// RestrictionsForFeed returns a reservation and a block of room 1, and fails for room 2
+func (m *testDBRepo) RestrictionsForFeed(roomID int, since time.Time) ([]models.RoomRestriction, error) {
+	if roomID == 2 {
+		return nil, errors.New("some error")
+	}
+
+	room := models.Room{ID: 1, RoomName: "General's Quarters"}
+	return []models.RoomRestriction{
+		{ID: 1, RoomID: 1, Room: room, ReservationID: 1, RestrictionID: 1,
+			Reservation: models.Reservation{ID: 1, FirstName: "John", LastName: "Smith"},
+			StartDate:   time.Date(2050, 1, 2, 0, 0, 0, 0, time.UTC),
+			EndDate:     time.Date(2050, 1, 4, 0, 0, 0, 0, time.UTC)},
+		{ID: 2, RoomID: 1, Room: room, RestrictionID: 2,
+			StartDate: time.Date(2050, 1, 10, 0, 0, 0, 0, time.UTC),
+			EndDate:   time.Date(2050, 1, 11, 0, 0, 0, 0, time.UTC)},
+	}, nil
+}
+
+func (m *testDBRepo) InsertCalendarSource(s models.CalendarSource) (int, error) {
+	if s.Name == "fail" {
+		return 0, errors.New("some error")
+	}
+	return 1, nil
+}
+
+func (m *testDBRepo) AllCalendarSources() ([]models.CalendarSource, error) {
+	return []models.CalendarSource{
+		{ID: 1, RoomID: 1, Room: models.Room{ID: 1, RoomName: "General's Quarters"}, Name: "Airbnb",
+			URL: "https://www.airbnb.com/calendar/ical/1.ics", LastSyncedAt: time.Now()},
+	}, nil
+}
+
+// GetCalendarSourceByID fails for ids above 100
+func (m *testDBRepo) GetCalendarSourceByID(id int) (models.CalendarSource, error) {
+	if id > 100 {
+		return models.CalendarSource{}, sql.ErrNoRows
+	}
+	return models.CalendarSource{ID: id, RoomID: 1, Room: models.Room{ID: 1, RoomName: "General's Quarters"},
+		Name: "Airbnb", URL: "http://127.0.0.1:1/calendar.ics"}, nil
+}
+
+func (m *testDBRepo) DeleteCalendarSource(id int) ([]models.RoomRestriction, error) {
+	if id > 100 {
+		return nil, errors.New("some error")
+	}
+	room := models.Room{ID: 1, RoomName: "General's Quarters"}
+	return []models.RoomRestriction{
+		{ID: 7, RoomID: 1, Room: room, RestrictionID: models.ExternalRestrictionID, CalendarSourceID: id,
+			StartDate: time.Date(2050, 1, 6, 0, 0, 0, 0, time.UTC), EndDate: time.Date(2050, 1, 8, 0, 0, 0, 0, time.UTC)},
+	}, nil
+}
+
+func (m *testDBRepo) RecordCalendarSync(id int, syncErr string) error {
+	return nil
+}
+
+func (m *testDBRepo) ExternalBlocks(sourceID int) ([]models.RoomRestriction, error) {
+	return nil, nil
+}
+
+func (m *testDBRepo) SaveExternalBlocks(sourceID int, blocks []models.RoomRestriction, removeIDs []int) error {
+	return nil
+}
+
+func (m *testDBRepo) CalendarConflicts(sourceID int) ([]models.CalendarConflict, error) {
+	room := models.Room{ID: 1, RoomName: "General's Quarters"}
+	return []models.CalendarConflict{
+		{
+			Source: models.CalendarSource{ID: 1, RoomID: 1, Room: room, Name: "Airbnb"},
+			Block: models.RoomRestriction{ID: 3, RoomID: 1, Room: room, RestrictionID: models.ExternalRestrictionID,
+				CalendarSourceID: 1, ExternalUID: "abc@airbnb.com",
+				StartDate: time.Date(2050, 1, 3, 0, 0, 0, 0, time.UTC),
+				EndDate:   time.Date(2050, 1, 5, 0, 0, 0, 0, time.UTC)},
+			Reservation: models.Reservation{ID: 1, RoomID: 1, Room: room, FirstName: "John", LastName: "Smith",
+				StartDate: time.Date(2050, 1, 2, 0, 0, 0, 0, time.UTC),
+				EndDate:   time.Date(2050, 1, 4, 0, 0, 0, 0, time.UTC)},
+		},
+	}, nil
+}
+
+func (m *testDBRepo) OccupancyStats(from, to time.Time) (models.OccupancyStats, error) {
+	if from.Year() == 3002 {
+		return models.OccupancyStats{}, errors.New("some error")
+	}
+	return models.OccupancyStats{From: from, To: to, Rooms: 2, NightsSold: 3, Stays: 2, StayNights: 3, Revenue: 36050}, nil
+}
+
+func (m *testDBRepo) DailyOccupancy(from, to time.Time) ([]models.DailyOccupancy, error) {
+	var days []models.DailyOccupancy
+	for d := from; !d.After(to); d = d.AddDate(0, 0, 1) {
+		days = append(days, models.DailyOccupancy{Date: d, Rooms: d.Day() % 3})
+	}
+	return days, nil
+}
+
+func (m *testDBRepo) CountMovements(from, to time.Time) (models.Movements, error) {
+	return models.Movements{Arrivals: 1, Departures: 2}, nil
+}
+
+func (m *testDBRepo) LeadTimes(from, to time.Time) ([]models.LeadTime, error) {
+	return []models.LeadTime{{Days: -3, Reservations: 5}, {Days: 0, Reservations: 1}, {Days: 14, Reservations: 2}, {Days: 120, Reservations: 1}}, nil
+}
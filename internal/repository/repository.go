@@ -1,32 +1,134 @@
 package repository
 
 import (
+	"errors"
 	"github.com/KingKord/bookings/internal/models"
 	"time"
 )
 
+var (
+	// ErrNothingToInvoice is returned when a reservation has no uninvoiced charges
+	ErrNothingToInvoice = errors.New("reservation has no charges to invoice")
+	// ErrAlreadyCredited is returned when a credit note already exists for an invoice
+	ErrAlreadyCredited = errors.New("invoice has already been credited")
+	// ErrChargeInvoiced is returned when trying to change a charge that is on an invoice
+	ErrChargeInvoiced = errors.New("charge has already been invoiced")
+	// ErrDuplicateEmail is returned when an account with the email address already exists
+	ErrDuplicateEmail = errors.New("email address is already registered")
+	// ErrInvalidToken is returned when a password reset token is unknown, expired or already used
+	ErrInvalidToken = errors.New("token is invalid or has expired")
+	// ErrAlreadyCancelled is returned when cancelling a reservation that is already cancelled
+	ErrAlreadyCancelled = errors.New("reservation has already been cancelled")
+	// ErrRoomNotAvailable is returned when booking a room that is taken for some of the nights
+	ErrRoomNotAvailable = errors.New("room is not available for these dates")
+	// ErrCalendarChanged is returned when editing blocks of a room whose restrictions changed since
+	// the edits were made
+	ErrCalendarChanged = errors.New("calendar has changed since it was loaded")
+)
+
 type DatabaseRepo interface {
-	AllUsers() bool
+	AllUsers() ([]models.User, error)
 
 	InsertReservation(res models.Reservation) (int, error)
 	InsertRoomRestriction(r models.RoomRestriction) error
 	SearchAvailabilityByDates(start, end time.Time, roomID int) (bool, error)
+	BookRoom(res models.Reservation) (int, error)
 	SearchAvailabilityForAllRooms(start, end time.Time) ([]models.Room, error)
 	GetRoomByID(id int) (models.Room, error)
 
 	GetUserByID(id int) (models.User, error)
+	InsertUser(u models.User) (int, error)
 	UpdateUser(u models.User) error
+	DeleteUser(id int) error
 	Authenticate(email, testPassword string) (int, string, error)
+	GetUserByEmail(email string) (models.User, error)
+
+	InsertPasswordReset(userID int, tokenHash string, expiresAt time.Time) error
+	GetPasswordResetUserID(tokenHash string) (int, error)
+	ResetPassword(tokenHash, password string) (int, error)
+
+	EnableTOTP(userID int, secret string, recoveryCodes []string) error
+	DisableTOTP(userID int) error
+	UseRecoveryCode(userID int, code string) (bool, error)
+	UseTOTPStep(userID int, step int64) (bool, error)
+
+	InsertLoginAttempt(a models.LoginAttempt) error
+	CountIPFailures(ip string, since time.Time) (int, error)
+	RecordFailedLogin(userID, maxFailures int, lockFor time.Duration) (bool, error)
+	ResetFailedLogins(userID int) error
+	UnlockUser(id int) error
+	LockedUsers() ([]models.User, error)
+	RecentLoginAttempts(limit int) ([]models.LoginAttempt, error)
+
+	InsertUserSession(s models.UserSession) error
+	TouchUserSession(sessionID, ip string) (bool, error)
+	ActiveUserSessions(userID int, since time.Time) ([]models.UserSession, error)
+	RevokeUserSession(userID int, sessionID string) error
+	RevokeUserSessions(userID int, exceptSessionID string) error
+
+	InsertAPIKey(k models.APIKey) (int, error)
+	AllAPIKeys() ([]models.APIKey, error)
+	GetAPIKeyByHash(keyHash string) (models.APIKey, error)
+	TouchAPIKey(id int) error
+	RevokeAPIKey(id int) error
 
-	AllReservations() ([]models.Reservation, error)
-	AllNewReservations() ([]models.Reservation, error)
+	InsertWebhook(h models.Webhook) (int, error)
+	AllWebhooks() ([]models.Webhook, error)
+	GetWebhookByID(id int) (models.Webhook, error)
+	UpdateWebhook(h models.Webhook) error
+	DeleteWebhook(id int) error
+	EnqueueWebhookDeliveries(eventType string, payload []byte) (int, error)
+	ClaimWebhookDeliveries(limit int, lease time.Duration) ([]models.WebhookDelivery, error)
+	RecordWebhookAttempt(d models.WebhookDelivery) error
+	WebhookDeliveries(webhookID, limit int) ([]models.WebhookDelivery, error)
+	RedeliverWebhookDelivery(webhookID, id int) error
+
+	InsertCalendarFeed(f models.CalendarFeed) (int, error)
+	AllCalendarFeeds() ([]models.CalendarFeed, error)
+	GetCalendarFeedByToken(token string) (models.CalendarFeed, error)
+	DeleteCalendarFeed(id int) error
+	RestrictionsForFeed(roomID int, since time.Time) ([]models.RoomRestriction, error)
+
+	InsertCalendarSource(s models.CalendarSource) (int, error)
+	AllCalendarSources() ([]models.CalendarSource, error)
+	GetCalendarSourceByID(id int) (models.CalendarSource, error)
+	DeleteCalendarSource(id int) ([]models.RoomRestriction, error)
+	RecordCalendarSync(id int, syncErr string) error
+	ExternalBlocks(sourceID int) ([]models.RoomRestriction, error)
+	SaveExternalBlocks(sourceID int, blocks []models.RoomRestriction, removeIDs []int) error
+	CalendarConflicts(sourceID int) ([]models.CalendarConflict, error)
+
+	ListReservations(f models.ReservationFilter, p models.Page) ([]models.Reservation, int, error)
+	SearchReservations(query string, limit int) ([]models.Reservation, error)
+	EachReservation(f models.ReservationFilter, fn func(models.Reservation) error) error
+	ImportReservations(reservations []models.Reservation) ([]int, error)
 	GetReservationByID(id int) (models.Reservation, error)
 	UpdateReservation(u models.Reservation) error
+	MoveReservation(id, roomID int, start, end time.Time) ([]models.RoomRestriction, error)
 	DeleteReservation(id int) error
+	CancelReservation(id int) error
 	UpdateProcessedForReservation(id, processed int) error
 	AllRooms() ([]models.Room, error)
 	GetRestrictionsForRoomByDate(roomID int, start, end time.Time) ([]models.RoomRestriction, error)
+	GetRestrictionsByDate(start, end time.Time) ([]models.RoomRestriction, error)
+
+	UpdateBlocks(c models.BlockChanges) ([]models.RoomRestriction, []models.RoomRestriction, error)
+
+	GetChargesForReservation(reservationID int) ([]models.Charge, error)
+	InsertCharge(c models.Charge) error
+	DeleteCharge(id, reservationID int) error
+	IssueInvoice(reservationID int, property string) (models.Invoice, error)
+	IssueCreditNote(invoiceID int) (models.Invoice, error)
+	GetInvoiceByID(id int) (models.Invoice, error)
+	GetInvoicesForReservation(reservationID int) ([]models.Invoice, error)
+
+	InsertGuest(g models.Guest) (int, error)
+	GetGuestByID(id int) (models.Guest, error)
+	AuthenticateGuest(email, testPassword string) (int, error)
+	GetReservationsForGuest(guestID int) ([]models.Reservation, error)
 
-	InsertBlockForRoom(id int, startDate time.Time) error
-	DeleteBlockByID(id int) error
+	OccupancyStats(from, to time.Time) (models.OccupancyStats, error)
+	DailyOccupancy(from, to time.Time) ([]models.DailyOccupancy, error)
+	CountMovements(from, to time.Time) (models.Movements, error)
+	LeadTimes(from, to time.Time) ([]models.LeadTime, error)
 }
@@ -0,0 +1,155 @@
+package sessionstore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/alexedwards/scs/v2"
+	"github.com/alexedwards/scs/v2/memstore"
+	"log"
+	"time"
+)
+
+// store kinds accepted by New
+const (
+	Memory   = "memory"
+	Postgres = "postgres"
+)
+
+// CleanupInterval is how often expired sessions are deleted from the postgres store
+const CleanupInterval = 5 * time.Minute
+
+// New returns the session store of the given kind. Memory sessions are lost on restart and
+// are not shared between replicas, so deployments with more than one replica need postgres
+func New(kind string, db *sql.DB) (scs.Store, error) {
+	switch kind {
+	case Memory:
+		return memstore.New(), nil
+	case Postgres:
+		return NewPostgresStore(db, CleanupInterval), nil
+	}
+	return nil, fmt.Errorf("unknown session store %q, use %s or %s", kind, Memory, Postgres)
+}
+
+// PostgresStore keeps sessions in the sessions table
+type PostgresStore struct {
+	db          *sql.DB
+	stopCleanup chan bool
+}
+
+// NewPostgresStore returns a postgres session store which deletes expired sessions every
+// cleanupInterval. A cleanupInterval of 0 disables the cleanup
+func NewPostgresStore(db *sql.DB, cleanupInterval time.Duration) *PostgresStore {
+	p := &PostgresStore{db: db}
+	if cleanupInterval > 0 {
+		p.stopCleanup = make(chan bool)
+		go p.startCleanup(cleanupInterval)
+	}
+	return p
+}
+
+// Find returns the data for a session token which has not expired
+func (p *PostgresStore) Find(token string) ([]byte, bool, error) {
+	return p.FindCtx(context.Background(), token)
+}
+
+// FindCtx returns the data for a session token which has not expired
+func (p *PostgresStore) FindCtx(ctx context.Context, token string) ([]byte, bool, error) {
+	var b []byte
+
+	query := `select data from sessions where token = $1 and current_timestamp < expiry`
+
+	err := p.db.QueryRowContext(ctx, query, token).Scan(&b)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return b, true, nil
+}
+
+// Commit adds a session token and its data, overwriting the data and expiry of an existing token
+func (p *PostgresStore) Commit(token string, b []byte, expiry time.Time) error {
+	return p.CommitCtx(context.Background(), token, b, expiry)
+}
+
+// CommitCtx adds a session token and its data, overwriting the data and expiry of an existing token
+func (p *PostgresStore) CommitCtx(ctx context.Context, token string, b []byte, expiry time.Time) error {
+	stmt := `insert into sessions (token, data, expiry) values ($1, $2, $3)
+			on conflict (token) do update set data = excluded.data, expiry = excluded.expiry`
+
+	_, err := p.db.ExecContext(ctx, stmt, token, b, expiry)
+	return err
+}
+
+// Delete removes a session token and its data
+func (p *PostgresStore) Delete(token string) error {
+	return p.DeleteCtx(context.Background(), token)
+}
+
+// DeleteCtx removes a session token and its data
+func (p *PostgresStore) DeleteCtx(ctx context.Context, token string) error {
+	_, err := p.db.ExecContext(ctx, `delete from sessions where token = $1`, token)
+	return err
+}
+
+// All returns the data of every session which has not expired, keyed by token
+func (p *PostgresStore) All() (map[string][]byte, error) {
+	return p.AllCtx(context.Background())
+}
+
+// AllCtx returns the data of every session which has not expired, keyed by token
+func (p *PostgresStore) AllCtx(ctx context.Context) (map[string][]byte, error) {
+	sessions := make(map[string][]byte)
+
+	rows, err := p.db.QueryContext(ctx, `select token, data from sessions where current_timestamp < expiry`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var token string
+		var data []byte
+		err = rows.Scan(&token, &data)
+		if err != nil {
+			return nil, err
+		}
+		sessions[token] = data
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// StopCleanup stops the background cleanup of expired sessions
+func (p *PostgresStore) StopCleanup() {
+	if p.stopCleanup != nil {
+		p.stopCleanup <- true
+	}
+}
+
+func (p *PostgresStore) startCleanup(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			err := p.deleteExpired()
+			if err != nil {
+				log.Println("cannot delete expired sessions:", err)
+			}
+		case <-p.stopCleanup:
+			return
+		}
+	}
+}
+
+func (p *PostgresStore) deleteExpired() error {
+	_, err := p.db.Exec(`delete from sessions where expiry < current_timestamp`)
+	return err
+}
@@ -0,0 +1,299 @@
+package sessionstore
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/gob"
+	"fmt"
+	"github.com/KingKord/bookings/internal/models"
+	"github.com/alexedwards/scs/v2"
+	"github.com/alexedwards/scs/v2/memstore"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNew(t *testing.T) {
+	store, err := New(Memory, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := store.(*memstore.MemStore); !ok {
+		t.Errorf("expected a memory store, got %T", store)
+	}
+
+	store, err = New(Postgres, openSessionsDB(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := store.(*PostgresStore); !ok {
+		t.Errorf("expected a postgres store, got %T", store)
+	}
+	store.(*PostgresStore).StopCleanup()
+
+	_, err = New("redis", nil)
+	if err == nil {
+		t.Error("expected an error for an unknown store")
+	}
+}
+
+func TestReservationSurvivesRestart(t *testing.T) {
+	gob.Register(models.Reservation{})
+
+	db := openSessionsDB(t)
+
+	before := scs.New()
+	before.Store = NewPostgresStore(db, 0)
+	ctx, _ := before.Load(context.Background(), "")
+	before.Put(ctx, "reservation", models.Reservation{
+		RoomID:    1,
+		StartDate: time.Date(2050, 1, 1, 0, 0, 0, 0, time.UTC),
+		Room:      models.Room{ID: 1, RoomName: "General's Quarters"},
+	})
+	token, _, err := before.Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a new session manager and store, as after a restart or on another replica, sharing the database
+	after := scs.New()
+	after.Store = NewPostgresStore(db, 0)
+	ctx, err = after.Load(context.Background(), token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, ok := after.Get(ctx, "reservation").(models.Reservation)
+	if !ok {
+		t.Fatal("reservation was lost")
+	}
+	if res.Room.RoomName != "General's Quarters" || res.StartDate.Year() != 2050 {
+		t.Errorf("reservation changed on the way through the store: %+v", res)
+	}
+
+	// committing again overwrites the session instead of adding another one
+	after.Put(ctx, "reservation", models.Reservation{RoomID: 2})
+	if _, _, err = after.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	all, err := after.Store.(*PostgresStore).All()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 1 {
+		t.Errorf("expected 1 session, got %d", len(all))
+	}
+}
+
+func TestPostgresStoreExpiry(t *testing.T) {
+	db := openSessionsDB(t)
+	store := NewPostgresStore(db, 0)
+
+	err := store.Commit("live", []byte("a"), time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Commit("expired", []byte("b"), time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if b, found, _ := store.Find("live"); !found || string(b) != "a" {
+		t.Errorf("expected live session to be found, got %q %t", b, found)
+	}
+	if _, found, _ := store.Find("expired"); found {
+		t.Error("expected expired session not to be found")
+	}
+	if all, _ := store.All(); len(all) != 1 {
+		t.Errorf("expected only the live session to be listed, got %d", len(all))
+	}
+
+	err = store.Delete("live")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, found, _ := store.Find("live"); found {
+		t.Error("expected deleted session not to be found")
+	}
+}
+
+func TestPostgresStoreCleanup(t *testing.T) {
+	db := openSessionsDB(t)
+	table := sessionsTables[t.Name()]
+
+	store := NewPostgresStore(db, 10*time.Millisecond)
+	defer store.StopCleanup()
+
+	_ = store.Commit("live", []byte("a"), time.Now().Add(time.Hour))
+	_ = store.Commit("expired", []byte("b"), time.Now().Add(-time.Minute))
+
+	deadline := time.Now().Add(time.Second)
+	for table.len() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the expired session to be cleaned up, %d sessions left", table.len())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if _, ok := table.get("live"); !ok {
+		t.Error("cleanup removed a live session")
+	}
+}
+
+// sessionsTables holds the sessions table of each test, keyed by test name, which is the DSN of its database
+var sessionsTables = map[string]*sessionsTable{}
+
+var registerSessionsDriver sync.Once
+
+// openSessionsDB opens a database on an in-memory sessions table, which answers the queries of
+// PostgresStore the way postgres does
+func openSessionsDB(t *testing.T) *sql.DB {
+	registerSessionsDriver.Do(func() {
+		sql.Register("sessions", sessionsDriver{})
+	})
+	sessionsTables[t.Name()] = &sessionsTable{rows: map[string]sessionRow{}}
+
+	db, err := sql.Open("sessions", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+	return db
+}
+
+type sessionRow struct {
+	data   []byte
+	expiry time.Time
+}
+
+type sessionsTable struct {
+	mu   sync.Mutex
+	rows map[string]sessionRow
+}
+
+func (s *sessionsTable) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.rows)
+}
+
+func (s *sessionsTable) get(token string) (sessionRow, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	row, ok := s.rows[token]
+	return row, ok
+}
+
+type sessionsDriver struct{}
+
+func (sessionsDriver) Open(name string) (driver.Conn, error) {
+	table, ok := sessionsTables[name]
+	if !ok {
+		return nil, fmt.Errorf("no sessions table for %s", name)
+	}
+	return sessionsConn{table}, nil
+}
+
+type sessionsConn struct {
+	table *sessionsTable
+}
+
+func (c sessionsConn) Prepare(query string) (driver.Stmt, error) {
+	return sessionsStmt{table: c.table, query: strings.Join(strings.Fields(query), " ")}, nil
+}
+
+func (c sessionsConn) Close() error {
+	return nil
+}
+
+func (c sessionsConn) Begin() (driver.Tx, error) {
+	return nil, fmt.Errorf("transactions are not supported")
+}
+
+type sessionsStmt struct {
+	table *sessionsTable
+	query string
+}
+
+func (s sessionsStmt) Close() error {
+	return nil
+}
+
+func (s sessionsStmt) NumInput() int {
+	return -1
+}
+
+func (s sessionsStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.table.mu.Lock()
+	defer s.table.mu.Unlock()
+
+	now := time.Now()
+	switch {
+	case strings.HasPrefix(s.query, "insert into sessions (token, data, expiry) values ($1, $2, $3) on conflict (token) do update"):
+		s.table.rows[args[0].(string)] = sessionRow{data: args[1].([]byte), expiry: args[2].(time.Time)}
+		return driver.RowsAffected(1), nil
+	case s.query == "delete from sessions where token = $1":
+		delete(s.table.rows, args[0].(string))
+		return driver.RowsAffected(1), nil
+	case s.query == "delete from sessions where expiry < current_timestamp":
+		var n int64
+		for token, row := range s.table.rows {
+			if row.expiry.Before(now) {
+				delete(s.table.rows, token)
+				n++
+			}
+		}
+		return driver.RowsAffected(n), nil
+	}
+	return nil, fmt.Errorf("unexpected statement %q", s.query)
+}
+
+func (s sessionsStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.table.mu.Lock()
+	defer s.table.mu.Unlock()
+
+	now := time.Now()
+	switch s.query {
+	case "select data from sessions where token = $1 and current_timestamp < expiry":
+		rows := &sessionsRows{columns: []string{"data"}}
+		if row, ok := s.table.rows[args[0].(string)]; ok && now.Before(row.expiry) {
+			rows.values = append(rows.values, []driver.Value{row.data})
+		}
+		return rows, nil
+	case "select token, data from sessions where current_timestamp < expiry":
+		rows := &sessionsRows{columns: []string{"token", "data"}}
+		for token, row := range s.table.rows {
+			if now.Before(row.expiry) {
+				rows.values = append(rows.values, []driver.Value{token, row.data})
+			}
+		}
+		return rows, nil
+	}
+	return nil, fmt.Errorf("unexpected query %q", s.query)
+}
+
+type sessionsRows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+func (r *sessionsRows) Columns() []string {
+	return r.columns
+}
+
+func (r *sessionsRows) Close() error {
+	return nil
+}
+
+func (r *sessionsRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
@@ -0,0 +1,34 @@
+package throttle
+
+import "time"
+
+// login limits, failures are counted per account until a successful login and per IP over Window
+const (
+	// MaxAccountFailures locks an account after this many failures in a row
+	MaxAccountFailures = 5
+	// LockoutDuration is how long a locked account stays locked unless an admin unlocks it
+	LockoutDuration = 15 * time.Minute
+	// MaxIPFailures blocks all logins from an address after this many failures within Window
+	MaxIPFailures = 20
+	// Window is the period failures from an address are counted over
+	Window = 15 * time.Minute
+	// maxDelay caps the progressive delay
+	maxDelay = 8 * time.Second
+)
+
+// Delay returns how long to wait before checking a password after failures
+// previous failed attempts. It doubles with every failure after the first,
+// so guessing gets slower long before anything is locked
+func Delay(failures int) time.Duration {
+	if failures <= 0 {
+		return 0
+	}
+	d := 250 * time.Millisecond
+	for i := 1; i < failures; i++ {
+		d *= 2
+		if d >= maxDelay {
+			return maxDelay
+		}
+	}
+	return d
+}
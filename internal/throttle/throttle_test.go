@@ -0,0 +1,26 @@
+package throttle
+
+import (
+	"testing"
+	"time"
+)
+
+var delayTests = []struct {
+	failures int
+	expected time.Duration
+}{
+	{0, 0},
+	{1, 250 * time.Millisecond},
+	{2, 500 * time.Millisecond},
+	{4, 2 * time.Second},
+	{6, 8 * time.Second},
+	{100, 8 * time.Second},
+}
+
+func TestDelay(t *testing.T) {
+	for _, e := range delayTests {
+		if got := Delay(e.failures); got != e.expected {
+			t.Errorf("%d failures: expected %s but got %s", e.failures, e.expected, got)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package totp
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// the SHA1 test vectors from RFC 6238 appendix B
+var rfcTests = []struct {
+	unix     int64
+	expected string
+}{
+	{59, "94287082"},
+	{1111111109, "07081804"},
+	{1111111111, "14050471"},
+	{1234567890, "89005924"},
+	{2000000000, "69279037"},
+	{20000000000, "65353130"},
+}
+
+func TestHOTP(t *testing.T) {
+	key := []byte("12345678901234567890")
+	for _, e := range rfcTests {
+		got := hotp(key, uint64(e.unix/period), 8)
+		if got != e.expected {
+			t.Errorf("at %d: expected %s but got %s", e.unix, e.expected, got)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Unix(1700000000, 0)
+	code, err := Code(secret, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !Validate(secret, code, now) {
+		t.Error("current code was rejected")
+	}
+	if !Validate(strings.ToLower(secret), code[:3]+" "+code[3:], now) {
+		t.Error("code with spaces or lower case secret was rejected")
+	}
+	if !Validate(secret, code, now.Add(period*time.Second)) {
+		t.Error("code from the previous period was rejected")
+	}
+	if Validate(secret, code, now.Add(3*period*time.Second)) {
+		t.Error("stale code was accepted")
+	}
+	if Validate(secret, "12345", now) {
+		t.Error("short code was accepted")
+	}
+	if Validate("not base32!", code, now) {
+		t.Error("code was accepted for an invalid secret")
+	}
+}
+
+func TestValidateStep(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Unix(1700000000, 0)
+	code, err := Code(secret, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the step is the one the code was made in, not the one it is checked in
+	for _, at := range []time.Time{now, now.Add(period * time.Second)} {
+		step, ok := ValidateStep(secret, code, at)
+		if !ok || step != now.Unix()/period {
+			t.Errorf("at %d: expected step %d but got %d %t", at.Unix(), now.Unix()/period, step, ok)
+		}
+	}
+	if _, ok := ValidateStep(secret, "000000", now); ok && code != "000000" {
+		t.Error("wrong code was accepted")
+	}
+}
+
+func TestURL(t *testing.T) {
+	u := URL("Fort Smythe", "me@here.ca", "JBSWY3DPEHPK3PXP")
+	if !strings.HasPrefix(u, "otpauth://totp/Fort%20Smythe:me@here.ca?") {
+		t.Errorf("unexpected label in %s", u)
+	}
+	if !strings.Contains(u, "secret=JBSWY3DPEHPK3PXP") || !strings.Contains(u, "issuer=Fort+Smythe") {
+		t.Errorf("missing parameters in %s", u)
+	}
+}
+
+func TestQRCode(t *testing.T) {
+	png, err := QRCode(URL("Fort Smythe", "me@here.ca", "JBSWY3DPEHPK3PXP"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(png), "\x89PNG") {
+		t.Error("expected a PNG image")
+	}
+}
+
+func TestGenerateRecoveryCodes(t *testing.T) {
+	codes, err := GenerateRecoveryCodes(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != 10 {
+		t.Fatalf("expected 10 codes but got %d", len(codes))
+	}
+
+	seen := make(map[string]bool)
+	for _, c := range codes {
+		if len(c) != 11 || c[5] != '-' {
+			t.Errorf("malformed recovery code %s", c)
+		}
+		if seen[c] {
+			t.Errorf("duplicate recovery code %s", c)
+		}
+		seen[c] = true
+	}
+}
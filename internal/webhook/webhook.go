@@ -0,0 +1,263 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/KingKord/bookings/internal/events"
+	"github.com/KingKord/bookings/internal/models"
+	"github.com/KingKord/bookings/internal/repository"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// headers sent with every delivery
+const (
+	SignatureHeader = "X-Bookings-Signature"
+	EventHeader     = "X-Bookings-Event"
+	DeliveryHeader  = "X-Bookings-Delivery"
+)
+
+// MaxAttempts is how many times a delivery is tried before it is given up on
+const MaxAttempts = 8
+
+// firstRetry is the wait before the first retry, it doubles with every further attempt
+const firstRetry = 30 * time.Second
+
+const (
+	// pollInterval is how often due retries are looked for
+	pollInterval = 5 * time.Second
+	// batchSize is how many deliveries are claimed at a time
+	batchSize = 20
+	// requestTimeout bounds a single attempt
+	requestTimeout = 10 * time.Second
+	// lease keeps a claimed delivery from being sent again while it is being sent, it must outlast
+	// the attempts of a whole batch
+	lease = batchSize * requestTimeout
+)
+
+const dateLayout = "2006-01-02"
+
+// GenerateSecret returns a new signing secret for a webhook
+func GenerateSecret() (string, error) {
+	b := make([]byte, 24)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return "whsec_" + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Sign returns the signature header of a payload sent at t: the unix time and the hex HMAC-SHA256,
+// keyed by the secret, of the time, a dot and the payload. Signing the time lets receivers reject replays
+func Sign(secret string, t time.Time, payload []byte) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts + "."))
+	mac.Write(payload)
+	return fmt.Sprintf("t=%s,v1=%s", ts, hex.EncodeToString(mac.Sum(nil)))
+}
+
+// Backoff returns how long to wait after a delivery failed for the nth time
+func Backoff(attempts int) time.Duration {
+	return firstRetry << (attempts - 1)
+}
+
+type room struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+type reservation struct {
+	ID        int       `json:"id"`
+	Room      room      `json:"room"`
+	StartDate string    `json:"start_date"`
+	EndDate   string    `json:"end_date"`
+	FirstName string    `json:"first_name"`
+	LastName  string    `json:"last_name"`
+	Email     string    `json:"email"`
+	Phone     string    `json:"phone"`
+	Processed bool      `json:"processed"`
+	Cancelled bool      `json:"cancelled"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type block struct {
+	Room      room   `json:"room"`
+	StartDate string `json:"start_date"`
+	EndDate   string `json:"end_date"`
+}
+
+// Payload returns the JSON body sent for an event
+func Payload(e events.Event) ([]byte, error) {
+	data := make(map[string]interface{})
+	if strings.HasPrefix(e.Type, "block.") {
+		b := e.Block
+		data["block"] = block{
+			Room:      room{ID: b.RoomID, Name: b.Room.RoomName},
+			StartDate: b.StartDate.Format(dateLayout),
+			EndDate:   b.EndDate.Format(dateLayout),
+		}
+	} else {
+		res := e.Reservation
+		data["reservation"] = reservation{
+			ID:        res.ID,
+			Room:      room{ID: res.RoomID, Name: res.Room.RoomName},
+			StartDate: res.StartDate.Format(dateLayout),
+			EndDate:   res.EndDate.Format(dateLayout),
+			FirstName: res.FirstName,
+			LastName:  res.LastName,
+			Email:     res.Email,
+			Phone:     res.Phone,
+			Processed: res.Processed == 1,
+			Cancelled: res.IsCancelled(),
+			CreatedAt: res.CreatedAt,
+		}
+	}
+
+	return json.Marshal(map[string]interface{}{
+		"type":        e.Type,
+		"occurred_at": e.OccurredAt,
+		"data":        data,
+	})
+}
+
+// Dispatcher queues an event for every webhook subscribed to it, and sends the queued deliveries,
+// retrying failed ones with exponential backoff. The queue lives in the database, so retries
+// survive restarts and replicas share the work
+type Dispatcher struct {
+	db       repository.DatabaseRepo
+	client   *http.Client
+	errorLog *log.Logger
+	wake     chan struct{}
+}
+
+// NewDispatcher returns a dispatcher using the database repository db
+func NewDispatcher(db repository.DatabaseRepo, errorLog *log.Logger) *Dispatcher {
+	return &Dispatcher{
+		db:       db,
+		client:   &http.Client{Timeout: requestTimeout},
+		errorLog: errorLog,
+		wake:     make(chan struct{}, 1),
+	}
+}
+
+// Start queues the events published on b as they are published, so none are lost when many happen
+// at once, and sends deliveries in the background
+func (d *Dispatcher) Start(b *events.Broker) {
+	b.Handle(d.enqueue)
+
+	go func() {
+		ticker := time.NewTicker(pollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-d.wake:
+			}
+			d.SendDue()
+		}
+	}()
+}
+
+func (d *Dispatcher) enqueue(e events.Event) {
+	payload, err := Payload(e)
+	if err != nil {
+		d.errorLog.Println(err)
+		return
+	}
+
+	n, err := d.db.EnqueueWebhookDeliveries(e.Type, payload)
+	if err != nil {
+		d.errorLog.Println(err)
+		return
+	}
+
+	if n > 0 {
+		select {
+		case d.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// SendDue sends every delivery that is due
+func (d *Dispatcher) SendDue() {
+	for {
+		deliveries, err := d.db.ClaimWebhookDeliveries(batchSize, lease)
+		if err != nil {
+			d.errorLog.Println(err)
+			return
+		}
+
+		for _, del := range deliveries {
+			err := d.db.RecordWebhookAttempt(d.attempt(del))
+			if err != nil {
+				d.errorLog.Println(err)
+			}
+		}
+
+		if len(deliveries) < batchSize {
+			return
+		}
+	}
+}
+
+// attempt sends a delivery once and returns it with the outcome recorded
+func (d *Dispatcher) attempt(del models.WebhookDelivery) models.WebhookDelivery {
+	del.Attempts++
+	del.ResponseStatus, del.Error = 0, ""
+
+	err := d.send(&del)
+	now := time.Now()
+	switch {
+	case err == nil:
+		del.DeliveredAt = now
+		del.NextAttemptAt = time.Time{}
+	case del.Attempts >= MaxAttempts:
+		del.Error = err.Error()
+		del.NextAttemptAt = time.Time{}
+	default:
+		del.Error = err.Error()
+		del.NextAttemptAt = now.Add(Backoff(del.Attempts))
+	}
+	return del
+}
+
+// send posts a delivery to its webhook, any response but a 2xx is an error
+func (d *Dispatcher) send(del *models.WebhookDelivery) error {
+	payload := []byte(del.Payload)
+
+	req, err := http.NewRequest(http.MethodPost, del.Webhook.URL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "bookings-webhooks/1")
+	req.Header.Set(EventHeader, del.Event)
+	req.Header.Set(DeliveryHeader, strconv.Itoa(del.ID))
+	req.Header.Set(SignatureHeader, Sign(del.Webhook.Secret, time.Now(), payload))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// read a little of the body so the connection can be reused
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+
+	del.ResponseStatus = resp.StatusCode
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("endpoint responded %s", resp.Status)
+	}
+	return nil
+}
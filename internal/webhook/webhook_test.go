@@ -0,0 +1,191 @@
+package webhook
+
+import (
+	"encoding/json"
+	"github.com/KingKord/bookings/internal/events"
+	"github.com/KingKord/bookings/internal/models"
+	"github.com/KingKord/bookings/internal/repository"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSign(t *testing.T) {
+	got := Sign("whsec_test", time.Unix(1700000000, 0), []byte(`{"type":"reservation.created"}`))
+	expected := "t=1700000000,v1=b975956961627e2a287627a8e23a5abe2c1bce1bb123bb82ba8a0750fa2ab487"
+	if got != expected {
+		t.Errorf("expected %s but got %s", expected, got)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	var tests = []struct {
+		attempts int
+		expected time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{7, 32 * time.Minute},
+	}
+
+	for _, e := range tests {
+		if got := Backoff(e.attempts); got != e.expected {
+			t.Errorf("after %d attempts expected %s but got %s", e.attempts, e.expected, got)
+		}
+	}
+}
+
+func TestGenerateSecret(t *testing.T) {
+	a, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := GenerateSecret()
+	if !strings.HasPrefix(a, "whsec_") || a == b {
+		t.Errorf("expected distinct secrets starting with whsec_, got %s and %s", a, b)
+	}
+}
+
+func TestPayload(t *testing.T) {
+	start := time.Date(2050, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	var tests = []struct {
+		name     string
+		event    events.Event
+		key      string
+		expected string
+	}{
+		{
+			"reservation",
+			events.Event{Type: events.ReservationCreated, Reservation: models.Reservation{ID: 4, RoomID: 1, StartDate: start, EndDate: start.AddDate(0, 0, 2)}},
+			"reservation",
+			`{"id":4,"room":{"id":1,"name":""},"start_date":"2050-01-01","end_date":"2050-01-03"`,
+		},
+		{
+			"block",
+			events.Event{Type: events.BlockAdded, Block: models.RoomRestriction{RoomID: 2, Room: models.Room{RoomName: "Major's Suite"}, StartDate: start, EndDate: start.AddDate(0, 0, 1)}},
+			"block",
+			`{"room":{"id":2,"name":"Major's Suite"},"start_date":"2050-01-01","end_date":"2050-01-02"}`,
+		},
+	}
+
+	for _, e := range tests {
+		payload, err := Payload(e.event)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var body struct {
+			Type string                     `json:"type"`
+			Data map[string]json.RawMessage `json:"data"`
+		}
+		err = json.Unmarshal(payload, &body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body.Type != e.event.Type {
+			t.Errorf("%s: expected type %s but got %s", e.name, e.event.Type, body.Type)
+		}
+		if !strings.HasPrefix(string(body.Data[e.key]), e.expected) {
+			t.Errorf("%s: expected data.%s to start with %s, got %s", e.name, e.key, e.expected, body.Data[e.key])
+		}
+	}
+}
+
+func TestAttempt(t *testing.T) {
+	var received *http.Request
+	var receivedBody string
+	status := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r
+		b, _ := io.ReadAll(r.Body)
+		receivedBody = string(b)
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	d := NewDispatcher(nil, log.New(io.Discard, "", 0))
+	del := models.WebhookDelivery{
+		ID:      9,
+		Event:   events.ReservationCreated,
+		Payload: `{"type":"reservation.created"}`,
+		Webhook: models.Webhook{URL: srv.URL, Secret: "whsec_test"},
+	}
+
+	got := d.attempt(del)
+	if !got.IsDelivered() || got.Attempts != 1 || got.ResponseStatus != http.StatusOK {
+		t.Errorf("expected a delivered delivery, got %+v", got)
+	}
+	if received.Header.Get(EventHeader) != events.ReservationCreated || received.Header.Get(DeliveryHeader) != "9" {
+		t.Errorf("unexpected headers %v", received.Header)
+	}
+	sig := received.Header.Get(SignatureHeader)
+	ts, _ := strings.CutPrefix(strings.Split(sig, ",")[0], "t=")
+	unix, _ := strconv.ParseInt(ts, 10, 64)
+	if sig != Sign("whsec_test", time.Unix(unix, 0), []byte(receivedBody)) {
+		t.Errorf("signature %s doesn't match the body", sig)
+	}
+
+	status = http.StatusInternalServerError
+	got = d.attempt(del)
+	if got.IsDelivered() || got.IsFailed() || got.ResponseStatus != http.StatusInternalServerError {
+		t.Errorf("expected a retry to be scheduled, got %+v", got)
+	}
+	if wait := time.Until(got.NextAttemptAt); wait < 25*time.Second || wait > 30*time.Second {
+		t.Errorf("expected the retry in 30s, got %s", wait)
+	}
+
+	del.Attempts = MaxAttempts - 1
+	got = d.attempt(del)
+	if !got.IsFailed() || got.Error == "" {
+		t.Errorf("expected the delivery to be given up on, got %+v", got)
+	}
+
+	srv.Close()
+	del.Attempts = 0
+	got = d.attempt(del)
+	if got.IsFailed() || got.Error == "" || got.ResponseStatus != 0 {
+		t.Errorf("expected a connection error to be retried, got %+v", got)
+	}
+}
+
+// queueRepo records the deliveries queued by a dispatcher, and has none due
+type queueRepo struct {
+	repository.DatabaseRepo
+	mu     sync.Mutex
+	queued []string
+}
+
+func (q *queueRepo) EnqueueWebhookDeliveries(eventType string, payload []byte) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.queued = append(q.queued, eventType)
+	return 1, nil
+}
+
+func (q *queueRepo) ClaimWebhookDeliveries(limit int, lease time.Duration) ([]models.WebhookDelivery, error) {
+	return nil, nil
+}
+
+func TestStartQueuesEveryEvent(t *testing.T) {
+	repo := &queueRepo{}
+	b := events.NewBroker()
+	NewDispatcher(repo, log.New(io.Discard, "", 0)).Start(b)
+
+	// far more events at once than a subscriber can buffer
+	for i := 0; i < 500; i++ {
+		b.Publish(events.ReservationCreated, models.Reservation{ID: i})
+	}
+
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	if len(repo.queued) != 500 {
+		t.Errorf("expected 500 queued events, got %d", len(repo.queued))
+	}
+}
@@ -0,0 +1 @@
+update users set access_level = 3 where email = 'admin@admin.com';
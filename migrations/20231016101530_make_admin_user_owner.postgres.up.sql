@@ -0,0 +1 @@
+update users set access_level = 4 where email = 'admin@admin.com';
@@ -0,0 +1,3 @@
+INSERT INTO public.restrictions (id,restriction_name,created_at,updated_at) VALUES
+    (3,'External','2023-12-25 00:00:00.000','2023-12-25 00:00:00.000') ON CONFLICT (id) DO NOTHING;
+SELECT setval(pg_get_serial_sequence('restrictions', 'id'), (SELECT max(id) FROM restrictions));
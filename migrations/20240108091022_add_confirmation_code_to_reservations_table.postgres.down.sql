@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS reservations_confirmation_code_idx;
+ALTER TABLE public.reservations DROP COLUMN IF EXISTS confirmation_code;
+DROP FUNCTION IF EXISTS random_confirmation_code();
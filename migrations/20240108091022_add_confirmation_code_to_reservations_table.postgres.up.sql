@@ -0,0 +1,8 @@
+-- codes use letters and digits that can't be mistaken for one another, as codes are read out on the phone
+CREATE OR REPLACE FUNCTION random_confirmation_code() RETURNS varchar AS $$
+    SELECT string_agg(substr('ABCDEFGHJKMNPQRSTUVWXYZ23456789', 1 + floor(random() * 31)::int, 1), '')
+    FROM generate_series(1, 8)
+$$ LANGUAGE sql VOLATILE;
+
+ALTER TABLE public.reservations ADD COLUMN confirmation_code varchar(16) NOT NULL DEFAULT random_confirmation_code();
+CREATE UNIQUE INDEX reservations_confirmation_code_idx ON public.reservations (confirmation_code);
@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS reservations_phone_digits_trgm_idx;
+DROP INDEX IF EXISTS reservations_email_trgm_idx;
+DROP INDEX IF EXISTS reservations_full_name_trgm_idx;
+DROP INDEX IF EXISTS reservations_last_name_trgm_idx;
+DROP INDEX IF EXISTS reservations_first_name_trgm_idx;
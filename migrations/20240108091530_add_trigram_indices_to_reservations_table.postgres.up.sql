@@ -0,0 +1,7 @@
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+CREATE INDEX reservations_first_name_trgm_idx ON public.reservations USING gin (first_name gin_trgm_ops);
+CREATE INDEX reservations_last_name_trgm_idx ON public.reservations USING gin (last_name gin_trgm_ops);
+CREATE INDEX reservations_full_name_trgm_idx ON public.reservations USING gin ((first_name || ' ' || last_name) gin_trgm_ops);
+CREATE INDEX reservations_email_trgm_idx ON public.reservations USING gin (email gin_trgm_ops);
+CREATE INDEX reservations_phone_digits_trgm_idx ON public.reservations USING gin ((regexp_replace(phone, '\D', '', 'g')) gin_trgm_ops);
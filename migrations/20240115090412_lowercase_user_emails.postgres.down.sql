@@ -0,0 +1 @@
+-- the original capitalisation is not kept, so there is nothing to restore
@@ -0,0 +1,8 @@
+-- logins match on lower(email), so addresses stored with capitals could no longer sign in.
+-- where two accounts differ only by case, the oldest keeps the address; the others are disabled
+-- and renamed so an owner can merge or delete them from the users page
+UPDATE public.users u
+SET email = 'duplicate-' || u.id || '+' || u.email, disabled = true
+WHERE EXISTS (SELECT 1 FROM public.users o WHERE lower(o.email) = lower(u.email) AND o.id < u.id);
+
+UPDATE public.users SET email = lower(email) WHERE email <> lower(email);
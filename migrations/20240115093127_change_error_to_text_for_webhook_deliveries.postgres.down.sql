@@ -0,0 +1 @@
+ALTER TABLE public.webhook_deliveries ALTER COLUMN error TYPE varchar(255) USING left(error, 255);
@@ -0,0 +1,2 @@
+-- endpoint errors can be longer than 255 characters, which made recording the attempt fail
+ALTER TABLE public.webhook_deliveries ALTER COLUMN error TYPE text;
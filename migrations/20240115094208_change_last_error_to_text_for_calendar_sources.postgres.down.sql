@@ -0,0 +1 @@
+ALTER TABLE public.calendar_sources ALTER COLUMN last_error TYPE varchar(255) USING left(last_error, 255);
@@ -0,0 +1,2 @@
+-- sync errors can be longer than 255 characters, which made recording the sync fail
+ALTER TABLE public.calendar_sources ALTER COLUMN last_error TYPE text;
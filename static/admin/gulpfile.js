@@ -156,11 +156,13 @@ gulp.task('buildBaseVendorStyles', function() {
 gulp.task('copyRecursiveVendorFiles', function () {
     var chartJs = gulp.src(['./node_modules/chart.js/dist/Chart.min.js'])
         .pipe(gulp.dest('./vendors/chart.js'));
+    var redoc = gulp.src(['./node_modules/redoc/bundles/redoc.standalone.js'])
+        .pipe(gulp.dest('./vendors/redoc'));
     var ti = gulp.src(['./node_modules/ti-icons/css/themify-icons.css'])
         .pipe(gulp.dest('./vendors/ti-icons/css'));
     var tiFonts = gulp.src(['./node_modules/ti-icons/fonts/*'])
         .pipe(gulp.dest('./vendors/ti-icons/fonts'));
-    return merge(chartJs, ti, tiFonts);
+    return merge(chartJs, redoc, ti, tiFonts);
 });
 
 //Copy essential map files